@@ -219,7 +219,10 @@ func (bs *BlockStatement) String() string  {
 type FunctionLiteral struct {
 	Token token.Token
 	Parameters []*Identifier
+	Defaults []Expression // Lines up with Parameters, nil for parameters without a default value
+	Rest *Identifier // Optional, collects any extra arguments into an array
 	Body *BlockStatement
+	Name string // Empty for anonymous functions, set from fn name() {} or let name = fn() {}
 }
 
 func (fl *FunctionLiteral) expressionNode() {}
@@ -227,12 +230,12 @@ func (fl *FunctionLiteral) TokenLiteral() string { return fl.Token.Literal }
 func (fl *FunctionLiteral) String() string {
 	var out bytes.Buffer
 
-	params := []string{}
-	for _, p := range fl.Parameters {
-		params = append(params, p.String())
-	}
+	params := fl.ParameterStrings()
 
 	out.WriteString(fl.TokenLiteral())
+	if fl.Name != "" {
+		out.WriteString("<" + fl.Name + ">")
+	}
 	out.WriteString("(")
 	out.WriteString(strings.Join(params, ", "))
 	out.WriteString(") ")
@@ -241,6 +244,31 @@ func (fl *FunctionLiteral) String() string {
 	return out.String()
 }
 
+func (fl *FunctionLiteral) Default(i int) Expression {
+	if i < len(fl.Defaults) {
+		return fl.Defaults[i]
+	}
+
+	return nil
+}
+
+func (fl *FunctionLiteral) ParameterStrings() []string {
+	params := []string{}
+	for i, p := range fl.Parameters {
+		if d := fl.Default(i); d != nil {
+			params = append(params, p.String()+" = "+d.String())
+		} else {
+			params = append(params, p.String())
+		}
+	}
+
+	if fl.Rest != nil {
+		params = append(params, "..."+fl.Rest.String())
+	}
+
+	return params
+}
+
 type CallExpression struct {
 	Token token.Token // The '( token'
 	Function Expression // The Identifier or Function Literal
@@ -336,4 +364,214 @@ func (hl *HashLiteral) String() string {
 	out.WriteString("}")
 
 	return out.String()
-}
\ No newline at end of file
+}
+
+type MethodCallExpression struct {
+	Token token.Token // The '.' token
+	Object Expression // The receiver the method is looked up on
+	Method *Identifier
+	Arguments []Expression
+}
+
+func (mc *MethodCallExpression) expressionNode() {}
+func (mc *MethodCallExpression) TokenLiteral() string { return mc.Token.Literal }
+func (mc *MethodCallExpression) String() string {
+	var out bytes.Buffer
+
+	args := []string{}
+	for _, a := range mc.Arguments {
+		args = append(args, a.String())
+	}
+
+	out.WriteString(mc.Object.String())
+	out.WriteString(".")
+	out.WriteString(mc.Method.String())
+	out.WriteString("(")
+	out.WriteString(strings.Join(args, ", "))
+	out.WriteString(")")
+
+	return out.String()
+}
+
+type MethodDefinition struct {
+	Token token.Token // The token.FUNCTION token
+	Name *Identifier
+	Function *FunctionLiteral // The receiver is always the first parameter, named self
+}
+
+func (md *MethodDefinition) TokenLiteral() string { return md.Token.Literal }
+func (md *MethodDefinition) String() string {
+	var out bytes.Buffer
+
+	params := md.Function.ParameterStrings()
+
+	out.WriteString(md.TokenLiteral() + " ")
+	out.WriteString(md.Name.String())
+	out.WriteString("(")
+	out.WriteString(strings.Join(params, ", "))
+	out.WriteString(") ")
+	out.WriteString(md.Function.Body.String())
+
+	return out.String()
+}
+
+type ImplStatement struct {
+	Token token.Token // The token.IMPL token
+	Type *Identifier
+	Methods []*MethodDefinition
+}
+
+func (is *ImplStatement) statementNode() {}
+func (is *ImplStatement) TokenLiteral() string { return is.Token.Literal }
+func (is *ImplStatement) String() string {
+	var out bytes.Buffer
+
+	methods := []string{}
+	for _, m := range is.Methods {
+		methods = append(methods, m.String())
+	}
+
+	out.WriteString(is.TokenLiteral() + " ")
+	out.WriteString(is.Type.String())
+	out.WriteString(" { ")
+	out.WriteString(strings.Join(methods, " "))
+	out.WriteString(" }")
+
+	return out.String()
+}
+
+type MatchArm struct {
+	Token token.Token // The first token of the pattern
+	Pattern Expression // Literals, identifiers (_ matches anything without binding), and array or hash literals of patterns
+	Guard Expression // Optional, the arm only matches if the guard is truthy
+	Body Expression
+}
+
+func (ma *MatchArm) TokenLiteral() string { return ma.Token.Literal }
+func (ma *MatchArm) String() string {
+	var out bytes.Buffer
+
+	out.WriteString(ma.Pattern.String())
+
+	if ma.Guard != nil {
+		out.WriteString(" if ")
+		out.WriteString(ma.Guard.String())
+	}
+
+	out.WriteString(" => ")
+	out.WriteString(ma.Body.String())
+
+	return out.String()
+}
+
+type MatchExpression struct {
+	Token token.Token // The token.MATCH token
+	Subject Expression
+	Arms []*MatchArm
+}
+
+func (me *MatchExpression) expressionNode() {}
+func (me *MatchExpression) TokenLiteral() string { return me.Token.Literal }
+func (me *MatchExpression) String() string {
+	var out bytes.Buffer
+
+	arms := []string{}
+	for _, a := range me.Arms {
+		arms = append(arms, a.String())
+	}
+
+	out.WriteString("match ")
+	out.WriteString(me.Subject.String())
+	out.WriteString(" { ")
+	out.WriteString(strings.Join(arms, ", "))
+	out.WriteString(" }")
+
+	return out.String()
+}
+
+type Pattern interface {
+	Node
+	patternNode()
+}
+
+type ArrayPattern struct {
+	Token token.Token // The '[' token
+	Elements []*Identifier
+	Rest *Identifier // Optional, collects the remaining elements into an array
+}
+
+func (ap *ArrayPattern) patternNode() {}
+func (ap *ArrayPattern) TokenLiteral() string { return ap.Token.Literal }
+func (ap *ArrayPattern) String() string {
+	var out bytes.Buffer
+
+	elements := []string{}
+	for _, el := range ap.Elements {
+		elements = append(elements, el.String())
+	}
+
+	if ap.Rest != nil {
+		elements = append(elements, "..."+ap.Rest.String())
+	}
+
+	out.WriteString("[")
+	out.WriteString(strings.Join(elements, ", "))
+	out.WriteString("]")
+
+	return out.String()
+}
+
+type HashPattern struct {
+	Token token.Token // The '{' token
+	Keys []*Identifier // Each name is both the string key looked up and the binding
+}
+
+func (hp *HashPattern) patternNode() {}
+func (hp *HashPattern) TokenLiteral() string { return hp.Token.Literal }
+func (hp *HashPattern) String() string {
+	var out bytes.Buffer
+
+	keys := []string{}
+	for _, k := range hp.Keys {
+		keys = append(keys, k.String())
+	}
+
+	out.WriteString("{")
+	out.WriteString(strings.Join(keys, ", "))
+	out.WriteString("}")
+
+	return out.String()
+}
+
+type DestructuringLetStatement struct {
+	Token token.Token // The token.LET token
+	Pattern Pattern
+	Value Expression
+}
+
+func (ds *DestructuringLetStatement) statementNode() {}
+func (ds *DestructuringLetStatement) TokenLiteral() string { return ds.Token.Literal }
+func (ds *DestructuringLetStatement) String() string {
+	var out bytes.Buffer
+
+	out.WriteString(ds.TokenLiteral() + " ")
+	out.WriteString(ds.Pattern.String())
+	out.WriteString(" = ")
+
+	if ds.Value != nil {
+		out.WriteString(ds.Value.String())
+	}
+
+	out.WriteString(";")
+
+	return out.String()
+}
+
+type SpreadExpression struct {
+	Token token.Token // The '...' token
+	Value Expression // Has to evaluate to an array, its elements are passed as separate arguments
+}
+
+func (se *SpreadExpression) expressionNode() {}
+func (se *SpreadExpression) TokenLiteral() string { return se.Token.Literal }
+func (se *SpreadExpression) String() string { return "..." + se.Value.String() }
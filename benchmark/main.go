@@ -3,18 +3,42 @@ package main
 import (
 	"flag"
 	"fmt"
+	"runtime"
 	"time"
 	"compiler/compiler"
 	"compiler/evaluator"
 	"compiler/lexer"
 	"compiler/object"
 	"compiler/parser"
+	"compiler/rvm"
 	"compiler/vm"
 )
 
-var engine = flag.String("engine", "vm", "use 'vm' or 'eval'") // engine is the pointer to a string variable "engine", "vm is the default value", "use vm or eval" is a brief description of what the "engine" flag represents, it will be displayed when the user runs "-invalid option"
+var engine = flag.String("engine", "vm", "use 'vm', 'rvm' or 'eval'") // engine is the pointer to a string variable "engine", "vm is the default value", "use vm or eval" is a brief description of what the "engine" flag represents, it will be displayed when the user runs "-invalid option"
 
-var input = `
+var optimize = flag.Bool("optimize", false, "compile with constant folding, the peephole pass and superinstructions (vm engine only)")
+
+var programName = flag.String("program", "fibonacci", "use 'fibonacci' or 'arithmetic'")
+
+// arithmetic is written the way config-like scripts are, with literal arithmetic and repeated locals the optimizer can fold and fuse
+var arithmetic = `
+let area = fn(w, h) {
+	let border = 2 * 4 - 6;
+	if (w < border) {
+		w * w + h * h + (60 * 60 - 3600)
+	} else {
+		area(w - 1, h) + area(w - 2, h) + (1024 / 4 - 256)
+	}
+};
+area(32, 3);
+`
+
+var programs = map[string]string{
+	"fibonacci": fibonacci,
+	"arithmetic": arithmetic,
+}
+
+var fibonacci = `
 let fibonacci = fn(x) {
 	if (x == 0) {
 		0
@@ -32,7 +56,13 @@ fibonacci(35);
 func main() {
 	flag.Parse()
 
-	var duration time.Duration
+	input, ok := programs[*programName]
+	if !ok {
+		fmt.Printf("unknown program %q, use 'fibonacci' or 'arithmetic'\n", *programName)
+		return
+	}
+
+	var m measurement
 	var result object.Object
 
 	l := lexer.New(input)
@@ -41,6 +71,7 @@ func main() {
 
 	if *engine == "vm" {
 		comp := compiler.New()
+		comp.SetOptions(compiler.Options{FoldConstants: *optimize, Peephole: *optimize, Superinstructions: *optimize})
 		err := comp.Compile(program)
 		if err != nil {
 			fmt.Printf("compiler error: %s", err)
@@ -49,26 +80,63 @@ func main() {
 
 		machine := vm.New(comp.Bytecode())
 
-		start := time.Now()
-
-		err = machine.Run()
+		m = measure(func() { err = machine.Run() })
 		if err != nil {
 			fmt.Printf("vm error: %s", err)
 			return
 		}
 
-		duration = time.Since(start)
 		result = machine.LastPoppedStackElem()
+	} else if *engine == "rvm" {
+		comp := rvm.NewCompiler()
+		compiled, err := comp.Compile(program)
+		if err != nil {
+			fmt.Printf("compiler error: %s", err)
+			return
+		}
+
+		machine := rvm.New()
+
+		m = measure(func() { result, err = machine.Run(compiled) })
+		if err != nil {
+			fmt.Printf("rvm error: %s", err)
+			return
+		}
 	} else {
 		env := object.NewEnvironment()
-		start := time.Now()
-		result = evaluator.Eval(program, env)
-		duration = time.Since(start)
+		m = measure(func() { result = evaluator.Eval(program, env) })
 	}
 
 	fmt.Printf(
-		"engine=%s, result=%s, duration=%s\n",
+		"program=%s, engine=%s, optimize=%t, result=%s, duration=%s, allocs=%d, bytes=%d\n",
+		*programName,
 		*engine,
+		*optimize,
 		result.Inspect(),
-		duration)
+		m.duration,
+		m.allocs,
+		m.bytes)
+}
+
+type measurement struct {
+	duration time.Duration
+	allocs uint64 // Heap allocations made while running, compiling is not counted
+	bytes uint64
+}
+
+func measure(run func()) measurement {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	run()
+
+	duration := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	return measurement{
+		duration: duration,
+		allocs: after.Mallocs - before.Mallocs,
+		bytes: after.TotalAlloc - before.TotalAlloc,
+	}
 }
\ No newline at end of file
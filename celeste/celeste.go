@@ -0,0 +1,223 @@
+// Package celeste runs Celeste scripts from a Go program. An Engine keeps the globals, methods and host
+// functions of everything it has run, like a REPL session does, and shares nothing with other engines so
+// each can be used from its own goroutine.
+package celeste
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"compiler/ast"
+	"compiler/compiler"
+	"compiler/lexer"
+	"compiler/object"
+	"compiler/parser"
+	"compiler/token"
+	"compiler/vm"
+)
+
+// An Engine is not safe for concurrent use by itself, give every goroutine its own
+type Engine struct {
+	symbolTable *compiler.SymbolTable
+	constants []object.Object
+	functions map[*object.CompiledFunction]bool // The functions among the constants, closures over any other came from another engine
+	globals []object.Object // The one store of every run, a run started by a host function included
+	methods object.MethodTable
+	running []*vm.VM // Runs in progress, innermost last, they are handed the store again whenever it moves
+}
+
+func New() *Engine {
+	symbolTable := compiler.NewSymbolTable()
+	for i, v := range object.Builtins {
+		symbolTable.DefineBuiltin(i, v.Name)
+	}
+
+	return &Engine{
+		symbolTable: symbolTable,
+		constants: []object.Object{},
+		functions: map[*object.CompiledFunction]bool{},
+		globals: []object.Object{}, // Grown as scripts and the host define more globals
+		methods: object.NewMethodTable(),
+	}
+}
+
+// ParseError lists everything the parser found wrong with a script
+type ParseError struct {
+	Errors []string
+}
+
+func (e *ParseError) Error() string {
+	return "parser errors: " + strings.Join(e.Errors, "; ")
+}
+
+// Eval runs src on the VM and returns the value of its last expression statement. Globals it defines stay
+// defined for later scripts and calls, even when it fails part way. An error value as the result, like
+// one from a failing host function, is returned as an error.
+func (e *Engine) Eval(src string) (object.Object, error) {
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, &ParseError{Errors: p.Errors()}
+	}
+
+	comp := compiler.NewWithState(e.symbolTable, e.constants)
+	err := comp.Compile(program)
+	if err != nil {
+		return nil, err
+	}
+
+	bytecode := comp.Bytecode()
+	for _, c := range bytecode.Constants[len(e.constants):] {
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			e.functions[fn] = true
+		}
+	}
+	e.constants = bytecode.Constants
+	e.growGlobals(bytecode.NumGlobals) // So the VM uses the engine's store as it is rather than a grown copy
+
+	machine := vm.NewWithState(bytecode, e.globals, e.methods)
+	err = e.run(machine, machine.Run)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(program.Statements)
+	if n == 0 {
+		return vm.Null, nil
+	}
+	if _, ok := program.Statements[n-1].(*ast.ExpressionStatement); !ok { // The last value popped belongs to some other statement
+		return vm.Null, nil
+	}
+
+	return result(machine.LastPoppedStackElem())
+}
+
+// RegisterFunc makes fn a global of the engine's scripts under name, shadowing a builtin of the same name.
+// fn is either an object.BuiltinFunction or any Go function object.WrapFunc can convert the arguments and
+// results of.
+func (e *Engine) RegisterFunc(name string, fn interface{}) error {
+	builtin, err := object.WrapFunc(fn)
+	if err != nil {
+		return err
+	}
+
+	return e.Set(name, builtin)
+}
+
+// Get returns the global name, false when no script has defined it
+func (e *Engine) Get(name string) (object.Object, bool) {
+	symbol, ok := e.symbolTable.Resolve(name)
+	if !ok || symbol.Scope != compiler.GlobalScope || symbol.Index >= len(e.globals) {
+		return nil, false
+	}
+
+	value := e.globals[symbol.Index]
+	return value, value != nil
+}
+
+// Set defines the global name for later scripts, or changes its value when it is already defined. A host
+// function can use it while a script runs.
+func (e *Engine) Set(name string, value object.Object) error {
+	if !isIdentifier(name) {
+		return fmt.Errorf("invalid global name %q", name)
+	}
+	if value == nil {
+		return fmt.Errorf("nil value for global %s", name)
+	}
+	if e.foreign(value) {
+		return fmt.Errorf("cannot set %s to a function of another engine", name)
+	}
+
+	symbol, ok := e.symbolTable.Resolve(name)
+	if !ok || symbol.Scope != compiler.GlobalScope {
+		symbol = e.symbolTable.Define(name)
+	}
+
+	e.growGlobals(symbol.Index + 1)
+	e.globals[symbol.Index] = value
+
+	return nil
+}
+
+// Call calls fn, a function the engine's scripts made or a builtin, with args. A host function can use it
+// to call back into the script that called it. Like Eval, an error value as the result is returned as an
+// error.
+func (e *Engine) Call(fn object.Object, args ...object.Object) (object.Object, error) {
+	for _, v := range append([]object.Object{fn}, args...) {
+		if e.foreign(v) { // Its instructions refer to another engine's constants and globals
+			return nil, errors.New("cannot call a function of another engine")
+		}
+	}
+
+	bytecode := &compiler.Bytecode{Constants: e.constants, NumGlobals: len(e.globals)} // The function's instructions refer to the engine's constants and globals
+
+	machine := vm.NewWithState(bytecode, e.globals, e.methods)
+	var value object.Object
+	err := e.run(machine, func() error {
+		var err error
+		value, err = machine.Call(fn, args...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result(value)
+}
+
+func (e *Engine) run(machine *vm.VM, run func() error) error {
+	e.running = append(e.running, machine)
+	defer func() { e.running = e.running[:len(e.running)-1] }()
+
+	return run()
+}
+
+// Grows the store to hold n globals, the runs in progress keep using it even when it moves
+func (e *Engine) growGlobals(n int) {
+	if n <= len(e.globals) {
+		return
+	}
+
+	e.globals = append(e.globals, make([]object.Object, n-len(e.globals))...)
+	for _, machine := range e.running {
+		machine.SetGlobals(e.globals)
+	}
+}
+
+// Whether obj is, or holds, a closure another engine's scripts made
+func (e *Engine) foreign(obj object.Object) bool {
+	switch obj := obj.(type) {
+	case *object.Closure:
+		return !e.functions[obj.Fn]
+	case *object.Array:
+		for _, element := range obj.Elements {
+			if e.foreign(element) {
+				return true
+			}
+		}
+	case *object.Hash:
+		for _, pair := range obj.Pairs {
+			if e.foreign(pair.Key) || e.foreign(pair.Value) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func result(value object.Object) (object.Object, error) {
+	if errObj, ok := value.(*object.Error); ok {
+		return nil, errors.New(errObj.Message)
+	}
+
+	return value, nil
+}
+
+// Names have to read as a single identifier in a script, or no script could refer to them
+func isIdentifier(name string) bool {
+	l := lexer.New(name)
+	tok := l.NextToken()
+
+	return tok.Type == token.IDENT && tok.Literal == name && l.NextToken().Type == token.EOF
+}
@@ -0,0 +1,356 @@
+package celeste
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"compiler/object"
+	"testing"
+)
+
+func testInteger(t *testing.T, obj object.Object, expected int64) {
+	t.Helper()
+
+	integer, ok := obj.(*object.Integer)
+	if !ok {
+		t.Fatalf("object is not Integer. got=%T (%+v)", obj, obj)
+	}
+	if integer.Value != expected {
+		t.Errorf("object has wrong value. got=%d, want=%d", integer.Value, expected)
+	}
+}
+
+func TestEvalKeepsGlobals(t *testing.T) {
+	e := New()
+
+	_, err := e.Eval(`let add = fn(a, b) { a + b }; impl Integer { fn double(self) { self * 2 } }`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+
+	result, err := e.Eval(`add(1, 2).double()`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	testInteger(t, result, 6)
+
+	result, err = e.Eval(`let x = 1;`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	if result.Type() != object.NULL_OBJ {
+		t.Errorf("expected null for a script without expressions, got=%s", result.Inspect())
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	e := New()
+
+	_, err := e.Eval(`let = 1;`)
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Errorf("expected a ParseError, got=%v", err)
+	}
+
+	_, err = e.Eval(`missing`)
+	if err == nil || err.Error() != "Undefined variable missing" {
+		t.Errorf("expected a compiler error, got=%v", err)
+	}
+
+	_, err = e.Eval(`let before = 1; 1 + "a"`)
+	if err == nil {
+		t.Fatalf("expected a runtime error")
+	}
+	if _, ok := e.Get("before"); !ok {
+		t.Errorf("globals set before a runtime error should stay defined")
+	}
+}
+
+func TestRegisterFunc(t *testing.T) {
+	e := New()
+
+	calls := 0
+	err := e.RegisterFunc("count", func(args ...object.Object) object.Object {
+		calls++
+		return object.NewInteger(int64(len(args)))
+	})
+	if err != nil {
+		t.Fatalf("register error: %s", err)
+	}
+
+	err = e.RegisterFunc("len", func(args ...object.Object) object.Object { return object.NewInteger(-1) })
+	if err != nil {
+		t.Fatalf("register error: %s", err)
+	}
+
+	result, err := e.Eval(`count(1, 2, 3) + count() + len([1])`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	testInteger(t, result, 2)
+
+	if calls != 2 {
+		t.Errorf("wrong number of calls. want=2, got=%d", calls)
+	}
+
+	for _, name := range []string{"", "two words", "let", "x1", "f()"} {
+		if e.RegisterFunc(name, nil) == nil {
+			t.Errorf("expected %q to be rejected as a name", name)
+		}
+	}
+}
+
+func TestRegisterTypedFunc(t *testing.T) {
+	type user struct {
+		Name string `celeste:"name"`
+		Roles []string `celeste:"roles"`
+	}
+
+	e := New()
+
+	err := e.RegisterFunc("describe", func(u user) string {
+		return fmt.Sprintf("%s (%d roles)", u.Name, len(u.Roles))
+	})
+	if err != nil {
+		t.Fatalf("register error: %s", err)
+	}
+
+	err = e.RegisterFunc("lookup", func(name string) (user, error) {
+		if name != "ada" {
+			return user{}, fmt.Errorf("no user %s", name)
+		}
+		return user{Name: "Ada", Roles: []string{"admin"}}, nil
+	})
+	if err != nil {
+		t.Fatalf("register error: %s", err)
+	}
+
+	result, err := e.Eval(`describe(lookup("ada")) + ", " + describe({"name": "Bob", "roles": []})`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	if result.Inspect() != "Ada (1 roles), Bob (0 roles)" {
+		t.Errorf("wrong result. got=%s", result.Inspect())
+	}
+
+	_, err = e.Eval(`lookup("eve")`)
+	if err == nil || err.Error() != "no user eve" {
+		t.Errorf("expected the host function's error, got=%v", err)
+	}
+
+	_, err = e.Eval(`describe(1)`)
+	if err == nil || err.Error() != "argument 1: cannot convert INTEGER to celeste.user" {
+		t.Errorf("expected a conversion error, got=%v", err)
+	}
+
+	result, err = e.Eval(`lookup("ada")`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+
+	var u user
+	err = object.ToGo(result, &u)
+	if err != nil {
+		t.Fatalf("ToGo error: %s", err)
+	}
+	if u.Name != "Ada" || len(u.Roles) != 1 || u.Roles[0] != "admin" {
+		t.Errorf("wrong user. got=%+v", u)
+	}
+
+	if e.RegisterFunc("bad", 1) == nil {
+		t.Errorf("expected a non-function to be rejected")
+	}
+}
+
+func TestGetAndSet(t *testing.T) {
+	e := New()
+
+	if _, ok := e.Get("x"); ok {
+		t.Errorf("expected x to be undefined")
+	}
+
+	err := e.Set("x", object.NewInteger(40))
+	if err != nil {
+		t.Fatalf("set error: %s", err)
+	}
+
+	result, err := e.Eval(`let y = x + 2; y`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	testInteger(t, result, 42)
+
+	err = e.Set("y", object.NewInteger(1))
+	if err != nil {
+		t.Fatalf("set error: %s", err)
+	}
+
+	y, ok := e.Get("y")
+	if !ok {
+		t.Fatalf("expected y to be defined")
+	}
+	testInteger(t, y, 1)
+
+	result, err = e.Eval(`y`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	testInteger(t, result, 1)
+}
+
+func TestCall(t *testing.T) {
+	e := New()
+
+	_, err := e.Eval(`
+	let base = 10;
+	let add = fn(x) { base + x };
+	let adder = fn(n) { fn(x) { x + n } };
+	`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+
+	add, _ := e.Get("add")
+	result, err := e.Call(add, object.NewInteger(5))
+	if err != nil {
+		t.Fatalf("call error: %s", err)
+	}
+	testInteger(t, result, 15)
+
+	adder, _ := e.Get("adder")
+	addThree, err := e.Call(adder, object.NewInteger(3))
+	if err != nil {
+		t.Fatalf("call error: %s", err)
+	}
+	result, err = e.Call(addThree, object.NewInteger(4))
+	if err != nil {
+		t.Fatalf("call error: %s", err)
+	}
+	testInteger(t, result, 7)
+
+	_, err = e.Call(add)
+	if err == nil || err.Error() != "wrong number of arguments to add: want=1, got=0" {
+		t.Errorf("expected an arity error, got=%v", err)
+	}
+
+	_, err = e.Call(object.NewInteger(1))
+	if err == nil {
+		t.Errorf("expected an error calling an integer")
+	}
+
+	other := New()
+	_, err = other.Eval(`let otherAdd = fn(x) { x };`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	otherAdd, _ := other.Get("otherAdd")
+
+	_, err = e.Call(otherAdd, object.NewInteger(1))
+	if err == nil || err.Error() != "cannot call a function of another engine" {
+		t.Errorf("expected a foreign closure to be rejected, got=%v", err)
+	}
+
+	_, err = e.Call(add, &object.Array{Elements: []object.Object{otherAdd}})
+	if err == nil {
+		t.Errorf("expected a foreign closure in an argument to be rejected")
+	}
+
+	if e.Set("stolen", otherAdd) == nil {
+		t.Errorf("expected setting a foreign closure to be rejected")
+	}
+}
+
+// Globals the host defines or changes while a script runs stay, however the store grows meanwhile
+func TestSetDuringEval(t *testing.T) {
+	e := New()
+	name := func(i int) string { return fmt.Sprintf("g%c%c", 'a'+i/26, 'a'+i%26) } // Identifiers can't have digits
+
+	err := e.RegisterFunc("define", func(args ...object.Object) object.Object {
+		for i := 0; i < 100; i++ { // Enough to move the store
+			err := e.Set(name(i), object.NewInteger(int64(i)))
+			if err != nil {
+				return &object.Error{Message: err.Error()}
+			}
+		}
+
+		_, err := e.Eval(fmt.Sprintf("let inner = %s + 1;", name(99)))
+		if err != nil {
+			return &object.Error{Message: err.Error()}
+		}
+
+		return object.NewInteger(1)
+	})
+	if err != nil {
+		t.Fatalf("register error: %s", err)
+	}
+
+	result, err := e.Eval(`let before = 1; let after = define(); before + after`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	testInteger(t, result, 2)
+
+	result, err = e.Eval(fmt.Sprintf("%s + %s + inner + after", name(0), name(99)))
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	testInteger(t, result, 200)
+}
+
+// A host function calling back into the script that called it
+func TestCallFromHostFunction(t *testing.T) {
+	e := New()
+
+	err := e.RegisterFunc("twice", func(args ...object.Object) object.Object {
+		once, err := e.Call(args[0], args[1])
+		if err != nil {
+			return &object.Error{Message: err.Error()}
+		}
+		result, err := e.Call(args[0], once)
+		if err != nil {
+			return &object.Error{Message: err.Error()}
+		}
+		return result
+	})
+	if err != nil {
+		t.Fatalf("register error: %s", err)
+	}
+
+	result, err := e.Eval(`let inc = fn(x) { x + 1 }; twice(inc, 1) + twice(fn(x) { x * 3 }, 2)`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	testInteger(t, result, 21)
+}
+
+func TestEnginesRunConcurrently(t *testing.T) {
+	var wg sync.WaitGroup
+	results := make([]object.Object, 8)
+	errs := make([]error, 8)
+
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			e := New()
+			e.RegisterFunc("offset", func(args ...object.Object) object.Object { return object.NewInteger(int64(i)) })
+
+			_, err := e.Eval(`let sum = fn(n, acc) { if (n == 0) { acc } else { sum(n - 1, acc + n) } };`)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+
+			results[i], errs[i] = e.Eval(`sum(1000, offset())`)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range results {
+		if errs[i] != nil {
+			t.Fatalf("engine %d: %s", i, errs[i])
+		}
+		testInteger(t, results[i], 500500+int64(i))
+	}
+}
@@ -0,0 +1,378 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"compiler/ast"
+	"compiler/compiler"
+	"compiler/disasm"
+	"compiler/evaluator"
+	"compiler/lexer"
+	"compiler/object"
+	"compiler/parser"
+	"compiler/repl"
+	"compiler/rvm"
+	"compiler/vm"
+)
+
+// Exit codes tell scripts calling celeste which stage failed
+const (
+	ExitOK = 0
+	ExitFailure = 1 // Anything outside the script itself, like a file that can't be read
+	ExitUsage = 2
+	ExitParseError = 3
+	ExitCompileError = 4
+	ExitRuntimeError = 5
+)
+
+const usage = `usage:
+  celeste run [--engine vm|rvm|eval] <file> [args...]
+  celeste compile [-o <out.celc>] <file>
+  celeste check <file>
+  celeste disasm <file>
+  celeste repl
+  celeste <file> [args...]
+`
+
+// Main runs the command line and returns the exit code instead of exiting so it can be tested
+func Main(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		return startRepl(stdin, stdout)
+	}
+
+	switch args[0] {
+	case "run":
+		return runCommand(args[1:], stderr)
+	case "check":
+		return checkCommand(args[1:], stdout, stderr)
+	case "compile":
+		return compileCommand(args[1:], stderr)
+	case "disasm":
+		return disasmCommand(args[1:], stdout, stderr)
+	case "repl":
+		return startRepl(stdin, stdout)
+	case "help", "-h", "--help":
+		fmt.Fprint(stdout, usage)
+		return ExitOK
+	default:
+		if strings.HasPrefix(args[0], "-") {
+			fmt.Fprintf(stderr, "unknown flag %s\n%s", args[0], usage)
+			return ExitUsage
+		}
+
+		return runCommand(args, stderr) // celeste script.cel is shorthand for celeste run script.cel
+	}
+}
+
+func startRepl(stdin io.Reader, stdout io.Writer) int {
+	if u, err := user.Current(); err == nil {
+		fmt.Fprintf(stdout, "Hello %s! This is my programming language!\n", u.Username)
+	}
+	fmt.Fprintf(stdout, "Feel free to type in commands\n")
+
+	repl.Start(stdin, stdout)
+	return ExitOK
+}
+
+func runCommand(args []string, stderr io.Writer) int {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	engine := flags.String("engine", "vm", "use 'vm', 'rvm' or 'eval'")
+
+	if err := flags.Parse(args); err != nil {
+		return ExitUsage
+	}
+
+	if flags.NArg() == 0 {
+		fmt.Fprintf(stderr, "run: missing script file\n%s", usage)
+		return ExitUsage
+	}
+
+	path := flags.Arg(0)
+	scriptArgs := flags.Args()[1:]
+
+	if isBytecodeFile(path) {
+		if *engine != "vm" {
+			fmt.Fprintf(stderr, "%s is precompiled bytecode, it can only run on the vm engine\n", path)
+			return ExitUsage
+		}
+
+		bytecode, code := loadBytecode(path, stderr)
+		if code != ExitOK {
+			return code
+		}
+
+		return runBytecode(bytecode, scriptArgs, stderr)
+	}
+
+	program, code := parseFile(path, stderr)
+	if code != ExitOK {
+		return code
+	}
+
+	switch *engine {
+	case "vm":
+		return runVM(program, scriptArgs, stderr)
+	case "rvm":
+		return runRVM(program, scriptArgs, stderr)
+	case "eval":
+		return runEval(program, scriptArgs, stderr)
+	default:
+		fmt.Fprintf(stderr, "unknown engine %q, use 'vm', 'rvm' or 'eval'\n", *engine)
+		return ExitUsage
+	}
+}
+
+func compileCommand(args []string, stderr io.Writer) int {
+	flags := flag.NewFlagSet("compile", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	output := flags.String("o", "", "where to write the bytecode, defaults to the script path with a .celc extension")
+
+	if err := flags.Parse(args); err != nil {
+		return ExitUsage
+	}
+
+	if flags.NArg() != 1 {
+		fmt.Fprintf(stderr, "compile: expected exactly one file\n%s", usage)
+		return ExitUsage
+	}
+
+	path := flags.Arg(0)
+	if *output == "" {
+		*output = strings.TrimSuffix(path, filepath.Ext(path)) + BytecodeExt
+	}
+
+	program, code := parseFile(path, stderr)
+	if code != ExitOK {
+		return code
+	}
+
+	bytecode, code := compileProgram(program, compiler.Options{Verify: true, FoldConstants: true, Peephole: true, Superinstructions: true}, stderr)
+	if code != ExitOK {
+		return code
+	}
+
+	data, err := compiler.Encode(bytecode)
+	if err != nil {
+		fmt.Fprintf(stderr, "compile error: %s\n", err)
+		return ExitCompileError
+	}
+
+	err = os.WriteFile(*output, data, 0o644)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err)
+		return ExitFailure
+	}
+
+	return ExitOK
+}
+
+func checkCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) != 1 {
+		fmt.Fprintf(stderr, "check: expected exactly one file\n%s", usage)
+		return ExitUsage
+	}
+
+	if isBytecodeFile(args[0]) {
+		_, code := loadBytecode(args[0], stderr)
+		if code == ExitOK {
+			fmt.Fprintf(stdout, "%s: ok\n", args[0])
+		}
+		return code
+	}
+
+	program, code := parseFile(args[0], stderr)
+	if code != ExitOK {
+		return code
+	}
+
+	_, code = compileProgram(program, compiler.Options{Verify: true, FoldConstants: true, Peephole: true, Superinstructions: true}, stderr)
+	if code != ExitOK {
+		return code
+	}
+
+	fmt.Fprintf(stdout, "%s: ok\n", args[0])
+	return ExitOK
+}
+
+// Works on scripts and on precompiled files, which is handy to see what ended up in a .celc
+func disasmCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) != 1 {
+		fmt.Fprintf(stderr, "disasm: expected exactly one file\n%s", usage)
+		return ExitUsage
+	}
+
+	var bytecode *compiler.Bytecode
+	var code int
+
+	if isBytecodeFile(args[0]) {
+		bytecode, code = loadBytecode(args[0], stderr)
+	} else {
+		var program *ast.Program
+		program, code = parseFile(args[0], stderr)
+		if code != ExitOK {
+			return code
+		}
+
+		bytecode, code = compileProgram(program, compiler.Options{FoldConstants: true, Peephole: true, Superinstructions: true}, stderr)
+	}
+
+	if code != ExitOK {
+		return code
+	}
+
+	disasm.Fprint(stdout, bytecode)
+	return ExitOK
+}
+
+func parseFile(path string, stderr io.Writer) (*ast.Program, int) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err)
+		return nil, ExitFailure
+	}
+
+	p := parser.New(lexer.New(string(src)))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		fmt.Fprintf(stderr, "%s: parser errors:\n", path)
+		for _, msg := range p.Errors() {
+			fmt.Fprintf(stderr, "\t%s\n", msg)
+		}
+		return nil, ExitParseError
+	}
+
+	return program, ExitOK
+}
+
+const BytecodeExt = ".celc"
+
+// Precompiled files are recognized by their extension, Decode still checks the contents
+func isBytecodeFile(path string) bool {
+	return filepath.Ext(path) == BytecodeExt
+}
+
+func loadBytecode(path string, stderr io.Writer) (*compiler.Bytecode, int) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err)
+		return nil, ExitFailure
+	}
+
+	bytecode, err := compiler.Decode(data)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", path, err)
+		return nil, ExitCompileError
+	}
+
+	return bytecode, ExitOK
+}
+
+// The script arguments live in a global defined before anything else, so each run gets its own and nothing is shared through package state.
+// It is always global 0, which lets precompiled bytecode find it without storing the symbol table.
+const argsGlobal = 0
+
+func compileProgram(program *ast.Program, options compiler.Options, stderr io.Writer) (*compiler.Bytecode, int) {
+	symbolTable := compiler.NewSymbolTable()
+	for i, v := range object.Builtins {
+		symbolTable.DefineBuiltin(i, v.Name)
+	}
+	symbolTable.Define("args") // The first global defined, so its index is argsGlobal
+
+	comp := compiler.NewWithState(symbolTable, []object.Object{})
+	comp.SetOptions(options)
+	err := comp.Compile(program)
+	if err != nil {
+		fmt.Fprintf(stderr, "compile error: %s\n", err)
+		return nil, ExitCompileError
+	}
+
+	for _, warning := range comp.Warnings() {
+		fmt.Fprintf(stderr, "warning: %s\n", warning)
+	}
+
+	return comp.Bytecode(), ExitOK
+}
+
+func runVM(program *ast.Program, scriptArgs []string, stderr io.Writer) int {
+	bytecode, code := compileProgram(program, compiler.Options{FoldConstants: true, Peephole: true, Superinstructions: true}, stderr)
+	if code != ExitOK {
+		return code
+	}
+
+	return runBytecode(bytecode, scriptArgs, stderr)
+}
+
+func runBytecode(bytecode *compiler.Bytecode, scriptArgs []string, stderr io.Writer) int {
+	globals := make([]object.Object, argsGlobal+1)
+	globals[argsGlobal] = argsArray(scriptArgs)
+
+	machine := vm.NewWithGlobalsStore(bytecode, globals)
+	err := machine.Run()
+	if err != nil {
+		fmt.Fprintf(stderr, "runtime error: %s\n", err)
+		for _, line := range machine.StackTrace() {
+			fmt.Fprintf(stderr, "\t%s\n", line)
+		}
+		return ExitRuntimeError
+	}
+
+	return ExitOK
+}
+
+// The register VM compiles straight from the AST, args is its first global too
+func runRVM(program *ast.Program, scriptArgs []string, stderr io.Writer) int {
+	comp := rvm.NewCompiler()
+	args := comp.DefineGlobal("args")
+
+	compiled, err := comp.Compile(program)
+	if err != nil {
+		fmt.Fprintf(stderr, "compile error: %s\n", err)
+		return ExitCompileError
+	}
+
+	for _, warning := range comp.Warnings() {
+		fmt.Fprintf(stderr, "warning: %s\n", warning)
+	}
+
+	machine := rvm.New()
+	machine.SetGlobal(args, argsArray(scriptArgs))
+
+	_, err = machine.Run(compiled)
+	if err != nil {
+		fmt.Fprintf(stderr, "runtime error: %s\n", err)
+		for _, line := range machine.StackTrace() {
+			fmt.Fprintf(stderr, "\t%s\n", line)
+		}
+		return ExitRuntimeError
+	}
+
+	return ExitOK
+}
+
+func runEval(program *ast.Program, scriptArgs []string, stderr io.Writer) int {
+	env := object.NewEnvironment()
+	env.Set("args", argsArray(scriptArgs))
+
+	result := evaluator.Eval(program, env)
+	if err, ok := result.(*object.Error); ok {
+		fmt.Fprintf(stderr, "runtime error: %s\n", err.Message)
+		return ExitRuntimeError
+	}
+
+	return ExitOK
+}
+
+func argsArray(args []string) *object.Array {
+	elements := make([]object.Object, len(args))
+	for i, a := range args {
+		elements[i] = &object.String{Value: a}
+	}
+
+	return &object.Array{Elements: elements}
+}
@@ -0,0 +1,204 @@
+package cli
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeScript(t *testing.T, src string) string {
+	path := filepath.Join(t.TempDir(), "script.cel")
+	err := os.WriteFile(path, []byte(src), 0o644)
+	if err != nil {
+		t.Fatalf("could not write script: %s", err)
+	}
+
+	return path
+}
+
+func TestExitCodes(t *testing.T) {
+	tests := []struct {
+		src string
+		expected int
+	} {
+		{`let x = 1 + 2;`, ExitOK},
+		{`let x = ;`, ExitParseError},
+		{`1 + true;`, ExitRuntimeError},
+		{`fn add(a, b) { a + b } add(1);`, ExitRuntimeError},
+	}
+
+	for _, engine := range []string{"vm", "rvm", "eval"} {
+		for _, tt := range tests {
+			path := writeScript(t, tt.src)
+
+			var stdout, stderr bytes.Buffer
+			code := Main([]string{"run", "--engine", engine, path}, nil, &stdout, &stderr)
+			if code != tt.expected {
+				t.Errorf("engine=%s, input=%q: wrong exit code. want=%d, got=%d (stderr=%q)", engine, tt.src, tt.expected, code, stderr.String())
+			}
+		}
+	}
+}
+
+func TestScriptArgs(t *testing.T) {
+	path := writeScript(t, `
+	match args {
+		["first", second] => second,
+		_ => 1 + true,
+	}
+	`)
+
+	for _, engine := range []string{"vm", "rvm", "eval"} {
+		var stdout, stderr bytes.Buffer
+		code := Main([]string{"run", "--engine", engine, path, "first", "second"}, nil, &stdout, &stderr)
+		if code != ExitOK {
+			t.Errorf("engine=%s: wrong exit code. want=%d, got=%d (stderr=%q)", engine, ExitOK, code, stderr.String())
+		}
+
+		code = Main([]string{"run", "--engine", engine, path, "first"}, nil, &stdout, &stderr)
+		if code != ExitRuntimeError {
+			t.Errorf("engine=%s: wrong exit code with one argument. want=%d, got=%d", engine, ExitRuntimeError, code)
+		}
+	}
+}
+
+func TestRunShorthand(t *testing.T) {
+	path := writeScript(t, `args[0]`)
+
+	var stdout, stderr bytes.Buffer
+	code := Main([]string{path, "x"}, nil, &stdout, &stderr)
+	if code != ExitOK {
+		t.Errorf("wrong exit code. want=%d, got=%d (stderr=%q)", ExitOK, code, stderr.String())
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		src string
+		expected int
+	} {
+		{`let x = 1 + true;`, ExitOK}, // Only a runtime error, check does not run the script
+		{`let x = ;`, ExitParseError},
+		{`impl Point { fn norm(self) { 0 } }`, ExitCompileError},
+	}
+
+	for _, tt := range tests {
+		path := writeScript(t, tt.src)
+
+		var stdout, stderr bytes.Buffer
+		code := Main([]string{"check", path}, nil, &stdout, &stderr)
+		if code != tt.expected {
+			t.Errorf("input=%q: wrong exit code. want=%d, got=%d (stderr=%q)", tt.src, tt.expected, code, stderr.String())
+		}
+	}
+}
+
+func TestUsageErrors(t *testing.T) {
+	path := writeScript(t, `1`)
+
+	tests := []struct {
+		args []string
+		expected int
+	} {
+		{[]string{"run"}, ExitUsage},
+		{[]string{"run", "--engine", "jit", path}, ExitUsage},
+		{[]string{"check"}, ExitUsage},
+		{[]string{"--verbose"}, ExitUsage},
+		{[]string{""}, ExitFailure}, // Not a flag, so it is taken for a script that doesn't exist
+		{[]string{"run", filepath.Join(t.TempDir(), "missing.cel")}, ExitFailure},
+	}
+
+	for _, tt := range tests {
+		var stdout, stderr bytes.Buffer
+		code := Main(tt.args, nil, &stdout, &stderr)
+		if code != tt.expected {
+			t.Errorf("args=%q: wrong exit code. want=%d, got=%d", strings.Join(tt.args, " "), tt.expected, code)
+		}
+	}
+}
+
+func TestCompileAndRunBytecode(t *testing.T) {
+	path := writeScript(t, `
+	fn greet(name, greeting = "hello") { greeting + " " + name }
+	match args {
+		[name] => greet(name),
+		_ => 1 + true,
+	}
+	`)
+
+	var stdout, stderr bytes.Buffer
+	code := Main([]string{"compile", path}, nil, &stdout, &stderr)
+	if code != ExitOK {
+		t.Fatalf("compile failed with exit code %d (stderr=%q)", code, stderr.String())
+	}
+
+	compiled := strings.TrimSuffix(path, ".cel") + BytecodeExt
+
+	tests := []struct {
+		args []string
+		expected int
+	} {
+		{[]string{"run", compiled, "world"}, ExitOK},
+		{[]string{compiled}, ExitRuntimeError},
+		{[]string{"check", compiled}, ExitOK},
+		{[]string{"run", "--engine", "eval", compiled}, ExitUsage},
+	}
+
+	for _, tt := range tests {
+		code := Main(tt.args, nil, &stdout, &stderr)
+		if code != tt.expected {
+			t.Errorf("args=%q: wrong exit code. want=%d, got=%d (stderr=%q)", strings.Join(tt.args, " "), tt.expected, code, stderr.String())
+		}
+	}
+}
+
+func TestCorruptedBytecode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.celc")
+	err := os.WriteFile(path, []byte("CELC garbage"), 0o644)
+	if err != nil {
+		t.Fatalf("could not write file: %s", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := Main([]string{"run", path}, nil, &stdout, &stderr)
+	if code != ExitCompileError {
+		t.Errorf("wrong exit code. want=%d, got=%d", ExitCompileError, code)
+	}
+
+	if !strings.Contains(stderr.String(), "checksum mismatch") {
+		t.Errorf("expected a checksum error. got=%q", stderr.String())
+	}
+}
+
+func TestDisasm(t *testing.T) {
+	path := writeScript(t, "fn greet(name) {\n  \"hello \" + name\n}\ngreet(\"world\")\n")
+
+	var stdout, stderr bytes.Buffer
+	code := Main([]string{"disasm", path}, nil, &stdout, &stderr)
+	if code != ExitOK {
+		t.Fatalf("wrong exit code. want=%d, got=%d (stderr=%q)", ExitOK, code, stderr.String())
+	}
+
+	for _, want := range []string{"== main ==", "fn greet (params 1, locals 1, free 0)", `; "hello "`, "0000    2  OpConstant"} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("disassembly is missing %q.\ngot=\n%s", want, stdout.String())
+		}
+	}
+
+	code = Main([]string{"compile", path}, nil, &stdout, &stderr)
+	if code != ExitOK {
+		t.Fatalf("compile failed with exit code %d (stderr=%q)", code, stderr.String())
+	}
+
+	var fromBytecode bytes.Buffer
+	code = Main([]string{"disasm", strings.TrimSuffix(path, ".cel") + BytecodeExt}, nil, &fromBytecode, &stderr)
+	if code != ExitOK {
+		t.Fatalf("wrong exit code for bytecode. want=%d, got=%d (stderr=%q)", ExitOK, code, stderr.String())
+	}
+
+	if fromBytecode.String() != stdout.String() {
+		t.Errorf("precompiled file disassembles differently.\nwant=\n%s\ngot=\n%s", stdout.String(), fromBytecode.String())
+	}
+}
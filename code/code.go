@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"sort"
 )
 
 type Instructions []byte
@@ -17,9 +19,20 @@ func (ins Instructions) String() string {
 		def, err := Lookup(ins[i])
 		if err != nil {
 			fmt.Fprintf(&out, "ERRORS: %s\n", err)
+			i++ // Skips the unknown byte, otherwise the same one is looked up forever
 			continue
 		}
 
+		width := 0
+		for _, w := range def.OperandWidths {
+			width += w
+		}
+
+		if i+1+width > len(ins) {
+			fmt.Fprintf(&out, "ERRORS: %04d %s is cut off\n", i, def.Name)
+			break
+		}
+
 		operand, read := ReadOperands(def, ins[i+1:])
 
 		fmt.Fprintf(&out, "%04d %s\n", i, ins.fmtInstruction(def, operand))
@@ -80,6 +93,52 @@ const (
 	OpGetBuiltin
 	OpClosure
 	OpGetFree
+	OpDefineMethod
+	OpCallMethod
+	OpMatchEqual
+	OpMatchArray
+	OpMatchHash
+	OpMatchKey
+	OpDestructureArray
+	OpDestructureHash
+	OpSkipDefault
+	OpCallSpread
+	OpCurrentClosure
+	OpConstantWide
+	OpGetLocalDup
+	OpSetGlobalWide
+	OpGetGlobalWide
+	OpSetLocalWide
+	OpGetLocalWide
+	OpGetFreeWide
+	OpCallWide
+	OpClosureWide
+	OpJumpWide
+	OpJumpNotTruthyWide
+	OpSkipDefaultWide
+	OpTailCall
+	OpCallMethodWide
+	OpCallSpreadWide
+	OpTailCallSpread
+	OpDefineMethodWide
+
+	// Superinstructions, the compiler only emits these when Options.Superinstructions is on
+	OpGetLocal0
+	OpGetLocal1
+	OpGetLocal2
+	OpGetLocal3
+	OpAddConstInt
+	OpSubConstInt
+	OpJumpIfNotGreater
+	OpCall0
+	OpCall1
+	OpCall2
+)
+
+// Flags for the last operand of OpDestructureArray and OpDestructureHash
+const (
+	DestructureRest = 1 << iota // The remaining array elements are pushed as one more array
+	DestructureStrict // Missing elements or keys are an error instead of null
 )
 
 type Definition struct {
@@ -117,6 +176,44 @@ var definitions = map[Opcode]*Definition { // This associates the operator (by o
 	OpGetBuiltin: {"OpGetBuiltin", []int{1}},
 	OpClosure: {"OpClosure", []int{2, 1}},
 	OpGetFree: {"OpGetFree", []int{1}},
+	OpDefineMethod: {"OpDefineMethod", []int{2, 2}}, // Constant index of the type name, constant index of the method name
+	OpCallMethod: {"OpCallMethod", []int{2, 1}}, // Constant index of the method name, number of arguments (not counting the receiver)
+	OpMatchEqual: {"OpMatchEqual", []int{}}, // Like OpEqual, but values of different types are never equal instead of being an error
+	OpMatchArray: {"OpMatchArray", []int{2}}, // Operand is the number of elements the array must have
+	OpMatchHash: {"OpMatchHash", []int{}},
+	OpMatchKey: {"OpMatchKey", []int{}},
+	OpDestructureArray: {"OpDestructureArray", []int{2, 1}}, // Number of elements to push, flags
+	OpDestructureHash: {"OpDestructureHash", []int{2, 1}}, // Number of keys (pushed above the hash), flags
+	OpSkipDefault: {"OpSkipDefault", []int{2, 2}}, // Parameter index, where to jump if the caller passed that argument
+	OpCallSpread: {"OpCallSpread", []int{1}}, // Number of argument arrays on the stack, they are flattened into the actual arguments
+	OpCurrentClosure: {"OpCurrentClosure", []int{}}, // Pushes the closure of the current frame, used by named functions to call themselves
+	OpConstantWide: {"OpConstantWide", []int{4}}, // OpConstant for constant pools past 65535 entries
+	OpGetLocalDup: {"OpGetLocalDup", []int{1}}, // Pushes the same local twice, made by the peephole pass for things like x * x
+	OpSetGlobalWide: {"OpSetGlobalWide", []int{4}}, // OpSetGlobal for programs with more than 65536 globals
+	OpGetGlobalWide: {"OpGetGlobalWide", []int{4}},
+	OpSetLocalWide: {"OpSetLocalWide", []int{2}}, // The wide forms below are for generated code with more than 255 locals, free variables or arguments
+	OpGetLocalWide: {"OpGetLocalWide", []int{2}},
+	OpGetFreeWide: {"OpGetFreeWide", []int{2}},
+	OpCallWide: {"OpCallWide", []int{2}},
+	OpClosureWide: {"OpClosureWide", []int{4, 2}}, // Constant index of the function, number of free variables
+	OpJumpWide: {"OpJumpWide", []int{4}}, // The compiler emits jumps in their wide form and narrows the ones whose target fits once the scope is done
+	OpJumpNotTruthyWide: {"OpJumpNotTruthyWide", []int{4}},
+	OpSkipDefaultWide: {"OpSkipDefaultWide", []int{2, 4}},
+	OpTailCall: {"OpTailCall", []int{1}}, // OpCall whose result the function returns right away, a closure callee takes over the caller's frame
+	OpCallMethodWide: {"OpCallMethodWide", []int{4, 2}}, // For method names past constant 65535 or calls with more than 255 arguments
+	OpCallSpreadWide: {"OpCallSpreadWide", []int{2}},
+	OpTailCallSpread: {"OpTailCallSpread", []int{1}}, // OpCallSpread in tail position, like OpTailCall
+	OpDefineMethodWide: {"OpDefineMethodWide", []int{4, 4}}, // For type or method names past constant 65535
+	OpGetLocal0: {"OpGetLocal0", []int{}}, // OpGetLocal with the index in the opcode, for the first few locals which most functions use the most
+	OpGetLocal1: {"OpGetLocal1", []int{}},
+	OpGetLocal2: {"OpGetLocal2", []int{}},
+	OpGetLocal3: {"OpGetLocal3", []int{}},
+	OpAddConstInt: {"OpAddConstInt", []int{2}}, // OpConstant then OpAdd, the constant is always an integer
+	OpSubConstInt: {"OpSubConstInt", []int{2}}, // OpConstant then OpSub, the constant is always an integer
+	OpJumpIfNotGreater: {"OpJumpIfNotGreater", []int{2}}, // OpGreaterThan then OpJumpNotTruthy
+	OpCall0: {"OpCall0", []int{}}, // OpCall with the number of arguments in the opcode
+	OpCall1: {"OpCall1", []int{}},
+	OpCall2: {"OpCall2", []int{}},
 }
 
 func Lookup(op byte) (*Definition, error) {
@@ -128,10 +225,45 @@ func Lookup(op byte) (*Definition, error) {
 	return def, nil
 }
 
+// TableVersion is a checksum of every opcode's number, name and operand widths.
+// Serialized bytecode records it so instructions compiled for a different set of opcodes are rejected instead of misread.
+func TableVersion() uint32 {
+	var out bytes.Buffer
+
+	for op := 0; op < 256; op++ {
+		def, ok := definitions[Opcode(op)]
+		if !ok {
+			continue
+		}
+
+		fmt.Fprintf(&out, "%d %s %v\n", op, def.Name, def.OperandWidths)
+	}
+
+	return crc32.ChecksumIEEE(out.Bytes())
+}
+
+// Make is for operands known to fit their width, it panics on one that doesn't instead of truncating it.
+// The compiler uses MakeChecked, which reports the operand as an error.
 func Make(op Opcode, operands ...int) []byte {
+	instruction, err := MakeChecked(op, operands...)
+	if err != nil {
+		panic(err)
+	}
+
+	return instruction
+}
+
+func MakeChecked(op Opcode, operands ...int) ([]byte, error) {
 	def, ok := definitions[op]
 	if !ok {
-		return []byte{}
+		return []byte{}, nil
+	}
+
+	for i, o := range operands {
+		width := def.OperandWidths[i]
+		if o < 0 || o >= 1<<(8*width) {
+			return nil, fmt.Errorf("operand %d of %s does not fit in %d byte(s): %d", i, def.Name, width, o)
+		}
 	}
 
 	instructionLen := 1
@@ -150,12 +282,14 @@ func Make(op Opcode, operands ...int) []byte {
 			instruction[offset] = byte(o)
 		case 2: // Will loop through the operands, in this clase in the case the width is 2 (requires 2 bytes to represent it will represent it in big endian style)
 			binary.BigEndian.PutUint16(instruction[offset:], uint16(o)) // Stores these two bytes inside of the instructions byte offsetting the op code byte
+		case 4:
+			binary.BigEndian.PutUint32(instruction[offset:], uint32(o))
 		}
 
 		offset += width // Increments the offset by the width to make sure next operand is stored at the correct position
 	}
 
-	return instruction // returns the final instruction slide with the op and all operands in order (case 2 ordered by big endian)
+	return instruction, nil // returns the final instruction slide with the op and all operands in order (case 2 ordered by big endian)
 }
 
 func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
@@ -168,6 +302,8 @@ func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
 			operands[i] = int(ReadUint8(ins[offset:])) // offset: means you are starting from the offset index :offset means ending at the offset index
 		case 2:
 			operands[i] = int(ReadUint16(ins[offset:]))
+		case 4:
+			operands[i] = int(ReadUint32(ins[offset:]))
 		}
 
 		offset += width
@@ -182,4 +318,27 @@ func ReadUint8(ins Instructions) uint8 {
 
 func ReadUint16(ins Instructions) uint16 {
 	return binary.BigEndian.Uint16(ins) // Likewise as mentioned above but binary.BigEndian.Uint16(ins) knows only to take the next two bytes
-}
\ No newline at end of file
+}
+
+func ReadUint32(ins Instructions) uint32 {
+	return binary.BigEndian.Uint32(ins)
+}
+
+// SourceMap ties instructions back to the source line they were compiled from.
+// Entries are sorted by offset and each one covers every instruction up to the next entry.
+type SourceMap []LineEntry
+
+type LineEntry struct {
+	Offset int
+	Line int
+}
+
+// Line returns the source line of the instruction at offset, or 0 when it isn't known
+func (sm SourceMap) Line(offset int) int {
+	i := sort.Search(len(sm), func(i int) bool { return sm[i].Offset > offset })
+	if i == 0 {
+		return 0
+	}
+
+	return sm[i-1].Line
+}
@@ -14,6 +14,8 @@ func TestMake(t *testing.T) {
 		{OpAdd, []int{}, []byte{byte(OpAdd)}},
 		{OpGetLocal, []int{255}, []byte{byte(OpGetLocal), 255}},
 		{OpClosure, []int{65534, 255}, []byte{byte(OpClosure), 255, 254, 255}},
+		{OpConstantWide, []int{65536}, []byte{byte(OpConstantWide), 0, 1, 0, 0}},
+		{OpClosureWide, []int{65536, 256}, []byte{byte(OpClosureWide), 0, 1, 0, 0, 1, 0}},
 	}
 
 	for _, tt := range tests {
@@ -31,6 +33,33 @@ func TestMake(t *testing.T) {
 	}
 }
 
+func TestMakeChecked(t *testing.T) {
+	tests := []struct {
+		op Opcode
+		operands []int
+		expected string
+	} {
+		{OpGetLocal, []int{256}, "operand 0 of OpGetLocal does not fit in 1 byte(s): 256"},
+		{OpConstant, []int{65536}, "operand 0 of OpConstant does not fit in 2 byte(s): 65536"},
+		{OpClosure, []int{1, 300}, "operand 1 of OpClosure does not fit in 1 byte(s): 300"},
+		{OpCall, []int{-1}, "operand 0 of OpCall does not fit in 1 byte(s): -1"},
+	}
+
+	for _, tt := range tests {
+		_, err := MakeChecked(tt.op, tt.operands...)
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%v", tt.expected, err)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Make should panic instead of truncating an operand")
+		}
+	}()
+	Make(OpGetLocal, 256)
+}
+
 func TestInstructionsString(t *testing.T) {
 	instructions := []Instructions{
 		Make(OpAdd),
@@ -58,6 +87,37 @@ func TestInstructionsString(t *testing.T) {
 	}
 }
 
+func TestInstructionsStringWithInvalidBytes(t *testing.T) {
+	ins := Instructions{byte(OpAdd), 255, byte(OpPop), byte(OpConstant), 1}
+
+	expected := `0000 OpAdd
+ERRORS: opcode 255 undefined
+0002 OpPop
+ERRORS: 0003 OpConstant is cut off
+`
+
+	if ins.String() != expected {
+		t.Errorf("instructions wrongly formatted.\nwant=%q\ngot=%q", expected, ins.String())
+	}
+}
+
+func TestTableVersion(t *testing.T) {
+	if TableVersion() != TableVersion() {
+		t.Errorf("TableVersion is not stable")
+	}
+
+	def := definitions[OpPop]
+	original := def.Name
+	before := TableVersion()
+
+	def.Name = "OpDiscard"
+	defer func() { def.Name = original }()
+
+	if TableVersion() == before {
+		t.Errorf("TableVersion did not change with the opcode table")
+	}
+}
+
 func TestReadOperands(t *testing.T) {
 	tests :=[]struct {
 		op Opcode
@@ -67,6 +127,7 @@ func TestReadOperands(t *testing.T) {
 		{OpConstant, []int{65535}, 2},
 		{OpGetLocal, []int{255}, 1},
 		{OpClosure, []int{65535, 255}, 3},
+		{OpConstantWide, []int{1 << 20}, 4},
 	}
 
 	for _, tt := range tests{
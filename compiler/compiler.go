@@ -5,6 +5,7 @@ import (
 	"compiler/ast"
 	"compiler/code"
 	"compiler/object"
+	"compiler/verifier"
 	"sort"
 )
 
@@ -18,17 +19,35 @@ type Compiler struct {
 	symbolTable *SymbolTable
 	scopes []CompilationScope
 	scopeIndex int
+	warnings []string
+	options Options
+	line int // Source line of the statement being compiled, recorded in the scope's source map
+	interned map[constantKey]int // Index of every constant that can be shared, see internKey
+	matchDepth int // How many match expressions the code being compiled is nested in, each depth has its own hidden slots
+	err error // First operand that did not fit its instruction, emit can't return it so the program's statements check it
+}
+
+// Options tune how programs are compiled, the zero value is what New uses
+type Options struct {
+	Strict bool // Missing elements or keys in a destructuring let are a runtime error instead of a null binding
+	Verify bool // Runs the verifier over the finished program, mostly useful to catch compiler bugs
+	FoldConstants bool // Evaluates operators on literals at compile time and drops if branches that can never run
+	Peephole bool // Rewrites short instruction sequences into cheaper ones once a function or the program is compiled
+	Superinstructions bool // Replaces common sequences with specialized opcodes that do the same work in one dispatch
 }
 
 type Bytecode struct {
 	Instructions code.Instructions
 	Constants []object.Object
+	SourceMap code.SourceMap // Lines of the main program's instructions, functions carry their own
+	NumGlobals int // How many global slots the instructions use, the VM sizes its globals store from it
 }
 
 type CompilationScope struct {
 	instructions code.Instructions
 	lastInstruction EmittedInstruction
 	previousInstruction EmittedInstruction
+	sourceMap code.SourceMap
 }
 
 func New() *Compiler {
@@ -49,6 +68,7 @@ func New() *Compiler {
 		symbolTable: symbolTable,
 		scopes: []CompilationScope{mainScope},
 		scopeIndex: 0,
+		interned: map[constantKey]int{},
 	}
 }
 
@@ -56,10 +76,40 @@ func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
 	compiler := New()
 	compiler.symbolTable = s
 	compiler.constants = constants
+	for i, obj := range constants { // Constants from earlier inputs are reused, the first of equal ones wins like it would have when they were added
+		if key, ok := internKey(obj); ok {
+			if _, found := compiler.interned[key]; !found {
+				compiler.interned[key] = i
+			}
+		}
+	}
 	return compiler
 }
 
+func (c *Compiler) SetOptions(options Options) {
+	c.options = options
+}
+
 func (c *Compiler) Compile(node ast.Node) error {
+	if c.err != nil { // Nothing after an instruction that couldn't be encoded is worth compiling
+		return c.err
+	}
+
+	err := c.compile(node)
+	if err != nil {
+		return err
+	}
+
+	return c.err
+}
+
+func (c *Compiler) compile(node ast.Node) error {
+	if line := statementLine(node); line != 0 { // The line of the enclosing statement comes back once a nested one is done
+		previous := c.line
+		c.line = line
+		defer func() { c.line = previous }()
+	}
+
 	switch node := node.(type) {
 	case *ast.Program:
 		for _, s := range node.Statements {
@@ -67,6 +117,25 @@ func (c *Compiler) Compile(node ast.Node) error {
 			if err != nil {
 				return err
 			}
+
+			if c.err != nil {
+				return c.err
+			}
+		}
+
+		scope := &c.scopes[c.scopeIndex]
+		instructions, sourceMap, err := c.optimize(scope.instructions, scope.sourceMap)
+		if err != nil {
+			return err
+		}
+		scope.instructions, scope.sourceMap = instructions, sourceMap
+		scope.lastInstruction, scope.previousInstruction = EmittedInstruction{}, EmittedInstruction{} // Positions from before optimizing mean nothing now
+
+		if c.options.Verify {
+			err := verifier.Verify(c.currentInstructions(), c.constants, c.numGlobals())
+			if err != nil {
+				return fmt.Errorf("compiler produced invalid bytecode: %s", err)
+			}
 		}
 	case *ast.ExpressionStatement:
 		err := c.Compile(node.Expression)
@@ -77,6 +146,13 @@ func (c *Compiler) Compile(node ast.Node) error {
 		c.emit(code.OpPop)
 
 	case *ast.InfixExpression: // Currently, the + (aka the operator) is ignored
+		if c.options.FoldConstants {
+			if folded, ok := fold(node); ok {
+				c.emitFolded(folded)
+				return nil
+			}
+		}
+
 		if node.Operator == "<" {
 			err := c.Compile(node.Right)
 			if err != nil {
@@ -122,6 +198,13 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 	
 	case *ast.PrefixExpression:
+		if c.options.FoldConstants {
+			if folded, ok := fold(node); ok {
+				c.emitFolded(folded)
+				return nil
+			}
+		}
+
 		err := c.Compile(node.Right)
 		if err != nil {
 			return err
@@ -137,12 +220,18 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 	
 	case *ast.IfExpression:
+		if c.options.FoldConstants {
+			if condition, ok := fold(node.Condition); ok {
+				return c.compileFoldedIf(node, condition)
+			}
+		}
+
 		err := c.Compile(node.Condition)
 		if err != nil {
 			return err
 		}
 
-		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999) // Bogus offset that will be back-patched once node.Consequence is compiled
+		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthyWide, 9999) // Bogus offset that will be back-patched once node.Consequence is compiled
 
 		err = c.Compile(node.Consequence)
 		if err != nil {
@@ -153,7 +242,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.removeLastPop()
 		}
 
-		jumpPos := c.emit(code.OpJump, 9999)
+		jumpPos := c.emit(code.OpJumpWide, 9999)
 
 		afterConsequencePos := len(c.currentInstructions())
 		c.changeOperand(jumpNotTruthyPos, afterConsequencePos)
@@ -196,6 +285,12 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpSetLocal, symbol.Index)
 		}
 	
+	case *ast.DestructuringLetStatement:
+		err := c.compileDestructuringLetStatement(node)
+		if err != nil {
+			return err
+		}
+
 	case *ast.Identifier:
 		symbol, ok := c.symbolTable.Resolve(node.Value)
 		if !ok {
@@ -268,11 +363,24 @@ func (c *Compiler) Compile(node ast.Node) error {
 	case *ast.FunctionLiteral:
 		c.enterScope()
 
+		if node.Name != "" {
+			c.symbolTable.DefineFunctionName(node.Name) // Defined first so parameters with the same name shadow it
+		}
+
 		for _, p := range node.Parameters {
 			c.symbolTable.Define(p.Value)
 		}
+
+		if node.Rest != nil {
+			c.symbolTable.Define(node.Rest.Value) // Right after the parameters, this is where the VM stores the collected arguments
+		}
+
+		err := c.compileParameterDefaults(node)
+		if err != nil {
+			return err
+		}
 		
-		err := c.Compile(node.Body)
+		err = c.Compile(node.Body)
 		if err != nil {
 			return err
 		}
@@ -285,9 +393,15 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpReturn)
 		}
 
+		sourceMap := c.scopes[c.scopeIndex].sourceMap
 		freeSymbols := c.symbolTable.FreeSymbols // Important that this is called before we leave the scope, as we would not have access to it after we leave the scope
 		numLocals := c.symbolTable.numDefinitions
 		instructions := c.leaveScope() // Returns compiled instructions of the scope within the function
+		markTailCalls(instructions)
+		instructions, sourceMap, err = c.optimize(instructions, sourceMap)
+		if err != nil {
+			return err
+		}
 
 		for _, s := range freeSymbols {
 			c.loadSymbol(s) // Loading the free symbol right after leaving the scope right before the closure OpCode is emitted
@@ -297,6 +411,11 @@ func (c *Compiler) Compile(node ast.Node) error {
 			Instructions: instructions,
 			NumLocals: numLocals,
 			NumParameters: len(node.Parameters),
+			NumDefaults: numDefaults(node),
+			Variadic: node.Rest != nil,
+			Name: node.Name,
+			NumFree: len(freeSymbols),
+			SourceMap: sourceMap,
 		}
 		
 		fnIndex := c.addConstant(compiledFn) // Add constant returns the location of the added constant
@@ -316,40 +435,191 @@ func (c *Compiler) Compile(node ast.Node) error {
 			return err
 		}
 
+		spread, count, err := c.compileCallArguments(node.Arguments)
+		if err != nil {
+			return err
+		}
+
+		if spread {
+			c.emit(code.OpCallSpread, count)
+		} else {
+			c.emit(code.OpCall, count)
+		}
+
+	case *ast.SpreadExpression: // Calls handle their spread arguments themselves, so reaching one here means it is somewhere else
+		return errSpreadOutsideCall()
+
+	case *ast.MatchExpression:
+		err := c.compileMatchExpression(node)
+		if err != nil {
+			return err
+		}
+
+	case *ast.MethodCallExpression:
+		err := c.Compile(node.Object) // The receiver sits below the arguments, the VM slides the method in underneath it
+		if err != nil {
+			return err
+		}
+
 		for _, a := range node.Arguments {
+			if _, ok := a.(*ast.SpreadExpression); ok {
+				return errSpreadOutsideCall()
+			}
+
 			err := c.Compile(a)
 			if err != nil {
 				return err
 			}
 		}
 
-		c.emit(code.OpCall, len(node.Arguments))
+		name := c.addConstant(&object.String{Value: node.Method.Value})
+		c.emit(code.OpCallMethod, name, len(node.Arguments))
+
+	case *ast.ImplStatement:
+		objType, ok := object.LookupTypeName(node.Type.Value)
+		if !ok {
+			return fmt.Errorf("unknown type %s", node.Type.Value)
+		}
+
+		typeName := c.addConstant(&object.String{Value: string(objType)})
+
+		for _, m := range node.Methods {
+			err := c.Compile(m.Function)
+			if err != nil {
+				return err
+			}
+
+			name := c.addConstant(&object.String{Value: m.Name.Value})
+			c.emit(code.OpDefineMethod, typeName, name)
+		}
 	}
 	
 	return nil
 }
 
+// Lines are tracked per statement, that is fine grained enough for stack traces and the disassembler
+func statementLine(node ast.Node) int {
+	switch node := node.(type) {
+	case *ast.LetStatement:
+		return node.Token.Line
+	case *ast.DestructuringLetStatement:
+		return node.Token.Line
+	case *ast.ReturnStatement:
+		return node.Token.Line
+	case *ast.ExpressionStatement:
+		return node.Token.Line
+	case *ast.ImplStatement:
+		return node.Token.Line
+	}
+
+	return 0
+}
+
 func (c *Compiler) Bytecode() *Bytecode {
 	return &Bytecode {
 		Instructions: c.currentInstructions(),
 		Constants: c.constants,
+		SourceMap: c.scopes[c.scopeIndex].sourceMap,
+		NumGlobals: c.numGlobals(),
 	}
 }
 
+// The outermost symbol table holds the globals, with NewWithState it also counts the ones from earlier inputs
+func (c *Compiler) numGlobals() int {
+	table := c.symbolTable
+	for table.Outer != nil {
+		table = table.Outer
+	}
+
+	return table.NumDefinitions()
+}
+
+// Warnings are problems that do not stop compilation, like a match expression without a _ arm
+func (c *Compiler) Warnings() []string {
+	return c.warnings
+}
+
 func (c *Compiler) addConstant(obj object.Object) int { // The point of this function is to add it to the constants slice and return the index of the newly added object, an argument for the c.emi() method
+	key, ok := internKey(obj)
+	if ok {
+		if index, found := c.interned[key]; found { // Equal integers, strings and functions share one slot
+			return index
+		}
+	}
+
 	c.constants = append(c.constants, obj)
-	return len(c.constants) - 1 // Returns the index of the newly added object
+	index := len(c.constants) - 1 // Returns the index of the newly added object
+
+	if ok {
+		c.interned[key] = index
+	}
+	return index
+}
+
+// Narrows the scope's jumps and then runs the passes turned on in the options over it
+func (c *Compiler) optimize(ins code.Instructions, sourceMap code.SourceMap) (code.Instructions, code.SourceMap, error) {
+	ins, sourceMap, err := narrowJumps(ins, sourceMap)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if c.options.Peephole {
+		ins, sourceMap, err = peephole(ins, sourceMap)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if c.options.Superinstructions { // Last, so the peephole pass never has to know about them
+		ins, sourceMap, err = superinstructions(ins, sourceMap, c.constants)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return ins, sourceMap, nil
+}
+
+// Opcodes with a form that takes wider operands, emit switches to it when an operand does not fit
+var wideForms = map[code.Opcode]code.Opcode{
+	code.OpConstant: code.OpConstantWide,
+	code.OpSetGlobal: code.OpSetGlobalWide,
+	code.OpGetGlobal: code.OpGetGlobalWide,
+	code.OpSetLocal: code.OpSetLocalWide,
+	code.OpGetLocal: code.OpGetLocalWide,
+	code.OpGetFree: code.OpGetFreeWide,
+	code.OpCall: code.OpCallWide,
+	code.OpCallMethod: code.OpCallMethodWide,
+	code.OpDefineMethod: code.OpDefineMethodWide,
+	code.OpCallSpread: code.OpCallSpreadWide,
+	code.OpClosure: code.OpClosureWide,
 }
 
 func (c *Compiler) emit(op code.Opcode, operands ...int) int { // Takes in the operator and operands and adds it to the instructions slice as BYTES! The operand itself (aka the identifier) is the index to a constant pool	
-	ins := code.Make(op, operands...) //The index of the constant is then used as an operand for the OpConstant instruction
+	ins, err := code.MakeChecked(op, operands...) //The index of the constant is then used as an operand for the OpConstant instruction
+	if wide, ok := wideForms[op]; ok && err != nil {
+		op = wide
+		ins, err = code.MakeChecked(op, operands...)
+	}
+	if err != nil { // Compile stops once the node being compiled is done, so the position is never patched
+		c.fail(err)
+		return -1
+	}
+
 	pos := c.addInstruction(ins) // Returns the position of the newly added instruction (operator and operand as bytes)
 
 	c.setLastInstruction(op, pos)
+	c.recordLine(pos)
 
 	return pos // returns the position of the instruction added
 }
 
+func (c *Compiler) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
 func (c *Compiler) currentInstructions() code.Instructions {
 	return c.scopes[c.scopeIndex].instructions
 }
@@ -363,6 +633,28 @@ func (c *Compiler) addInstruction(ins []byte) int { //Adds the operator and oper
 	return posNewInstruction // You do not -1 because you append to the array, and this returns the STARTING POSITION of the newly added instruction
 }
 
+// Only line changes are recorded, the instructions after an entry belong to the same line until the next one
+func (c *Compiler) recordLine(pos int) {
+	scope := &c.scopes[c.scopeIndex]
+	if c.line == 0 {
+		return
+	}
+
+	if n := len(scope.sourceMap); n > 0 && scope.sourceMap[n-1].Line == c.line {
+		return
+	}
+
+	scope.sourceMap = append(scope.sourceMap, code.LineEntry{Offset: pos, Line: c.line})
+}
+
+// Entries pointing past the end of the instructions are dropped after instructions are cut off
+func (c *Compiler) trimSourceMap() {
+	scope := &c.scopes[c.scopeIndex]
+	for len(scope.sourceMap) > 0 && scope.sourceMap[len(scope.sourceMap)-1].Offset >= len(scope.instructions) {
+		scope.sourceMap = scope.sourceMap[:len(scope.sourceMap)-1]
+	}
+}
+
 func(c *Compiler) setLastInstruction(op code.Opcode, pos int) {
 	previous := c.scopes[c.scopeIndex].lastInstruction
 	last := EmittedInstruction{Opcode: op, Position: pos}
@@ -388,6 +680,7 @@ func (c *Compiler) removeLastPop() {
 
 	c.scopes[c.scopeIndex].instructions = new
 	c.scopes[c.scopeIndex].lastInstruction = previous
+	c.trimSourceMap()
 }
 
 func (c *Compiler) replaceInstructions(pos int, newInstruction []byte) {
@@ -397,10 +690,18 @@ func (c *Compiler) replaceInstructions(pos int, newInstruction []byte) {
 	}
 }
 
-func (c *Compiler) changeOperand(opPos int, operand int) {
+func (c *Compiler) changeOperand(opPos int, operands ...int) {
+	if c.err != nil { // opPos may belong to an instruction emit couldn't encode
+		return
+	}
+
 	ins := c.currentInstructions()
 	op := code.Opcode(ins[opPos])
-	newInstruction := code.Make(op, operand)
+	newInstruction, err := code.MakeChecked(op, operands...)
+	if err != nil { // A jump past what its operand can hold, the instruction keeps its placeholder
+		c.fail(err)
+		return
+	}
 
 	c.replaceInstructions(opPos, newInstruction)
 }
@@ -431,7 +732,12 @@ func (c *Compiler) leaveScope() code.Instructions {
 
 func (c *Compiler) replaceLastPopWithReturn() {
 	lastPos := c.scopes[c.scopeIndex].lastInstruction.Position
-	c.replaceInstructions(lastPos, code.Make(code.OpReturnValue))
+	ins, err := code.MakeChecked(code.OpReturnValue)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	c.replaceInstructions(lastPos, ins)
 
 	c.scopes[c.scopeIndex].lastInstruction.Opcode = code.OpReturnValue
 }
@@ -446,5 +752,7 @@ func (c *Compiler) loadSymbol(s Symbol) {
 		c.emit(code.OpGetBuiltin, s.Index)
 	case FreeScope:
 		c.emit(code.OpGetFree, s.Index)
+	case FunctionScope:
+		c.emit(code.OpCurrentClosure)
 	}
 }
\ No newline at end of file
@@ -1,12 +1,14 @@
 package compiler
 
 import (
+	"bytes"
 	"compiler/ast"
 	"compiler/code"
 	"compiler/lexer"
 	"compiler/object"
 	"compiler/parser"
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -48,6 +50,33 @@ func runCompilerTests(t *testing.T, tests []compilerTestCase) {
 	}
 }
 
+func runCompilerTestsWithOptions(t *testing.T, options Options, tests []compilerTestCase) {
+	t.Helper()
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		compiler := New()
+		compiler.SetOptions(options)
+		err := compiler.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		bytecode := compiler.Bytecode()
+
+		err = testInstructions(tt.expectedInstructions, bytecode.Instructions)
+		if err != nil {
+			t.Fatalf("input=%q: testInstructions failed:%s", tt.input, err)
+		}
+
+		err = testConstants(t, tt.expectedConstants, bytecode.Constants)
+		if err != nil {
+			t.Fatalf("input=%q: testConstants failed:%s", tt.input, err)
+		}
+	}
+}
+
 func TestIntegerArithmetic(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -402,14 +431,14 @@ func TestIndexExpressions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
 			input: "[1, 2, 3][1 + 1]",
-			expectedConstants: []interface{}{1, 2, 3, 1, 1},
+			expectedConstants: []interface{}{1, 2, 3},
 			expectedInstructions: []code.Instructions {
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
 				code.Make(code.OpConstant, 2),
 				code.Make(code.OpArray, 3),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpConstant, 4),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpAdd),
 				code.Make(code.OpIndex),
 				code.Make(code.OpPop),
@@ -417,13 +446,13 @@ func TestIndexExpressions(t *testing.T) {
 		},
 		{
 			input: "{1: 2}[2 - 1]",
-			expectedConstants: []interface{}{1, 2, 2, 1},
+			expectedConstants: []interface{}{1, 2},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
 				code.Make(code.OpHash, 2),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpSub),
 				code.Make(code.OpIndex),
 				code.Make(code.OpPop),
@@ -763,7 +792,7 @@ func TestBuiltins(t *testing.T) {
 				[]code.Instructions{
 				code.Make(code.OpGetBuiltin, 0),
 				code.Make(code.OpArray, 0),
-				code.Make(code.OpCall, 1),
+				code.Make(code.OpTailCall, 1),
 				code.Make(code.OpReturnValue),
 				},
 			},
@@ -901,93 +930,981 @@ func TestClosures(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
-func testInstructions(expected []code.Instructions, actual code.Instructions) error {
-	concatted := concatInstructions(expected)
-
-	if len(actual) != len(concatted) {
-		return fmt.Errorf("wrong instructions length.\nwant=%q\ngot =%q",
-			concatted, actual)
+func TestRecursiveFunctions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+			let countDown = fn(x) { countDown(x - 1); };
+			countDown(1);
+			`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpCurrentClosure),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSub),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+			let wrapper = fn() {
+				fn countDown(x) { countDown(x - 1); }
+				countDown(1);
+			};
+			wrapper();
+			`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpCurrentClosure),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSub),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpClosure, 1, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpCall, 0),
+				code.Make(code.OpPop),
+			},
+		},
 	}
 
-	for i, ins := range concatted {
-		if actual[i] != ins {
-			return fmt.Errorf("wrong instruction at %d.\nwant=%q\ngot =%q",
-			i, concatted, actual)
-		}
+	runCompilerTests(t, tests)
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			// Both branches end the function, only the call whose value is used stays an OpCall
+			input: `fn(f, n) { if (n) { f(n) } else { f(n) + 1 } }`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpJumpNotTruthy, 14),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpJump, 24),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn(f, xs) { f(...xs) }`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpTailCallSpread, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// Main has no frame to give up
+			input: `let f = fn() { 1 }; f()`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpCall, 0),
+				code.Make(code.OpPop),
+			},
+		},
 	}
 
-	return nil
+	runCompilerTests(t, tests)
 }
 
-func testConstants(t *testing.T, expected []interface{}, actual []object.Object) error { // returning the type of error, if all tests pass, no errors are returned
-	if len(expected) != len(actual) {
-		return fmt.Errorf("wrong number of constants. got=%d, want=%d",
-			len(actual), len(expected))
+func TestFunctionNames(t *testing.T) {
+	program := parse(`let add = fn(a, b) { a + b }; fn sub(a, b) { a - b }; impl Integer { fn neg(self) { -self } }; fn() { 1 }`)
+
+	compiler := New()
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
 	}
 
-	for i, constant := range expected {
-		switch constant := constant.(type) {
-		case int:
-			err := testIntegerObject(int64(constant), actual[i])
-			if err != nil {
-				return fmt.Errorf("constant %d - testIntegerObject failed: %s",
-				i, err)
-			}
-		case string:
-			err := testStringObject(constant, actual[i])
-			if err != nil {
-				return fmt.Errorf("constant %d - testStringObject failed: %s", i, err)
-			}
-		case []code.Instructions:
-			fn, ok := actual[i].(*object.CompiledFunction)
-			if !ok {
-				return fmt.Errorf("constant %d - not a function: %T", i, actual[i])
-			}
-			
-			err := testInstructions(constant, fn.Instructions)
-			if err != nil {
-				return fmt.Errorf("constant %d - testInstructions failed: %s", i, err)
-			}
+	names := []string{}
+	for _, constant := range compiler.Bytecode().Constants {
+		if fn, ok := constant.(*object.CompiledFunction); ok {
+			names = append(names, fn.Name)
 		}
 	}
 
-	return nil
-}
+	expected := []string{"add", "sub", "Integer.neg", ""}
+	if len(names) != len(expected) {
+		t.Fatalf("wrong number of functions. want=%d, got=%d", len(expected), len(names))
+	}
 
-func testIntegerObject(expected int64, actual object.Object) error {
-	result, ok := actual.(*object.Integer)
-	if !ok {
-		return fmt.Errorf("object is not Integer. got=%T (%+v)",
-			actual, actual)
+	for i, name := range expected {
+		if names[i] != name {
+			t.Errorf("wrong name for function %d. want=%q, got=%q", i, name, names[i])
+		}
 	}
+}
 
-	if result.Value != expected {
-		return fmt.Errorf("object has wrong value. got=%d, want=%d",
-			result.Value, expected)
+func TestMethods(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `[1].push(2)`,
+			expectedConstants: []interface{}{1, 2, "push"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpCallMethod, 2, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `impl Integer { fn double(self) { self * 2 } }`,
+			expectedConstants: []interface{}{
+				"INTEGER",
+				2,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpMul),
+					code.Make(code.OpReturnValue),
+				},
+				"double",
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpDefineMethod, 0, 3),
+			},
+		},
 	}
 
-	return nil
+	runCompilerTests(t, tests)
 }
 
-func testStringObject(expected string, actual object.Object) error {
-	result, ok := actual.(*object.String)
-	if !ok {
-		return fmt.Errorf("object is not String. got=%T (%+v)", actual, actual)
-	}
+func TestImplUnknownType(t *testing.T) {
+	program := parse(`impl Point { fn norm(self) { 0 } }`)
 
-	if result.Value != expected {
-		return fmt.Errorf("object has wrong value. got=%q, want=%q", result.Value, expected)
+	compiler := New()
+	err := compiler.Compile(program)
+	if err == nil {
+		t.Fatalf("expected compiler error but resulted in none.")
 	}
 
-	return nil
+	if err.Error() != "unknown type Point" {
+		t.Fatalf("wrong compiler error: got=%q", err)
+	}
 }
 
-func concatInstructions(s []code.Instructions) code.Instructions {
-	out := code.Instructions{}
+func TestMatchExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `match 1 { 1 => 2, _ => 3 }`,
+			expectedConstants: []interface{}{1, 2, 3},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpSetGlobal, 0),
+				// 0006
+				code.Make(code.OpGetGlobal, 0),
+				// 0009
+				code.Make(code.OpConstant, 0),
+				// 0012
+				code.Make(code.OpMatchEqual),
+				// 0013
+				code.Make(code.OpJumpNotTruthy, 22),
+				// 0016
+				code.Make(code.OpConstant, 1),
+				// 0019
+				code.Make(code.OpJump, 29),
+				// 0022
+				code.Make(code.OpConstant, 2),
+				// 0025
+				code.Make(code.OpJump, 29),
+				// 0028
+				code.Make(code.OpNull),
+				// 0029
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `match [1] { [x] => x }`,
+			expectedConstants: []interface{}{1, 0},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpArray, 1),
+				// 0006
+				code.Make(code.OpSetGlobal, 0),
+				// 0009
+				code.Make(code.OpGetGlobal, 0),
+				// 0012
+				code.Make(code.OpMatchArray, 1),
+				// 0015
+				code.Make(code.OpJumpNotTruthy, 34),
+				// 0018
+				code.Make(code.OpGetGlobal, 0),
+				// 0021
+				code.Make(code.OpConstant, 1),
+				// 0024
+				code.Make(code.OpIndex),
+				// 0025
+				code.Make(code.OpSetGlobal, 1),
+				// 0028
+				code.Make(code.OpGetGlobal, 1),
+				// 0031
+				code.Make(code.OpJump, 35),
+				// 0034
+				code.Make(code.OpNull),
+				// 0035
+				code.Make(code.OpPop),
+			},
+		},
+	}
 
-	for _, ins := range s {
+	runCompilerTests(t, tests)
+}
+
+func TestMatchExhaustivenessWarning(t *testing.T) {
+	tests := []struct {
+		input string
+		warnings int
+	} {
+		{`match 1 { 1 => 2, _ => 3 }`, 0},
+		{`match 1 { 1 => 2, x => x }`, 0},
+		{`match 1 { 1 => 2 }`, 1},
+		{`match 1 { x if x > 1 => 2 }`, 1},
+		{`match 1 { 1 => match 2 { 2 => 3 } }`, 2},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		if len(compiler.Warnings()) != tt.warnings {
+			t.Errorf("wrong number of warnings for %q. want=%d, got=%d (%q)", tt.input, tt.warnings, len(compiler.Warnings()), compiler.Warnings())
+		}
+	}
+}
+
+func TestDestructuringLetStatements(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `let [a, ...b] = [1, 2];`,
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpArray, 2),
+				code.Make(code.OpDestructureArray, 1, code.DestructureRest),
+				code.Make(code.OpSetGlobal, 1),
+				code.Make(code.OpSetGlobal, 0),
+			},
+		},
+		{
+			input: `fn(person) { let {name, age} = person; name }`,
+			expectedConstants: []interface{}{
+				"name",
+				"age",
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpDestructureHash, 2, 0),
+					code.Make(code.OpSetLocal, 2),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestDefaultParameters(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `fn(a, b = 10) { a + b }`,
+			expectedConstants: []interface{}{
+				10,
+				[]code.Instructions{
+					code.Make(code.OpSkipDefault, 1, 10),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn(a, ...rest) { rest }`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestSpreadCalls(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `let f = fn(...xs) { xs }; f(1, ...[2], 3, 4);`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+				1,
+				2,
+				3,
+				4,
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpConstant, 4),
+				code.Make(code.OpArray, 2),
+				code.Make(code.OpCallSpread, 3),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestSpreadOutsideCall(t *testing.T) {
+	inputs := []string{
+		`[...[1, 2]]`,
+		`[1].push(...[2])`,
+	}
+
+	for _, input := range inputs {
+		program := parse(input)
+
+		compiler := New()
+		err := compiler.Compile(program)
+		if err == nil {
+			t.Fatalf("expected compiler error for %q but resulted in none.", input)
+		}
+
+		if err.Error() != "spread arguments are only supported in function calls" {
+			t.Errorf("wrong compiler error. got=%q", err)
+		}
+	}
+}
+
+func testInstructions(expected []code.Instructions, actual code.Instructions) error {
+	concatted := concatInstructions(expected)
+
+	if len(actual) != len(concatted) {
+		return fmt.Errorf("wrong instructions length.\nwant=%q\ngot =%q",
+			concatted, actual)
+	}
+
+	for i, ins := range concatted {
+		if actual[i] != ins {
+			return fmt.Errorf("wrong instruction at %d.\nwant=%q\ngot =%q",
+			i, concatted, actual)
+		}
+	}
+
+	return nil
+}
+
+func testConstants(t *testing.T, expected []interface{}, actual []object.Object) error { // returning the type of error, if all tests pass, no errors are returned
+	if len(expected) != len(actual) {
+		return fmt.Errorf("wrong number of constants. got=%d, want=%d",
+			len(actual), len(expected))
+	}
+
+	for i, constant := range expected {
+		switch constant := constant.(type) {
+		case int:
+			err := testIntegerObject(int64(constant), actual[i])
+			if err != nil {
+				return fmt.Errorf("constant %d - testIntegerObject failed: %s",
+				i, err)
+			}
+		case string:
+			err := testStringObject(constant, actual[i])
+			if err != nil {
+				return fmt.Errorf("constant %d - testStringObject failed: %s", i, err)
+			}
+		case []code.Instructions:
+			fn, ok := actual[i].(*object.CompiledFunction)
+			if !ok {
+				return fmt.Errorf("constant %d - not a function: %T", i, actual[i])
+			}
+			
+			err := testInstructions(constant, fn.Instructions)
+			if err != nil {
+				return fmt.Errorf("constant %d - testInstructions failed: %s", i, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func testIntegerObject(expected int64, actual object.Object) error {
+	result, ok := actual.(*object.Integer)
+	if !ok {
+		return fmt.Errorf("object is not Integer. got=%T (%+v)",
+			actual, actual)
+	}
+
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%d, want=%d",
+			result.Value, expected)
+	}
+
+	return nil
+}
+
+func testStringObject(expected string, actual object.Object) error {
+	result, ok := actual.(*object.String)
+	if !ok {
+		return fmt.Errorf("object is not String. got=%T (%+v)", actual, actual)
+	}
+
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%q, want=%q", result.Value, expected)
+	}
+
+	return nil
+}
+
+func concatInstructions(s []code.Instructions) code.Instructions {
+	out := code.Instructions{}
+
+	for _, ins := range s {
 		out = append(out, ins...) // Flattening out the slice of slices of byte --> code.Make() returns a []bytes each time
 	}
 
 	return out
 }
+
+func TestConstantFolding(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "1 + 2 * 3",
+			expectedConstants: []interface{}{7},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "-5",
+			expectedConstants: []interface{}{-5},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "!true == (1 < 2)",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpFalse),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `"foo" + "bar"`,
+			expectedConstants: []interface{}{"foobar"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "1 / 0 + 2 * 3",
+			expectedConstants: []interface{}{1, 0, 6},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpDiv),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `"a" == "a"`,
+			expectedConstants: []interface{}{"a"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpEqual),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "let x = 1; x + 2 * 2",
+			expectedConstants: []interface{}{1, 4},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTestsWithOptions(t, Options{FoldConstants: true}, tests)
+}
+
+func TestFoldedConditionals(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "if (true) { 10 } else { 20 }; 3333;",
+			expectedConstants: []interface{}{10, 20, 3333},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "if (1 > 2) { 10 }",
+			expectedConstants: []interface{}{10},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// The dropped branch still defines b, so c gets the same slot as without folding
+			input: "if (false) { let b = 1; b } else { 2 }; let c = 3;",
+			expectedConstants: []interface{}{1, 2, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpSetGlobal, 1),
+			},
+		},
+	}
+
+	runCompilerTestsWithOptions(t, Options{FoldConstants: true}, tests)
+}
+
+func TestConstantDeduplication(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `1 + 1; "name"; "name"; 1`,
+			expectedConstants: []interface{}{1, "name"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `[fn() { 5 }, fn() { 5 }]`,
+			expectedConstants: []interface{}{
+				5,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpArray, 2),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// Same instructions, but a different name, so they stay apart
+			input: `let a = fn() { 5 }; let b = fn() { 5 };`,
+			expectedConstants: []interface{}{
+				5,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpSetGlobal, 1),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestConstantsReusedAcrossCompilers(t *testing.T) {
+	first := New()
+	err := first.Compile(parse(`let x = 1 + 2; "hello"`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	constants := first.Bytecode().Constants
+	if len(constants) != 3 {
+		t.Fatalf("wrong number of constants. want=3, got=%d", len(constants))
+	}
+
+	second := NewWithState(first.symbolTable, constants)
+	err = second.Compile(parse(`x + 2; "hello" + "!"`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	err = testConstants(t, []interface{}{1, 2, "hello", "!"}, second.Bytecode().Constants)
+	if err != nil {
+		t.Fatalf("testConstants failed: %s", err)
+	}
+}
+
+func TestWideConstants(t *testing.T) {
+	var input strings.Builder
+	for i := 0; i <= 70000; i++ {
+		fmt.Fprintf(&input, "%d;", i)
+	}
+
+	compiler := New()
+	err := compiler.Compile(parse(input.String()))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+	if len(bytecode.Constants) != 70001 {
+		t.Fatalf("wrong number of constants. want=70001, got=%d", len(bytecode.Constants))
+	}
+
+	ins := bytecode.Instructions
+	narrow := len(code.Make(code.OpConstant, 0)) + 1
+	lastNarrow := ins[65535*narrow : 65536*narrow]
+	firstWide := ins[65536*narrow:]
+
+	if !bytes.Equal(lastNarrow, concatInstructions([]code.Instructions{code.Make(code.OpConstant, 65535), code.Make(code.OpPop)})) {
+		t.Errorf("constant 65535 should still use OpConstant. got=%q", lastNarrow.String())
+	}
+
+	want := concatInstructions([]code.Instructions{code.Make(code.OpConstantWide, 65536), code.Make(code.OpPop)})
+	if !bytes.Equal(firstWide[:len(want)], want) {
+		t.Errorf("constant 65536 should use OpConstantWide. got=%q", firstWide[:len(want)].String())
+	}
+}
+
+func TestWideMethodConstants(t *testing.T) {
+	var input strings.Builder
+	for i := 0; i <= 70000; i++ {
+		fmt.Fprintf(&input, "%d;", i)
+	}
+	input.WriteString("impl Integer { fn add(self, x) { self + x } }\n1.add(2)")
+
+	compiler := New()
+	err := compiler.Compile(parse(input.String()))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+	ins := bytecode.Instructions
+	names := map[code.Opcode][]string{}
+	for i := 0; i < len(ins); {
+		def, err := code.Lookup(ins[i])
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		op := code.Opcode(ins[i])
+		operands, read := code.ReadOperands(def, ins[i+1:])
+		switch op {
+		case code.OpDefineMethod, code.OpDefineMethodWide: // Type name, method name
+			names[op] = append(names[op], bytecode.Constants[operands[0]].Inspect(), bytecode.Constants[operands[1]].Inspect())
+		case code.OpCallMethod, code.OpCallMethodWide: // Method name, number of arguments
+			names[op] = append(names[op], bytecode.Constants[operands[0]].Inspect())
+		}
+		i += 1 + read
+	}
+
+	if len(names[code.OpDefineMethod]) != 0 || len(names[code.OpCallMethod]) != 0 {
+		t.Errorf("names past constant 65535 should not use the narrow forms. got=%v", names)
+	}
+	if got := strings.Join(names[code.OpDefineMethodWide], "."); got != "INTEGER.add" {
+		t.Errorf("wrong OpDefineMethodWide names. want=INTEGER.add, got=%q", got)
+	}
+	if got := strings.Join(names[code.OpCallMethodWide], "."); got != "add" {
+		t.Errorf("wrong OpCallMethodWide name. want=add, got=%q", got)
+	}
+}
+
+// Identifiers can't contain digits, so the digits of i are spelled with letters
+func spelledName(i int) string {
+	return "g" + strings.Map(func(r rune) rune { return 'a' + r - '0' }, fmt.Sprint(i))
+}
+
+func TestWideGlobals(t *testing.T) {
+	var input strings.Builder
+	for i := 0; i <= 70000; i++ {
+		fmt.Fprintf(&input, "let %s = 1;", spelledName(i))
+	}
+	fmt.Fprintf(&input, "%s; %s", spelledName(65535), spelledName(70000))
+
+	compiler := New()
+	err := compiler.Compile(parse(input.String()))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+	if bytecode.NumGlobals != 70001 {
+		t.Fatalf("wrong number of globals. want=70001, got=%d", bytecode.NumGlobals)
+	}
+
+	expected := []code.Instructions{
+		code.Make(code.OpSetGlobal, 65535),
+		code.Make(code.OpSetGlobalWide, 65536),
+		code.Make(code.OpGetGlobal, 65535),
+		code.Make(code.OpGetGlobalWide, 70000),
+	}
+
+	for _, ins := range expected {
+		if !bytes.Contains(bytecode.Instructions, ins) {
+			t.Errorf("instructions do not contain %q", ins.String())
+		}
+	}
+}
+
+func TestNumGlobals(t *testing.T) {
+	tests := []struct {
+		input string
+		expected int
+	}{
+		{"1 + 2", 0},
+		{"let a = 1; let b = fn(x) { let y = x; y }; a", 2},
+		{"let a = 1; let a = 2;", 2}, // Defining a name again takes a new slot
+		{"match 1 { n => n }; match 2 { n => n }; match 3 { m => m }", 3}, // Later matches reuse the subject's and the bindings' slots
+		{"match 1 { n if match n { m => m } => n, _ => 0 }", 4}, // A nested match gets its own
+		{"let f = match 1 { n => fn() { n } }; match 2 { n => n }", 4}, // A binding a function refers to is never reused
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		if got := compiler.Bytecode().NumGlobals; got != tt.expected {
+			t.Errorf("input=%q: wrong number of globals. want=%d, got=%d", tt.input, tt.expected, got)
+		}
+	}
+}
+
+// Generated code can have more locals, free variables and arguments than a byte holds
+func TestWideLocalsAndCalls(t *testing.T) {
+	var lets, names strings.Builder
+	for i := 0; i < 300; i++ {
+		fmt.Fprintf(&lets, "let %s = 1;", spelledName(i))
+		if i > 0 {
+			names.WriteString(", ")
+		}
+		names.WriteString(spelledName(i))
+	}
+
+	ones := strings.TrimSuffix(strings.Repeat("1, ", 300), ", ")
+	spreads := strings.TrimSuffix(strings.Repeat("...[1], ", 300), ", ")
+	input := fmt.Sprintf("fn() { %s fn() { [%s] } }; fn(%s) { 1 }(%s); 1.abs(%s); len(%s)", lets.String(), names.String(), names.String(), ones, ones, spreads)
+
+	compiler := New()
+	err := compiler.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+	instructions := bytecode.Instructions
+	for _, c := range bytecode.Constants {
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			instructions = append(instructions, fn.Instructions...)
+		}
+	}
+
+	expected := []code.Instructions{
+		code.Make(code.OpSetLocal, 255),
+		code.Make(code.OpSetLocalWide, 256),
+		code.Make(code.OpGetLocalWide, 299),
+		code.Make(code.OpGetFreeWide, 299),
+		code.Make(code.OpCallWide, 300),
+		code.Make(code.OpCallSpreadWide, 300),
+	}
+
+	for _, ins := range expected {
+		if !bytes.Contains(instructions, ins) {
+			t.Errorf("instructions do not contain %q", ins.String())
+		}
+	}
+
+	if !bytes.Contains(instructions, []byte{byte(code.OpCallMethodWide)}) {
+		t.Errorf("method call with 300 arguments should use OpCallMethodWide")
+	}
+
+	if !bytes.Contains(instructions, []byte{byte(code.OpClosureWide)}) {
+		t.Errorf("closure with 300 free variables should use OpClosureWide")
+	}
+}
+
+func TestOperandTooLarge(t *testing.T) {
+	input := fmt.Sprintf("fn(x) { if (x) { [%s] } else { 1 } }", strings.TrimSuffix(strings.Repeat("1, ", 70000), ", "))
+
+	compiler := New()
+	err := compiler.Compile(parse(input))
+	if err == nil {
+		t.Fatalf("expected a compiler error")
+	}
+
+	expected := "operand 0 of OpArray does not fit in 2 byte(s): 70000"
+	if err.Error() != expected {
+		t.Errorf("wrong error. want=%q, got=%q", expected, err)
+	}
+}
+
+// Jumps over more than 64KiB of instructions keep their 4-byte form, short ones are narrowed again
+func TestLargeJumps(t *testing.T) {
+	body := strings.Repeat("x + 1;", 10000) // 7 bytes each
+
+	input := fmt.Sprintf("fn(x) { let y = if (x) { 2 } else { 3 }; if (x) { %s y } else { y } }", body)
+
+	compiler := New()
+	err := compiler.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var fn *object.CompiledFunction
+	for _, c := range compiler.Bytecode().Constants {
+		if f, ok := c.(*object.CompiledFunction); ok {
+			fn = f
+		}
+	}
+
+	decoded := map[code.Opcode][]int{}
+	for i := 0; i < len(fn.Instructions); {
+		def, err := code.Lookup(fn.Instructions[i])
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		op := code.Opcode(fn.Instructions[i])
+		operands, read := code.ReadOperands(def, fn.Instructions[i+1:])
+		switch op {
+		case code.OpJump, code.OpJumpNotTruthy, code.OpJumpWide, code.OpJumpNotTruthyWide:
+			decoded[op] = append(decoded[op], operands[0])
+		}
+		i += 1 + read
+	}
+
+	if targets := decoded[code.OpJumpNotTruthyWide]; len(targets) != 1 || targets[0] <= 65535 {
+		t.Errorf("the outer if should jump with OpJumpNotTruthyWide past 65535. got=%v", targets)
+	}
+
+	if targets := decoded[code.OpJumpWide]; len(targets) != 1 || targets[0] <= 65535 {
+		t.Errorf("the end of the consequence should jump with OpJumpWide past 65535. got=%v", targets)
+	}
+
+	if len(decoded[code.OpJumpNotTruthy]) != 1 || len(decoded[code.OpJump]) != 1 {
+		t.Errorf("the small if should keep narrow jumps. got=%v", decoded)
+	}
+}
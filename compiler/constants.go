@@ -0,0 +1,31 @@
+package compiler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"compiler/object"
+)
+
+type constantKey struct {
+	Type object.ObjectType
+	Value string
+}
+
+// Only constants nothing can change are shared. Functions are shared when everything about them matches,
+// including the source map, so a stack trace never points at the other copy's lines.
+func internKey(obj object.Object) (constantKey, bool) {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return constantKey{obj.Type(), strconv.FormatInt(obj.Value, 10)}, true
+	case *object.String:
+		return constantKey{obj.Type(), obj.Value}, true
+	case *object.CompiledFunction:
+		var key strings.Builder
+		fmt.Fprintf(&key, "%s %d %d %d %d %t %v ", obj.Name, obj.NumLocals, obj.NumParameters, obj.NumDefaults, obj.NumFree, obj.Variadic, obj.SourceMap)
+		key.Write(obj.Instructions) // Last, so the fields before it can't run into it
+		return constantKey{obj.Type(), key.String()}, true
+	}
+
+	return constantKey{}, false
+}
@@ -0,0 +1,54 @@
+package compiler
+
+import (
+	"compiler/ast"
+	"compiler/code"
+	"compiler/object"
+)
+
+// The destructuring instructions replace the value with one element per name on the stack, which are then stored from the top down
+func (c *Compiler) compileDestructuringLetStatement(node *ast.DestructuringLetStatement) error {
+	err := c.Compile(node.Value)
+	if err != nil {
+		return err
+	}
+
+	flags := 0
+	if c.options.Strict {
+		flags |= code.DestructureStrict
+	}
+
+	names := []*ast.Identifier{}
+
+	switch pattern := node.Pattern.(type) {
+	case *ast.ArrayPattern:
+		names = append(names, pattern.Elements...)
+
+		if pattern.Rest != nil {
+			names = append(names, pattern.Rest)
+			flags |= code.DestructureRest
+		}
+
+		c.emit(code.OpDestructureArray, len(pattern.Elements), flags)
+
+	case *ast.HashPattern:
+		names = append(names, pattern.Keys...)
+
+		for _, k := range pattern.Keys {
+			c.emit(code.OpConstant, c.addConstant(&object.String{Value: k.Value}))
+		}
+
+		c.emit(code.OpDestructureHash, len(pattern.Keys), flags)
+	}
+
+	symbols := make([]Symbol, len(names))
+	for i, name := range names {
+		symbols[i] = c.symbolTable.Define(name.Value)
+	}
+
+	for i := len(symbols) - 1; i >= 0; i-- { // The last name's value is on top of the stack
+		c.setSymbol(symbols[i])
+	}
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package compiler
+
+import (
+	"compiler/ast"
+	"compiler/code"
+	"compiler/object"
+)
+
+// fold evaluates an expression made only of literals and operators. It only folds what the VM and the
+// evaluator agree on, anything that would be a runtime error (like a division by zero) is left for them to report.
+func fold(node ast.Expression) (object.Object, bool) {
+	switch node := node.(type) {
+	case *ast.IntegerLiteral:
+		return &object.Integer{Value: node.Value}, true
+	case *ast.StringLiteral:
+		return &object.String{Value: node.Value}, true
+	case *ast.Boolean:
+		return &object.Boolean{Value: node.Value}, true
+	case *ast.PrefixExpression:
+		right, ok := fold(node.Right)
+		if !ok {
+			return nil, false
+		}
+		return foldPrefix(node.Operator, right)
+	case *ast.InfixExpression:
+		left, ok := fold(node.Left)
+		if !ok {
+			return nil, false
+		}
+
+		right, ok := fold(node.Right)
+		if !ok {
+			return nil, false
+		}
+		return foldInfix(node.Operator, left, right)
+	}
+
+	return nil, false
+}
+
+func foldPrefix(operator string, right object.Object) (object.Object, bool) {
+	switch operator {
+	case "!":
+		if b, ok := right.(*object.Boolean); ok {
+			return &object.Boolean{Value: !b.Value}, true
+		}
+		return &object.Boolean{Value: false}, true // Integers and strings are truthy
+	case "-":
+		if i, ok := right.(*object.Integer); ok {
+			return &object.Integer{Value: -i.Value}, true
+		}
+	}
+
+	return nil, false
+}
+
+func foldInfix(operator string, left, right object.Object) (object.Object, bool) {
+	switch left := left.(type) {
+	case *object.Integer:
+		right, ok := right.(*object.Integer)
+		if !ok {
+			return nil, false
+		}
+		return foldIntegerInfix(operator, left.Value, right.Value)
+	case *object.String:
+		right, ok := right.(*object.String)
+		if !ok || operator != "+" { // The evaluator can't compare strings and the VM compares them by identity
+			return nil, false
+		}
+		return &object.String{Value: left.Value + right.Value}, true
+	case *object.Boolean:
+		right, ok := right.(*object.Boolean)
+		if !ok {
+			return nil, false
+		}
+
+		switch operator {
+		case "==":
+			return &object.Boolean{Value: left.Value == right.Value}, true
+		case "!=":
+			return &object.Boolean{Value: left.Value != right.Value}, true
+		}
+	}
+
+	return nil, false
+}
+
+func foldIntegerInfix(operator string, left, right int64) (object.Object, bool) {
+	switch operator {
+	case "+":
+		return &object.Integer{Value: left + right}, true
+	case "-":
+		return &object.Integer{Value: left - right}, true
+	case "*":
+		return &object.Integer{Value: left * right}, true
+	case "/":
+		if right == 0 {
+			return nil, false
+		}
+		return &object.Integer{Value: left / right}, true
+	case "<":
+		return &object.Boolean{Value: left < right}, true
+	case ">":
+		return &object.Boolean{Value: left > right}, true
+	case "==":
+		return &object.Boolean{Value: left == right}, true
+	case "!=":
+		return &object.Boolean{Value: left != right}, true
+	}
+
+	return nil, false
+}
+
+func (c *Compiler) emitFolded(obj object.Object) {
+	if b, ok := obj.(*object.Boolean); ok {
+		if b.Value {
+			c.emit(code.OpTrue)
+		} else {
+			c.emit(code.OpFalse)
+		}
+		return
+	}
+
+	c.emit(code.OpConstant, c.addConstant(obj))
+}
+
+func foldedTruthy(obj object.Object) bool {
+	if b, ok := obj.(*object.Boolean); ok {
+		return b.Value
+	}
+
+	return true
+}
+
+// Only the branch that can run is kept. The other one is still compiled, in source order, and then thrown away
+// so the names it defines get the same slots they would have without folding.
+func (c *Compiler) compileFoldedIf(node *ast.IfExpression, condition object.Object) error {
+	truthy := foldedTruthy(condition)
+
+	if truthy {
+		err := c.compileBranch(node.Consequence)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := c.compileDiscarded(node.Consequence)
+		if err != nil {
+			return err
+		}
+	}
+
+	if node.Alternative == nil {
+		if !truthy {
+			c.emit(code.OpNull)
+		}
+		return nil
+	}
+
+	if truthy {
+		return c.compileDiscarded(node.Alternative)
+	}
+
+	return c.compileBranch(node.Alternative)
+}
+
+// Like a branch of an unfolded if, the value of its last expression is left on the stack
+func (c *Compiler) compileBranch(block *ast.BlockStatement) error {
+	err := c.Compile(block)
+	if err != nil {
+		return err
+	}
+
+	if c.lastInstructionIs(code.OpPop) {
+		c.removeLastPop()
+	}
+
+	return nil
+}
+
+func (c *Compiler) compileDiscarded(block *ast.BlockStatement) error {
+	scope := &c.scopes[c.scopeIndex]
+	start := len(scope.instructions)
+	last, previous := scope.lastInstruction, scope.previousInstruction
+
+	err := c.Compile(block)
+	if err != nil {
+		return err
+	}
+
+	scope = &c.scopes[c.scopeIndex]
+	scope.instructions = scope.instructions[:start]
+	scope.lastInstruction, scope.previousInstruction = last, previous
+	c.trimSourceMap()
+
+	return nil
+}
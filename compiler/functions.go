@@ -0,0 +1,103 @@
+package compiler
+
+import (
+	"fmt"
+
+	"compiler/ast"
+	"compiler/code"
+)
+
+// Defaults are compiled into the function itself so they are evaluated at call time and can refer to earlier parameters.
+// Each one is skipped when the caller passed that argument.
+func (c *Compiler) compileParameterDefaults(node *ast.FunctionLiteral) error {
+	for i := range node.Parameters {
+		def := node.Default(i)
+		if def == nil {
+			continue
+		}
+
+		skipPos := c.emit(code.OpSkipDefaultWide, i, 9999)
+
+		err := c.Compile(def)
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpSetLocal, i)
+
+		c.changeOperand(skipPos, i, len(c.currentInstructions()))
+	}
+
+	return nil
+}
+
+// Without a spread the arguments are pushed as usual, otherwise every run of plain arguments is wrapped into an array
+// so the VM only has to flatten a list of arrays
+func (c *Compiler) compileCallArguments(args []ast.Expression) (spread bool, count int, err error) {
+	for _, a := range args {
+		if _, ok := a.(*ast.SpreadExpression); ok {
+			spread = true
+		}
+	}
+
+	if !spread {
+		for _, a := range args {
+			err := c.Compile(a)
+			if err != nil {
+				return false, 0, err
+			}
+		}
+
+		return false, len(args), nil
+	}
+
+	segments := 0
+	plain := 0
+
+	flush := func() {
+		if plain > 0 {
+			c.emit(code.OpArray, plain)
+			segments++
+			plain = 0
+		}
+	}
+
+	for _, a := range args {
+		if s, ok := a.(*ast.SpreadExpression); ok {
+			flush()
+
+			err := c.Compile(s.Value)
+			if err != nil {
+				return false, 0, err
+			}
+
+			segments++
+			continue
+		}
+
+		err := c.Compile(a)
+		if err != nil {
+			return false, 0, err
+		}
+
+		plain++
+	}
+	flush()
+
+	return true, segments, nil
+}
+
+func errSpreadOutsideCall() error {
+	return fmt.Errorf("spread arguments are only supported in function calls")
+}
+
+func numDefaults(node *ast.FunctionLiteral) int {
+	n := 0
+	for i := range node.Parameters {
+		if node.Default(i) != nil {
+			n++
+		}
+	}
+
+	return n
+}
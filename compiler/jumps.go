@@ -0,0 +1,44 @@
+package compiler
+
+import (
+	"math"
+	"compiler/code"
+)
+
+// Jumps are emitted with 4-byte targets because their target isn't known until the code after them is
+// compiled. Once a scope is done, every jump whose target fits in 2 bytes gets its narrow form back, so
+// only function bodies past 64KiB of instructions keep wide jumps.
+
+var narrowJumpForms = map[code.Opcode]code.Opcode{
+	code.OpJumpWide: code.OpJump,
+	code.OpJumpNotTruthyWide: code.OpJumpNotTruthy,
+	code.OpSkipDefaultWide: code.OpSkipDefault,
+}
+
+// Narrowing only moves code closer to the start, so a target that fit before still fits afterwards
+func narrowJumps(ins code.Instructions, sourceMap code.SourceMap) (code.Instructions, code.SourceMap, error) {
+	decoded, ok := decodeForPeephole(ins)
+	if !ok {
+		return ins, sourceMap, nil
+	}
+
+	changed := false
+	for _, in := range decoded {
+		narrow, ok := narrowJumpForms[in.op]
+		if !ok {
+			continue
+		}
+
+		i, _ := jumpTarget(in.op)
+		if in.operands[i] <= math.MaxUint16 {
+			in.op = narrow
+			changed = true
+		}
+	}
+
+	if !changed {
+		return ins, sourceMap, nil
+	}
+
+	return reassemble(decoded, len(ins), sourceMap)
+}
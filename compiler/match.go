@@ -0,0 +1,223 @@
+package compiler
+
+import (
+	"compiler/ast"
+	"compiler/code"
+	"compiler/object"
+	"sort"
+)
+
+// Each arm is compiled into a sequence of checks that jump to the next arm as soon as one fails:
+//
+//	<subject>; OpSet(subject)
+//	<checks and bindings of arm 1>; <guard>; OpJumpNotTruthy arm2; <body>; OpJump end
+//	arm2: ...
+//	OpNull
+//	end:
+func (c *Compiler) compileMatchExpression(node *ast.MatchExpression) error {
+	err := c.Compile(node.Subject)
+	if err != nil {
+		return err
+	}
+
+	c.matchDepth++
+	defer func() { c.matchDepth-- }()
+
+	subject := c.symbolTable.defineMatchSlot(c.matchDepth, "") // No name, so scripts can never refer to it
+	c.setSymbol(subject)
+
+	endJumps := []int{}
+	exhaustive := false
+
+	for _, arm := range node.Arms {
+		failJumps := []int{}
+		shadowed := map[string]*Symbol{}
+
+		load := func() error {
+			c.loadSymbol(subject)
+			return nil
+		}
+
+		err := c.compilePattern(arm.Pattern, load, &failJumps, shadowed)
+		if err != nil {
+			return err
+		}
+
+		if arm.Guard != nil {
+			err := c.Compile(arm.Guard)
+			if err != nil {
+				return err
+			}
+
+			failJumps = append(failJumps, c.emit(code.OpJumpNotTruthyWide, 9999))
+		} else if isCatchAllPattern(arm.Pattern) {
+			exhaustive = true
+		}
+
+		err = c.Compile(arm.Body)
+		if err != nil {
+			return err
+		}
+
+		endJumps = append(endJumps, c.emit(code.OpJumpWide, 9999))
+
+		nextArmPos := len(c.currentInstructions())
+		for _, pos := range failJumps {
+			c.changeOperand(pos, nextArmPos)
+		}
+
+		for name, symbol := range shadowed { // Bindings only live as long as their arm
+			c.symbolTable.releaseMatchSlot(c.matchDepth, name)
+			if symbol == nil {
+				c.symbolTable.restore(name, Symbol{}, false)
+			} else {
+				c.symbolTable.restore(name, *symbol, true)
+			}
+		}
+	}
+
+	c.emit(code.OpNull) // No arm matched
+
+	afterMatchPos := len(c.currentInstructions())
+	for _, pos := range endJumps {
+		c.changeOperand(pos, afterMatchPos)
+	}
+
+	if !exhaustive {
+		c.warnings = append(c.warnings, "match expression is not exhaustive, add a _ arm: "+node.String())
+	}
+
+	return nil
+}
+
+// load emits the instructions that push the value being matched, nested patterns extend it with an index into the parent value
+func (c *Compiler) compilePattern(pattern ast.Expression, load func() error, failJumps *[]int, shadowed map[string]*Symbol) error {
+	switch pattern := pattern.(type) {
+	case *ast.Identifier:
+		if pattern.Value == "_" {
+			return nil
+		}
+
+		if _, ok := shadowed[pattern.Value]; !ok {
+			if previous, ok := c.symbolTable.store[pattern.Value]; ok {
+				shadowed[pattern.Value] = &previous
+			} else {
+				shadowed[pattern.Value] = nil
+			}
+		}
+
+		err := load()
+		if err != nil {
+			return err
+		}
+
+		c.setSymbol(c.symbolTable.defineMatchSlot(c.matchDepth, pattern.Value))
+
+	case *ast.ArrayLiteral:
+		err := load()
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpMatchArray, len(pattern.Elements))
+		*failJumps = append(*failJumps, c.emit(code.OpJumpNotTruthyWide, 9999))
+
+		for i, el := range pattern.Elements {
+			index := c.addConstant(&object.Integer{Value: int64(i)})
+			err := c.compilePattern(el, func() error {
+				err := load()
+				if err != nil {
+					return err
+				}
+
+				c.emit(code.OpConstant, index)
+				c.emit(code.OpIndex)
+				return nil
+			}, failJumps, shadowed)
+			if err != nil {
+				return err
+			}
+		}
+
+	case *ast.HashLiteral:
+		err := load()
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpMatchHash)
+		*failJumps = append(*failJumps, c.emit(code.OpJumpNotTruthyWide, 9999))
+
+		keys := []ast.Expression{}
+		for k := range pattern.Pairs {
+			keys = append(keys, k)
+		}
+
+		sort.Slice(keys, func(i, j int) bool { // Same ordering as hash literals so the output is deterministic
+			return keys[i].String() < keys[j].String()
+		})
+
+		for _, k := range keys {
+			key := k
+
+			loadValue := func() error {
+				err := load()
+				if err != nil {
+					return err
+				}
+
+				return c.Compile(key)
+			}
+
+			err := loadValue()
+			if err != nil {
+				return err
+			}
+
+			c.emit(code.OpMatchKey)
+			*failJumps = append(*failJumps, c.emit(code.OpJumpNotTruthyWide, 9999))
+
+			err = c.compilePattern(pattern.Pairs[key], func() error {
+				err := loadValue()
+				if err != nil {
+					return err
+				}
+
+				c.emit(code.OpIndex)
+				return nil
+			}, failJumps, shadowed)
+			if err != nil {
+				return err
+			}
+		}
+
+	default: // Literals, the parser has already rejected anything else
+		err := load()
+		if err != nil {
+			return err
+		}
+
+		err = c.Compile(pattern)
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpMatchEqual)
+		*failJumps = append(*failJumps, c.emit(code.OpJumpNotTruthyWide, 9999))
+	}
+
+	return nil
+}
+
+func (c *Compiler) setSymbol(s Symbol) {
+	if s.Scope == GlobalScope {
+		c.emit(code.OpSetGlobal, s.Index)
+	} else {
+		c.emit(code.OpSetLocal, s.Index)
+	}
+}
+
+func isCatchAllPattern(pattern ast.Expression) bool {
+	_, ok := pattern.(*ast.Identifier)
+	return ok
+}
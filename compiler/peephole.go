@@ -0,0 +1,195 @@
+package compiler
+
+import (
+	"compiler/code"
+)
+
+// The peephole pass works on finished instructions instead of while emitting them, so it sees a scope's
+// jumps and their targets all at once. Every rewrite only shrinks the code, and jump operands and the
+// source map are moved to the new offsets afterwards.
+
+type peepholeInstruction struct {
+	op code.Opcode
+	operands []int
+	offset int // Where the instruction was before this round of rewrites
+	removed bool
+}
+
+// Rewrites are applied in rounds until none matches, since one can expose another, like a jump that
+// only lands on the next instruction once the instructions between were dropped
+func peephole(ins code.Instructions, sourceMap code.SourceMap) (code.Instructions, code.SourceMap, error) {
+	for {
+		decoded, ok := decodeForPeephole(ins)
+		if !ok { // Can't happen with our own instructions, but nothing is rewritten unless every byte is understood
+			return ins, sourceMap, nil
+		}
+
+		if !rewrite(decoded, len(ins)) {
+			return ins, sourceMap, nil
+		}
+
+		var err error
+		ins, sourceMap, err = reassemble(decoded, len(ins), sourceMap)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+func decodeForPeephole(ins code.Instructions) ([]*peepholeInstruction, bool) {
+	decoded := []*peepholeInstruction{}
+
+	i := 0
+	for i < len(ins) {
+		def, err := code.Lookup(ins[i])
+		if err != nil {
+			return nil, false
+		}
+
+		width := 0
+		for _, w := range def.OperandWidths {
+			width += w
+		}
+		if i+1+width > len(ins) {
+			return nil, false
+		}
+
+		operands, read := code.ReadOperands(def, ins[i+1:])
+		decoded = append(decoded, &peepholeInstruction{op: code.Opcode(ins[i]), operands: operands, offset: i})
+
+		i += 1 + read
+	}
+
+	return decoded, true
+}
+
+// Which operand of an instruction is a jump target, if any
+func jumpTarget(op code.Opcode) (int, bool) {
+	switch op {
+	case code.OpJump, code.OpJumpNotTruthy, code.OpJumpIfNotGreater, code.OpJumpWide, code.OpJumpNotTruthyWide:
+		return 0, true
+	case code.OpSkipDefault, code.OpSkipDefaultWide:
+		return 1, true
+	}
+
+	return 0, false
+}
+
+func jumpTargets(decoded []*peepholeInstruction) map[int]bool {
+	targets := map[int]bool{}
+	for _, in := range decoded {
+		if i, ok := jumpTarget(in.op); ok {
+			targets[in.operands[i]] = true
+		}
+	}
+
+	return targets
+}
+
+func rewrite(decoded []*peepholeInstruction, end int) bool {
+	targets := jumpTargets(decoded)
+
+	changed := false
+	for i := 0; i < len(decoded); i++ {
+		in := decoded[i]
+
+		var next *peepholeInstruction
+		if i+1 < len(decoded) {
+			next = decoded[i+1]
+		}
+
+		// Pairs are only rewritten when nothing jumps between them, otherwise the second half runs on its own
+		pair := next != nil && !targets[next.offset]
+
+		switch {
+		case in.op == code.OpJump && in.operands[0] == nextOffset(decoded, i, end):
+			in.removed = true
+		case pair && in.op == code.OpTrue && next.op == code.OpJumpNotTruthy: // Never jumps
+			in.removed, next.removed = true, true
+			i++
+		case pair && in.op == code.OpFalse && next.op == code.OpJumpNotTruthy: // Always jumps
+			in.removed = true
+			next.op = code.OpJump
+			i++
+		case pair && in.op == code.OpNull && next.op == code.OpPop && nextOffset(decoded, i+1, end) != end: // The last pop is the result of the program, the REPL prints it
+			in.removed, next.removed = true, true
+			i++
+		case pair && in.op == code.OpGetLocal && next.op == code.OpGetLocal && in.operands[0] == next.operands[0]:
+			in.op = code.OpGetLocalDup
+			next.removed = true
+			i++
+		default:
+			continue
+		}
+
+		changed = true
+	}
+
+	return changed
+}
+
+// The offset right after instruction i, which is where execution goes next
+func nextOffset(decoded []*peepholeInstruction, i int, end int) int {
+	if i+1 < len(decoded) {
+		return decoded[i+1].offset
+	}
+
+	return end
+}
+
+// A rewritten instruction whose operands no longer fit is an error, like it is when the compiler emits one
+func reassemble(decoded []*peepholeInstruction, end int, sourceMap code.SourceMap) (code.Instructions, code.SourceMap, error) {
+	// A removed instruction's offset moves to whatever comes after it, so jumps to it land on the same code
+	moved := make(map[int]int, len(decoded)+1)
+	newOffset := 0
+	for _, in := range decoded {
+		moved[in.offset] = newOffset
+		if !in.removed {
+			ins, err := code.MakeChecked(in.op, in.operands...)
+			if err != nil {
+				return nil, nil, err
+			}
+			newOffset += len(ins)
+		}
+	}
+	moved[end] = newOffset
+
+	out := code.Instructions{}
+	for _, in := range decoded {
+		if in.removed {
+			continue
+		}
+
+		if i, ok := jumpTarget(in.op); ok {
+			in.operands[i] = moved[in.operands[i]]
+		}
+		ins, err := code.MakeChecked(in.op, in.operands...)
+		if err != nil {
+			return nil, nil, err
+		}
+		out = append(out, ins...)
+	}
+
+	return out, moveSourceMap(sourceMap, moved, len(out)), nil
+}
+
+func moveSourceMap(sourceMap code.SourceMap, moved map[int]int, end int) code.SourceMap {
+	var out code.SourceMap
+	for _, e := range sourceMap {
+		offset, ok := moved[e.Offset]
+		if !ok || offset >= end {
+			continue
+		}
+
+		if n := len(out); n > 0 && out[n-1].Offset == offset { // Every instruction of the earlier line was removed
+			out = out[:n-1]
+		}
+		if n := len(out); n > 0 && out[n-1].Line == e.Line {
+			continue
+		}
+
+		out = append(out, code.LineEntry{Offset: offset, Line: e.Line})
+	}
+
+	return out
+}
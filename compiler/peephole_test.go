@@ -0,0 +1,159 @@
+package compiler
+
+import (
+	"reflect"
+	"testing"
+	"compiler/code"
+)
+
+func TestPeephole(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "if (true) { 10 }; 20",
+			expectedConstants: []interface{}{10, 20},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpJump, 7),
+				// 0006
+				code.Make(code.OpNull),
+				// 0007
+				code.Make(code.OpPop),
+				// 0008
+				code.Make(code.OpConstant, 1),
+				// 0011
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "if (false) { 10 }; 20",
+			expectedConstants: []interface{}{10, 20},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpJump, 9),
+				// 0003
+				code.Make(code.OpConstant, 0),
+				// 0006
+				code.Make(code.OpJump, 10),
+				// 0009
+				code.Make(code.OpNull),
+				// 0010
+				code.Make(code.OpPop),
+				// 0011
+				code.Make(code.OpConstant, 1),
+				// 0014
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn(x) { x * x }",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocalDup, 0),
+					code.Make(code.OpMul),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTestsWithOptions(t, Options{Peephole: true}, tests)
+}
+
+func TestPeepholeAfterFolding(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "fn() { if (false) { 1 }; 2 }",
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// The last pop of the program is its result, so the null stays
+			input: "if (false) { 1 }",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTestsWithOptions(t, Options{FoldConstants: true, Peephole: true}, tests)
+}
+
+func TestPeepholeRewritesJumpsAndLines(t *testing.T) {
+	ins := concatInstructions([]code.Instructions{
+		// 0000
+		code.Make(code.OpGetGlobal, 0),
+		// 0003
+		code.Make(code.OpJumpNotTruthy, 12),
+		// 0006
+		code.Make(code.OpJump, 9),
+		// 0009
+		code.Make(code.OpConstant, 0),
+		// 0012
+		code.Make(code.OpTrue),
+		// 0013
+		code.Make(code.OpPop),
+	})
+	sourceMap := code.SourceMap{{Offset: 0, Line: 1}, {Offset: 6, Line: 2}, {Offset: 9, Line: 3}, {Offset: 12, Line: 4}}
+
+	gotIns, gotMap, err := peephole(ins, sourceMap)
+	if err != nil {
+		t.Fatalf("peephole failed: %s", err)
+	}
+
+	wantIns := concatInstructions([]code.Instructions{
+		// 0000
+		code.Make(code.OpGetGlobal, 0),
+		// 0003
+		code.Make(code.OpJumpNotTruthy, 9),
+		// 0006
+		code.Make(code.OpConstant, 0),
+		// 0009
+		code.Make(code.OpTrue),
+		// 0010
+		code.Make(code.OpPop),
+	})
+	wantMap := code.SourceMap{{Offset: 0, Line: 1}, {Offset: 6, Line: 3}, {Offset: 9, Line: 4}}
+
+	if gotIns.String() != wantIns.String() {
+		t.Errorf("wrong instructions.\nwant=%q\ngot =%q", wantIns.String(), gotIns.String())
+	}
+
+	if !reflect.DeepEqual(gotMap, wantMap) {
+		t.Errorf("wrong source map. want=%v, got=%v", wantMap, gotMap)
+	}
+}
+
+func TestReassembleOperandTooLarge(t *testing.T) {
+	decoded := []*peepholeInstruction{
+		{op: code.OpGetLocal, operands: []int{300}}, // Only OpGetLocalWide holds this
+		{op: code.OpPop, offset: 2},
+	}
+
+	_, _, err := reassemble(decoded, 3, nil)
+	if err == nil {
+		t.Fatalf("expected an error but got none")
+	}
+
+	expected := "operand 0 of OpGetLocal does not fit in 1 byte(s): 300"
+	if err.Error() != expected {
+		t.Errorf("wrong error. want=%q, got=%q", expected, err)
+	}
+}
@@ -0,0 +1,411 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"compiler/code"
+	"compiler/object"
+	"compiler/verifier"
+)
+
+// Layout of an encoded program:
+//
+//	magic          4 bytes  "CELC"
+//	format version uvarint  FormatVersion
+//	opcode table   4 bytes  code.TableVersion() of the compiler that wrote it
+//	instructions   uvarint length, then the bytes
+//	source map     uvarint count, then an offset and line uvarint pair per entry
+//	globals        uvarint  NumGlobals
+//	constants      uvarint count, then one tagged constant each
+//	checksum       4 bytes  CRC-32 (IEEE) of everything before it
+//
+// Decoded bytecode is run through the verifier, so the VM never sees instructions it could crash on.
+// Integers inside the payload are varints, multi-byte fixed fields are big endian like the operands in code.Instructions.
+const Magic = "CELC"
+const FormatVersion = 4
+
+const (
+	tagInteger byte = iota + 1
+	tagString
+	tagBoolean
+	tagNull
+	tagArray
+	tagHash
+	tagCompiledFunction
+)
+
+func Encode(bytecode *Bytecode) ([]byte, error) {
+	var out bytes.Buffer
+
+	out.WriteString(Magic)
+	writeUvarint(&out, FormatVersion)
+
+	var table [4]byte
+	binary.BigEndian.PutUint32(table[:], code.TableVersion())
+	out.Write(table[:])
+
+	writeBytes(&out, bytecode.Instructions)
+	writeSourceMap(&out, bytecode.SourceMap)
+	writeUvarint(&out, uint64(bytecode.NumGlobals))
+
+	writeUvarint(&out, uint64(len(bytecode.Constants)))
+	for i, c := range bytecode.Constants {
+		err := encodeObject(&out, c)
+		if err != nil {
+			return nil, fmt.Errorf("constant %d: %s", i, err)
+		}
+	}
+
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(out.Bytes()))
+	out.Write(checksum[:])
+
+	return out.Bytes(), nil
+}
+
+func encodeObject(out *bytes.Buffer, obj object.Object) error {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		out.WriteByte(tagInteger)
+		writeVarint(out, obj.Value)
+	case *object.String:
+		out.WriteByte(tagString)
+		writeBytes(out, []byte(obj.Value))
+	case *object.Boolean:
+		out.WriteByte(tagBoolean)
+		if obj.Value {
+			out.WriteByte(1)
+		} else {
+			out.WriteByte(0)
+		}
+	case *object.Null:
+		out.WriteByte(tagNull)
+	case *object.Array:
+		out.WriteByte(tagArray)
+		writeUvarint(out, uint64(len(obj.Elements)))
+		for _, e := range obj.Elements {
+			err := encodeObject(out, e)
+			if err != nil {
+				return err
+			}
+		}
+	case *object.Hash:
+		out.WriteByte(tagHash)
+		writeUvarint(out, uint64(len(obj.Pairs)))
+		for _, pair := range sortedPairs(obj) {
+			err := encodeObject(out, pair.Key)
+			if err != nil {
+				return err
+			}
+
+			err = encodeObject(out, pair.Value)
+			if err != nil {
+				return err
+			}
+		}
+	case *object.CompiledFunction:
+		out.WriteByte(tagCompiledFunction)
+		writeBytes(out, []byte(obj.Name))
+		writeUvarint(out, uint64(obj.NumLocals))
+		writeUvarint(out, uint64(obj.NumParameters))
+		writeUvarint(out, uint64(obj.NumDefaults))
+		writeUvarint(out, uint64(obj.NumFree))
+		if obj.Variadic {
+			out.WriteByte(1)
+		} else {
+			out.WriteByte(0)
+		}
+		writeBytes(out, obj.Instructions)
+		writeSourceMap(out, obj.SourceMap)
+	default:
+		return fmt.Errorf("cannot serialize %s", obj.Type())
+	}
+
+	return nil
+}
+
+// Map order is random, sorting keeps the encoding of a program the same from one run to the next
+func sortedPairs(hash *object.Hash) []object.HashPair {
+	keys := make([]object.HashKey, 0, len(hash.Pairs))
+	for k := range hash.Pairs {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Type != keys[j].Type {
+			return keys[i].Type < keys[j].Type
+		}
+		return keys[i].Value < keys[j].Value
+	})
+
+	pairs := make([]object.HashPair, len(keys))
+	for i, k := range keys {
+		pairs[i] = hash.Pairs[k]
+	}
+
+	return pairs
+}
+
+func writeUvarint(out *bytes.Buffer, x uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], x)
+	out.Write(buf[:n])
+}
+
+func writeVarint(out *bytes.Buffer, x int64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], x)
+	out.Write(buf[:n])
+}
+
+func writeBytes(out *bytes.Buffer, b []byte) {
+	writeUvarint(out, uint64(len(b)))
+	out.Write(b)
+}
+
+func writeSourceMap(out *bytes.Buffer, sm code.SourceMap) {
+	writeUvarint(out, uint64(len(sm)))
+	for _, e := range sm {
+		writeUvarint(out, uint64(e.Offset))
+		writeUvarint(out, uint64(e.Line))
+	}
+}
+
+func Decode(data []byte) (*Bytecode, error) {
+	if len(data) < len(Magic) || string(data[:len(Magic)]) != Magic {
+		return nil, fmt.Errorf("not a celeste bytecode file")
+	}
+
+	if len(data) < len(Magic)+4 {
+		return nil, fmt.Errorf("truncated bytecode")
+	}
+
+	payload, checksum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, fmt.Errorf("bytecode checksum mismatch, the file is corrupted")
+	}
+
+	d := &decoder{data: payload, pos: len(Magic)}
+
+	version := d.uvarint()
+	if d.err == nil && version != FormatVersion {
+		return nil, fmt.Errorf("unsupported bytecode format version %d, want %d", version, FormatVersion)
+	}
+
+	table := d.uint32()
+	if d.err == nil && table != code.TableVersion() {
+		return nil, fmt.Errorf("bytecode was compiled for a different instruction set (opcode table %08x, want %08x)", table, code.TableVersion())
+	}
+
+	bytecode := &Bytecode{Instructions: code.Instructions(d.bytes())}
+	bytecode.SourceMap = d.sourceMap()
+	bytecode.NumGlobals = d.length()
+
+	numConstants := d.length()
+	bytecode.Constants = make([]object.Object, 0, numConstants)
+	for i := 0; i < numConstants && d.err == nil; i++ {
+		bytecode.Constants = append(bytecode.Constants, d.object())
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	if d.pos != len(d.data) {
+		return nil, fmt.Errorf("%d unexpected bytes after the constants", len(d.data)-d.pos)
+	}
+
+	err := verifier.Verify(bytecode.Instructions, bytecode.Constants, bytecode.NumGlobals) // The checksum only proves the file is intact, not that it came from our compiler
+	if err != nil {
+		return nil, fmt.Errorf("invalid bytecode: %s", err)
+	}
+
+	return bytecode, nil
+}
+
+// The decoder remembers the first error and returns zero values after it, so callers only check d.err once they are done
+type decoder struct {
+	data []byte
+	pos int
+	err error
+}
+
+func (d *decoder) fail(format string, a ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf(format, a...)
+	}
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+
+	if d.pos >= len(d.data) {
+		d.fail("truncated bytecode")
+		return 0
+	}
+
+	b := d.data[d.pos]
+	d.pos++
+	return b
+}
+
+func (d *decoder) uint32() uint32 {
+	if d.err != nil {
+		return 0
+	}
+
+	if d.pos+4 > len(d.data) {
+		d.fail("truncated bytecode")
+		return 0
+	}
+
+	v := binary.BigEndian.Uint32(d.data[d.pos:])
+	d.pos += 4
+	return v
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(d.data[d.pos:])
+	if n <= 0 {
+		d.fail("truncated bytecode")
+		return 0
+	}
+
+	d.pos += n
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Varint(d.data[d.pos:])
+	if n <= 0 {
+		d.fail("truncated bytecode")
+		return 0
+	}
+
+	d.pos += n
+	return v
+}
+
+// Lengths are checked against the bytes left so a corrupted count can't make us allocate a huge slice
+func (d *decoder) length() int {
+	n := d.uvarint()
+	if n > uint64(len(d.data)-d.pos) {
+		d.fail("truncated bytecode")
+		return 0
+	}
+
+	return int(n)
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.length()
+	if d.err != nil {
+		return nil
+	}
+
+	b := make([]byte, n)
+	copy(b, d.data[d.pos:d.pos+n])
+	d.pos += n
+	return b
+}
+
+// An empty source map decodes to nil, which is what the compiler leaves behind when nothing was emitted
+func (d *decoder) sourceMap() code.SourceMap {
+	n := d.length()
+	if n == 0 || d.err != nil {
+		return nil
+	}
+
+	sm := make(code.SourceMap, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		sm = append(sm, code.LineEntry{Offset: int(d.uvarint()), Line: int(d.uvarint())})
+	}
+	return sm
+}
+
+func (d *decoder) bool() bool {
+	switch b := d.byte(); b {
+	case 0:
+		return false
+	case 1:
+		return true
+	default:
+		d.fail("invalid boolean %d", b)
+		return false
+	}
+}
+
+func (d *decoder) object() object.Object {
+	switch tag := d.byte(); tag {
+	case tagInteger:
+		return &object.Integer{Value: d.varint()}
+	case tagString:
+		return &object.String{Value: string(d.bytes())}
+	case tagBoolean:
+		return &object.Boolean{Value: d.bool()}
+	case tagNull:
+		return &object.Null{}
+	case tagArray:
+		n := d.length()
+		elements := make([]object.Object, 0, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			elements = append(elements, d.object())
+		}
+		return &object.Array{Elements: elements}
+	case tagHash:
+		n := d.length()
+		pairs := make(map[object.HashKey]object.HashPair, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			key := d.object()
+			value := d.object()
+			if d.err != nil {
+				break
+			}
+
+			hashable, ok := key.(object.Hashable)
+			if !ok {
+				d.fail("unusable as hash key: %s", key.Type())
+				break
+			}
+			pairs[hashable.HashKey()] = object.HashPair{Key: key, Value: value}
+		}
+		return &object.Hash{Pairs: pairs}
+	case tagCompiledFunction:
+		fn := &object.CompiledFunction{}
+		fn.Name = string(d.bytes())
+		fn.NumLocals = int(d.uvarint())
+		fn.NumParameters = int(d.uvarint())
+		fn.NumDefaults = int(d.uvarint())
+		fn.NumFree = int(d.uvarint())
+		fn.Variadic = d.bool()
+		fn.Instructions = code.Instructions(d.bytes())
+		fn.SourceMap = d.sourceMap()
+
+		minLocals := fn.NumParameters
+		if fn.Variadic {
+			minLocals++
+		}
+		if d.err == nil && (fn.NumDefaults > fn.NumParameters || fn.NumLocals < minLocals) {
+			d.fail("function %q has inconsistent parameter counts", fn.Name)
+		}
+		return fn
+	default:
+		if d.err == nil {
+			d.fail("unknown constant tag %d", tag)
+		}
+		return nil
+	}
+}
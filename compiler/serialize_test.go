@@ -0,0 +1,170 @@
+package compiler
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"reflect"
+	"strings"
+	"testing"
+	"compiler/code"
+	"compiler/object"
+)
+
+func compileForSerialization(t *testing.T, input string) *Bytecode {
+	program := parse(input)
+
+	compiler := New()
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	return compiler.Bytecode()
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	inputs := []string{
+		`1 + 2`,
+		`let s = "hello" + " world"; s`,
+		`fn add(a, b = -10, ...rest) { a + b }; add(1)`,
+		`let outer = fn(x) { fn(y) { x + y } }; outer(1)(2)`,
+		`match [1, 2] { [a, b] => a + b, _ => 0 }`,
+		`impl Array { fn sum(self) { 0 } }; {"a": 1}`,
+	}
+
+	for _, input := range inputs {
+		bytecode := compileForSerialization(t, input)
+
+		data, err := Encode(bytecode)
+		if err != nil {
+			t.Fatalf("encode error for %q: %s", input, err)
+		}
+
+		decoded, err := Decode(data)
+		if err != nil {
+			t.Fatalf("decode error for %q: %s", input, err)
+		}
+
+		if !reflect.DeepEqual(bytecode, decoded) {
+			t.Errorf("round trip changed the bytecode of %q.\nwant=%+v\ngot =%+v", input, bytecode, decoded)
+		}
+	}
+}
+
+func TestEncodeDecodeConstants(t *testing.T) {
+	hash := &object.Hash{Pairs: map[object.HashKey]object.HashPair{}}
+	for _, k := range []object.Object{&object.String{Value: "a"}, &object.Integer{Value: 2}, &object.Boolean{Value: true}} {
+		hash.Pairs[k.(object.Hashable).HashKey()] = object.HashPair{Key: k, Value: &object.Null{}}
+	}
+
+	bytecode := &Bytecode{
+		Constants: []object.Object{
+			&object.Integer{Value: -1 << 62},
+			&object.String{Value: ""},
+			&object.Array{Elements: []object.Object{&object.Integer{Value: 1}, &object.Array{Elements: []object.Object{}}}},
+			hash,
+		},
+	}
+
+	data, err := Encode(bytecode)
+	if err != nil {
+		t.Fatalf("encode error: %s", err)
+	}
+
+	again, err := Encode(bytecode)
+	if err != nil {
+		t.Fatalf("encode error: %s", err)
+	}
+
+	if string(data) != string(again) {
+		t.Errorf("encoding is not deterministic")
+	}
+
+	decoded, err := Decode(data)
+	if err != nil {
+		t.Fatalf("decode error: %s", err)
+	}
+
+	if !reflect.DeepEqual(bytecode.Constants, decoded.Constants) {
+		t.Errorf("constants changed.\nwant=%+v\ngot =%+v", bytecode.Constants, decoded.Constants)
+	}
+}
+
+func TestEncodeUnsupportedConstant(t *testing.T) {
+	bytecode := &Bytecode{Constants: []object.Object{object.GetBuiltinByName("len")}}
+
+	_, err := Encode(bytecode)
+	if err == nil {
+		t.Fatalf("expected encode error but got none")
+	}
+
+	if err.Error() != "constant 0: cannot serialize BUILTIN" {
+		t.Errorf("wrong error. got=%q", err)
+	}
+}
+
+// Replaces the checksum so a deliberately broken payload gets past the integrity check
+func resign(data []byte) []byte {
+	payload := data[:len(data)-4]
+	out := append([]byte{}, payload...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(payload))
+}
+
+func TestDecodeErrors(t *testing.T) {
+	data, err := Encode(compileForSerialization(t, `fn(a) { a }(1)`))
+	if err != nil {
+		t.Fatalf("encode error: %s", err)
+	}
+
+	flipped := append([]byte{}, data...)
+	flipped[len(flipped)/2] ^= 0xff
+
+	wrongVersion := append([]byte{}, data...)
+	wrongVersion[4] = FormatVersion + 1
+
+	wrongTable := append([]byte{}, data...)
+	wrongTable[5] ^= 0xff
+
+	tests := []struct {
+		data []byte
+		expected string
+	} {
+		{[]byte("MONK"), "not a celeste bytecode file"},
+		{[]byte{}, "not a celeste bytecode file"},
+		{flipped, "bytecode checksum mismatch"},
+		{data[:len(data)-1], "bytecode checksum mismatch"},
+		{resign(wrongVersion), "unsupported bytecode format version"},
+		{resign(wrongTable), "different instruction set"},
+		{resign(data[:len(data)-8]), "truncated bytecode"},
+	}
+
+	for i, tt := range tests {
+		_, err := Decode(tt.data)
+		if err == nil {
+			t.Errorf("test %d: expected decode error but got none", i)
+			continue
+		}
+
+		if !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("test %d: wrong error. want it to contain %q, got=%q", i, tt.expected, err)
+		}
+	}
+}
+
+func TestDecodeVerifiesInstructions(t *testing.T) {
+	bytecode := &Bytecode{Instructions: code.Make(code.OpConstant, 3)}
+
+	data, err := Encode(bytecode)
+	if err != nil {
+		t.Fatalf("encode error: %s", err)
+	}
+
+	_, err = Decode(data)
+	if err == nil {
+		t.Fatalf("expected decode error but got none")
+	}
+
+	if !strings.Contains(err.Error(), "invalid bytecode") || !strings.Contains(err.Error(), "constant 3 out of range") {
+		t.Errorf("wrong error. got=%q", err)
+	}
+}
@@ -0,0 +1,65 @@
+package compiler
+
+import (
+	"compiler/code"
+	"compiler/object"
+)
+
+// Superinstructions save the VM a dispatch, and often an operand decode, on the sequences hot code is made of.
+// The pass reuses the peephole pass's decoding and reassembly, so jumps and the source map follow along.
+func superinstructions(ins code.Instructions, sourceMap code.SourceMap, constants []object.Object) (code.Instructions, code.SourceMap, error) {
+	decoded, ok := decodeForPeephole(ins)
+	if !ok {
+		return ins, sourceMap, nil
+	}
+
+	targets := jumpTargets(decoded)
+
+	changed := false
+	for i := 0; i < len(decoded); i++ {
+		in := decoded[i]
+
+		var next *peepholeInstruction
+		if i+1 < len(decoded) {
+			next = decoded[i+1]
+		}
+		pair := next != nil && !targets[next.offset]
+
+		switch {
+		case pair && in.op == code.OpConstant && isIntegerConstant(in.operands[0], constants) && next.op == code.OpAdd:
+			in.op = code.OpAddConstInt
+			next.removed = true
+			i++
+		case pair && in.op == code.OpConstant && isIntegerConstant(in.operands[0], constants) && next.op == code.OpSub:
+			in.op = code.OpSubConstInt
+			next.removed = true
+			i++
+		case pair && in.op == code.OpGreaterThan && next.op == code.OpJumpNotTruthy:
+			in.op = code.OpJumpIfNotGreater
+			in.operands = next.operands
+			next.removed = true
+			i++
+		case in.op == code.OpGetLocal && in.operands[0] <= 3:
+			in.op = code.OpGetLocal0 + code.Opcode(in.operands[0])
+			in.operands = nil
+		case in.op == code.OpCall && in.operands[0] <= 2:
+			in.op = code.OpCall0 + code.Opcode(in.operands[0])
+			in.operands = nil
+		default:
+			continue
+		}
+
+		changed = true
+	}
+
+	if !changed {
+		return ins, sourceMap, nil
+	}
+
+	return reassemble(decoded, len(ins), sourceMap)
+}
+
+func isIntegerConstant(index int, constants []object.Object) bool {
+	_, ok := constants[index].(*object.Integer)
+	return ok
+}
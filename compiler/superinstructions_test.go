@@ -0,0 +1,92 @@
+package compiler
+
+import (
+	"testing"
+	"compiler/code"
+)
+
+func TestSuperinstructions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+			let fib = fn(x) { if (x < 2) { x } else { fib(x - 1) + fib(x - 2) } };
+			fib(10)
+			`,
+			expectedConstants: []interface{}{
+				2,
+				1,
+				[]code.Instructions{
+					// 0000
+					code.Make(code.OpConstant, 0),
+					// 0003
+					code.Make(code.OpGetLocal0),
+					// 0004
+					code.Make(code.OpJumpIfNotGreater, 11),
+					// 0007
+					code.Make(code.OpGetLocal0),
+					// 0008
+					code.Make(code.OpJump, 24),
+					// 0011
+					code.Make(code.OpCurrentClosure),
+					// 0012
+					code.Make(code.OpGetLocal0),
+					// 0013
+					code.Make(code.OpSubConstInt, 1),
+					// 0016
+					code.Make(code.OpCall1),
+					// 0017
+					code.Make(code.OpCurrentClosure),
+					// 0018
+					code.Make(code.OpGetLocal0),
+					// 0019
+					code.Make(code.OpSubConstInt, 0),
+					// 0022
+					code.Make(code.OpCall1),
+					// 0023
+					code.Make(code.OpAdd),
+					// 0024
+					code.Make(code.OpReturnValue),
+				},
+				10,
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpCall1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// Only integer constants become OpAddConstInt
+			input: `fn(a, b, c, d, e) { e + "x"; d + 1; b(a, c); d }`,
+			expectedConstants: []interface{}{
+				"x",
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 4),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpPop),
+					code.Make(code.OpGetLocal3),
+					code.Make(code.OpAddConstInt, 1),
+					code.Make(code.OpPop),
+					code.Make(code.OpGetLocal1),
+					code.Make(code.OpGetLocal0),
+					code.Make(code.OpGetLocal2),
+					code.Make(code.OpCall2),
+					code.Make(code.OpPop),
+					code.Make(code.OpGetLocal3),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTestsWithOptions(t, Options{Superinstructions: true}, tests)
+}
@@ -1,5 +1,10 @@
 package compiler
 
+import (
+	"sort"
+	"strconv"
+)
+
 type SymbolScope string
 
 const (
@@ -7,6 +12,7 @@ const (
 	GlobalScope SymbolScope = "GLOBAL"
 	BuiltinScope SymbolScope = "BUILTIN"
 	FreeScope SymbolScope = "FREE"
+	FunctionScope SymbolScope = "FUNCTION"
 )
 
 type Symbol struct {
@@ -21,6 +27,8 @@ type SymbolTable struct {
 	store map[string]Symbol
 	numDefinitions int
 	FreeSymbols []Symbol
+	matchSlots map[string]Symbol // Slots match expressions have already taken, by nesting depth and name
+	captured map[int]bool // Globals some function refers to, only kept on the outermost table
 }
 
 func NewSymbolTable() *SymbolTable {
@@ -56,7 +64,12 @@ func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
 			return obj, ok
 		}
 
-		if obj.Scope == GlobalScope || obj.Scope == BuiltinScope {
+		if obj.Scope == GlobalScope {
+			s.markCaptured(obj.Index)
+			return obj, ok
+		}
+
+		if obj.Scope == BuiltinScope {
 			return obj, ok
 		}
 
@@ -67,6 +80,28 @@ func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
 	return obj, ok
 }
 
+// NumDefinitions is how many slots Define has handed out, for the outermost table that is the size of the globals store
+func (s *SymbolTable) NumDefinitions() int {
+	return s.numDefinitions
+}
+
+// Symbols lists the names defined directly in this table, ordered by scope and then index
+func (s *SymbolTable) Symbols() []Symbol {
+	symbols := make([]Symbol, 0, len(s.store))
+	for _, symbol := range s.store {
+		symbols = append(symbols, symbol)
+	}
+
+	sort.Slice(symbols, func(i, j int) bool {
+		if symbols[i].Scope != symbols[j].Scope {
+			return symbols[i].Scope < symbols[j].Scope
+		}
+		return symbols[i].Index < symbols[j].Index
+	})
+
+	return symbols
+}
+
 func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
 	symbol := Symbol{Name: name, Index: index, Scope: BuiltinScope}
 	s.store[name] = symbol
@@ -74,6 +109,14 @@ func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
 	return symbol
 }
 
+// The function's own name resolves to the closure currently executing, so it can call itself without capturing the binding it is stored in
+func (s *SymbolTable) DefineFunctionName(name string) Symbol {
+	symbol := Symbol{Name: name, Index: 0, Scope: FunctionScope}
+	s.store[name] = symbol
+
+	return symbol
+}
+
 func (s *SymbolTable) defineFree(original Symbol) Symbol {
 	s.FreeSymbols = append(s.FreeSymbols, original)
 
@@ -82,4 +125,56 @@ func (s *SymbolTable) defineFree(original Symbol) Symbol {
 
 	s.store[original.Name] = symbol
 	return symbol
-}
\ No newline at end of file
+}
+
+func (s *SymbolTable) markCaptured(index int) {
+	outermost := s
+	for outermost.Outer != nil {
+		outermost = outermost.Outer
+	}
+
+	if outermost.captured == nil {
+		outermost.captured = map[int]bool{}
+	}
+	outermost.captured[index] = true
+}
+
+// A match subject or binding takes a slot the first time its nesting depth needs one and every later match reuses it,
+// so matching at the top level over and over doesn't use up globals. An empty name is the hidden subject slot
+func (s *SymbolTable) defineMatchSlot(depth int, name string) Symbol {
+	key := strconv.Itoa(depth) + "#" + name
+	symbol, ok := s.matchSlots[key]
+	if !ok {
+		symbol = s.Define(name)
+		if name == "" {
+			delete(s.store, name)
+		}
+
+		if s.matchSlots == nil {
+			s.matchSlots = map[string]Symbol{}
+		}
+		s.matchSlots[key] = symbol
+	}
+
+	if name != "" {
+		s.store[name] = symbol
+	}
+	return symbol
+}
+
+// Once a function refers to a global match binding, the function keeps seeing that slot so no later match may reuse it
+func (s *SymbolTable) releaseMatchSlot(depth int, name string) {
+	key := strconv.Itoa(depth) + "#" + name
+	if symbol, ok := s.matchSlots[key]; ok && symbol.Scope == GlobalScope && s.captured[symbol.Index] {
+		delete(s.matchSlots, key)
+	}
+}
+
+// Forgets a name defined for a narrower scope than the table itself (like a match arm), putting back whatever it shadowed
+func (s *SymbolTable) restore(name string, shadowed Symbol, ok bool) {
+	if ok {
+		s.store[name] = shadowed
+	} else {
+		delete(s.store, name)
+	}
+}
@@ -0,0 +1,48 @@
+package compiler
+
+import "compiler/code"
+
+// Calls that have a tail form with operands of the same width, so they can be rewritten in place
+var tailForms = map[code.Opcode]code.Opcode{
+	code.OpCall: code.OpTailCall,
+	code.OpCallSpread: code.OpTailCallSpread,
+}
+
+// A call whose value the function returns straight away, either directly or through the jumps at the end
+// of an if's branches or a match's arms, becomes a tail call so deep recursion doesn't grow the frame stack.
+// Only function bodies are marked, main has no frame to give up.
+func markTailCalls(ins code.Instructions) {
+	decoded, ok := decodeForPeephole(ins)
+	if !ok {
+		return
+	}
+
+	byOffset := make(map[int]*peepholeInstruction, len(decoded))
+	for _, in := range decoded {
+		byOffset[in.offset] = in
+	}
+
+	for i, in := range decoded {
+		tail, ok := tailForms[in.op]
+		if !ok {
+			continue
+		}
+
+		next := len(ins)
+		if i+1 < len(decoded) {
+			next = decoded[i+1].offset
+		}
+
+		for steps := 0; steps < len(decoded); steps++ { // Bounded so a jump cycle can't hang the compiler
+			target, ok := byOffset[next]
+			if !ok || (target.op != code.OpJump && target.op != code.OpJumpWide) {
+				break
+			}
+			next = target.operands[0]
+		}
+
+		if target, ok := byOffset[next]; ok && target.op == code.OpReturnValue {
+			ins[in.offset] = byte(tail)
+		}
+	}
+}
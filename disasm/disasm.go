@@ -0,0 +1,258 @@
+// Package disasm prints compiled programs for people to read. Unlike code.Instructions.String it
+// walks into every function in the constant pool, shows constants by value instead of by index,
+// labels jump targets and tells which source line each instruction came from.
+package disasm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"compiler/code"
+	"compiler/compiler"
+	"compiler/object"
+)
+
+// Disassemble returns the listing Fprint would write
+func Disassemble(bytecode *compiler.Bytecode) string {
+	var out bytes.Buffer
+	Fprint(&out, bytecode)
+	return out.String()
+}
+
+// Fprint writes the main program followed by every compiled function in the constant pool
+func Fprint(out io.Writer, bytecode *compiler.Bytecode) {
+	FprintMain(out, bytecode)
+
+	for i, c := range bytecode.Constants {
+		fn, ok := c.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+
+		io.WriteString(out, "\n")
+		FprintFunction(out, i, fn, bytecode.Constants)
+	}
+}
+
+func FprintMain(out io.Writer, bytecode *compiler.Bytecode) {
+	io.WriteString(out, "== main ==\n")
+	fprintInstructions(out, bytecode.Instructions, bytecode.SourceMap, bytecode.Constants)
+}
+
+// index is the function's position in the constant pool, it is what OpClosure refers to it by
+func FprintFunction(out io.Writer, index int, fn *object.CompiledFunction, constants []object.Object) {
+	fmt.Fprintf(out, "== constant %d: %s ==\n", index, describe(fn))
+	fprintInstructions(out, fn.Instructions, fn.SourceMap, constants)
+}
+
+func describe(fn *object.CompiledFunction) string {
+	name := fn.Name
+	if name == "" {
+		name = "<anonymous>"
+	}
+
+	details := []string{fmt.Sprintf("params %d", fn.NumParameters)}
+	if fn.NumDefaults > 0 {
+		details = append(details, fmt.Sprintf("defaults %d", fn.NumDefaults))
+	}
+	if fn.Variadic {
+		details = append(details, "variadic")
+	}
+	details = append(details, fmt.Sprintf("locals %d", fn.NumLocals), fmt.Sprintf("free %d", fn.NumFree))
+
+	return fmt.Sprintf("fn %s (%s)", name, strings.Join(details, ", "))
+}
+
+type instruction struct {
+	offset int
+	def *code.Definition
+	op code.Opcode
+	operands []int
+}
+
+func fprintInstructions(out io.Writer, ins code.Instructions, sourceMap code.SourceMap, constants []object.Object) {
+	decoded, trailing := decode(ins)
+	labels := jumpLabels(decoded)
+
+	lastLine := 0
+	for _, in := range decoded {
+		if label, ok := labels[in.offset]; ok {
+			fmt.Fprintf(out, "%s:\n", label)
+		}
+
+		lineColumn := ""
+		if line := sourceMap.Line(in.offset); line != 0 && line != lastLine {
+			lineColumn = fmt.Sprint(line)
+			lastLine = line
+		}
+
+		text := formatInstruction(in)
+		comment := annotate(in, constants, labels)
+		if comment == "" {
+			fmt.Fprintf(out, "%04d %4s  %s\n", in.offset, lineColumn, text)
+			continue
+		}
+
+		fmt.Fprintf(out, "%04d %4s  %-28s ; %s\n", in.offset, lineColumn, text, comment)
+	}
+
+	if label, ok := labels[len(ins)]; ok { // A jump to the end of the instructions, like an if finishing the main program
+		fmt.Fprintf(out, "%s:\n", label)
+	}
+
+	if trailing != "" {
+		fmt.Fprintf(out, "ERROR: %s\n", trailing)
+	}
+}
+
+// Stops at the first byte that is not a valid instruction and describes the problem, the verifier reports these properly
+func decode(ins code.Instructions) ([]instruction, string) {
+	decoded := []instruction{}
+
+	i := 0
+	for i < len(ins) {
+		def, err := code.Lookup(ins[i])
+		if err != nil {
+			return decoded, fmt.Sprintf("%04d %s", i, err)
+		}
+
+		width := 0
+		for _, w := range def.OperandWidths {
+			width += w
+		}
+
+		if i+1+width > len(ins) {
+			return decoded, fmt.Sprintf("%04d %s is cut off", i, def.Name)
+		}
+
+		operands, read := code.ReadOperands(def, ins[i+1:])
+		decoded = append(decoded, instruction{offset: i, def: def, op: code.Opcode(ins[i]), operands: operands})
+
+		i += 1 + read
+	}
+
+	return decoded, ""
+}
+
+// Which operand of a jumping instruction holds its target
+func jumpOperand(op code.Opcode) (int, bool) {
+	switch op {
+	case code.OpJump, code.OpJumpNotTruthy, code.OpJumpIfNotGreater, code.OpJumpWide, code.OpJumpNotTruthyWide:
+		return 0, true
+	case code.OpSkipDefault, code.OpSkipDefaultWide:
+		return 1, true
+	}
+
+	return 0, false
+}
+
+// Labels are numbered in the order their targets appear, so the listing reads top to bottom
+func jumpLabels(decoded []instruction) map[int]string {
+	targets := map[int]bool{}
+	for _, in := range decoded {
+		if i, ok := jumpOperand(in.op); ok {
+			targets[in.operands[i]] = true
+		}
+	}
+
+	labels := map[int]string{}
+	for _, in := range decoded {
+		if targets[in.offset] {
+			labels[in.offset] = fmt.Sprintf("L%d", len(labels)+1)
+			delete(targets, in.offset)
+		}
+	}
+
+	for target := range targets { // Anything left is past the last instruction, there is at most one such offset that is valid
+		labels[target] = fmt.Sprintf("L%d", len(labels)+1)
+	}
+
+	return labels
+}
+
+func formatInstruction(in instruction) string {
+	parts := []string{in.def.Name}
+	for _, o := range in.operands {
+		parts = append(parts, fmt.Sprint(o))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// The comment explains what the operands refer to, an empty one means there is nothing to add
+func annotate(in instruction, constants []object.Object, labels map[int]string) string {
+	if i, ok := jumpOperand(in.op); ok {
+		if label, ok := labels[in.operands[i]]; ok {
+			return "-> " + label
+		}
+		return ""
+	}
+
+	switch in.op {
+	case code.OpConstant, code.OpConstantWide, code.OpAddConstInt, code.OpSubConstInt:
+		return constantValue(in.operands[0], constants)
+	case code.OpClosure, code.OpClosureWide:
+		fn, ok := constantAt(in.operands[0], constants).(*object.CompiledFunction)
+		if !ok {
+			return ""
+		}
+		if fn.Name == "" {
+			return "fn <anonymous>"
+		}
+		return "fn " + fn.Name
+	case code.OpGetBuiltin:
+		if in.operands[0] < len(object.Builtins) {
+			return object.Builtins[in.operands[0]].Name
+		}
+	case code.OpDefineMethod, code.OpDefineMethodWide:
+		return fmt.Sprintf("%s.%s", constantName(in.operands[0], constants), constantName(in.operands[1], constants))
+	case code.OpCallMethod, code.OpCallMethodWide:
+		return "." + constantName(in.operands[0], constants)
+	case code.OpDestructureArray, code.OpDestructureHash:
+		return destructureFlags(in.operands[1])
+	}
+
+	return ""
+}
+
+func constantAt(index int, constants []object.Object) object.Object {
+	if index < 0 || index >= len(constants) {
+		return nil
+	}
+
+	return constants[index]
+}
+
+func constantValue(index int, constants []object.Object) string {
+	c := constantAt(index, constants)
+	switch c := c.(type) {
+	case nil:
+		return "<missing>"
+	case *object.String:
+		return fmt.Sprintf("%q", c.Value)
+	default:
+		return c.Inspect()
+	}
+}
+
+// Method and type names are string constants, they read better without quotes
+func constantName(index int, constants []object.Object) string {
+	if s, ok := constantAt(index, constants).(*object.String); ok {
+		return s.Value
+	}
+
+	return "<missing>"
+}
+
+func destructureFlags(flags int) string {
+	names := []string{}
+	if flags&code.DestructureRest != 0 {
+		names = append(names, "rest")
+	}
+	if flags&code.DestructureStrict != 0 {
+		names = append(names, "strict")
+	}
+
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,94 @@
+package disasm
+
+import (
+	"strings"
+	"testing"
+	"compiler/ast"
+	"compiler/compiler"
+	"compiler/lexer"
+	"compiler/parser"
+)
+
+func parse(input string) *ast.Program {
+	l := lexer.New(input)
+	p := parser.New(l)
+	return p.ParseProgram()
+}
+
+func compile(t *testing.T, input string) *compiler.Bytecode {
+	comp := compiler.New()
+	err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	return comp.Bytecode()
+}
+
+func TestDisassemble(t *testing.T) {
+	input := `let greeting = "hello";
+fn add(a, b = 2) {
+  if (a > 1) { a + b } else { len([a]) }
+}
+add(1);
+`
+
+	expected := `== main ==
+0000    1  OpConstant 0                 ; "hello"
+0003       OpSetGlobal 0
+0006    2  OpClosure 3 0                ; fn add
+0010       OpSetGlobal 1
+0013    5  OpGetGlobal 1
+0016       OpConstant 2                 ; 1
+0019       OpCall 1
+0021       OpPop
+
+== constant 3: fn add (params 2, defaults 1, locals 2, free 0) ==
+0000    2  OpSkipDefault 1 10           ; -> L1
+0005       OpConstant 1                 ; 2
+0008       OpSetLocal 1
+L1:
+0010    3  OpGetLocal 0
+0012       OpConstant 2                 ; 1
+0015       OpGreaterThan
+0016       OpJumpNotTruthy 27           ; -> L2
+0019       OpGetLocal 0
+0021       OpGetLocal 1
+0023       OpAdd
+0024       OpJump 36                    ; -> L3
+L2:
+0027       OpGetBuiltin 0               ; len
+0029       OpGetLocal 0
+0031       OpArray 1
+0034       OpTailCall 1
+L3:
+0036       OpReturnValue
+`
+
+	got := Disassemble(compile(t, input))
+	if got != expected {
+		t.Errorf("wrong disassembly.\nwant=\n%s\ngot=\n%s", expected, got)
+	}
+}
+
+func TestDisassembleAnnotations(t *testing.T) {
+	tests := []struct {
+		input string
+		expected []string
+	}{
+		{`impl Array { fn sum(self) { 0 } }; [1].sum()`, []string{"; ARRAY.sum", "; .sum", "fn Array.sum (params 1, locals 1, free 0)"}},
+		{`let f = fn(x) { fn(y) { x + y } }`, []string{"; fn <anonymous>", "fn <anonymous> (params 1, locals 1, free 1)"}},
+		{`fn f(...rest) { rest }`, []string{"fn f (params 0, variadic, locals 1, free 0)"}},
+		{`let [a, ...b] = [1, 2]`, []string{"OpDestructureArray 1 1       ; rest"}},
+		{`if (true) { 1 }`, []string{"; -> L1", "L1:"}},
+	}
+
+	for _, tt := range tests {
+		got := Disassemble(compile(t, tt.input))
+		for _, want := range tt.expected {
+			if !strings.Contains(got, want) {
+				t.Errorf("input=%q: disassembly is missing %q.\ngot=\n%s", tt.input, want, got)
+			}
+		}
+	}
+}
@@ -1,18 +1,32 @@
 package evaluator
 
 import (
+	"context"
 	"fmt"
 	"compiler/ast"
 	"compiler/object"
 )
 
-var (
-	NULL = &object.Null{}
-	TRUE = &object.Boolean{Value: true}
-	FALSE = &object.Boolean{Value: false}
-)
+// EvalContext is Eval for scripts that aren't trusted: the run stops once ctx is done or it goes past
+// limits, which is reported as a *object.LimitError instead of an error object
+func EvalContext(ctx context.Context, node ast.Node, env *object.Environment, limits object.Limits) (object.Object, error) {
+	meter := env.Meter()
+	meter.Start(ctx, limits)
+	defer meter.Stop()
+
+	result := Eval(node, env)
+	if err := meter.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
 
 func Eval(node ast.Node, env *object.Environment) object.Object {
+	if err := env.Meter().Step(); err != nil { // Only fails under EvalContext, the error object then unwinds the whole run
+		return newError("%s", err)
+	}
+
 	switch node := node.(type) {
 	// Statements
 	case *ast.Program:
@@ -23,7 +37,7 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 
 	// Expressions
 	case *ast.IntegerLiteral:
-		return &object.Integer{Value: node.Value}
+		return object.NewInteger(node.Value)
 
 	case *ast.Boolean:
 		return nativeBoolToBooleanObject(node.Value)
@@ -78,10 +92,19 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 
 		env.Set(node.Name.Value, val)
 
+	case *ast.DestructuringLetStatement:
+		val := Eval(node.Value, env)
+
+		if isError(val) {
+			return val
+		}
+
+		return evalDestructuring(node.Pattern, val, env)
+
 	case *ast.FunctionLiteral:
 		params := node.Parameters
 		body := node.Body
-		return &object.Function{Parameters: params, Env: env, Body: body}
+		return &object.Function{Parameters: params, Defaults: node.Defaults, Rest: node.Rest, Name: node.Name, Env: env, Body: body}
 
 	case *ast.CallExpression:
 		function := Eval(node.Function, env)
@@ -89,12 +112,15 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 			return function
 		}
 
-		args := evalExpressions(node.Arguments, env)
+		args := evalCallArguments(node.Arguments, env)
 		if len(args) == 1 && isError(args[0]) { // If te argument returned is an error argument (error arguments will be the only argument returned, so if len(arg) != 1, it is not an error argument)
 			return args[0]
 		}
 
-		return applyFunction(function, args)
+		return callFunction(function, args, env)
+
+	case *ast.SpreadExpression: // Only call arguments may be spread, those never reach Eval directly
+		return newError("spread arguments are only supported in function calls")
 
 	case *ast.StringLiteral:
 		return &object.String{Value: node.Value}
@@ -122,6 +148,15 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 	
 	case *ast.HashLiteral:
 		return evalHashLiteral(node, env)
+
+	case *ast.MethodCallExpression:
+		return evalMethodCallExpression(node, env)
+
+	case *ast.ImplStatement:
+		return evalImplStatement(node, env)
+
+	case *ast.MatchExpression:
+		return evalMatchExpression(node, env, Eval)
 	}
 
 	return nil
@@ -169,14 +204,14 @@ func evalPrefixExpression(operator string, right object.Object) object.Object {
 
 func evalBangOperatorExpression(right object.Object) object.Object {
 	switch right {
-	case TRUE:
-		return FALSE
-	case FALSE:
-		return TRUE
-	case NULL:
-		return TRUE
+	case object.TRUE:
+		return object.FALSE
+	case object.FALSE:
+		return object.TRUE
+	case object.NULL:
+		return object.TRUE
 	default:
-		return FALSE
+		return object.FALSE
 	}
 }
 
@@ -186,7 +221,7 @@ func evalMinusPrefixOperatorExpression(right object.Object) object.Object {
 	}
 
 	value := right.(*object.Integer).Value
-	return &object.Integer{Value: -value}
+	return object.NewInteger(-value)
 }
 
 func evalInfixExpression(operator string, left, right object.Object) object.Object { // This takes in both the left and right parameters as an object.Object data type
@@ -212,13 +247,16 @@ func evalIntegerInfixExpression(operator string, left, right object.Object) obje
 	
 	switch operator {
 	case "+":
-		return &object.Integer{Value: leftVal + rightVal}
+		return object.NewInteger(leftVal + rightVal)
 	case "-":
-		return &object.Integer{Value: leftVal - rightVal}
+		return object.NewInteger(leftVal - rightVal)
 	case "*":
-		return &object.Integer{Value: leftVal * rightVal}
+		return object.NewInteger(leftVal * rightVal)
 	case "/":
-		return &object.Integer{Value: leftVal / rightVal}
+		if rightVal == 0 {
+			return newError("division by zero")
+		}
+		return object.NewInteger(leftVal / rightVal)
 	case "<":
 		return nativeBoolToBooleanObject(leftVal < rightVal)
 	case ">":
@@ -254,7 +292,7 @@ func evalIfExpression(ie *ast.IfExpression, env *object.Environment) object.Obje
 	} else if ie.Alternative != nil {
 		return Eval(ie.Alternative, env) 
 	} else {
-		return NULL
+		return object.NULL
 	}
 }
 
@@ -289,6 +327,36 @@ func evalExpressions(exps []ast.Expression, env *object.Environment) []object.Ob
 	return result
 }
 
+// Like evalExpressions, but the elements of spread arrays are passed as separate arguments
+func evalCallArguments(exps []ast.Expression, env *object.Environment) []object.Object {
+	result := []object.Object{}
+
+	for _, e := range exps {
+		spread, ok := e.(*ast.SpreadExpression)
+		if !ok {
+			evaluated := Eval(e, env)
+			if isError(evaluated) {
+				return []object.Object{evaluated}
+			}
+			result = append(result, evaluated)
+			continue
+		}
+
+		evaluated := Eval(spread.Value, env)
+		if isError(evaluated) {
+			return []object.Object{evaluated}
+		}
+
+		arr, ok := evaluated.(*object.Array)
+		if !ok {
+			return []object.Object{newError("spread argument must be ARRAY, got %s", evaluated.Type())}
+		}
+		result = append(result, arr.Elements...)
+	}
+
+	return result
+}
+
 func evalIndexExpression(left, index object.Object) object.Object {
 	switch {
 	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
@@ -306,7 +374,7 @@ func evalArrayIndexExpression(array, index object.Object) object.Object {
 	max := int64(len(arrayObject.Elements) - 1)
 	
 	if idx < 0 || idx > max {
-		return NULL
+		return object.NULL
 	}
 
 	return arrayObject.Elements[idx]
@@ -348,39 +416,381 @@ func evalHashIndexExpression(hash, index object.Object) object.Object {
 
 	pair, ok := hashObject.Pairs[key.HashKey()]
 	if !ok {
-		return NULL
+		return object.NULL
 	}
 
 	return pair.Value
 }
 
+// Calls made by the script count against the depth limit, tail calls don't make it deeper
+func callFunction(fn object.Object, args []object.Object, env *object.Environment) object.Object {
+	meter := env.Meter()
+	if err := meter.Enter(); err != nil {
+		return newError("%s", err)
+	}
+	defer meter.Leave()
+
+	return applyFunction(fn, args)
+}
+
+// A body ending in a call hands it back as a tailCall and the loop makes it, so tail recursion runs in
+// constant Go stack like it does in the VMs
 func applyFunction(fn object.Object, args []object.Object) object.Object {
-	switch fn := fn.(type) {
-	case *object.Function:
-		extendedEnv := extendFunctionEnv(fn, args)
-		evaluated := Eval(fn.Body, extendedEnv)
-		return unwrapReturnValue(evaluated)
-	case *object.Builtin:
-		if result := fn.Fn(args...); result != nil {
-			return result
+	for {
+		switch f := fn.(type) {
+		case *object.Function:
+			extendedEnv, err := extendFunctionEnv(f, args)
+			if err != nil {
+				return err
+			}
+
+			evaluated := evalTail(f.Body, extendedEnv)
+			if tc, ok := evaluated.(*tailCall); ok {
+				fn, args = tc.fn, tc.args
+				continue
+			}
+			return unwrapReturnValue(evaluated)
+		case *object.Builtin:
+			if result := f.Fn(args...); result != nil {
+				return result
+			}
+			return object.NULL
+		default:
+			return newError("not a function: %s", f.Type())
+		}
+	}
+}
+
+// A call left for applyFunction to make, it never escapes a function body
+type tailCall struct {
+	fn object.Object
+	args []object.Object
+}
+
+func (tc *tailCall) Type() object.ObjectType { return "TAIL_CALL" }
+func (tc *tailCall) Inspect() string { return "tail call" }
+
+// Like Eval, except a call whose value the function would return right away comes back as a tailCall
+func evalTail(node ast.Node, env *object.Environment) object.Object {
+	switch node := node.(type) {
+	case *ast.BlockStatement:
+		statements := node.Statements
+		if len(statements) == 0 {
+			return nil
+		}
+
+		for _, statement := range statements[:len(statements)-1] {
+			result := Eval(statement, env)
+
+			if result != nil {
+				rt := result.Type()
+				if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ {
+					return result
+				}
+			}
+		}
+
+		return evalTail(statements[len(statements)-1], env)
+
+	case *ast.ExpressionStatement:
+		return evalTail(node.Expression, env)
+
+	case *ast.ReturnStatement:
+		val := evalTail(node.ReturnValue, env)
+		if _, ok := val.(*tailCall); ok || isError(val) {
+			return val
+		}
+
+		return &object.ReturnValue{Value: val}
+
+	case *ast.IfExpression:
+		condition := Eval(node.Condition, env)
+		if isError(condition) {
+			return condition
+		}
+
+		if isTruthy(condition) {
+			return evalTail(node.Consequence, env)
+		} else if node.Alternative != nil {
+			return evalTail(node.Alternative, env)
+		}
+		return object.NULL
+
+	case *ast.CallExpression:
+		function := Eval(node.Function, env)
+		if isError(function) {
+			return function
+		}
+
+		args := evalCallArguments(node.Arguments, env)
+		if len(args) == 1 && isError(args[0]) {
+			return args[0]
+		}
+
+		return &tailCall{fn: function, args: args}
+
+	case *ast.MatchExpression:
+		return evalMatchExpression(node, env, evalTail)
+	}
+
+	return Eval(node, env)
+}
+
+func evalMethodCallExpression(node *ast.MethodCallExpression, env *object.Environment) object.Object {
+	receiver := Eval(node.Object, env)
+	if isError(receiver) {
+		return receiver
+	}
+
+	for _, a := range node.Arguments {
+		if _, ok := a.(*ast.SpreadExpression); ok {
+			return newError("spread arguments are only supported in function calls")
+		}
+	}
+
+	args := evalExpressions(node.Arguments, env)
+	if len(args) == 1 && isError(args[0]) {
+		return args[0]
+	}
+
+	method, ok := lookupMethod(receiver.Type(), node.Method.Value, env)
+	if !ok {
+		return newError("undefined method %s for %s", node.Method.Value, receiver.Type())
+	}
+
+	return callFunction(method, append([]object.Object{receiver}, args...), env) // The receiver is bound to self, the first parameter
+}
+
+func lookupMethod(t object.ObjectType, name string, env *object.Environment) (object.Object, bool) {
+	if method, ok := env.GetMethod(t, name); ok {
+		return method, true
+	}
+
+	if builtin := object.GetBuiltinMethod(t, name); builtin != nil {
+		return builtin, true
+	}
+
+	return nil, false
+}
+
+func evalImplStatement(node *ast.ImplStatement, env *object.Environment) object.Object {
+	objType, ok := object.LookupTypeName(node.Type.Value)
+	if !ok {
+		return newError("unknown type %s", node.Type.Value)
+	}
+
+	for _, m := range node.Methods {
+		method := Eval(m.Function, env)
+		env.SetMethod(objType, m.Name.Value, method)
+	}
+
+	return nil
+}
+
+// The arm that matches has its body evaluated by eval, evalTail when the match is in tail position
+func evalMatchExpression(node *ast.MatchExpression, env *object.Environment, eval func(ast.Node, *object.Environment) object.Object) object.Object {
+	subject := Eval(node.Subject, env)
+	if isError(subject) {
+		return subject
+	}
+
+	for _, arm := range node.Arms {
+		armEnv := object.NewEnclosedEnvironment(env) // Bindings only live as long as their arm
+
+		matched, err := matchPattern(arm.Pattern, subject, armEnv)
+		if err != nil {
+			return err
+		}
+
+		if !matched {
+			continue
+		}
+
+		if arm.Guard != nil {
+			guard := Eval(arm.Guard, armEnv)
+			if isError(guard) {
+				return guard
+			}
+
+			if !isTruthy(guard) {
+				continue
+			}
 		}
-		return NULL
+
+		return eval(arm.Body, armEnv)
+	}
+
+	return object.NULL
+}
+
+func matchPattern(pattern ast.Expression, value object.Object, env *object.Environment) (bool, *object.Error) {
+	switch pattern := pattern.(type) {
+	case *ast.Identifier:
+		if pattern.Value != "_" {
+			env.Set(pattern.Value, value)
+		}
+
+		return true, nil
+
+	case *ast.ArrayLiteral:
+		array, ok := value.(*object.Array)
+		if !ok || len(array.Elements) != len(pattern.Elements) {
+			return false, nil
+		}
+
+		for i, el := range pattern.Elements {
+			matched, err := matchPattern(el, array.Elements[i], env)
+			if err != nil || !matched {
+				return false, err
+			}
+		}
+
+		return true, nil
+
+	case *ast.HashLiteral:
+		hash, ok := value.(*object.Hash)
+		if !ok {
+			return false, nil
+		}
+
+		for keyNode, valueNode := range pattern.Pairs {
+			key := Eval(keyNode, env)
+			if isError(key) {
+				return false, key.(*object.Error)
+			}
+
+			pair, ok := hash.Pairs[key.(object.Hashable).HashKey()] // The parser only allows literal keys, which are all hashable
+			if !ok {
+				return false, nil
+			}
+
+			matched, err := matchPattern(valueNode, pair.Value, env)
+			if err != nil || !matched {
+				return false, err
+			}
+		}
+
+		return true, nil
+
 	default:
-		return newError("not a function: %s", fn.Type())
+		literal := Eval(pattern, env)
+		if isError(literal) {
+			return false, literal.(*object.Error)
+		}
+
+		return object.Equal(literal, value), nil
 	}
 }
 
-func extendFunctionEnv(fn *object.Function, args []object.Object) *object.Environment {
+func evalDestructuring(pattern ast.Pattern, val object.Object, env *object.Environment) object.Object {
+	switch pattern := pattern.(type) {
+	case *ast.ArrayPattern:
+		array, ok := val.(*object.Array)
+		if !ok {
+			return newError("cannot destructure %s as an array", val.Type())
+		}
+
+		for i, name := range pattern.Elements {
+			var element object.Object = object.NULL
+
+			if i < len(array.Elements) {
+				element = array.Elements[i]
+			} else if env.Strict() {
+				return newError("missing element %d in destructuring, array has %d elements", i, len(array.Elements))
+			}
+
+			env.Set(name.Value, element)
+		}
+
+		if pattern.Rest != nil {
+			rest := []object.Object{}
+			if len(pattern.Elements) < len(array.Elements) {
+				rest = append(rest, array.Elements[len(pattern.Elements):]...)
+			}
+
+			env.Set(pattern.Rest.Value, &object.Array{Elements: rest})
+		}
+
+	case *ast.HashPattern:
+		hash, ok := val.(*object.Hash)
+		if !ok {
+			return newError("cannot destructure %s as a hash", val.Type())
+		}
+
+		for _, name := range pattern.Keys {
+			var element object.Object = object.NULL
+
+			key := &object.String{Value: name.Value}
+			if pair, ok := hash.Pairs[key.HashKey()]; ok {
+				element = pair.Value
+			} else if env.Strict() {
+				return newError("missing key %s in destructuring", name.Value)
+			}
+
+			env.Set(name.Value, element)
+		}
+	}
+
+	return nil
+}
+
+func extendFunctionEnv(fn *object.Function, args []object.Object) (*object.Environment, *object.Error) {
+	minArgs := 0
+	for i := range fn.Parameters {
+		if i >= len(fn.Defaults) || fn.Defaults[i] == nil {
+			minArgs = i + 1
+		}
+	}
+
+	if len(args) < minArgs || (fn.Rest == nil && len(args) > len(fn.Parameters)) {
+		if fn.Name != "" {
+			return nil, newError("wrong number of arguments to %s: want=%s, got=%d", fn.Name, arityString(fn, minArgs), len(args))
+		}
+		return nil, newError("wrong number of arguments: want=%s, got=%d", arityString(fn, minArgs), len(args))
+	}
+
 	env := object.NewEnclosedEnvironment(fn.Env)
 
 	for paramIdx, param := range fn.Parameters {
-		env.Set(param.Value, args[paramIdx])
+		if paramIdx < len(args) {
+			env.Set(param.Value, args[paramIdx])
+			continue
+		}
+
+		val := Eval(fn.Defaults[paramIdx], env) // Evaluated in the new environment so a default can refer to the parameters before it
+		if err, ok := val.(*object.Error); ok {
+			return nil, err
+		}
+		env.Set(param.Value, val)
+	}
+
+	if fn.Rest != nil {
+		rest := []object.Object{}
+		if len(args) > len(fn.Parameters) {
+			rest = append(rest, args[len(fn.Parameters):]...)
+		}
+		env.Set(fn.Rest.Value, &object.Array{Elements: rest})
 	}
 
-	return env
+	return env, nil
+}
+
+func arityString(fn *object.Function, minArgs int) string {
+	switch {
+	case fn.Rest != nil:
+		return fmt.Sprintf("at least %d", minArgs)
+	case minArgs < len(fn.Parameters):
+		return fmt.Sprintf("%d..%d", minArgs, len(fn.Parameters))
+	default:
+		return fmt.Sprintf("%d", len(fn.Parameters))
+	}
 }
 
 func unwrapReturnValue(obj object.Object) object.Object {
+	if obj == nil { // An empty body, calling it gives null like it does in the VM
+		return object.NULL
+	}
+
 	if returnValue, ok := obj.(*object.ReturnValue); ok {
 		return returnValue.Value
 	}
@@ -390,18 +800,18 @@ func unwrapReturnValue(obj object.Object) object.Object {
 
 func nativeBoolToBooleanObject(input bool) *object.Boolean {
 	if input {
-		return TRUE
+		return object.TRUE
 	}
-	return FALSE
+	return object.FALSE
 }
 
 func isTruthy(obj object.Object) bool {
 	switch obj {
-	case NULL:
+	case object.NULL:
 		return false
-	case TRUE:
+	case object.TRUE:
 		return true
-	case FALSE:
+	case object.FALSE:
 		return false
 	default:
 		return true
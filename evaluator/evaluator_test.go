@@ -1,10 +1,13 @@
 package evaluator
 
 import (
+	"context"
+	"errors"
 	"compiler/lexer"
 	"compiler/object"
 	"compiler/parser"
 	"testing"
+	"time"
 )
 
 func TestEvalIntegerExpression(t *testing.T) {
@@ -192,6 +195,134 @@ func TestFunctionApplication(t *testing.T) {
 	}
 }
 
+func TestTailCalls(t *testing.T) {
+	tests := []struct {
+		input string
+		expected interface{}
+	}{
+		{"let count = fn(n, acc) { if (n == 0) { acc } else { count(n - 1, acc + 1) } }; count(100000, 0)", 100000},
+		{"let sum = fn(n, acc) { if (n == 0) { return acc; } return sum(n - 1, acc + n); }; sum(100000, 0)", 5000050000},
+		{"let last = fn(a) { if (len(a) == 1) { first(a) } else { last(rest(a)) } }; last([1, 2, 3])", 3},
+		{"let h = fn(n, acc) { match n { 0 => acc, _ => h(n - 1, acc + 1) } }; h(100000, 0)", 100000},
+		{"let s = fn(n, acc) { if (n == 0) { acc } else { s(n - 1, ...[acc + 1]) } }; s(100000, 0)", 100000},
+		{"fn(f) { f(1, 2) }(fn(a) { a })", "wrong number of arguments: want=1, got=2"},
+		{"fn(f) { f(1) }(1)", "not a function: INTEGER"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("no error object returned. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		}
+	}
+}
+
+func TestEvalContextLimits(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		input string
+		limits object.Limits
+		ctx context.Context
+		expected object.LimitKind
+	}{
+		{input: `let f = fn() { f() }; f()`, limits: object.Limits{MaxInstructions: 10000}, expected: object.InstructionLimit},
+		{input: `let f = fn(n) { f(n) + 1 }; f(0)`, limits: object.Limits{MaxDepth: 100}, expected: object.DepthLimit},
+		{input: `impl Integer { fn down(self) { self.down() + 1 } } 1.down()`, limits: object.Limits{MaxDepth: 100}, expected: object.DepthLimit},
+		{input: `let f = fn() { f() }; f()`, ctx: cancelled, expected: object.Cancelled},
+		{input: `let f = fn() { 1 + f() }; f()`, expected: object.DepthLimit}, // MaxDepth applies without limits too
+	}
+
+	for _, tt := range tests {
+		ctx := tt.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		_, err := EvalContext(ctx, program, object.NewEnvironment(), tt.limits)
+
+		var limitErr *object.LimitError
+		if !errors.As(err, &limitErr) {
+			t.Errorf("%q: expected a LimitError, got=%v", tt.input, err)
+			continue
+		}
+		if limitErr.Kind != tt.expected {
+			t.Errorf("%q: wrong limit. want=%d, got=%d (%s)", tt.input, tt.expected, limitErr.Kind, limitErr)
+		}
+	}
+}
+
+// Calls in tail position don't count towards the depth however deep the recursion goes
+func TestTailCallsWithinDepthLimit(t *testing.T) {
+	inputs := []string{
+		`let count = fn(n) { if (n == 0) { 0 } else { count(n - 1) } }; count(1000)`,
+		`let h = fn(n) { match n { 0 => 0, _ => h(n - 1) } }; h(1000)`,
+		`let s = fn(n) { if (n == 0) { 0 } else { s(...[n - 1]) } }; s(1000)`,
+	}
+
+	for _, input := range inputs {
+		program := parser.New(lexer.New(input)).ParseProgram()
+		result, err := EvalContext(context.Background(), program, object.NewEnvironment(), object.Limits{MaxDepth: 10})
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", input, err)
+			continue
+		}
+		testIntegerObject(t, result, 0)
+	}
+}
+
+func TestEvalContextDeadline(t *testing.T) {
+	program := parser.New(lexer.New(`let f = fn() { f() }; f()`)).ParseProgram()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := EvalContext(ctx, program, object.NewEnvironment(), object.Limits{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to stop the run, got=%v", err)
+	}
+}
+
+// The limits only last for one run, closures from it work in later ones
+func TestEvalContextKeepsEnvironment(t *testing.T) {
+	env := object.NewEnvironment()
+
+	program := parser.New(lexer.New(`let add = fn(a, b) { a + b }; add(1, 2)`)).ParseProgram()
+	result, err := EvalContext(context.Background(), program, env, object.Limits{MaxInstructions: 100})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	testIntegerObject(t, result, 3)
+
+	program = parser.New(lexer.New(`add(add(1, 2), add(3, 4))`)).ParseProgram()
+	testIntegerObject(t, Eval(program, env), 10)
+}
+
+func TestSmallIntegerResults(t *testing.T) {
+	for _, input := range []string{"5", "2 + 3", "10 / 2", "-(-5)", "len([1, 2, 3, 4, 5])"} {
+		if testEval(input) != object.NewInteger(5) {
+			t.Errorf("result of %q is not the shared integer 5", input)
+		}
+	}
+}
+
+func TestCallingEmptyFunction(t *testing.T) {
+	testNullObject(t, testEval("let noReturn = fn() { }; noReturn();"))
+}
+
 func TestClosures(t *testing.T) {
 	input := `
 		let newAdder = fn(x) {
@@ -361,8 +492,8 @@ func TestHashLiterals(t *testing.T) {
 		(&object.String{Value: "two"}).HashKey(): 2,
 		(&object.String{Value: "three"}).HashKey(): 3,
 		(&object.Integer{Value: 4}).HashKey(): 4,
-		TRUE.HashKey(): 5,
-		FALSE.HashKey(): 6,
+		object.TRUE.HashKey(): 5,
+		object.FALSE.HashKey(): 6,
 	}
 	
 	if len(result.Pairs) != len(expected) {
@@ -465,6 +596,10 @@ func TestErrorHandling(t *testing.T) {
 				}
 			`, "unknown operator: BOOLEAN + BOOLEAN",
 		},
+		{
+			"10 / (5 - 5)",
+			"division by zero",
+		},
 		{
 			"foobar",
 			"identifier not found: foobar",
@@ -477,6 +612,10 @@ func TestErrorHandling(t *testing.T) {
 			`{"name": "Monkey"}[fn(x) { x }];`,
 			"unusable as hash key: FUNCTION",
 		},
+		{
+			"let f = fn() { 1 + f() }; f()",
+			"stack overflow",
+		},
 	}
 
 	for _, tt := range tests {
@@ -494,6 +633,256 @@ func TestErrorHandling(t *testing.T) {
 	}
 }
 
+func TestMethodCalls(t *testing.T) {
+	tests := []struct {
+		input string
+		expected interface{}
+	} {
+		{`[1, 2, 3].len()`, 3},
+		{`"four".len()`, 4},
+		{`{1: 2, 3: 4}.len()`, 2},
+		{`[1, 2].push(3)`, []int{1, 2, 3}},
+		{`[1, 2, 3].rest().first()`, 2},
+		{`impl Integer { fn add(self, x) { self + x } }; 1.add(2).add(3)`, 6},
+		{`
+		impl Array {
+			fn sum(self) {
+				if (self.len() == 0) {
+					0
+				} else {
+					self.first() + self.rest().sum()
+				}
+			}
+		}
+		[1, 2, 3, 4].sum()
+		`, 10},
+		{`let f = fn() { impl Integer { fn one(self) { 1 } } }; f(); 5.one()`, 1},
+		{`impl String { fn len(self) { 42 } }; "abc".len()`, 42},
+		{`1.len()`, "undefined method len for INTEGER"},
+		{`impl Point { fn norm(self) { 0 } }`, "unknown type Point"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case []int:
+			testArrayObject(t, evaluated, expected)
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object is not Error. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		}
+	}
+}
+
+func TestNamedFunctions(t *testing.T) {
+	tests := []struct {
+		input string
+		expected int64
+	} {
+		{`fn add(a, b) { a + b } add(1, 2)`, 3},
+		{`fn fact(n) { if (n == 0) { 1 } else { n * fact(n - 1) } }; fact(5)`, 120},
+		{`let wrapper = fn() { fn countDown(x) { if (x == 0) { 0 } else { countDown(x - 1) } } countDown(3) }; wrapper()`, 0},
+	}
+
+	for _, tt := range tests {
+		testIntegerObject(t, testEval(tt.input), tt.expected)
+	}
+
+	evaluated := testEval(`fn add(a, b) { a + b } add`)
+	fn, ok := evaluated.(*object.Function)
+	if !ok {
+		t.Fatalf("object is not Function. got=%T (%+v)", evaluated, evaluated)
+	}
+
+	if fn.Name != "add" {
+		t.Errorf("function has wrong name. want=%q, got=%q", "add", fn.Name)
+	}
+}
+
+func TestDefaultAndRestParameters(t *testing.T) {
+	tests := []struct {
+		input string
+		expected interface{}
+	} {
+		{`fn(a, b = 10) { a + b }(1)`, 11},
+		{`fn(a, b = 10) { a + b }(1, 2)`, 3},
+		{`fn(a = 1, b = a * 2) { a + b }()`, 3},
+		{`let f = fn(x = []) { push(x, 1) }; f(); f()`, []int{1}},
+		{`fn(...rest) { rest }(1, 2, 3)`, []int{1, 2, 3}},
+		{`fn(a, b = 2, ...rest) { [a, b, len(rest)] }(1, 5, 6, 7)`, []int{1, 5, 2}},
+		{`let f = fn(...xs) { xs }; f(1, ...[2, 3], 4, ...[])`, []int{1, 2, 3, 4}},
+		{`let add = fn(a, b) { a + b }; add(...[1, 2])`, 3},
+		{`impl Integer { fn plus(self, x = 1) { self + x } }; 5.plus() + 5.plus(10)`, 21},
+		{`fn(a) { a }()`, "wrong number of arguments: want=1, got=0"},
+		{`fn(a, b = 1) { a + b }(1, 2, 3)`, "wrong number of arguments: want=1..2, got=3"},
+		{`fn(a, ...rest) { a }()`, "wrong number of arguments: want=at least 1, got=0"},
+		{`fn add(a, b) { a + b } add(1)`, "wrong number of arguments to add: want=2, got=1"},
+		{`fn(a = b) { a }()`, "identifier not found: b"},
+		{`fn(a) { a }(...1)`, "spread argument must be ARRAY, got INTEGER"},
+		{`[...[1]]`, "spread arguments are only supported in function calls"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case []int:
+			testArrayObject(t, evaluated, expected)
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object is not Error. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		}
+	}
+}
+
+func TestMatchExpressions(t *testing.T) {
+	tests := []struct {
+		input string
+		expected interface{}
+	} {
+		{`match 0 { 0 => 10, _ => 20 }`, 10},
+		{`match 5 { 0 => 10, _ => 20 }`, 20},
+		{`match -1 { 1 => 1, -1 => 2 }`, 2},
+		{`match "b" { "a" => 1, "b" => 2 }`, 2},
+		{`match "1" { 1 => 1, _ => 2 }`, 2},
+		{`match 3 { 1 => 1, 2 => 2 }`, nil},
+		{`match [1, 2] { [a] => a, [a, b] => a + b, _ => 0 }`, 3},
+		{`match [1, [2, 3]] { [a, [b, c]] => a + b + c }`, 6},
+		{`match [3, 2] { [1, x] => x, _ => 0 }`, 0},
+		{`match {"type": "x", "v": 7} { {"type": "y", "v": v} => 0, {"type": "x", "v": v} => v }`, 7},
+		{`match {"v": 7} { {"type": "x"} => 0, {} => 1 }`, 1},
+		{`match 12 { n if n > 10 => n * 2, n => n }`, 24},
+		{`match 8 { n if n > 10 => n * 2, n => n }`, 8},
+		{`let x = 1; match 2 { x => x }; x`, 1},
+		{`match 1 { x => x }; x`, "identifier not found: x"},
+		{`let sum = fn(arr) { match len(arr) { 0 => 0, _ => first(arr) + sum(rest(arr)) } }; sum([1, 2, 3, 4])`, 10},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object is not Error. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		default:
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestDestructuringLetStatements(t *testing.T) {
+	tests := []struct {
+		input string
+		strict bool
+		expected interface{}
+	} {
+		{`let [a, b] = [1, 2]; a + b`, false, 3},
+		{`let [a, b] = [1]; b`, false, nil},
+		{`let [a, ...rest] = [1, 2, 3]; rest`, false, []int{2, 3}},
+		{`let [a, b, ...rest] = [1]; rest`, false, []int{}},
+		{`let {name, age} = {"name": 1, "age": 2}; name + age`, false, 3},
+		{`let {name, missing} = {"name": 1}; missing`, false, nil},
+		{`let swap = fn(pair) { let [a, b] = pair; [b, a] }; swap([1, 2])`, false, []int{2, 1}},
+		{`let [a] = 1;`, false, "cannot destructure INTEGER as an array"},
+		{`let {a} = [1];`, false, "cannot destructure ARRAY as a hash"},
+		{`let [a, b] = [1];`, true, "missing element 1 in destructuring, array has 1 elements"},
+		{`let {name, age} = {"name": 1};`, true, "missing key age in destructuring"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := parser.New(l)
+		program := p.ParseProgram()
+		env := object.NewEnvironment()
+		env.SetStrict(tt.strict)
+
+		evaluated := Eval(program, env)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case []int:
+			testArrayObject(t, evaluated, expected)
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object is not Error. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		default:
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestValuesFromGo(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		input string
+		expected interface{}
+	} {
+		{false, `if (x) { 1 } else { 2 }`, 2},
+		{false, `!x`, true},
+		{true, `if (x) { 1 } else { 2 }`, 1},
+		{nil, `if (x) { 1 } else { 2 }`, 2},
+		{nil, `!x`, true},
+		{nil, `x`, nil},
+	}
+
+	for _, tt := range tests {
+		value, err := object.FromGo(tt.value)
+		if err != nil {
+			t.Fatalf("FromGo(%v) failed: %s", tt.value, err)
+		}
+
+		l := lexer.New(tt.input)
+		p := parser.New(l)
+		program := p.ParseProgram()
+		env := object.NewEnvironment()
+		env.Set("x", value)
+
+		evaluated := Eval(program, env)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		default:
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
 func testEval(input string) object.Object {
 	l := lexer.New(input)
 	p := parser.New(l)
@@ -555,7 +944,7 @@ func testArrayObject(t *testing.T, obj object.Object, expected []int) bool {
 }
 
 func testNullObject(t *testing.T, obj object.Object) bool {
-	if obj != NULL {
+	if obj != object.NULL {
 		t.Errorf("object is not NULL. got=%T (%+v)", obj, obj)
 		return false
 	}
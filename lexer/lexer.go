@@ -7,9 +7,14 @@ type Lexer struct {
 	position int // current position in input (points to current char)
 	readPosition int // current reading position in input (after current char) 
 	ch byte // current char under examination
+	line int // line of the current char, starting at 1
 }
 
 func (l *Lexer) readChar() {
+	if l.ch == '\n' { // Leaving a newline behind means the next char is on the following line
+		l.line++
+	}
+
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
 	} else {
@@ -60,7 +65,7 @@ func (l *Lexer) skipWhitespace() {
 }
 
 func New(input string) *Lexer {
-	l := &Lexer{input: input}
+	l := &Lexer{input: input, line: 1}
 	l.readChar()
 	return l
 }
@@ -69,6 +74,7 @@ func (l *Lexer) NextToken() token.Token {
 	var tok token.Token
 
 	l.skipWhitespace()
+	line := l.line // Taken before reading the token, a string literal may span several lines
 
 	switch l.ch {
 		case '=':
@@ -77,6 +83,10 @@ func (l *Lexer) NextToken() token.Token {
 				l.readChar()
 				tok = token.Token{Type: token.EQ, Literal: string(ch) + string(l.ch)}
 
+			} else if l.peekChar() == '>' {
+				ch := l.ch
+				l.readChar()
+				tok = token.Token{Type: token.ARROW, Literal: string(ch) + string(l.ch)}
 			} else {
 				tok = newToken(token.ASSIGN, l.ch)
 			}
@@ -104,6 +114,14 @@ func (l *Lexer) NextToken() token.Token {
 			tok = newToken(token.SEMICOLON, l.ch)
 		case ':':
 			tok = newToken(token.COLON, l.ch)
+		case '.':
+			if l.peekChar() == '.' && l.readPosition+1 < len(l.input) && l.input[l.readPosition+1] == '.' {
+				l.readChar()
+				l.readChar()
+				tok = token.Token{Type: token.ELLIPSIS, Literal: "..."}
+			} else {
+				tok = newToken(token.DOT, l.ch)
+			}
 		case '(':
 			tok = newToken(token.LPAREN, l.ch)
 		case ')':
@@ -125,10 +143,12 @@ func (l *Lexer) NextToken() token.Token {
 			if isLetter(l.ch) {
 				tok.Literal = l.readIdentifier()
 				tok.Type = token.LookupIndent(tok.Literal)
+				tok.Line = line
 				return tok
 			} else if isDigit(l.ch) {
 				tok.Type = token.INT
 				tok.Literal = l.readNumber()
+				tok.Line = line
 				return tok
 			} else {
 				tok = newToken(token.ILLEGAL, l.ch)
@@ -138,6 +158,7 @@ func (l *Lexer) NextToken() token.Token {
 			tok.Type = token.EOF  
 	}
 	
+	tok.Line = line
 	l.readChar()
 	return tok
 }
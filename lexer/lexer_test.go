@@ -31,6 +31,10 @@ func TestNextToken(t *testing.T) {
 	"foo bar"
 	[1, 2];
 	{"foo":"bar"}
+	impl Array { fn sum(self) {} }
+	arr.len();
+	match x { _ => 1 }
+	let [a, ...b] = c;
 	`
 
 	tests := []struct {
@@ -123,6 +127,40 @@ func TestNextToken(t *testing.T) {
 		{token.COLON, ":"},
 		{token.STRING, "bar"},
 		{token.RBRACE, "}"},
+		{token.IMPL, "impl"},
+		{token.IDENT, "Array"},
+		{token.LBRACE, "{"},
+		{token.FUNCTION, "fn"},
+		{token.IDENT, "sum"},
+		{token.LPAREN, "("},
+		{token.IDENT, "self"},
+		{token.RPAREN, ")"},
+		{token.LBRACE, "{"},
+		{token.RBRACE, "}"},
+		{token.RBRACE, "}"},
+		{token.IDENT, "arr"},
+		{token.DOT, "."},
+		{token.IDENT, "len"},
+		{token.LPAREN, "("},
+		{token.RPAREN, ")"},
+		{token.SEMICOLON, ";"},
+		{token.MATCH, "match"},
+		{token.IDENT, "x"},
+		{token.LBRACE, "{"},
+		{token.IDENT, "_"},
+		{token.ARROW, "=>"},
+		{token.INT, "1"},
+		{token.RBRACE, "}"},
+		{token.LET, "let"},
+		{token.LBRACKET, "["},
+		{token.IDENT, "a"},
+		{token.COMMA, ","},
+		{token.ELLIPSIS, "..."},
+		{token.IDENT, "b"},
+		{token.RBRACKET, "]"},
+		{token.ASSIGN, "="},
+		{token.IDENT, "c"},
+		{token.SEMICOLON, ";"},
 		{token.EOF, ""},
 	}
 
@@ -141,4 +179,43 @@ func TestNextToken(t *testing.T) {
 			i, tt.expectedLiteral, tok.Literal)
 		}
 	}
-}
\ No newline at end of file
+}
+func TestTokenLines(t *testing.T) {
+	input := `let x = 5;
+
+let s = "two
+lines";
+x`
+
+	tests := []struct {
+		expectedLiteral string
+		expectedLine int
+	}{
+		{"let", 1},
+		{"x", 1},
+		{"=", 1},
+		{"5", 1},
+		{";", 1},
+		{"let", 3},
+		{"s", 3},
+		{"=", 3},
+		{"two\nlines", 3}, // A token starts on the line of its first character
+		{";", 4},
+		{"x", 5},
+		{"", 5},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+
+		if tok.Line != tt.expectedLine {
+			t.Fatalf("tests[%d] - line wrong for %q. expected=%d, got=%d", i, tok.Literal, tt.expectedLine, tok.Line)
+		}
+	}
+}
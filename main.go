@@ -1,20 +1,10 @@
 package main
 
 import (
-	"fmt"
 	"os"
-	"os/user"
-	"compiler/repl"
+	"compiler/cli"
 )
 
 func main() {
-	user, err := user.Current()
-	
-	if err != nil {
-		panic(err)
-	}
-
-	fmt.Printf("Hello %s! This is my programming language!\n", user.Username)
-	fmt.Printf("Feel free to type in commands\n")
-	repl.Start(os.Stdin, os.Stdout)
-}
\ No newline at end of file
+	os.Exit(cli.Main(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
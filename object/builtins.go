@@ -17,9 +17,11 @@ var Builtins = []struct {
 
 			switch arg := args[0].(type) {
 			case *Array:
-				return &Integer{Value: int64(len(arg.Elements))}
+				return NewInteger(int64(len(arg.Elements)))
 			case *String:
-				return &Integer{Value: int64(len(arg.Value))}
+				return NewInteger(int64(len(arg.Value)))
+			case *Hash:
+				return NewInteger(int64(len(arg.Pairs)))
 			default:
 				return newError("argument to `len` not supported, got=%s", args[0].Type())
 			}
@@ -87,7 +89,13 @@ var Builtins = []struct {
 			}
 			
 			return nil
-		},},
+		}, Size: func(args ...Object) int64 {
+			if arr, ok := arrayArgument(args, 1); ok && len(arr.Elements) > 0 {
+				return ArraySize(len(arr.Elements) - 1)
+			}
+
+			return 0
+		}},
 	},
 	{
 		"push",
@@ -109,7 +117,13 @@ var Builtins = []struct {
 			newElements[length] = args[1]
 
 			return &Array{Elements: newElements}
-		},},
+		}, Size: func(args ...Object) int64 {
+			if arr, ok := arrayArgument(args, 2); ok {
+				return ArraySize(len(arr.Elements) + 1)
+			}
+
+			return 0
+		}},
 	},
 	{
 		"puts",
@@ -123,6 +137,16 @@ var Builtins = []struct {
 	},
 }
 
+// The array a builtin taking numArgs arguments is called on, when the call is a valid one
+func arrayArgument(args []Object, numArgs int) (*Array, bool) {
+	if len(args) != numArgs {
+		return nil, false
+	}
+
+	arr, ok := args[0].(*Array)
+	return arr, ok
+}
+
 func GetBuiltinByName(name string) *Builtin {
 	for _, def := range Builtins {
 		if def.Name == name {
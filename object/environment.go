@@ -1,13 +1,18 @@
 package object
 
+import "sort"
+
 func NewEnvironment() *Environment {
 	s := make(map[string]Object)
-	return &Environment{store: s, outer: nil}
+	return &Environment{store: s, outer: nil, meter: &Meter{}}
 }
 
 type Environment struct {
 	store map[string]Object
 	outer *Environment
+	methods MethodTable // Only the outermost environment holds methods, so impl blocks are visible everywhere like they are in the VM
+	strict bool // Also only set on the outermost environment
+	meter *Meter // Shared with the outermost environment, copied rather than looked up since every evaluation step uses it
 }
 
 func (e *Environment) Get(name string) (Object, bool) {
@@ -24,10 +29,60 @@ func (e *Environment) Set(name string, val Object) Object {
 	return val
 }
 
+// Names lists the bindings of this environment only, not the ones of enclosing environments
+func (e *Environment) Names() []string {
+	names := make([]string, 0, len(e.store))
+	for name := range e.store {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
 func NewEnclosedEnvironment(outer *Environment) *Environment {
-	env := NewEnvironment()
-	env.outer = outer
+	return &Environment{store: make(map[string]Object), outer: outer, meter: outer.meter}
+}
 
-	return env
+func (e *Environment) Meter() *Meter {
+	return e.meter
 }
 
+func (e *Environment) GetMethod(t ObjectType, name string) (Object, bool) {
+	if e.outer != nil {
+		return e.outer.GetMethod(t, name)
+	}
+
+	return e.methods.Get(t, name)
+}
+
+func (e *Environment) SetMethod(t ObjectType, name string, method Object) {
+	if e.outer != nil {
+		e.outer.SetMethod(t, name, method)
+		return
+	}
+
+	if e.methods == nil {
+		e.methods = NewMethodTable()
+	}
+
+	e.methods.Set(t, name, method)
+}
+
+// Strict mode turns missing elements or keys in a destructuring let into errors instead of null bindings
+func (e *Environment) SetStrict(strict bool) {
+	if e.outer != nil {
+		e.outer.SetStrict(strict)
+		return
+	}
+
+	e.strict = strict
+}
+
+func (e *Environment) Strict() bool {
+	if e.outer != nil {
+		return e.outer.Strict()
+	}
+
+	return e.strict
+}
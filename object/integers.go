@@ -0,0 +1,25 @@
+package object
+
+// The integers between SmallIntMin and SmallIntMax are allocated once and shared, loop counters, indexes and
+// lengths mostly fall in this range. Sharing is safe because nothing changes an Integer after it is made.
+const (
+	SmallIntMin = -128
+	SmallIntMax = 1024
+)
+
+var smallInts = func() []*Integer {
+	ints := make([]*Integer, SmallIntMax-SmallIntMin+1)
+	for i := range ints {
+		ints[i] = &Integer{Value: int64(i + SmallIntMin)}
+	}
+	return ints
+}()
+
+// NewInteger returns the shared Integer for small values and allocates a new one otherwise
+func NewInteger(value int64) *Integer {
+	if value >= SmallIntMin && value <= SmallIntMax {
+		return smallInts[value-SmallIntMin]
+	}
+
+	return &Integer{Value: value}
+}
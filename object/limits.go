@@ -0,0 +1,130 @@
+package object
+
+import (
+	"context"
+	"fmt"
+)
+
+// Limits bound a single run of the VM or the evaluator, so a host can run scripts it doesn't trust. A
+// zero field means no limit beyond the engine's own fixed sizes.
+type Limits struct {
+	MaxInstructions int64 // Instructions executed by the VM, nodes evaluated by the evaluator
+	MaxDepth int // Calls in progress at once
+	MaxStack int // Stack slots of the VM, registers of the register VM
+	MaxMemory int64 // Bytes of strings, arrays and hashes held at once, the VMs only
+}
+
+type LimitKind int
+
+const (
+	InstructionLimit LimitKind = iota
+	DepthLimit
+	StackLimit
+	MemoryLimit
+	Cancelled // The run's context was cancelled or its deadline passed
+)
+
+// LimitError is the error a run stops with when it hits one of its Limits or its context is done, hosts
+// can tell it apart from an error in the script with errors.As
+type LimitError struct {
+	Kind LimitKind
+	Limit int64 // The limit that was hit, unused for Cancelled
+	Err error // The context's error for Cancelled
+}
+
+func (e *LimitError) Error() string {
+	switch e.Kind {
+	case InstructionLimit:
+		return fmt.Sprintf("instruction limit exceeded: %d", e.Limit)
+	case MemoryLimit:
+		return fmt.Sprintf("memory limit exceeded: %d bytes", e.Limit)
+	case Cancelled:
+		return fmt.Sprintf("execution stopped: %s", e.Err)
+	default: // Same message as when the engine's own fixed sizes run out
+		return "stack overflow"
+	}
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// CancelCheckInterval is how many steps or instructions the Meter and both VMs run between two looks at
+// the context, checking a channel on every step costs too much
+const CancelCheckInterval = 1024
+
+// MaxDepth bounds the calls of every evaluator run, like MaxFrames does the VMs', so runaway recursion
+// ends in an error rather than overflowing the Go stack. Limits.MaxDepth can only lower it.
+const MaxDepth = 1024
+
+// Meter counts the work of an evaluator run against its Limits. An environment shares its meter with
+// every environment enclosed in it, so closures made in an earlier run are metered by the current one.
+type Meter struct {
+	active bool
+	limits Limits
+	ctx context.Context
+	steps int64
+	depth int
+	err *LimitError // The limit that stopped the run, later steps keep failing with it so the run unwinds
+}
+
+// Start resets the meter for a new run, Stop lifts its limits again afterwards. The depth is kept, a run
+// can start inside a call of another one.
+func (m *Meter) Start(ctx context.Context, limits Limits) {
+	*m = Meter{active: true, limits: limits, ctx: ctx, depth: m.depth}
+}
+
+func (m *Meter) Stop() {
+	*m = Meter{depth: m.depth}
+}
+
+// Err is the limit the run hit, nil if it hit none
+func (m *Meter) Err() *LimitError {
+	return m.err
+}
+
+func (m *Meter) Step() *LimitError {
+	if !m.active || m.err != nil {
+		return m.err
+	}
+
+	if m.steps%CancelCheckInterval == 0 && m.ctx.Err() != nil {
+		m.err = &LimitError{Kind: Cancelled, Err: m.ctx.Err()}
+		return m.err
+	}
+
+	m.steps++
+	if m.limits.MaxInstructions > 0 && m.steps > m.limits.MaxInstructions {
+		m.err = &LimitError{Kind: InstructionLimit, Limit: m.limits.MaxInstructions}
+	}
+
+	return m.err
+}
+
+// Enter counts a call starting, every call that entered successfully must Leave. Depth is counted
+// outside of a run too, MaxDepth always applies.
+func (m *Meter) Enter() *LimitError {
+	if m.err != nil {
+		return m.err
+	}
+
+	limit := MaxDepth
+	if m.active && m.limits.MaxDepth > 0 && m.limits.MaxDepth < limit {
+		limit = m.limits.MaxDepth
+	}
+
+	if m.depth >= limit {
+		err := &LimitError{Kind: DepthLimit, Limit: int64(limit)}
+		if m.active {
+			m.err = err
+		}
+		return err
+	}
+
+	m.depth++
+	return nil
+}
+
+func (m *Meter) Leave() {
+	m.depth--
+}
@@ -0,0 +1,442 @@
+package object
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// ConversionError says what couldn't be converted between Go and Celeste, and where in the value it was
+type ConversionError struct {
+	Path string // Like [2].name, empty when it's the value itself
+	Message string
+}
+
+func (e *ConversionError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+
+	return fmt.Sprintf("%s: %s", strings.TrimPrefix(e.Path, "."), e.Message)
+}
+
+func conversionError(path string, format string, a ...interface{}) *ConversionError {
+	return &ConversionError{Path: path, Message: fmt.Sprintf(format, a...)}
+}
+
+var objectType = reflect.TypeOf((*Object)(nil)).Elem()
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// FromGo converts a Go value: integers, booleans, strings, slices and arrays, maps whose keys convert to
+// something hashable, structs and functions. A struct becomes a hash of its exported fields, named by
+// their celeste tag when they have one, and a tag of "-" leaves the field out. Nil becomes null, and an
+// Object is returned as it is.
+func FromGo(v interface{}) (Object, error) {
+	if v == nil {
+		return NULL, nil
+	}
+
+	return fromGo(reflect.ValueOf(v), "")
+}
+
+func fromGo(v reflect.Value, path string) (Object, error) {
+	if v.Type().Implements(objectType) && v.Kind() != reflect.Interface {
+		if v.Kind() == reflect.Pointer && v.IsNil() {
+			return NULL, nil
+		}
+		return v.Interface().(Object), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return TRUE, nil
+		}
+		return FALSE, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return NewInteger(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() > math.MaxInt64 {
+			return nil, conversionError(path, "%d overflows INTEGER", v.Uint())
+		}
+		return NewInteger(int64(v.Uint())), nil
+	case reflect.String:
+		return &String{Value: v.String()}, nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return &Array{Elements: []Object{}}, nil
+		}
+
+		elements := make([]Object, v.Len())
+		for i := range elements {
+			element, err := fromGo(v.Index(i), fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = element
+		}
+		return &Array{Elements: elements}, nil
+	case reflect.Map:
+		pairs := make(map[HashKey]HashPair, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			keyPath := fmt.Sprintf("%s[%v]", path, iter.Key().Interface())
+
+			key, err := fromGo(iter.Key(), keyPath)
+			if err != nil {
+				return nil, err
+			}
+			hashable, ok := key.(Hashable)
+			if !ok {
+				return nil, conversionError(keyPath, "unusable as hash key: %s", key.Type())
+			}
+
+			value, err := fromGo(iter.Value(), keyPath)
+			if err != nil {
+				return nil, err
+			}
+			pairs[hashable.HashKey()] = HashPair{Key: key, Value: value}
+		}
+		return &Hash{Pairs: pairs}, nil
+	case reflect.Struct:
+		pairs := map[HashKey]HashPair{}
+		for _, field := range reflect.VisibleFields(v.Type()) {
+			name, ok := fieldName(field)
+			if !ok {
+				continue
+			}
+
+			value, err := fromGo(v.FieldByIndex(field.Index), path+"."+name)
+			if err != nil {
+				return nil, err
+			}
+
+			key := &String{Value: name}
+			pairs[key.HashKey()] = HashPair{Key: key, Value: value}
+		}
+		return &Hash{Pairs: pairs}, nil
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return NULL, nil
+		}
+		return fromGo(v.Elem(), path)
+	case reflect.Func:
+		if v.IsNil() {
+			return NULL, nil
+		}
+		return WrapFunc(v.Interface())
+	default:
+		return nil, conversionError(path, "cannot convert %s to a Celeste value", v.Type())
+	}
+}
+
+// The key a field goes under in a hash, false for fields that are left out
+func fieldName(field reflect.StructField) (string, bool) {
+	if !field.IsExported() || field.Anonymous {
+		return "", false
+	}
+
+	tag := field.Tag.Get("celeste")
+	switch tag {
+	case "-":
+		return "", false
+	case "":
+		return field.Name, true
+	default:
+		return tag, true
+	}
+}
+
+// ToGo stores obj in the value target points to, converting it the opposite way FromGo does. Into an
+// interface{} an integer becomes an int64, an array a []interface{} and a hash a map[string]interface{},
+// or a map[interface{}]interface{} when its keys aren't all strings. Functions only go into an Object or
+// an interface{} as they are, a closure needs a VM to run so it can't become a Go function. A nil obj,
+// like an undefined global, converts as null.
+func ToGo(obj Object, target interface{}) error {
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return &ConversionError{Message: fmt.Sprintf("target must be a non-nil pointer, got %T", target)}
+	}
+
+	return toGo(obj, v.Elem(), "")
+}
+
+func toGo(obj Object, v reflect.Value, path string) error {
+	if obj == nil {
+		obj = NULL
+	}
+
+	if reflect.TypeOf(obj).AssignableTo(v.Type()) && (v.Kind() != reflect.Interface || v.NumMethod() > 0) { // Like a *Array field, or an Object
+		v.Set(reflect.ValueOf(obj))
+		return nil
+	}
+
+	if _, ok := obj.(*Null); ok {
+		switch v.Kind() {
+		case reflect.Pointer, reflect.Interface, reflect.Slice, reflect.Map, reflect.Func:
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return conversionError(path, "cannot convert %s to %s", obj.Type(), v.Type())
+		}
+
+		natural, err := naturalGo(obj, path)
+		if err != nil {
+			return err
+		}
+		if natural == nil {
+			v.Set(reflect.Zero(v.Type()))
+		} else {
+			v.Set(reflect.ValueOf(natural))
+		}
+		return nil
+	case reflect.Bool:
+		b, ok := obj.(*Boolean)
+		if !ok {
+			return conversionError(path, "cannot convert %s to %s", obj.Type(), v.Type())
+		}
+		v.SetBool(b.Value)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := obj.(*Integer)
+		if !ok {
+			return conversionError(path, "cannot convert %s to %s", obj.Type(), v.Type())
+		}
+		if v.OverflowInt(i.Value) {
+			return conversionError(path, "%d overflows %s", i.Value, v.Type())
+		}
+		v.SetInt(i.Value)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i, ok := obj.(*Integer)
+		if !ok {
+			return conversionError(path, "cannot convert %s to %s", obj.Type(), v.Type())
+		}
+		if i.Value < 0 || v.OverflowUint(uint64(i.Value)) {
+			return conversionError(path, "%d overflows %s", i.Value, v.Type())
+		}
+		v.SetUint(uint64(i.Value))
+		return nil
+	case reflect.String:
+		s, ok := obj.(*String)
+		if !ok {
+			return conversionError(path, "cannot convert %s to %s", obj.Type(), v.Type())
+		}
+		v.SetString(s.Value)
+		return nil
+	case reflect.Slice, reflect.Array:
+		arr, ok := obj.(*Array)
+		if !ok {
+			return conversionError(path, "cannot convert %s to %s", obj.Type(), v.Type())
+		}
+
+		if v.Kind() == reflect.Array && v.Len() != len(arr.Elements) {
+			return conversionError(path, "cannot convert an array of %d elements to %s", len(arr.Elements), v.Type())
+		}
+		if v.Kind() == reflect.Slice {
+			v.Set(reflect.MakeSlice(v.Type(), len(arr.Elements), len(arr.Elements)))
+		}
+
+		for i, element := range arr.Elements {
+			err := toGo(element, v.Index(i), fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		hash, ok := obj.(*Hash)
+		if !ok {
+			return conversionError(path, "cannot convert %s to %s", obj.Type(), v.Type())
+		}
+
+		m := reflect.MakeMapWithSize(v.Type(), len(hash.Pairs))
+		for _, pair := range hash.Pairs {
+			keyPath := fmt.Sprintf("%s[%s]", path, pair.Key.Inspect())
+
+			key := reflect.New(v.Type().Key()).Elem()
+			err := toGo(pair.Key, key, keyPath)
+			if err != nil {
+				return err
+			}
+
+			value := reflect.New(v.Type().Elem()).Elem()
+			err = toGo(pair.Value, value, keyPath)
+			if err != nil {
+				return err
+			}
+
+			m.SetMapIndex(key, value)
+		}
+		v.Set(m)
+		return nil
+	case reflect.Struct:
+		hash, ok := obj.(*Hash)
+		if !ok {
+			return conversionError(path, "cannot convert %s to %s", obj.Type(), v.Type())
+		}
+
+		for _, field := range reflect.VisibleFields(v.Type()) {
+			name, ok := fieldName(field)
+			if !ok {
+				continue
+			}
+
+			pair, found := hash.Pairs[(&String{Value: name}).HashKey()]
+			if !found { // Missing keys leave the field as it was
+				continue
+			}
+
+			err := toGo(pair.Value, v.FieldByIndex(field.Index), path+"."+name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Pointer:
+		target := reflect.New(v.Type().Elem())
+		err := toGo(obj, target.Elem(), path)
+		if err != nil {
+			return err
+		}
+		v.Set(target)
+		return nil
+	default:
+		return conversionError(path, "cannot convert %s to %s", obj.Type(), v.Type())
+	}
+}
+
+// The Go value an object is most like, for targets of type interface{}
+func naturalGo(obj Object, path string) (interface{}, error) {
+	switch obj := obj.(type) {
+	case *Null:
+		return nil, nil
+	case *Integer:
+		return obj.Value, nil
+	case *Boolean:
+		return obj.Value, nil
+	case *String:
+		return obj.Value, nil
+	case *Array:
+		elements := make([]interface{}, len(obj.Elements))
+		for i, element := range obj.Elements {
+			natural, err := naturalGo(element, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = natural
+		}
+		return elements, nil
+	case *Hash:
+		stringKeys := true
+		for _, pair := range obj.Pairs {
+			if _, ok := pair.Key.(*String); !ok {
+				stringKeys = false
+			}
+		}
+
+		if stringKeys {
+			m := make(map[string]interface{}, len(obj.Pairs))
+			for _, pair := range obj.Pairs {
+				name := pair.Key.(*String).Value
+				natural, err := naturalGo(pair.Value, path+"."+name)
+				if err != nil {
+					return nil, err
+				}
+				m[name] = natural
+			}
+			return m, nil
+		}
+
+		m := make(map[interface{}]interface{}, len(obj.Pairs))
+		for _, pair := range obj.Pairs {
+			keyPath := fmt.Sprintf("%s[%s]", path, pair.Key.Inspect())
+			key, err := naturalGo(pair.Key, keyPath)
+			if err != nil {
+				return nil, err
+			}
+			natural, err := naturalGo(pair.Value, keyPath)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = natural
+		}
+		return m, nil
+	default: // Functions have no plainer Go form than the object
+		return obj, nil
+	}
+}
+
+// WrapFunc makes a builtin of a Go function whose parameters ToGo can fill and whose result FromGo can
+// convert. A function with the BuiltinFunction signature is used as it is. The last result may be an
+// error, a call returning a non-nil one gives an error object like a failing builtin does.
+func WrapFunc(fn interface{}) (*Builtin, error) {
+	switch fn := fn.(type) {
+	case BuiltinFunction:
+		return &Builtin{Fn: fn}, nil
+	case func(...Object) Object:
+		return &Builtin{Fn: fn}, nil
+	}
+
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		return nil, &ConversionError{Message: fmt.Sprintf("cannot wrap %T, it is not a function", fn)}
+	}
+
+	t := v.Type()
+	returnsError := t.NumOut() > 0 && t.Out(t.NumOut()-1) == errorType
+	if t.NumOut() > 2 || (t.NumOut() == 2 && !returnsError) {
+		return nil, &ConversionError{Message: fmt.Sprintf("cannot wrap %s, it may only return a value, an error or both", t)}
+	}
+
+	return &Builtin{Fn: func(args ...Object) Object {
+		numIn := t.NumIn()
+		if t.IsVariadic() && len(args) < numIn-1 {
+			return newError("wrong number of arguments. got=%d, want at least %d", len(args), numIn-1)
+		}
+		if !t.IsVariadic() && len(args) != numIn {
+			return newError("wrong number of arguments. got=%d, want=%d", len(args), numIn)
+		}
+
+		in := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			var paramType reflect.Type
+			if t.IsVariadic() && i >= numIn-1 {
+				paramType = t.In(numIn - 1).Elem()
+			} else {
+				paramType = t.In(i)
+			}
+
+			param := reflect.New(paramType).Elem()
+			err := toGo(arg, param, "")
+			if err != nil {
+				return newError("argument %d: %s", i+1, err)
+			}
+			in[i] = param
+		}
+
+		out := v.Call(in)
+		if returnsError {
+			if err := out[len(out)-1].Interface(); err != nil {
+				return newError("%s", err)
+			}
+			out = out[:len(out)-1]
+		}
+
+		if len(out) == 0 {
+			return nil
+		}
+
+		result, err := fromGo(out[0], "")
+		if err != nil {
+			return newError("result: %s", err)
+		}
+		return result
+	}}, nil
+}
@@ -0,0 +1,308 @@
+package object
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+type address struct {
+	City string `celeste:"city"`
+	Zip int `celeste:"zip"`
+}
+
+type person struct {
+	Name string `celeste:"name"`
+	Age int
+	Tags []string `celeste:"tags"`
+	Home *address `celeste:"home"`
+	Secret string `celeste:"-"`
+	internal int
+}
+
+func TestFromGo(t *testing.T) {
+	tests := []struct {
+		input interface{}
+		expected string
+	}{
+		{nil, "null"},
+		{42, "42"},
+		{uint8(7), "7"},
+		{true, "true"},
+		{"hi", "hi"},
+		{[]int{1, 2, 3}, "[1, 2, 3]"},
+		{[2]bool{true, false}, "[true, false]"},
+		{[]string(nil), "[]"},
+		{map[string]int{"a": 1}, "{a: 1}"},
+		{map[int][]int{1: {2}}, "{1: [2]}"},
+		{(*address)(nil), "null"},
+		{&struct{ City string `celeste:"city"` }{"Oslo"}, "{city: Oslo}"},
+		{[]interface{}{1, "a", nil, NewInteger(5)}, "[1, a, null, 5]"},
+	}
+
+	for _, tt := range tests {
+		obj, err := FromGo(tt.input)
+		if err != nil {
+			t.Errorf("FromGo(%#v) failed: %s", tt.input, err)
+			continue
+		}
+
+		if obj.Inspect() != tt.expected { // Hashes print in map order, so the ones here have a single pair
+			t.Errorf("FromGo(%#v) wrong. want=%s, got=%s", tt.input, tt.expected, obj.Inspect())
+		}
+	}
+}
+
+func TestFromGoStruct(t *testing.T) {
+	obj, err := FromGo(person{Name: "Ada", Age: 36, Tags: []string{"x"}, Secret: "s", internal: 1})
+	if err != nil {
+		t.Fatalf("FromGo failed: %s", err)
+	}
+
+	hash, ok := obj.(*Hash)
+	if !ok {
+		t.Fatalf("object is not Hash. got=%T", obj)
+	}
+
+	expected := map[string]string{"name": "Ada", "Age": "36", "tags": "[x]", "home": "null"}
+	if len(hash.Pairs) != len(expected) {
+		t.Errorf("wrong number of pairs. want=%d, got=%d", len(expected), len(hash.Pairs))
+	}
+
+	for key, value := range expected {
+		pair, ok := hash.Pairs[(&String{Value: key}).HashKey()]
+		if !ok {
+			t.Errorf("no pair for %q", key)
+			continue
+		}
+		if pair.Value.Inspect() != value {
+			t.Errorf("wrong value for %q. want=%s, got=%s", key, value, pair.Value.Inspect())
+		}
+	}
+}
+
+func TestFromGoErrors(t *testing.T) {
+	tests := []struct {
+		input interface{}
+		expected string
+	}{
+		{1.5, "cannot convert float64 to a Celeste value"},
+		{uint64(math.MaxUint64), "18446744073709551615 overflows INTEGER"},
+		{[]interface{}{1, []float32{2}}, "[1][0]: cannot convert float32 to a Celeste value"},
+		{map[string]interface{}{"a": struct{ C chan int }{}}, "[a].C: cannot convert chan int to a Celeste value"},
+		{map[bool][]int{true: {1}, false: nil}, ""},
+		{map[[1]int]int{{1}: 1}, "[[1]]: unusable as hash key: ARRAY"},
+	}
+
+	for _, tt := range tests {
+		_, err := FromGo(tt.input)
+		if tt.expected == "" {
+			if err != nil {
+				t.Errorf("FromGo(%#v) failed: %s", tt.input, err)
+			}
+			continue
+		}
+
+		var convErr *ConversionError
+		if !errors.As(err, &convErr) {
+			t.Errorf("FromGo(%#v): expected a ConversionError, got=%v", tt.input, err)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("FromGo(%#v) wrong error. want=%q, got=%q", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestToGo(t *testing.T) {
+	var i int
+	var u uint16
+	var b bool
+	var s string
+	var ints []int
+	var pair [2]string
+	var counts map[string]int
+	var p person
+	var any interface{}
+	var arr *Array
+	var obj Object
+	var home *address
+
+	hash := func(pairs ...Object) *Hash {
+		h := &Hash{Pairs: map[HashKey]HashPair{}}
+		for j := 0; j < len(pairs); j += 2 {
+			h.Pairs[pairs[j].(Hashable).HashKey()] = HashPair{Key: pairs[j], Value: pairs[j+1]}
+		}
+		return h
+	}
+	str := func(s string) *String { return &String{Value: s} }
+	array := func(elements ...Object) *Array { return &Array{Elements: elements} }
+
+	tests := []struct {
+		obj Object
+		target interface{}
+		expected interface{}
+	}{
+		{NewInteger(-3), &i, -3},
+		{NewInteger(300), &u, uint16(300)},
+		{&Boolean{Value: true}, &b, true},
+		{str("hi"), &s, "hi"},
+		{array(NewInteger(1), NewInteger(2)), &ints, []int{1, 2}},
+		{array(str("a"), str("b")), &pair, [2]string{"a", "b"}},
+		{hash(str("a"), NewInteger(1)), &counts, map[string]int{"a": 1}},
+		{
+			hash(str("name"), str("Ada"), str("Age"), NewInteger(36), str("tags"), array(str("x")), str("home"), hash(str("city"), str("Oslo")), str("extra"), NewInteger(1)),
+			&p,
+			person{Name: "Ada", Age: 36, Tags: []string{"x"}, Home: &address{City: "Oslo"}},
+		},
+		{&Null{}, &home, (*address)(nil)},
+		{array(NewInteger(1), str("a"), &Null{}), &any, []interface{}{int64(1), "a", nil}},
+		{hash(str("a"), array()), &any, map[string]interface{}{"a": []interface{}{}}},
+		{hash(NewInteger(1), &Boolean{Value: true}), &any, map[interface{}]interface{}{int64(1): true}},
+		{array(NewInteger(1)), &arr, array(NewInteger(1))},
+		{NewInteger(1), &obj, NewInteger(1)},
+		{nil, &home, (*address)(nil)},
+		{&Array{Elements: []Object{nil}}, &any, []interface{}{nil}},
+	}
+
+	for _, tt := range tests {
+		err := ToGo(tt.obj, tt.target)
+		if err != nil {
+			t.Errorf("ToGo(%s) failed: %s", tt.obj.Inspect(), err)
+			continue
+		}
+
+		got := reflect.ValueOf(tt.target).Elem().Interface()
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("ToGo(%s) wrong. want=%#v, got=%#v", tt.obj.Inspect(), tt.expected, got)
+		}
+	}
+}
+
+func TestToGoErrors(t *testing.T) {
+	var i8 int8
+	var u uint
+	var s string
+	var people []person
+	var pair [2]int
+	var stringer interface{ String() string }
+
+	tests := []struct {
+		obj Object
+		target interface{}
+		expected string
+	}{
+		{NewInteger(1), s, "target must be a non-nil pointer, got string"},
+		{NewInteger(1), &s, "cannot convert INTEGER to string"},
+		{NewInteger(200), &i8, "200 overflows int8"},
+		{NewInteger(-1), &u, "-1 overflows uint"},
+		{&Array{Elements: []Object{NewInteger(1)}}, &pair, "cannot convert an array of 1 elements to [2]int"},
+		{&Null{}, &s, "cannot convert NULL to string"},
+		{nil, &s, "cannot convert NULL to string"},
+		{NewInteger(1), &stringer, "cannot convert INTEGER to interface { String() string }"},
+		{
+			&Array{Elements: []Object{&Hash{Pairs: map[HashKey]HashPair{}}, &Hash{Pairs: map[HashKey]HashPair{
+				(&String{Value: "name"}).HashKey(): {Key: &String{Value: "name"}, Value: NewInteger(1)},
+			}}}},
+			&people,
+			"[1].name: cannot convert INTEGER to string",
+		},
+	}
+
+	for _, tt := range tests {
+		err := ToGo(tt.obj, tt.target)
+
+		var convErr *ConversionError
+		if !errors.As(err, &convErr) {
+			t.Errorf("ToGo(%s): expected a ConversionError, got=%v", tt.obj.Inspect(), err)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("ToGo(%s) wrong error. want=%q, got=%q", tt.obj.Inspect(), tt.expected, err)
+		}
+	}
+}
+
+func TestWrapFunc(t *testing.T) {
+	repeat, err := WrapFunc(func(s string, n int) string {
+		out := ""
+		for i := 0; i < n; i++ {
+			out += s
+		}
+		return out
+	})
+	if err != nil {
+		t.Fatalf("WrapFunc failed: %s", err)
+	}
+
+	sum, err := WrapFunc(func(base int, rest ...int) int {
+		for _, n := range rest {
+			base += n
+		}
+		return base
+	})
+	if err != nil {
+		t.Fatalf("WrapFunc failed: %s", err)
+	}
+
+	half, err := WrapFunc(func(n int) (int, error) {
+		if n%2 != 0 {
+			return 0, errors.New("odd number")
+		}
+		return n / 2, nil
+	})
+	if err != nil {
+		t.Fatalf("WrapFunc failed: %s", err)
+	}
+
+	called := false
+	noResult, err := WrapFunc(func() { called = true })
+	if err != nil {
+		t.Fatalf("WrapFunc failed: %s", err)
+	}
+
+	tests := []struct {
+		fn *Builtin
+		args []Object
+		expected string
+	}{
+		{repeat, []Object{&String{Value: "ab"}, NewInteger(3)}, "ababab"},
+		{repeat, []Object{&String{Value: "ab"}}, "ERROR: wrong number of arguments. got=1, want=2"},
+		{repeat, []Object{NewInteger(3), NewInteger(3)}, "ERROR: argument 1: cannot convert INTEGER to string"},
+		{sum, []Object{NewInteger(1)}, "1"},
+		{sum, []Object{NewInteger(1), NewInteger(2), NewInteger(3)}, "6"},
+		{sum, []Object{}, "ERROR: wrong number of arguments. got=0, want at least 1"},
+		{half, []Object{NewInteger(8)}, "4"},
+		{half, []Object{NewInteger(7)}, "ERROR: odd number"},
+	}
+
+	for _, tt := range tests {
+		result := tt.fn.Fn(tt.args...)
+		if result == nil || result.Inspect() != tt.expected {
+			t.Errorf("wrong result. want=%s, got=%v", tt.expected, result)
+		}
+	}
+
+	if result := noResult.Fn(); result != nil || !called {
+		t.Errorf("expected the function to be called and give nil, got=%v", result)
+	}
+}
+
+func TestWrapFuncErrors(t *testing.T) {
+	tests := []struct {
+		fn interface{}
+		expected string
+	}{
+		{1, "cannot wrap int, it is not a function"},
+		{nil, "cannot wrap <nil>, it is not a function"},
+		{func() (int, int) { return 0, 0 }, "cannot wrap func() (int, int), it may only return a value, an error or both"},
+	}
+
+	for _, tt := range tests {
+		_, err := WrapFunc(tt.fn)
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%v", tt.expected, err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package object
+
+// Rough sizes in bytes, close enough for a ceiling to mean something. A value is charged for its header
+// and what it holds directly, the elements of an array are charged when they are made themselves.
+const (
+	stringHeaderSize = 16
+	arrayHeaderSize = 24
+	hashHeaderSize = 48
+	elementSize = 16 // An Object interface
+	pairSize = 64 // A HashKey and a HashPair, plus the map's own bookkeeping
+)
+
+func StringSize(length int) int64 {
+	return stringHeaderSize + int64(length)
+}
+
+func ArraySize(length int) int64 {
+	return arrayHeaderSize + elementSize*int64(length)
+}
+
+func HashSize(pairs int) int64 {
+	return hashHeaderSize + pairSize*int64(pairs)
+}
+
+// SizeOf is what a string, array or hash is charged, other values aren't tracked
+func SizeOf(obj Object) int64 {
+	switch obj := obj.(type) {
+	case *String:
+		return StringSize(len(obj.Value))
+	case *Array:
+		return ArraySize(len(obj.Elements))
+	case *Hash:
+		return HashSize(len(obj.Pairs))
+	default:
+		return 0
+	}
+}
+
+// Container is a value that holds others without being an array or a hash, a closure and its free
+// variables for instance. The memory tracker follows what it holds.
+type Container interface {
+	Contents() []Object
+}
+
+// MemoryTracker keeps the strings, arrays and hashes a VM holds under a ceiling, and records the most
+// it held at once. Values turning into garbage can't be seen as it happens, so everything the VM makes
+// is charged to an estimate that only grows and is never below what is really held. Once the estimate
+// would pass the ceiling, or has grown a quarter past the peak, the tracker walks what the VM can still
+// reach and starts the estimate again from what it found. A run only fails when what it holds and what
+// it is about to make don't fit, and the real peak is never more than a quarter above Peak. A run that
+// keeps close to its ceiling walks on most of what it makes, which is slow but keeps it under.
+type MemoryTracker struct {
+	limit int64 // Zero for no ceiling
+	roots func(visit func(Object)) // Hands every value the VM can reach directly to visit
+	estimate int64
+	stale bool // Set between runs, the host may have changed what the VM holds without it being charged
+	peak int64
+}
+
+func NewMemoryTracker(limit int64, roots func(visit func(Object))) *MemoryTracker {
+	return &MemoryTracker{limit: limit, roots: roots, stale: true}
+}
+
+func (t *MemoryTracker) SetLimit(limit int64) {
+	t.limit = limit
+}
+
+// Alloc charges size bytes for a value that is about to be made, unless the VM can't hold it on top of
+// what it holds already
+func (t *MemoryTracker) Alloc(size int64) error {
+	estimate := t.estimate + size
+	if !t.stale && estimate <= t.peak+t.peak/4 && (t.limit == 0 || estimate <= t.limit) {
+		t.estimate = estimate
+		return nil
+	}
+
+	held := t.walk()
+	if t.limit > 0 && held+size > t.limit {
+		return &LimitError{Kind: MemoryLimit, Limit: t.limit}
+	}
+
+	t.estimate = held + size
+	if t.estimate > t.peak {
+		t.peak = t.estimate
+	}
+
+	return nil
+}
+
+// Reset starts a new run, the peak is kept
+func (t *MemoryTracker) Reset() {
+	t.stale = true
+}
+
+// Used is what the VM holds right now
+func (t *MemoryTracker) Used() int64 {
+	held := t.walk()
+	if held > t.peak {
+		t.peak = held
+	}
+
+	return held
+}
+
+// Peak is the most the VM has held at once over all its runs
+func (t *MemoryTracker) Peak() int64 {
+	return t.peak
+}
+
+// Adds up every string, array and hash reachable from the roots, each only once however many values
+// hold it
+func (t *MemoryTracker) walk() int64 {
+	seen := make(map[Object]bool)
+	var pending []Object
+	t.roots(func(obj Object) {
+		pending = appendHeld(pending, obj)
+	})
+
+	var held int64
+	for len(pending) > 0 {
+		obj := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		if seen[obj] {
+			continue
+		}
+		seen[obj] = true
+		held += SizeOf(obj)
+
+		switch obj := obj.(type) {
+		case *Array:
+			pending = appendHeld(pending, obj.Elements...)
+		case *Hash:
+			for _, pair := range obj.Pairs {
+				pending = appendHeld(pending, pair.Key, pair.Value)
+			}
+		case Container:
+			pending = appendHeld(pending, obj.Contents()...)
+		}
+	}
+
+	t.estimate = held
+	t.stale = false
+	return held
+}
+
+// Leaves out what is neither charged nor holds anything, which is most elements of most arrays, so the
+// walk doesn't look at them twice
+func appendHeld(pending []Object, objs ...Object) []Object {
+	for _, obj := range objs {
+		switch obj.(type) {
+		case *String, *Array, *Hash, Container:
+			pending = append(pending, obj)
+		}
+	}
+
+	return pending
+}
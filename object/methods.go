@@ -0,0 +1,54 @@
+package object
+
+// MethodTable maps an object type to the methods attached to it with impl blocks
+type MethodTable map[ObjectType]map[string]Object
+
+func NewMethodTable() MethodTable {
+	return make(MethodTable)
+}
+
+func (mt MethodTable) Get(t ObjectType, name string) (Object, bool) {
+	method, ok := mt[t][name] // Indexing a missing inner map yields a nil map, which is still safe to read from
+	return method, ok
+}
+
+func (mt MethodTable) Set(t ObjectType, name string, method Object) {
+	methods, ok := mt[t]
+	if !ok {
+		methods = make(map[string]Object)
+		mt[t] = methods
+	}
+
+	methods[name] = method
+}
+
+// The builtins that can also be called with method syntax, the receiver is passed in as the first argument
+var builtinMethods = map[ObjectType][]string{
+	ARRAY_OBJ: {"len", "first", "last", "rest", "push"},
+	STRING_OBJ: {"len"},
+	HASH_OBJ: {"len"},
+}
+
+func GetBuiltinMethod(t ObjectType, name string) *Builtin {
+	for _, method := range builtinMethods[t] {
+		if method == name {
+			return GetBuiltinByName(name)
+		}
+	}
+
+	return nil
+}
+
+// The names impl blocks use to refer to object types
+var typeNames = map[string]ObjectType{
+	"Integer": INTEGER_OBJ,
+	"Boolean": BOOLEAN_OBJ,
+	"String": STRING_OBJ,
+	"Array": ARRAY_OBJ,
+	"Hash": HASH_OBJ,
+}
+
+func LookupTypeName(name string) (ObjectType, bool) {
+	t, ok := typeNames[name]
+	return t, ok
+}
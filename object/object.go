@@ -50,6 +50,13 @@ type Null struct {}
 func (n *Null) Type() ObjectType { return NULL_OBJ }
 func (n *Null) Inspect() string { return "null" }
 
+// The evaluator tells booleans and null apart by identity, so every one it sees has to be one of these
+var (
+	NULL = &Null{}
+	TRUE = &Boolean{Value: true}
+	FALSE = &Boolean{Value: false}
+)
+
 type ReturnValue struct {
 	Value Object
 }
@@ -66,6 +73,9 @@ func (e *Error) Inspect() string { return "ERROR: " + e.Message}
 
 type Function struct {
 	Parameters []*ast.Identifier
+	Defaults []ast.Expression
+	Rest *ast.Identifier
+	Name string
 	Body *ast.BlockStatement
 	Env *Environment
 }
@@ -74,12 +84,13 @@ func (f *Function) Type() ObjectType { return FUNCTION_OBJ }
 func (f *Function) Inspect() string {
 	var out bytes.Buffer
 
-	params := []string{}
-	for _, p := range f.Parameters {
-		params = append(params, p.String())
-	}
+	fn := &ast.FunctionLiteral{Parameters: f.Parameters, Defaults: f.Defaults, Rest: f.Rest}
+	params := fn.ParameterStrings()
 
 	out.WriteString("fn")
+	if f.Name != "" {
+		out.WriteString("<" + f.Name + ">")
+	}
 	out.WriteString("(")
 	out.WriteString(strings.Join(params, ", "))
 	out.WriteString(") {\n")
@@ -100,6 +111,7 @@ type BuiltinFunction func (args ...Object) Object
 
 type Builtin struct {
 	Fn BuiltinFunction
+	Size func(args ...Object) int64 // How big the string, array or hash it makes from args is, nil when it makes none. A VM tracking memory charges it before the call
 }
 
 func (b *Builtin) Type() ObjectType { return BUILTIN_OBJ }
@@ -161,6 +173,25 @@ func (s *String) HashKey() HashKey {
 	return HashKey{Type: s.Type(), Value: h.Sum64()}
 }
 
+// Equal compares two objects by value, objects of different types are never equal
+func Equal(left, right Object) bool {
+	switch left := left.(type) {
+	case *Integer:
+		right, ok := right.(*Integer)
+		return ok && left.Value == right.Value
+	case *String:
+		right, ok := right.(*String)
+		return ok && left.Value == right.Value
+	case *Boolean:
+		right, ok := right.(*Boolean)
+		return ok && left.Value == right.Value
+	case *Null:
+		_, ok := right.(*Null)
+		return ok
+	default:
+		return left == right
+	}
+}
 
 type Hash struct {
 	Pairs map[HashKey]HashPair
@@ -185,11 +216,20 @@ func (h *Hash) Inspect() string {
 type CompiledFunction struct {
 	Instructions code.Instructions
 	NumLocals int
-	NumParameters int
+	NumParameters int // Counts parameters with a default value but not the rest parameter
+	NumDefaults int // The last NumDefaults parameters have a default value and may be left out by the caller
+	Variadic bool // Extra arguments are collected into an array stored in the local right after the parameters
+	Name string // Empty for anonymous functions
+	NumFree int // How many free variables OpClosure has to capture for it
+	SourceMap code.SourceMap
 }
 
 func (cf *CompiledFunction) Type() ObjectType { return COMPILED_FUNCTION_OBJ }
 func (cf *CompiledFunction) Inspect() string {
+	if cf.Name != "" {
+		return fmt.Sprintf("CompiledFunction[%s]", cf.Name)
+	}
+
 	return fmt.Sprintf("CompiledFunction[%p]", cf)
 }
 
@@ -200,5 +240,11 @@ type Closure struct {
 
 func (c *Closure) Type() ObjectType { return CLOSURE_OBJ }
 func (c *Closure) Inspect() string {
+	if c.Fn.Name != "" {
+		return fmt.Sprintf("Closure[%s]", c.Fn.Name)
+	}
+
 	return fmt.Sprintf("Closure[%p]", c)
-}
\ No newline at end of file
+}
+
+func (c *Closure) Contents() []Object { return c.Free }
\ No newline at end of file
@@ -19,4 +19,66 @@ func TestStringHashKey(t *testing.T) {
 	if hello1.HashKey() == diff1.HashKey() {
 		t.Errorf("strings with different content have same hash keys")
 	}
-}
\ No newline at end of file
+}
+func TestSmallIntegerCache(t *testing.T) {
+	for _, v := range []int64{SmallIntMin, -1, 0, 1, 255, SmallIntMax} {
+		if NewInteger(v) != NewInteger(v) {
+			t.Errorf("integer %d is not shared", v)
+		}
+		if NewInteger(v).Value != v {
+			t.Errorf("wrong value. want=%d, got=%d", v, NewInteger(v).Value)
+		}
+	}
+
+	for _, v := range []int64{SmallIntMin - 1, SmallIntMax + 1, 1 << 40} {
+		if NewInteger(v) == NewInteger(v) {
+			t.Errorf("integer %d is shared but is outside the cache", v)
+		}
+		if NewInteger(v).Value != v {
+			t.Errorf("wrong value. want=%d, got=%d", v, NewInteger(v).Value)
+		}
+	}
+}
+
+func TestLenUsesSmallIntegers(t *testing.T) {
+	length := GetBuiltinByName("len").Fn(&Array{Elements: []Object{&Null{}, &Null{}}})
+	if length != NewInteger(2) {
+		t.Errorf("len did not return the shared integer. got=%+v", length)
+	}
+}
+
+func TestMemoryTrackerWalk(t *testing.T) {
+	shared := &String{Value: "abc"}
+	inner := &Array{Elements: []Object{shared, NewInteger(1)}}
+	held := []Object{
+		&Array{Elements: []Object{inner, inner, shared}}, // What is held twice is counted once
+		&Closure{Fn: &CompiledFunction{}, Free: []Object{&Hash{Pairs: map[HashKey]HashPair{shared.HashKey(): {Key: shared, Value: inner}}}}},
+		TRUE,
+		nil,
+	}
+
+	tracker := NewMemoryTracker(0, func(visit func(Object)) {
+		for _, obj := range held {
+			visit(obj)
+		}
+	})
+
+	expected := ArraySize(3) + ArraySize(2) + StringSize(3) + HashSize(1)
+	if tracker.Used() != expected {
+		t.Errorf("wrong usage. want=%d, got=%d", expected, tracker.Used())
+	}
+
+	held = held[1:] // The outer array is dropped, the hash still holds the rest
+	expected -= ArraySize(3)
+	if tracker.Used() != expected {
+		t.Errorf("wrong usage after a drop. want=%d, got=%d", expected, tracker.Used())
+	}
+
+	tracker.SetLimit(expected + ArraySize(1))
+	if err := tracker.Alloc(ArraySize(2)); err == nil {
+		t.Errorf("expected an allocation past the limit to fail")
+	}
+	if err := tracker.Alloc(ArraySize(1)); err != nil {
+		t.Errorf("expected an allocation up to the limit to succeed, got=%v", err)
+	}
+}
@@ -42,6 +42,8 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerPrefix(token.STRING, p.parseStringLiteral)
 	p.registerPrefix(token.LBRACKET, p.parseArrayLiteral)
 	p.registerPrefix(token.LBRACE, p.parseHashLiteral)
+	p.registerPrefix(token.MATCH, p.parseMatchExpression)
+	p.registerPrefix(token.ELLIPSIS, p.parseSpreadExpression)
 
 	p.infixParseFns = make(map[token.TokenType]infixParseFn)
 	p.registerInfix(token.PLUS, p.parseInfixExpression)
@@ -54,6 +56,7 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerInfix(token.GT, p.parseInfixExpression)
 	p.registerInfix(token.LPAREN, p.parseCallExpression)
 	p.registerInfix(token.LBRACKET, p.parseIndexExpression)
+	p.registerInfix(token.DOT, p.parseMethodCallExpression)
 
 	// Read two tokens, so curToken and peekToken are both set
 	p.NextToken()
@@ -97,9 +100,21 @@ func (p *Parser) ParseProgram() *ast.Program {
 func (p *Parser) parseStatement() ast.Statement {
 	switch p.curToken.Type {
 	case token.LET:
+		if p.peekTokenIs(token.LBRACKET) || p.peekTokenIs(token.LBRACE) {
+			return p.parseDestructuringLetStatement()
+		}
+
 		return p.parseLetStatement()
 	case token.RETURN:
 		return p.parseReturnStatement()
+	case token.IMPL:
+		return p.parseImplStatement()
+	case token.FUNCTION:
+		if p.peekTokenIs(token.IDENT) { // A function literal is always followed by its parameters, so a name means a declaration
+			return p.parseFunctionStatement()
+		}
+
+		return p.parseExpressionStatement()
 	default:
 		return p.parseExpressionStatement()
 	}
@@ -122,6 +137,10 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 
 	stmt.Value = p.parseExpression(LOWEST)
 
+	if fl, ok := stmt.Value.(*ast.FunctionLiteral); ok { // The function takes the name it is bound to for error messages and stack traces
+		fl.Name = stmt.Name.Value
+	}
+
 	if p.peekTokenIs(token.SEMICOLON) {
 		p.NextToken()
 	}
@@ -129,6 +148,124 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 	return stmt
 }
 
+// fn name(params) { body } is shorthand for let name = fn(params) { body };
+func (p *Parser) parseFunctionStatement() *ast.LetStatement {
+	stmt := &ast.LetStatement{Token: token.Token{Type: token.LET, Literal: "let", Line: p.curToken.Line}}
+	lit := &ast.FunctionLiteral{Token: p.curToken}
+
+	p.NextToken()
+	stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	lit.Name = stmt.Name.Value
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+
+	if !p.parseFunctionParameters(lit) {
+		return nil
+	}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	lit.Body = p.parseBlockStatement()
+	stmt.Value = lit
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.NextToken()
+	}
+
+	return stmt
+}
+
+func (p *Parser) parseDestructuringLetStatement() *ast.DestructuringLetStatement {
+	stmt := &ast.DestructuringLetStatement{Token: p.curToken}
+
+	p.NextToken()
+
+	if p.curTokenIs(token.LBRACKET) {
+		stmt.Pattern = p.parseArrayPattern()
+	} else {
+		stmt.Pattern = p.parseHashPattern()
+	}
+
+	if stmt.Pattern == nil {
+		return nil
+	}
+
+	if !p.expectPeek(token.ASSIGN) {
+		return nil
+	}
+
+	p.NextToken()
+
+	stmt.Value = p.parseExpression(LOWEST)
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.NextToken()
+	}
+
+	return stmt
+}
+
+func (p *Parser) parseArrayPattern() ast.Pattern {
+	pattern := &ast.ArrayPattern{Token: p.curToken}
+	pattern.Elements = []*ast.Identifier{}
+
+	for !p.peekTokenIs(token.RBRACKET) {
+		if p.peekTokenIs(token.ELLIPSIS) {
+			p.NextToken()
+
+			if !p.expectPeek(token.IDENT) {
+				return nil
+			}
+
+			pattern.Rest = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+			break // The rest binding has to come last, so the closing bracket is expected below
+		}
+
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+
+		pattern.Elements = append(pattern.Elements, &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal})
+
+		if !p.peekTokenIs(token.RBRACKET) && !p.expectPeek(token.COMMA) {
+			return nil
+		}
+	}
+
+	if !p.expectPeek(token.RBRACKET) {
+		return nil
+	}
+
+	return pattern
+}
+
+func (p *Parser) parseHashPattern() ast.Pattern {
+	pattern := &ast.HashPattern{Token: p.curToken}
+	pattern.Keys = []*ast.Identifier{}
+
+	for !p.peekTokenIs(token.RBRACE) {
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+
+		pattern.Keys = append(pattern.Keys, &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal})
+
+		if !p.peekTokenIs(token.RBRACE) && !p.expectPeek(token.COMMA) {
+			return nil
+		}
+	}
+
+	if !p.expectPeek(token.RBRACE) {
+		return nil
+	}
+
+	return pattern
+}
+
 func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 	stmt := &ast.ReturnStatement{Token: p.curToken}
 
@@ -178,6 +315,7 @@ var presedences = map[token.TokenType] int { // Map is declared with token.TokeT
 	token.ASTERIK: PRODUCT,
 	token.LPAREN: CALL,
 	token.LBRACKET: INDEX,
+	token.DOT: INDEX,
 }
 
 func (p *Parser) parseExpression(precedence int) ast.Expression {
@@ -323,7 +461,9 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 		return nil
 	}
 
-	lit.Parameters = p.parseFunctionParameters()
+	if !p.parseFunctionParameters(lit) {
+		return nil
+	}
 
 	if !p.expectPeek(token.LBRACE) {
 		return nil
@@ -334,31 +474,60 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 	return lit
 }
 
-func (p *Parser) parseFunctionParameters() []*ast.Identifier {
-	identifiers := []*ast.Identifier{}
+func (p *Parser) parseFunctionParameters(fn *ast.FunctionLiteral) bool {
+	fn.Parameters = []*ast.Identifier{}
 
 	if p.peekTokenIs(token.RPAREN) {
 		p.NextToken()
-		return identifiers
+		return true
 	}
 
-	p.NextToken()
-
-	ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
-	identifiers = append(identifiers, ident)
+	hasDefaults := false
 
-	for p.peekTokenIs(token.COMMA) {
-		p.NextToken()
+	for {
 		p.NextToken()
+
+		if p.curTokenIs(token.ELLIPSIS) { // The rest parameter collects whatever is left, so nothing may follow it
+			if !p.expectPeek(token.IDENT) {
+				return false
+			}
+			fn.Rest = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+			break
+		}
+
+		if !p.curTokenIs(token.IDENT) {
+			msg := fmt.Sprintf("expected parameter name, got %s instead", p.curToken.Type)
+			p.errors = append(p.errors, msg)
+			return false
+		}
+
 		ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
-		identifiers = append(identifiers, ident)
+		fn.Parameters = append(fn.Parameters, ident)
+
+		var def ast.Expression
+		if p.peekTokenIs(token.ASSIGN) {
+			p.NextToken()
+			p.NextToken()
+			def = p.parseExpression(LOWEST)
+			hasDefaults = true
+		} else if hasDefaults { // Arguments are matched by position, so a required parameter can't come after an optional one
+			msg := fmt.Sprintf("parameter %s without a default value follows a parameter with one", ident.Value)
+			p.errors = append(p.errors, msg)
+			return false
+		}
+		fn.Defaults = append(fn.Defaults, def)
+
+		if !p.peekTokenIs(token.COMMA) {
+			break
+		}
+		p.NextToken()
 	}
 
-	if !p.expectPeek(token.RPAREN) {
-		return nil
+	if !hasDefaults {
+		fn.Defaults = nil
 	}
 
-	return identifiers
+	return p.expectPeek(token.RPAREN)
 }
 
 func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
@@ -371,6 +540,15 @@ func (p *Parser) parseStringLiteral() ast.Expression {
 	return &ast.StringLiteral{Token: p.curToken, Value: p.curToken.Literal}
 }
 
+func (p *Parser) parseSpreadExpression() ast.Expression {
+	exp := &ast.SpreadExpression{Token: p.curToken}
+
+	p.NextToken()
+	exp.Value = p.parseExpression(PREFIX)
+
+	return exp
+}
+
 func (p *Parser) parseArrayLiteral() ast.Expression {
 	array := &ast.ArrayLiteral{Token: p.curToken}
 	array.Elements = p.parseExpressionList(token.RBRACKET)
@@ -415,6 +593,102 @@ func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 	return exp
 }
 
+func (p *Parser) parseMethodCallExpression(object ast.Expression) ast.Expression {
+	exp := &ast.MethodCallExpression{Token: p.curToken, Object: object}
+
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+
+	exp.Method = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+
+	exp.Arguments = p.parseExpressionList(token.RPAREN)
+
+	return exp
+}
+
+func (p *Parser) parseImplStatement() *ast.ImplStatement {
+	stmt := &ast.ImplStatement{Token: p.curToken}
+
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+
+	stmt.Type = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	stmt.Methods = []*ast.MethodDefinition{}
+
+	for !p.peekTokenIs(token.RBRACE) && !p.peekTokenIs(token.EOF) {
+		if !p.expectPeek(token.FUNCTION) {
+			return nil
+		}
+
+		method := p.parseMethodDefinition()
+		if method == nil {
+			return nil
+		}
+
+		method.Function.Name = stmt.Type.Value + "." + method.Name.Value
+		stmt.Methods = append(stmt.Methods, method)
+
+		if p.peekTokenIs(token.SEMICOLON) {
+			p.NextToken()
+		}
+	}
+
+	if !p.expectPeek(token.RBRACE) {
+		return nil
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.NextToken()
+	}
+
+	return stmt
+}
+
+func (p *Parser) parseMethodDefinition() *ast.MethodDefinition {
+	method := &ast.MethodDefinition{Token: p.curToken}
+
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+
+	method.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+
+	fn := &ast.FunctionLiteral{Token: method.Token}
+	if !p.parseFunctionParameters(fn) {
+		return nil
+	}
+
+	if len(fn.Parameters) == 0 || fn.Parameters[0].Value != "self" { // The receiver is passed as the first argument, so it has to be declared like any other parameter
+		msg := fmt.Sprintf("method %s must take self as its first parameter", method.Name.Value)
+		p.errors = append(p.errors, msg)
+		return nil
+	}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	fn.Body = p.parseBlockStatement()
+	method.Function = fn
+
+	return method
+}
+
 func (p *Parser) parseHashLiteral() ast.Expression {
 	hash := &ast.HashLiteral{Token: p.curToken}
 	hash.Pairs = make(map[ast.Expression]ast.Expression)
@@ -444,6 +718,104 @@ func (p *Parser) parseHashLiteral() ast.Expression {
 	return hash
 }
 
+func (p *Parser) parseMatchExpression() ast.Expression {
+	exp := &ast.MatchExpression{Token: p.curToken}
+
+	p.NextToken()
+	exp.Subject = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	exp.Arms = []*ast.MatchArm{}
+
+	for !p.peekTokenIs(token.RBRACE) {
+		p.NextToken()
+
+		arm := p.parseMatchArm()
+		if arm == nil {
+			return nil
+		}
+
+		exp.Arms = append(exp.Arms, arm)
+
+		if !p.peekTokenIs(token.RBRACE) && !p.expectPeek(token.COMMA) { // Arms are separated by commas, a trailing comma is allowed
+			return nil
+		}
+	}
+
+	if !p.expectPeek(token.RBRACE) {
+		return nil
+	}
+
+	return exp
+}
+
+func (p *Parser) parseMatchArm() *ast.MatchArm {
+	arm := &ast.MatchArm{Token: p.curToken}
+
+	arm.Pattern = p.parseExpression(LOWEST) // Patterns share the expression syntax, anything that is not a valid pattern is rejected below
+	if arm.Pattern == nil {
+		return nil
+	}
+
+	if !p.validPattern(arm.Pattern) {
+		msg := fmt.Sprintf("invalid pattern: %s", arm.Pattern.String())
+		p.errors = append(p.errors, msg)
+		return nil
+	}
+
+	if p.peekTokenIs(token.IF) {
+		p.NextToken()
+		p.NextToken()
+		arm.Guard = p.parseExpression(LOWEST)
+	}
+
+	if !p.expectPeek(token.ARROW) {
+		return nil
+	}
+
+	p.NextToken()
+	arm.Body = p.parseExpression(LOWEST)
+
+	return arm
+}
+
+func (p *Parser) validPattern(pattern ast.Expression) bool {
+	switch pattern := pattern.(type) {
+	case *ast.IntegerLiteral, *ast.StringLiteral, *ast.Boolean, *ast.Identifier:
+		return true
+	case *ast.PrefixExpression:
+		_, ok := pattern.Right.(*ast.IntegerLiteral) // Negative integer literals
+		return pattern.Operator == "-" && ok
+	case *ast.ArrayLiteral:
+		for _, el := range pattern.Elements {
+			if !p.validPattern(el) {
+				return false
+			}
+		}
+
+		return true
+	case *ast.HashLiteral:
+		for key, value := range pattern.Pairs {
+			switch key.(type) {
+			case *ast.IntegerLiteral, *ast.StringLiteral, *ast.Boolean:
+			default:
+				return false
+			}
+
+			if !p.validPattern(value) {
+				return false
+			}
+		}
+
+		return true
+	default:
+		return false
+	}
+}
+
 func (p *Parser) noPrefixParseFnError(t token.TokenType) {
 	msg := fmt.Sprintf("no prefix parse function for %s found", t)
 	p.errors = append(p.errors, msg)
@@ -327,6 +327,14 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"a * [1, 2, 3, 4][b * c] * d",
 			"((a * ([1, 2, 3, 4][(b * c)])) * d)",
 		},
+		{
+			"-a.len() + b.push(1 * 2).first()",
+			"((-a.len()) + b.push((1 * 2)).first())",
+		},
+		{
+			"a[0].len()",
+			"(a[0]).len()",
+		},
 	}
 
 	for _, tt := range tests {
@@ -741,6 +749,421 @@ func TestParsingHashLiteralsWithExpressions(t *testing.T) {
 	}
 }
 
+func TestMethodCallExpressionParsing(t *testing.T) {
+	input := "arr.push(1, 2 * 3);"
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	exp, ok := stmt.Expression.(*ast.MethodCallExpression)
+	if !ok {
+		t.Fatalf("stmt.Expression is not ast.MethodCallExpression. got=%T", stmt.Expression)
+	}
+
+	if !testIdentifier(t, exp.Object, "arr") {
+		return
+	}
+
+	if !testIdentifier(t, exp.Method, "push") {
+		return
+	}
+
+	if len(exp.Arguments) != 2 {
+		t.Fatalf("wrong length of arguments. got=%d", len(exp.Arguments))
+	}
+
+	testLiteralExpression(t, exp.Arguments[0], 1)
+	testInfixExpression(t, exp.Arguments[1], 2, "*", 3)
+}
+
+func TestImplStatementParsing(t *testing.T) {
+	input := `
+	impl Array {
+		fn sum(self) { 0 }
+		fn add(self, x, y) { x + y }
+	}`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain 1 statement. got=%d", len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.ImplStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.ImplStatement. got=%T", program.Statements[0])
+	}
+
+	if !testIdentifier(t, stmt.Type, "Array") {
+		return
+	}
+
+	expected := []struct {
+		name string
+		params []string
+	} {
+		{"sum", []string{"self"}},
+		{"add", []string{"self", "x", "y"}},
+	}
+
+	if len(stmt.Methods) != len(expected) {
+		t.Fatalf("wrong number of methods. want=%d, got=%d", len(expected), len(stmt.Methods))
+	}
+
+	for i, tt := range expected {
+		method := stmt.Methods[i]
+		if !testIdentifier(t, method.Name, tt.name) {
+			return
+		}
+
+		if len(method.Function.Parameters) != len(tt.params) {
+			t.Fatalf("wrong number of parameters for %s. want=%d, got=%d", tt.name, len(tt.params), len(method.Function.Parameters))
+		}
+
+		for j, param := range tt.params {
+			testLiteralExpression(t, method.Function.Parameters[j], param)
+		}
+	}
+}
+
+func TestImplMethodWithoutSelf(t *testing.T) {
+	input := "impl Array { fn sum(x) { x } }"
+
+	l := lexer.New(input)
+	p := New(l)
+	p.ParseProgram()
+
+	errors := p.Errors()
+	if len(errors) == 0 {
+		t.Fatalf("expected parser errors but got none")
+	}
+
+	expected := "method sum must take self as its first parameter"
+	if errors[0] != expected {
+		t.Errorf("wrong parser error. want=%q, got=%q", expected, errors[0])
+	}
+}
+
+func TestMatchExpressionParsing(t *testing.T) {
+	input := `match x {
+		0 => "zero",
+		-1 => "minus one",
+		[a, b] => a + b,
+		{"type": "point", "x": x} => x,
+		n if n > 10 => n,
+		_ => "other",
+	}`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	exp, ok := stmt.Expression.(*ast.MatchExpression)
+	if !ok {
+		t.Fatalf("stmt.Expression is not ast.MatchExpression. got=%T", stmt.Expression)
+	}
+
+	if !testIdentifier(t, exp.Subject, "x") {
+		return
+	}
+
+	if len(exp.Arms) != 6 {
+		t.Fatalf("wrong number of arms. want=6, got=%d", len(exp.Arms))
+	}
+
+	testLiteralExpression(t, exp.Arms[0].Pattern, 0)
+	testPrefixExpression(t, exp.Arms[1].Pattern, 1, "-")
+
+	array, ok := exp.Arms[2].Pattern.(*ast.ArrayLiteral)
+	if !ok {
+		t.Fatalf("arm 2 pattern is not ast.ArrayLiteral. got=%T", exp.Arms[2].Pattern)
+	}
+
+	testIdentifier(t, array.Elements[0], "a")
+	testIdentifier(t, array.Elements[1], "b")
+	testInfixExpression(t, exp.Arms[2].Body, "a", "+", "b")
+
+	if _, ok := exp.Arms[3].Pattern.(*ast.HashLiteral); !ok {
+		t.Fatalf("arm 3 pattern is not ast.HashLiteral. got=%T", exp.Arms[3].Pattern)
+	}
+
+	testIdentifier(t, exp.Arms[4].Pattern, "n")
+	testInfixExpression(t, exp.Arms[4].Guard, "n", ">", 10)
+
+	testIdentifier(t, exp.Arms[5].Pattern, "_")
+	if exp.Arms[5].Guard != nil {
+		t.Errorf("arm 5 should not have a guard. got=%s", exp.Arms[5].Guard.String())
+	}
+}
+
+func TestInvalidMatchPatterns(t *testing.T) {
+	tests := []struct {
+		input string
+		expected string
+	} {
+		{"match x { a + b => 1 }", "invalid pattern: (a + b)"},
+		{"match x { f(a) => 1 }", "invalid pattern: f(a)"},
+		{"match x { {y: 1} => 1 }", "invalid pattern: {y:1}"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Fatalf("expected parser errors for %q but got none", tt.input)
+		}
+
+		if errors[0] != tt.expected {
+			t.Errorf("wrong parser error. want=%q, got=%q", tt.expected, errors[0])
+		}
+	}
+}
+
+func TestDestructuringLetStatements(t *testing.T) {
+	tests := []struct {
+		input string
+		expected string
+		names []string
+	} {
+		{"let [a, b] = arr;", "let [a, b] = arr;", []string{"a", "b"}},
+		{"let [a, ...rest] = [1, 2, 3];", "let [a, ...rest] = [1, 2, 3];", []string{"a", "rest"}},
+		{"let [...all] = arr", "let [...all] = arr;", []string{"all"}},
+		{"let [] = arr;", "let [] = arr;", []string{}},
+		{"let {name, age} = person;", "let {name, age} = person;", []string{"name", "age"}},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt, ok := program.Statements[0].(*ast.DestructuringLetStatement)
+		if !ok {
+			t.Fatalf("program.Statements[0] is not ast.DestructuringLetStatement. got=%T", program.Statements[0])
+		}
+
+		if stmt.String() != tt.expected {
+			t.Errorf("stmt.String() wrong. want=%q, got=%q", tt.expected, stmt.String())
+		}
+
+		names := []*ast.Identifier{}
+		switch pattern := stmt.Pattern.(type) {
+		case *ast.ArrayPattern:
+			names = append(names, pattern.Elements...)
+			if pattern.Rest != nil {
+				names = append(names, pattern.Rest)
+			}
+		case *ast.HashPattern:
+			names = append(names, pattern.Keys...)
+		}
+
+		if len(names) != len(tt.names) {
+			t.Fatalf("wrong number of names. want=%d, got=%d", len(tt.names), len(names))
+		}
+
+		for i, name := range tt.names {
+			testIdentifier(t, names[i], name)
+		}
+	}
+}
+
+func TestInvalidDestructuringLetStatements(t *testing.T) {
+	tests := []string{
+		"let [a, ...rest, b] = arr;",
+		"let [1] = arr;",
+		"let {\"name\"} = person;",
+		"let [a b] = arr;",
+	}
+
+	for _, input := range tests {
+		l := lexer.New(input)
+		p := New(l)
+		p.ParseProgram()
+
+		if len(p.Errors()) == 0 {
+			t.Errorf("expected parser errors for %q but got none", input)
+		}
+	}
+}
+
+func TestFunctionLiteralWithName(t *testing.T) {
+	input := `let myFunction = fn() { };`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt, ok := program.Statements[0].(*ast.LetStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.LetStatement. got=%T", program.Statements[0])
+	}
+
+	function, ok := stmt.Value.(*ast.FunctionLiteral)
+	if !ok {
+		t.Fatalf("stmt.Value is not ast.FunctionLiteral. got=%T", stmt.Value)
+	}
+
+	if function.Name != "myFunction" {
+		t.Errorf("function literal name wrong. want 'myFunction', got=%q", function.Name)
+	}
+}
+
+func TestFunctionStatementParsing(t *testing.T) {
+	input := `
+	fn add(x, y = 1) { x + y }
+	add(1);
+	`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("program.Statements does not contain 2 statements. got=%d", len(program.Statements))
+	}
+
+	if !testLetStatement(t, program.Statements[0], "add") {
+		return
+	}
+
+	stmt := program.Statements[0].(*ast.LetStatement)
+	function, ok := stmt.Value.(*ast.FunctionLiteral)
+	if !ok {
+		t.Fatalf("stmt.Value is not ast.FunctionLiteral. got=%T", stmt.Value)
+	}
+
+	if function.Name != "add" {
+		t.Errorf("function literal name wrong. want 'add', got=%q", function.Name)
+	}
+
+	if len(function.Parameters) != 2 {
+		t.Fatalf("function literal parameters wrong. want 2, got=%d", len(function.Parameters))
+	}
+
+	if stmt.String() != "let add = fn<add>(x, y = 1) (x + y);" {
+		t.Errorf("stmt.String() wrong. got=%q", stmt.String())
+	}
+}
+
+func TestDefaultAndRestParameterParsing(t *testing.T) {
+	tests := []struct {
+		input string
+		expectedParams []string
+		expectedDefaults []string // Empty string for parameters without a default value
+		expectedRest string
+	} {
+		{"fn(a, b = 10) {};", []string{"a", "b"}, []string{"", "10"}, ""},
+		{"fn(a = 1, b = a * 2) {};", []string{"a", "b"}, []string{"1", "(a * 2)"}, ""},
+		{"fn(...rest) {};", []string{}, []string{}, "rest"},
+		{"fn(a, b = 10, ...rest) {};", []string{"a", "b"}, []string{"", "10"}, "rest"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		function := stmt.Expression.(*ast.FunctionLiteral)
+
+		if len(function.Parameters) != len(tt.expectedParams) {
+			t.Fatalf("length parameters is wrong. want %d, got=%d\n", len(tt.expectedParams), len(function.Parameters))
+		}
+
+		for i, ident := range tt.expectedParams {
+			testLiteralExpression(t, function.Parameters[i], ident)
+
+			def := function.Default(i)
+			if tt.expectedDefaults[i] == "" {
+				if def != nil {
+					t.Errorf("parameter %s should not have a default. got=%q", ident, def.String())
+				}
+				continue
+			}
+
+			if def == nil || def.String() != tt.expectedDefaults[i] {
+				t.Errorf("wrong default for parameter %s. want=%q, got=%v", ident, tt.expectedDefaults[i], def)
+			}
+		}
+
+		if tt.expectedRest == "" {
+			if function.Rest != nil {
+				t.Errorf("function.Rest should be nil. got=%q", function.Rest.Value)
+			}
+			continue
+		}
+
+		if function.Rest == nil || function.Rest.Value != tt.expectedRest {
+			t.Errorf("wrong rest parameter. want=%q, got=%v", tt.expectedRest, function.Rest)
+		}
+	}
+}
+
+func TestInvalidFunctionParameters(t *testing.T) {
+	tests := []string{
+		"fn(a = 1, b) {};",
+		"fn(...rest, a) {};",
+		"fn(...) {};",
+		"fn(1) {};",
+	}
+
+	for _, input := range tests {
+		l := lexer.New(input)
+		p := New(l)
+		p.ParseProgram()
+
+		if len(p.Errors()) == 0 {
+			t.Errorf("expected parser errors for %q but got none", input)
+		}
+	}
+}
+
+func TestSpreadCallParsing(t *testing.T) {
+	input := "add(1, ...rest, ...[2, 3]);"
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	exp, ok := stmt.Expression.(*ast.CallExpression)
+	if !ok {
+		t.Fatalf("stmt.Expression is not ast.CallExpression. got=%T", stmt.Expression)
+	}
+
+	if len(exp.Arguments) != 3 {
+		t.Fatalf("wrong length of arguments. got=%d", len(exp.Arguments))
+	}
+
+	testLiteralExpression(t, exp.Arguments[0], 1)
+
+	spread, ok := exp.Arguments[1].(*ast.SpreadExpression)
+	if !ok {
+		t.Fatalf("exp.Arguments[1] is not ast.SpreadExpression. got=%T", exp.Arguments[1])
+	}
+	testIdentifier(t, spread.Value, "rest")
+
+	if exp.String() != "add(1, ...rest, ...[2, 3])" {
+		t.Errorf("exp.String() wrong. got=%q", exp.String())
+	}
+}
+
 func testIdentifier(t *testing.T, exp ast.Expression, value string) bool {
 	ident, ok := exp.(*ast.Identifier)
 	if !ok  {
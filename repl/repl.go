@@ -4,85 +4,335 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"os"
+	"strings"
+	"compiler/ast"
 	"compiler/compiler"
+	"compiler/disasm"
+	"compiler/evaluator"
 	"compiler/lexer"
-	"compiler/parser"
-//	"compiler/evaluator"
 	"compiler/object"
-//	"compiler/token"
+	"compiler/parser"
+	"compiler/rvm"
+	"compiler/token"
 	"compiler/vm"
 )
 
 const PROMPT = ">> "
+const CONTINUE_PROMPT = ".. " // Shown while braces, brackets or parentheses are still open
+
+const HELP = `meta-commands:
+  :ast                   toggle printing the parsed program before running it
+  :bytecode              toggle printing the compiled instructions before running them
+  :engine [vm|rvm|eval]  show or switch the engine, each engine keeps its own globals
+  :env                   list the globals of the current engine
+  :load <file>           run a file as if it was typed in
+  :reset                 forget all globals, methods and constants
+  :help                  show this message
+`
+
+type session struct {
+	out io.Writer
+
+	engine string
+	showAST bool
+	showBytecode bool
+
+	// State of the vm engine, carried from one input to the next
+	constants []object.Object
+	globals []object.Object
+	methods object.MethodTable
+	symbolTable *compiler.SymbolTable
+
+	// State of the rvm engine
+	rvmCompiler *rvm.Compiler
+	rvmMachine *rvm.VM
+
+	// State of the eval engine
+	env *object.Environment
+}
 
 func Start(in io.Reader, out io.Writer) {
 	scanner := bufio.NewScanner(in)
 
-	constants := []object.Object{}
-	globals := make([]object.Object, vm.GlobalsSize)
-	symbolTable := compiler.NewSymbolTable()
+	s := &session{out: out, engine: "vm"}
+	s.reset()
 
-	for i, v := range object.Builtins {
-		symbolTable.DefineBuiltin(i, v.Name)
-	}
-//	env := object.NewEnvironment()
+	var input strings.Builder
 
 	for {
-		fmt.Printf(PROMPT)
+		if input.Len() == 0 {
+			io.WriteString(out, PROMPT)
+		} else {
+			io.WriteString(out, CONTINUE_PROMPT)
+		}
+
 		scanned := scanner.Scan()
 		if !scanned {
 			return
 		}
 
 		line := scanner.Text()
-		l := lexer.New(line)
-
 
-		//  Outputs tokenization 
-		// for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
-		// 	fmt.Printf("%+v\n", tok)
-		// }
+		if input.Len() == 0 && strings.HasPrefix(strings.TrimSpace(line), ":") {
+			s.metaCommand(strings.TrimSpace(line))
+			continue
+		}
 
-		p := parser.New(l)
+		input.WriteString(line)
+		input.WriteString("\n")
 
-		program := p.ParseProgram()
-		if len(p.Errors()) != 0 {
-			printParserErrors(out, p.Errors())
+		if isIncomplete(input.String()) {
 			continue
 		}
 
-		//	Outputs parsed data 
-		// io.WriteString(out, program.String())
-		// io.WriteString(out, "\n")
+		s.run(input.String())
+		input.Reset()
+	}
+}
 
-		// Outputs evaluated data
-		// evaluated := evaluator.Eval(program, env)
-		// if evaluated != nil {
-		// 	io.WriteString(out, evaluated.Inspect())
-		// 	io.WriteString(out, "\n")
-		// }
+// An input is incomplete while it has more opening than closing delimiters, the lexer is used so ones inside strings are not counted
+func isIncomplete(input string) bool {
+	depth := 0
+
+	l := lexer.New(input)
+	for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+		switch tok.Type {
+		case token.LPAREN, token.LBRACE, token.LBRACKET:
+			depth++
+		case token.RPAREN, token.RBRACE, token.RBRACKET:
+			depth--
+		}
+	}
+
+	return depth > 0
+}
+
+func (s *session) reset() {
+	s.constants = []object.Object{}
+	s.globals = []object.Object{} // The VM grows it as inputs define more globals
+	s.methods = object.NewMethodTable()
+	s.symbolTable = compiler.NewSymbolTable()
+
+	for i, v := range object.Builtins {
+		s.symbolTable.DefineBuiltin(i, v.Name)
+	}
 
-		comp := compiler.NewWithState(symbolTable, constants)
-		err := comp.Compile(program)
+	s.rvmCompiler = rvm.NewCompiler()
+	s.rvmMachine = rvm.New()
+
+	s.env = object.NewEnvironment()
+}
+
+func (s *session) metaCommand(line string) {
+	fields := strings.Fields(line)
+	command, args := fields[0], fields[1:]
+
+	switch command {
+	case ":ast":
+		s.showAST = !s.showAST
+		fmt.Fprintf(s.out, "printing the ast is %s\n", onOff(s.showAST))
+	case ":bytecode":
+		s.showBytecode = !s.showBytecode
+		fmt.Fprintf(s.out, "printing bytecode is %s\n", onOff(s.showBytecode))
+	case ":engine":
+		if len(args) == 0 {
+			fmt.Fprintf(s.out, "engine is %s\n", s.engine)
+			return
+		}
+
+		if args[0] != "vm" && args[0] != "rvm" && args[0] != "eval" {
+			fmt.Fprintf(s.out, "unknown engine %q, use vm, rvm or eval\n", args[0])
+			return
+		}
+
+		s.engine = args[0]
+		fmt.Fprintf(s.out, "switched to the %s engine\n", s.engine)
+	case ":env":
+		s.printEnv()
+	case ":load":
+		if len(args) != 1 {
+			io.WriteString(s.out, "usage: :load <file>\n")
+			return
+		}
+
+		src, err := os.ReadFile(args[0])
 		if err != nil {
-			fmt.Fprintf(out, "Whoops! Compilation failed:\n%s\n", err)
+			fmt.Fprintf(s.out, "%s\n", err)
+			return
+		}
+
+		s.run(string(src))
+	case ":reset":
+		s.reset()
+		io.WriteString(s.out, "state cleared\n")
+	case ":help":
+		io.WriteString(s.out, HELP)
+	default:
+		fmt.Fprintf(s.out, "unknown meta-command %s, try :help\n", command)
+	}
+}
+
+func (s *session) printEnv() {
+	if s.engine == "eval" {
+		for _, name := range s.env.Names() {
+			val, _ := s.env.Get(name)
+			fmt.Fprintf(s.out, "%s = %s\n", name, val.Inspect())
+		}
+		return
+	}
+
+	if s.engine == "rvm" {
+		for _, global := range s.rvmCompiler.Globals() {
+			val := s.rvmMachine.Global(global.Index)
+			if val == nil {
+				continue
+			}
+			fmt.Fprintf(s.out, "%s = %s\n", global.Name, val.Inspect())
+		}
+		return
+	}
+
+	for _, symbol := range s.symbolTable.Symbols() {
+		if symbol.Scope != compiler.GlobalScope {
 			continue
 		}
 
-		code := comp.Bytecode()
-		constants = code.Constants
+		if symbol.Index >= len(s.globals) { // Defined by an input that failed to compile, so it never had a slot
+			continue
+		}
 
-		machine := vm.NewWithGlobalsStore(code, globals)
-		err = machine.Run()
-		if err != nil {
-			fmt.Fprintf(out, "Woops! Executing bytecode failed:\n %s\n", err)
+		val := s.globals[symbol.Index]
+		if val == nil {
+			continue
+		}
+		fmt.Fprintf(s.out, "%s = %s\n", symbol.Name, val.Inspect())
+	}
+}
+
+func (s *session) run(input string) {
+	l := lexer.New(input)
+	p := parser.New(l)
+
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		printParserErrors(s.out, p.Errors())
+		return
+	}
+
+	if s.showAST {
+		io.WriteString(s.out, program.String())
+		io.WriteString(s.out, "\n")
+	}
+
+	if s.engine == "eval" {
+		evaluated := evaluator.Eval(program, s.env)
+		if evaluated != nil {
+			io.WriteString(s.out, evaluated.Inspect())
+			io.WriteString(s.out, "\n")
+		}
+		return
+	}
+
+	if s.engine == "rvm" {
+		s.runRVM(program)
+		return
+	}
+
+	s.runVM(program)
+}
+
+func (s *session) runVM(program *ast.Program) {
+	comp := compiler.NewWithState(s.symbolTable, s.constants)
+	err := comp.Compile(program)
+	if err != nil {
+		fmt.Fprintf(s.out, "Whoops! Compilation failed:\n%s\n", err)
+		return
+	}
+
+	for _, warning := range comp.Warnings() {
+		fmt.Fprintf(s.out, "warning: %s\n", warning)
+	}
+
+	code := comp.Bytecode()
+
+	if s.showBytecode {
+		s.printBytecode(code, len(s.constants))
+	}
+
+	s.constants = code.Constants
+
+	machine := vm.NewWithState(code, s.globals, s.methods)
+	err = machine.Run()
+	s.globals = machine.Globals() // Kept even when the run fails, globals set before the error stay defined
+	if err != nil {
+		fmt.Fprintf(s.out, "Woops! Executing bytecode failed:\n %s\n", err)
+		for _, line := range machine.StackTrace() {
+			fmt.Fprintf(s.out, "   %s\n", line)
+		}
+		return
+	}
+
+	stackTop := machine.LastPoppedStackElem()
+	if stackTop == nil { // Nothing was popped, like after a let statement in a fresh session
+		return
+	}
+
+	io.WriteString(s.out, stackTop.Inspect())
+	io.WriteString(s.out, "\n")
+}
+
+func (s *session) runRVM(program *ast.Program) {
+	compiled, err := s.rvmCompiler.Compile(program)
+	if err != nil {
+		fmt.Fprintf(s.out, "Whoops! Compilation failed:\n%s\n", err)
+		return
+	}
+
+	for _, warning := range s.rvmCompiler.Warnings() {
+		fmt.Fprintf(s.out, "warning: %s\n", warning)
+	}
+
+	if s.showBytecode {
+		io.WriteString(s.out, compiled.Main.String())
+	}
+
+	result, err := s.rvmMachine.Run(compiled)
+	if err != nil {
+		fmt.Fprintf(s.out, "Woops! Executing bytecode failed:\n %s\n", err)
+		for _, line := range s.rvmMachine.StackTrace() {
+			fmt.Fprintf(s.out, "   %s\n", line)
+		}
+		return
+	}
+
+	if result == nil {
+		return
+	}
+
+	io.WriteString(s.out, result.Inspect())
+	io.WriteString(s.out, "\n")
+}
+
+// Prints the main instructions and the functions this input added to the constant pool, earlier ones were already shown
+func (s *session) printBytecode(code *compiler.Bytecode, firstNew int) {
+	disasm.FprintMain(s.out, code)
+
+	for i := firstNew; i < len(code.Constants); i++ {
+		fn, ok := code.Constants[i].(*object.CompiledFunction)
+		if !ok {
 			continue
 		}
 
-		stackTop := machine.LastPoppedStackElem()
-		io.WriteString(out, stackTop.Inspect())
-		io.WriteString(out, "\n")
+		disasm.FprintFunction(s.out, i, fn, code.Constants)
+	}
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
 	}
+	return "off"
 }
 
 func printParserErrors(out io.Writer, errors []string) {
@@ -91,4 +341,4 @@ func printParserErrors(out io.Writer, errors []string) {
 		io.WriteString(out, "parser errors:\n")
 		io.WriteString(out, "\t" + msg + "\n")
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,103 @@
+package repl
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func runSession(input string) string {
+	var out bytes.Buffer
+	Start(strings.NewReader(input), &out)
+	return out.String()
+}
+
+func TestMultiLineInput(t *testing.T) {
+	out := runSession("let add = fn(a, b) {\n  a + b\n};\nadd(\n1, 2)\n")
+
+	if strings.Count(out, CONTINUE_PROMPT) != 3 {
+		t.Errorf("expected 3 continuation prompts. got=%q", out)
+	}
+
+	if !strings.Contains(out, "3\n") {
+		t.Errorf("expected the result of the multi-line call. got=%q", out)
+	}
+}
+
+func TestIsIncomplete(t *testing.T) {
+	tests := []struct {
+		input string
+		expected bool
+	} {
+		{"let x = 1;", false},
+		{"fn(x) {", true},
+		{"[1, [2,", true},
+		{"{\"a\": 1}", false},
+		{"\"{\"", false},
+		{"}", false},
+	}
+
+	for _, tt := range tests {
+		if isIncomplete(tt.input) != tt.expected {
+			t.Errorf("isIncomplete(%q) wrong. want=%t", tt.input, tt.expected)
+		}
+	}
+}
+
+func TestMetaCommands(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lib.cel")
+	err := os.WriteFile(path, []byte("let double = fn(x) { x * 2 };"), 0o644)
+	if err != nil {
+		t.Fatalf("could not write file: %s", err)
+	}
+
+	tests := []struct {
+		input string
+		contains []string
+		excludes []string
+	} {
+		{":ast\nlet x = 1 + 2;\n", []string{"let x = (1 + 2);"}, nil},
+		{":bytecode\n1 + 2\n", []string{"OpAdd", "3"}, nil},
+		{"let f = fn() { 1 };\n:bytecode\nfn g(x) { \"hi\" }\n", []string{"fn g (params 1, locals 1, free 0)", `; "hi"`}, []string{"== constant 1: fn f"}},
+		{"let x = 5;\nmatch x { y => y }\n:env\n", []string{"x = 5"}, []string{"#"}},
+		{":engine eval\nlet x = 7;\n:env\n:engine\n", []string{"switched to the eval engine", "x = 7", "engine is eval"}, nil},
+		{"let x = 5;\n:engine eval\nx\n", []string{"identifier not found: x"}, nil},
+		{":engine rvm\nlet add = fn(a, b) { a + b };\nadd(2, 3)\n:env\n", []string{"switched to the rvm engine", "5", "add = Closure[add]"}, nil},
+		{":engine rvm\n:bytecode\nfn(a) { a + 1 }\n", []string{"ADDK R1 R0 K0"}, nil},
+		{":load " + path + "\ndouble(21)\n", []string{"42"}, nil},
+		{"let x = 5;\n:reset\nx\n", []string{"Undefined variable x"}, nil},
+		{":nope\n", []string{"unknown meta-command :nope"}, nil},
+		{"let x = 1;\nlet y = nope;\n:env\nlet z = x + 1;\nz\n", []string{"Undefined variable nope", "x = 1", "2"}, []string{"y ="}},
+	}
+
+	for _, tt := range tests {
+		out := runSession(tt.input)
+
+		for _, s := range tt.contains {
+			if !strings.Contains(out, s) {
+				t.Errorf("input %q: expected output to contain %q. got=%q", tt.input, s, out)
+			}
+		}
+
+		for _, s := range tt.excludes {
+			if strings.Contains(out, s) {
+				t.Errorf("input %q: expected output not to contain %q. got=%q", tt.input, s, out)
+			}
+		}
+	}
+}
+
+func TestConstantsReusedAcrossInputs(t *testing.T) {
+	s := &session{out: &bytes.Buffer{}, engine: "vm"}
+	s.reset()
+
+	for i := 0; i < 10; i++ {
+		s.run(`let greeting = "hello"; greeting + " " + "world"; 1 + 1`)
+	}
+
+	if len(s.constants) != 4 {
+		t.Errorf("constants grew across inputs. want=4, got=%d", len(s.constants))
+	}
+}
@@ -0,0 +1,165 @@
+// Package rvm is a register based backend, an alternative to the stack VM in package vm. It compiles
+// the same AST into its own instruction set where every instruction names the registers it reads and
+// writes, so a statement like x + 1 is one instruction instead of three pushes and a pop.
+package rvm
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Opcode byte
+
+// R[n] is register n of the current call, K[n] is constant n and G[n] is global n
+const (
+	OpMove Opcode = iota // R[A] = R[B]
+	OpLoadK // R[A] = K[B]
+	OpLoadTrue // R[A] = true
+	OpLoadFalse // R[A] = false
+	OpLoadNull // R[A] = null
+	OpGetGlobal // R[A] = G[B]
+	OpSetGlobal // G[B] = R[A]
+	OpGetFree // R[A] = free variable B of the running closure
+	OpGetBuiltin // R[A] = builtin B
+	OpCurrentClosure // R[A] = the running closure, for functions calling themselves by name
+	OpAdd // R[A] = R[B] + R[C]
+	OpSub // R[A] = R[B] - R[C]
+	OpMul // R[A] = R[B] * R[C]
+	OpDiv // R[A] = R[B] / R[C]
+	OpAddK // R[A] = R[B] + K[C]
+	OpSubK // R[A] = R[B] - K[C]
+	OpEqual // R[A] = R[B] == R[C]
+	OpNotEqual // R[A] = R[B] != R[C]
+	OpGreater // R[A] = R[B] > R[C]
+	OpMinus // R[A] = -R[B]
+	OpNot // R[A] = !R[B]
+	OpJump // Continue at A
+	OpJumpIfFalse // Continue at B unless R[A] is truthy
+	OpJumpIfNotGreater // Continue at C unless R[A] > R[B]
+	OpJumpIfNotEqual // Continue at C unless R[A] == R[B]
+	OpArray // R[A] = [R[B], ..., R[B+C-1]]
+	OpHash // R[A] = {R[B]: R[B+1], ...} with C pairs
+	OpIndex // R[A] = R[B][R[C]]
+	OpClosure // R[A] = closure over prototype B, capturing what the prototype lists
+	OpCall // R[A] = R[A](R[A+1], ..., R[A+B])
+	OpTailCall // OpCall whose result the function returns right away, a closure takes over the current frame
+	OpCallSpread // R[A] = R[A](the arrays R[A+1], ..., R[A+B] flattened)
+	OpTailCallSpread // OpCallSpread whose result the function returns right away, like OpTailCall
+	OpCallMethod // R[A] = R[A].K[C](R[A+1], ..., R[A+B]), R[A+B+1] must be free for the receiver to move into
+	OpDefineMethod // The method K[B] of type K[A] is R[C]
+	OpSkipDefault // Continue at B when the caller passed more than A arguments
+	OpMatchEqual // R[A] = R[B] and R[C] are equal values
+	OpMatchArray // R[A] = R[B] is an array with C elements
+	OpMatchHash // R[A] = R[B] is a hash
+	OpMatchKey // R[A] = the hash R[B] has the key R[C]
+	OpDestructureArray // R[A], ..., R[A+B-1] = the elements of R[A], and the rest in R[A+B] if C has DestructureRest
+	OpDestructureHash // R[A], ..., R[A+B-1] = the values of R[A] under the keys R[A+1], ..., R[A+B]
+	OpReturn // Return R[A]
+	OpReturnNull // Return null
+)
+
+// Flags of the destructuring instructions, the same ones the stack VM uses
+const (
+	DestructureRest = 1 << iota
+	DestructureStrict
+)
+
+type Instruction struct {
+	Op Opcode
+	A, B, C int
+}
+
+type operandKind int
+
+const (
+	unused operandKind = iota
+	register
+	constant
+	target // An instruction index
+	number // Anything else, like a count or a global index
+)
+
+type Definition struct {
+	Name string
+	operands [3]operandKind
+}
+
+var definitions = map[Opcode]*Definition{
+	OpMove: {"MOVE", [3]operandKind{register, register}},
+	OpLoadK: {"LOADK", [3]operandKind{register, constant}},
+	OpLoadTrue: {"LOADTRUE", [3]operandKind{register}},
+	OpLoadFalse: {"LOADFALSE", [3]operandKind{register}},
+	OpLoadNull: {"LOADNULL", [3]operandKind{register}},
+	OpGetGlobal: {"GETGLOBAL", [3]operandKind{register, number}},
+	OpSetGlobal: {"SETGLOBAL", [3]operandKind{register, number}},
+	OpGetFree: {"GETFREE", [3]operandKind{register, number}},
+	OpGetBuiltin: {"GETBUILTIN", [3]operandKind{register, number}},
+	OpCurrentClosure: {"CURRENTCLOSURE", [3]operandKind{register}},
+	OpAdd: {"ADD", [3]operandKind{register, register, register}},
+	OpSub: {"SUB", [3]operandKind{register, register, register}},
+	OpMul: {"MUL", [3]operandKind{register, register, register}},
+	OpDiv: {"DIV", [3]operandKind{register, register, register}},
+	OpAddK: {"ADDK", [3]operandKind{register, register, constant}},
+	OpSubK: {"SUBK", [3]operandKind{register, register, constant}},
+	OpEqual: {"EQ", [3]operandKind{register, register, register}},
+	OpNotEqual: {"NE", [3]operandKind{register, register, register}},
+	OpGreater: {"GT", [3]operandKind{register, register, register}},
+	OpMinus: {"MINUS", [3]operandKind{register, register}},
+	OpNot: {"NOT", [3]operandKind{register, register}},
+	OpJump: {"JUMP", [3]operandKind{target}},
+	OpJumpIfFalse: {"JUMPIFFALSE", [3]operandKind{register, target}},
+	OpJumpIfNotGreater: {"JUMPIFNOTGT", [3]operandKind{register, register, target}},
+	OpJumpIfNotEqual: {"JUMPIFNOTEQ", [3]operandKind{register, register, target}},
+	OpArray: {"ARRAY", [3]operandKind{register, register, number}},
+	OpHash: {"HASH", [3]operandKind{register, register, number}},
+	OpIndex: {"INDEX", [3]operandKind{register, register, register}},
+	OpClosure: {"CLOSURE", [3]operandKind{register, number}},
+	OpCall: {"CALL", [3]operandKind{register, number}},
+	OpTailCall: {"TAILCALL", [3]operandKind{register, number}},
+	OpCallSpread: {"CALLSPREAD", [3]operandKind{register, number}},
+	OpTailCallSpread: {"TAILCALLSPREAD", [3]operandKind{register, number}},
+	OpCallMethod: {"CALLMETHOD", [3]operandKind{register, number, constant}},
+	OpDefineMethod: {"DEFINEMETHOD", [3]operandKind{constant, constant, register}},
+	OpSkipDefault: {"SKIPDEFAULT", [3]operandKind{number, target}},
+	OpMatchEqual: {"MATCHEQ", [3]operandKind{register, register, register}},
+	OpMatchArray: {"MATCHARRAY", [3]operandKind{register, register, number}},
+	OpMatchHash: {"MATCHHASH", [3]operandKind{register, register}},
+	OpMatchKey: {"MATCHKEY", [3]operandKind{register, register, register}},
+	OpDestructureArray: {"DESTRUCTUREARRAY", [3]operandKind{register, number, number}},
+	OpDestructureHash: {"DESTRUCTUREHASH", [3]operandKind{register, number, number}},
+	OpReturn: {"RETURN", [3]operandKind{register}},
+	OpReturnNull: {"RETURNNULL", [3]operandKind{}},
+}
+
+func Lookup(op Opcode) (*Definition, error) {
+	def, ok := definitions[op]
+	if !ok {
+		return nil, fmt.Errorf("opcode %d undefined", op)
+	}
+
+	return def, nil
+}
+
+// Registers print as R0, constants as K0 and jump targets as @0, like the comments above
+func (ins Instruction) String() string {
+	def, err := Lookup(ins.Op)
+	if err != nil {
+		return fmt.Sprintf("ERROR: %s", err)
+	}
+
+	parts := []string{def.Name}
+	for i, value := range [3]int{ins.A, ins.B, ins.C} {
+		switch def.operands[i] {
+		case register:
+			parts = append(parts, fmt.Sprintf("R%d", value))
+		case constant:
+			parts = append(parts, fmt.Sprintf("K%d", value))
+		case target:
+			parts = append(parts, fmt.Sprintf("@%d", value))
+		case number:
+			parts = append(parts, fmt.Sprint(value))
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,831 @@
+package rvm
+
+import (
+	"fmt"
+	"sort"
+	"compiler/ast"
+	"compiler/object"
+)
+
+// Program is what Compile produces, the constants are shared by every program a Compiler made so
+// closures from earlier ones keep working when the REPL runs later input
+type Program struct {
+	Main *Function
+	Constants []object.Object
+}
+
+type Options struct {
+	Strict bool // Missing elements or keys in a destructuring let are a runtime error instead of a null binding
+}
+
+type Compiler struct {
+	constants []object.Object
+	interned map[constantKey]int
+	globals *symbolTable
+	fn *function
+	options Options
+	warnings []string
+	matchDepth int // How many match expressions the code being compiled is nested in
+}
+
+type constantKey struct {
+	objType object.ObjectType
+	value string
+}
+
+// Temporaries are numbered from tempBase while a function is compiled, since a let further down can still add a
+// local below them. Once the function is done they are moved to the registers right after its locals.
+const tempBase = 1 << 24
+
+// mainResult is the register the main program keeps the value of its last statement in, the REPL prints it
+const mainResult = 0
+
+type function struct {
+	outer *function
+	symbols *symbolTable
+	instructions []Instruction
+	functions []*Function
+	temps int
+	maxTemps int
+	isMain bool
+}
+
+func NewCompiler() *Compiler {
+	globals := newSymbolTable(nil)
+	for i, v := range object.Builtins {
+		globals.defineBuiltin(i, v.Name)
+	}
+
+	return &Compiler{
+		constants: []object.Object{},
+		interned: map[constantKey]int{},
+		globals: globals,
+	}
+}
+
+func (c *Compiler) SetOptions(options Options) {
+	c.options = options
+}
+
+// DefineGlobal reserves a global before the program is compiled, the CLI puts the script arguments in one
+func (c *Compiler) DefineGlobal(name string) int {
+	return c.globals.define(name).index
+}
+
+type Global struct {
+	Name string
+	Index int
+}
+
+// Globals lists the globals defined so far in index order
+func (c *Compiler) Globals() []Global {
+	return c.globals.globals()
+}
+
+// Warnings are problems found by the last Compile that do not stop compilation, like a match expression without a _ arm
+func (c *Compiler) Warnings() []string {
+	return c.warnings
+}
+
+// Compile can be called again with more input, the globals and constants of earlier programs stay defined
+func (c *Compiler) Compile(program *ast.Program) (*Program, error) {
+	c.warnings = nil
+	c.fn = &function{symbols: c.globals, isMain: true}
+
+	for _, s := range program.Statements {
+		err := c.compileStatement(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.emit(OpReturn, mainResult, 0, 0)
+
+	main := c.finish(c.fn)
+	c.fn = nil
+
+	return &Program{Main: main, Constants: c.constants}, nil
+}
+
+// The main program's only local is the result register, its names are all globals
+func (fn *function) numLocals() int {
+	if fn.isMain {
+		return 1
+	}
+
+	return fn.symbols.numDefinitions
+}
+
+// Moves the temporaries down to right after the locals, now that the number of locals is known
+func (c *Compiler) finish(fn *function) *Function {
+	numLocals := fn.numLocals()
+
+	for i := range fn.instructions {
+		ins := &fn.instructions[i]
+		def := definitions[ins.Op]
+
+		operands := [3]*int{&ins.A, &ins.B, &ins.C}
+		for j, kind := range def.operands {
+			if kind == register && *operands[j] >= tempBase {
+				*operands[j] = *operands[j] - tempBase + numLocals
+			}
+		}
+	}
+
+	return &Function{
+		Instructions: fn.instructions,
+		NumRegisters: numLocals + fn.maxTemps,
+		Functions: fn.functions,
+	}
+}
+
+func (c *Compiler) emit(op Opcode, a, b, cc int) int {
+	c.fn.instructions = append(c.fn.instructions, Instruction{Op: op, A: a, B: b, C: cc})
+	return len(c.fn.instructions) - 1
+}
+
+// Points the jump at index to the next instruction that will be emitted
+func (c *Compiler) patchJump(index int) {
+	ins := &c.fn.instructions[index]
+	next := len(c.fn.instructions)
+
+	operands := [3]*int{&ins.A, &ins.B, &ins.C}
+	for i, kind := range definitions[ins.Op].operands {
+		if kind == target {
+			*operands[i] = next
+		}
+	}
+}
+
+func (c *Compiler) temp() int {
+	r := tempBase + c.fn.temps
+	c.fn.temps++
+	if c.fn.temps > c.fn.maxTemps {
+		c.fn.maxTemps = c.fn.temps
+	}
+
+	return r
+}
+
+// Frees every temporary allocated since temps was mark
+func (c *Compiler) freeTemps(mark int) {
+	c.fn.temps = mark
+}
+
+func (c *Compiler) addConstant(obj object.Object) int {
+	key, ok := constantKeyOf(obj)
+	if ok {
+		if index, found := c.interned[key]; found {
+			return index
+		}
+	}
+
+	c.constants = append(c.constants, obj)
+	index := len(c.constants) - 1
+
+	if ok {
+		c.interned[key] = index
+	}
+	return index
+}
+
+func constantKeyOf(obj object.Object) (constantKey, bool) {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return constantKey{obj.Type(), obj.Inspect()}, true
+	case *object.String:
+		return constantKey{obj.Type(), obj.Value}, true
+	}
+
+	return constantKey{}, false
+}
+
+func (c *Compiler) compileStatement(node ast.Statement) error {
+	mark := c.fn.temps
+	defer c.freeTemps(mark)
+
+	switch node := node.(type) {
+	case *ast.ExpressionStatement:
+		if c.fn.isMain {
+			return c.compileExpression(node.Expression, mainResult)
+		}
+
+		_, err := c.operand(node.Expression)
+		return err
+
+	case *ast.LetStatement:
+		symbol := c.fn.symbols.define(node.Name.Value) // Defined first so a function can call itself by the name it is bound to
+
+		if symbol.scope == localScope {
+			return c.compileExpression(node.Value, symbol.index)
+		}
+
+		err := c.compileExpression(node.Value, mainResult) // Like the stack VM, a let at the top level leaves its value as the result
+		if err != nil {
+			return err
+		}
+
+		c.emit(OpSetGlobal, mainResult, symbol.index, 0)
+
+	case *ast.DestructuringLetStatement:
+		return c.compileDestructuringLetStatement(node)
+
+	case *ast.ReturnStatement:
+		r, err := c.operand(node.ReturnValue)
+		if err != nil {
+			return err
+		}
+
+		c.emit(OpReturn, r, 0, 0)
+
+	case *ast.ImplStatement:
+		objType, ok := object.LookupTypeName(node.Type.Value)
+		if !ok {
+			return fmt.Errorf("unknown type %s", node.Type.Value)
+		}
+
+		typeName := c.addConstant(&object.String{Value: string(objType)})
+
+		for _, m := range node.Methods {
+			r := c.temp()
+			err := c.compileExpression(m.Function, r)
+			if err != nil {
+				return err
+			}
+
+			name := c.addConstant(&object.String{Value: m.Name.Value})
+			c.emit(OpDefineMethod, typeName, name, r)
+		}
+
+	case *ast.BlockStatement:
+		for _, s := range node.Statements {
+			err := c.compileStatement(s)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// The value of a block is the value of its last statement when that is an expression, null otherwise
+func (c *Compiler) compileBlock(block *ast.BlockStatement, dst int) error {
+	for i, s := range block.Statements {
+		if es, ok := s.(*ast.ExpressionStatement); ok && i == len(block.Statements)-1 {
+			mark := c.fn.temps
+			err := c.compileExpression(es.Expression, dst)
+			c.freeTemps(mark)
+			return err
+		}
+
+		err := c.compileStatement(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.emit(OpLoadNull, dst, 0, 0)
+	return nil
+}
+
+// operand returns a register holding the value of node. A local is used where it is instead of being copied,
+// which is safe because nothing writes to a local's register once its let has run.
+func (c *Compiler) operand(node ast.Expression) (int, error) {
+	if ident, ok := node.(*ast.Identifier); ok {
+		if symbol, ok := c.fn.symbols.resolve(ident.Value); ok && symbol.scope == localScope {
+			return symbol.index, nil
+		}
+	}
+
+	r := c.temp()
+	return r, c.compileExpression(node, r)
+}
+
+// Computes node into the register dst, the temporaries it needs are freed again before it returns
+func (c *Compiler) compileExpression(node ast.Expression, dst int) error {
+	mark := c.fn.temps
+	defer c.freeTemps(mark)
+
+	switch node := node.(type) {
+	case *ast.IntegerLiteral:
+		c.emit(OpLoadK, dst, c.addConstant(&object.Integer{Value: node.Value}), 0)
+
+	case *ast.StringLiteral:
+		c.emit(OpLoadK, dst, c.addConstant(&object.String{Value: node.Value}), 0)
+
+	case *ast.Boolean:
+		if node.Value {
+			c.emit(OpLoadTrue, dst, 0, 0)
+		} else {
+			c.emit(OpLoadFalse, dst, 0, 0)
+		}
+
+	case *ast.Identifier:
+		symbol, ok := c.fn.symbols.resolve(node.Value)
+		if !ok {
+			return fmt.Errorf("Undefined variable %s", node.Value)
+		}
+
+		c.loadSymbol(symbol, dst)
+
+	case *ast.PrefixExpression:
+		r, err := c.operand(node.Right)
+		if err != nil {
+			return err
+		}
+
+		switch node.Operator {
+		case "!":
+			c.emit(OpNot, dst, r, 0)
+		case "-":
+			c.emit(OpMinus, dst, r, 0)
+		default:
+			return fmt.Errorf("unknown operator %s", node.Operator)
+		}
+
+	case *ast.InfixExpression:
+		return c.compileInfix(node, dst)
+
+	case *ast.IfExpression:
+		jump, err := c.compileCondition(node.Condition)
+		if err != nil {
+			return err
+		}
+
+		err = c.compileBlock(node.Consequence, dst)
+		if err != nil {
+			return err
+		}
+
+		end := c.emit(OpJump, 0, 0, 0)
+		c.patchJump(jump)
+
+		if node.Alternative == nil {
+			c.emit(OpLoadNull, dst, 0, 0)
+		} else {
+			err := c.compileBlock(node.Alternative, dst)
+			if err != nil {
+				return err
+			}
+		}
+
+		c.patchJump(end)
+
+	case *ast.ArrayLiteral:
+		first, err := c.compileSequence(node.Elements)
+		if err != nil {
+			return err
+		}
+
+		c.emit(OpArray, dst, first, len(node.Elements))
+
+	case *ast.HashLiteral:
+		keys := []ast.Expression{}
+		for k := range node.Pairs {
+			keys = append(keys, k)
+		}
+
+		sort.Slice(keys, func(i, j int) bool { // Same order as the stack compiler, so keys are evaluated in the same order
+			return keys[i].String() < keys[j].String()
+		})
+
+		elements := []ast.Expression{}
+		for _, k := range keys {
+			elements = append(elements, k, node.Pairs[k])
+		}
+
+		first, err := c.compileSequence(elements)
+		if err != nil {
+			return err
+		}
+
+		c.emit(OpHash, dst, first, len(keys))
+
+	case *ast.IndexExpression:
+		left, err := c.operand(node.Left)
+		if err != nil {
+			return err
+		}
+
+		index, err := c.operand(node.Index)
+		if err != nil {
+			return err
+		}
+
+		c.emit(OpIndex, dst, left, index)
+
+	case *ast.FunctionLiteral:
+		index, err := c.compileFunction(node)
+		if err != nil {
+			return err
+		}
+
+		c.emit(OpClosure, dst, index, 0)
+
+	case *ast.CallExpression:
+		return c.compileCall(node, dst)
+
+	case *ast.MethodCallExpression:
+		return c.compileMethodCall(node, dst)
+
+	case *ast.SpreadExpression: // Calls handle their spread arguments themselves, so reaching one here means it is somewhere else
+		return errSpreadOutsideCall()
+
+	case *ast.MatchExpression:
+		return c.compileMatchExpression(node, dst)
+
+	default:
+		return fmt.Errorf("unsupported expression %T", node)
+	}
+
+	return nil
+}
+
+func (c *Compiler) loadSymbol(symbol symbol, dst int) {
+	switch symbol.scope {
+	case localScope:
+		if symbol.index != dst {
+			c.emit(OpMove, dst, symbol.index, 0)
+		}
+	case globalScope:
+		c.emit(OpGetGlobal, dst, symbol.index, 0)
+	case builtinScope:
+		c.emit(OpGetBuiltin, dst, symbol.index, 0)
+	case freeScope:
+		c.emit(OpGetFree, dst, symbol.index, 0)
+	case functionScope:
+		c.emit(OpCurrentClosure, dst, 0, 0)
+	}
+}
+
+// Computes the expressions into consecutive temporaries and returns the first one, they stay allocated
+func (c *Compiler) compileSequence(nodes []ast.Expression) (int, error) {
+	first := tempBase + c.fn.temps
+	for _, n := range nodes {
+		err := c.compileExpression(n, c.temp())
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return first, nil
+}
+
+func (c *Compiler) compileInfix(node *ast.InfixExpression, dst int) error {
+	if node.Operator == "<" { // The operands are swapped for OpGreater, and like in the stack VM the right one is evaluated first
+		right, err := c.operand(node.Right)
+		if err != nil {
+			return err
+		}
+
+		left, err := c.operand(node.Left)
+		if err != nil {
+			return err
+		}
+
+		c.emit(OpGreater, dst, right, left)
+		return nil
+	}
+
+	left, err := c.operand(node.Left)
+	if err != nil {
+		return err
+	}
+
+	if integer, ok := node.Right.(*ast.IntegerLiteral); ok && (node.Operator == "+" || node.Operator == "-") {
+		k := c.addConstant(&object.Integer{Value: integer.Value})
+		if node.Operator == "+" {
+			c.emit(OpAddK, dst, left, k)
+		} else {
+			c.emit(OpSubK, dst, left, k)
+		}
+		return nil
+	}
+
+	right, err := c.operand(node.Right)
+	if err != nil {
+		return err
+	}
+
+	switch node.Operator {
+	case "+":
+		c.emit(OpAdd, dst, left, right)
+	case "-":
+		c.emit(OpSub, dst, left, right)
+	case "*":
+		c.emit(OpMul, dst, left, right)
+	case "/":
+		c.emit(OpDiv, dst, left, right)
+	case ">":
+		c.emit(OpGreater, dst, left, right)
+	case "==":
+		c.emit(OpEqual, dst, left, right)
+	case "!=":
+		c.emit(OpNotEqual, dst, left, right)
+	default:
+		return fmt.Errorf("unknown operator %s", node.Operator)
+	}
+
+	return nil
+}
+
+// Emits a jump taken when the condition is false and returns it for patching. Comparisons jump on
+// their operands directly instead of materializing a boolean first.
+func (c *Compiler) compileCondition(condition ast.Expression) (int, error) {
+	mark := c.fn.temps
+	defer c.freeTemps(mark)
+
+	if infix, ok := condition.(*ast.InfixExpression); ok {
+		first, second := infix.Left, infix.Right
+		if infix.Operator == "<" {
+			first, second = infix.Right, infix.Left
+		}
+
+		var op Opcode
+		switch infix.Operator {
+		case ">", "<":
+			op = OpJumpIfNotGreater
+		case "==":
+			op = OpJumpIfNotEqual
+		}
+
+		if op != 0 {
+			a, err := c.operand(first)
+			if err != nil {
+				return 0, err
+			}
+
+			b, err := c.operand(second)
+			if err != nil {
+				return 0, err
+			}
+
+			return c.emit(op, a, b, 0), nil
+		}
+	}
+
+	r, err := c.operand(condition)
+	if err != nil {
+		return 0, err
+	}
+
+	return c.emit(OpJumpIfFalse, r, 0, 0), nil
+}
+
+func (c *Compiler) compileFunction(node *ast.FunctionLiteral) (int, error) {
+	fn := &function{outer: c.fn, symbols: newSymbolTable(c.fn.symbols)}
+	c.fn = fn
+
+	if node.Name != "" {
+		fn.symbols.defineFunctionName(node.Name) // Defined first so parameters with the same name shadow it
+	}
+
+	for _, p := range node.Parameters {
+		fn.symbols.define(p.Value)
+	}
+
+	if node.Rest != nil {
+		fn.symbols.define(node.Rest.Value) // The register right after the parameters, where the VM collects the extra arguments
+	}
+
+	numDefaults := 0
+	for i := range node.Parameters { // Defaults run at call time, in the parameter's own register, unless the caller passed it
+		def := node.Default(i)
+		if def == nil {
+			continue
+		}
+		numDefaults++
+
+		skip := c.emit(OpSkipDefault, i, 0, 0)
+
+		err := c.compileExpression(def, i)
+		if err != nil {
+			return 0, err
+		}
+
+		c.patchJump(skip)
+	}
+
+	err := c.compileBody(node.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	markTailCalls(fn.instructions)
+	compiled := c.finish(fn)
+	compiled.NumParameters = len(node.Parameters)
+	compiled.NumDefaults = numDefaults
+	compiled.Variadic = node.Rest != nil
+	compiled.Name = node.Name
+
+	for _, s := range fn.symbols.free {
+		switch s.scope {
+		case localScope:
+			compiled.Captures = append(compiled.Captures, Capture{kind: captureRegister, index: s.index})
+		case freeScope:
+			compiled.Captures = append(compiled.Captures, Capture{kind: captureFree, index: s.index})
+		case functionScope:
+			compiled.Captures = append(compiled.Captures, Capture{kind: captureSelf})
+		}
+	}
+
+	c.fn = fn.outer
+	c.fn.functions = append(c.fn.functions, compiled)
+
+	return len(c.fn.functions) - 1, nil
+}
+
+// A function returns the value of its last expression statement, or null when it ends any other way
+func (c *Compiler) compileBody(body *ast.BlockStatement) error {
+	statements := body.Statements
+
+	for i, s := range statements {
+		if es, ok := s.(*ast.ExpressionStatement); ok && i == len(statements)-1 {
+			r, err := c.operand(es.Expression)
+			if err != nil {
+				return err
+			}
+
+			c.emit(OpReturn, r, 0, 0)
+			return nil
+		}
+
+		err := c.compileStatement(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	if n := len(statements); n == 0 || !isReturn(statements[n-1]) {
+		c.emit(OpReturnNull, 0, 0, 0)
+	}
+
+	return nil
+}
+
+func isReturn(s ast.Statement) bool {
+	_, ok := s.(*ast.ReturnStatement)
+	return ok
+}
+
+// Lua style: the callee and the arguments go into consecutive registers and the result replaces the callee
+func (c *Compiler) compileCall(node *ast.CallExpression, dst int) error {
+	base := c.callBase(dst)
+	err := c.compileExpression(node.Function, base)
+	if err != nil {
+		return err
+	}
+
+	spread := false
+	for _, a := range node.Arguments {
+		if _, ok := a.(*ast.SpreadExpression); ok {
+			spread = true
+		}
+	}
+
+	if !spread {
+		_, err := c.compileSequence(node.Arguments)
+		if err != nil {
+			return err
+		}
+
+		c.emit(OpCall, base, len(node.Arguments), 0)
+	} else {
+		segments, err := c.compileSpreadArguments(node.Arguments)
+		if err != nil {
+			return err
+		}
+
+		c.emit(OpCallSpread, base, segments, 0)
+	}
+
+	if dst != base {
+		c.emit(OpMove, dst, base, 0)
+	}
+
+	return nil
+}
+
+var tailForms = map[Opcode]Opcode{
+	OpCall: OpTailCall,
+	OpCallSpread: OpTailCallSpread,
+}
+
+// A call whose result reaches a return untouched, through the moves and jumps that end an if's branches or
+// a match's arms, becomes a tail call so deep recursion doesn't run out of frames. Main's calls are left alone.
+func markTailCalls(instructions []Instruction) {
+	for i := range instructions {
+		tail, ok := tailForms[instructions[i].Op]
+		if !ok {
+			continue
+		}
+
+		r := instructions[i].A
+		next := i + 1
+		for steps := 0; next < len(instructions) && steps < len(instructions); steps++ { // Bounded so a jump cycle can't hang the compiler
+			in := instructions[next]
+			if in.Op == OpJump {
+				next = in.A
+			} else if in.Op == OpMove && in.B == r {
+				r = in.A
+				next++
+			} else {
+				break
+			}
+		}
+
+		if next < len(instructions) && instructions[next].Op == OpReturn && instructions[next].A == r {
+			instructions[i].Op = tail
+		}
+	}
+}
+
+// The call can happen right in dst when it is the newest temporary, since the arguments go into the registers after it
+func (c *Compiler) callBase(dst int) int {
+	if dst == tempBase+c.fn.temps-1 {
+		return dst
+	}
+
+	return c.temp()
+}
+
+// Like the stack compiler, every run of plain arguments is wrapped into an array so the VM only flattens arrays
+func (c *Compiler) compileSpreadArguments(args []ast.Expression) (int, error) {
+	segments := 0
+	plain := []ast.Expression{}
+
+	flush := func() error {
+		if len(plain) == 0 {
+			return nil
+		}
+
+		r := c.temp()
+		mark := c.fn.temps
+		first, err := c.compileSequence(plain)
+		if err != nil {
+			return err
+		}
+		c.emit(OpArray, r, first, len(plain))
+		c.freeTemps(mark)
+
+		segments++
+		plain = plain[:0]
+		return nil
+	}
+
+	for _, a := range args {
+		s, ok := a.(*ast.SpreadExpression)
+		if !ok {
+			plain = append(plain, a)
+			continue
+		}
+
+		err := flush()
+		if err != nil {
+			return 0, err
+		}
+
+		err = c.compileExpression(s.Value, c.temp())
+		if err != nil {
+			return 0, err
+		}
+		segments++
+	}
+
+	return segments, flush()
+}
+
+func (c *Compiler) compileMethodCall(node *ast.MethodCallExpression, dst int) error {
+	base := c.callBase(dst)
+	err := c.compileExpression(node.Object, base)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range node.Arguments {
+		if _, ok := a.(*ast.SpreadExpression); ok {
+			return errSpreadOutsideCall()
+		}
+	}
+
+	_, err = c.compileSequence(node.Arguments)
+	if err != nil {
+		return err
+	}
+
+	c.temp() // The receiver and the arguments move up one register when the method is a closure
+
+	name := c.addConstant(&object.String{Value: node.Method.Value})
+	c.emit(OpCallMethod, base, len(node.Arguments), name)
+
+	if dst != base {
+		c.emit(OpMove, dst, base, 0)
+	}
+
+	return nil
+}
+
+func errSpreadOutsideCall() error {
+	return fmt.Errorf("spread arguments are only supported in function calls")
+}
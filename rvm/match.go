@@ -0,0 +1,219 @@
+package rvm
+
+import (
+	"compiler/ast"
+	"compiler/object"
+	"sort"
+)
+
+// The subject stays in a temporary for the whole match. Each arm checks its pattern one part at a time and
+// jumps to the next arm as soon as a check fails, the same layout the stack compiler uses.
+func (c *Compiler) compileMatchExpression(node *ast.MatchExpression, dst int) error {
+	subject, err := c.operand(node.Subject)
+	if err != nil {
+		return err
+	}
+
+	c.matchDepth++
+	defer func() { c.matchDepth-- }()
+
+	endJumps := []int{}
+	exhaustive := false
+
+	for _, arm := range node.Arms {
+		mark := c.fn.temps
+		failJumps := []int{}
+		shadowed := map[string]*symbol{}
+
+		err := c.compilePattern(arm.Pattern, subject, &failJumps, shadowed)
+		if err != nil {
+			return err
+		}
+
+		if arm.Guard != nil {
+			r, err := c.operand(arm.Guard)
+			if err != nil {
+				return err
+			}
+
+			failJumps = append(failJumps, c.emit(OpJumpIfFalse, r, 0, 0))
+		} else if _, ok := arm.Pattern.(*ast.Identifier); ok {
+			exhaustive = true
+		}
+
+		err = c.compileExpression(arm.Body, dst)
+		if err != nil {
+			return err
+		}
+
+		endJumps = append(endJumps, c.emit(OpJump, 0, 0, 0))
+
+		for _, jump := range failJumps {
+			c.patchJump(jump)
+		}
+
+		for name, s := range shadowed { // Bindings only live as long as their arm
+			c.fn.symbols.releaseMatchSlot(c.matchDepth, name)
+			if s == nil {
+				c.fn.symbols.restore(name, symbol{}, false)
+			} else {
+				c.fn.symbols.restore(name, *s, true)
+			}
+		}
+
+		c.freeTemps(mark)
+	}
+
+	c.emit(OpLoadNull, dst, 0, 0) // No arm matched
+
+	for _, jump := range endJumps {
+		c.patchJump(jump)
+	}
+
+	if !exhaustive {
+		c.warnings = append(c.warnings, "match expression is not exhaustive, add a _ arm: "+node.String())
+	}
+
+	return nil
+}
+
+// value is the register holding what the pattern is matched against, nested patterns index into it
+func (c *Compiler) compilePattern(pattern ast.Expression, value int, failJumps *[]int, shadowed map[string]*symbol) error {
+	switch pattern := pattern.(type) {
+	case *ast.Identifier:
+		if pattern.Value == "_" {
+			return nil
+		}
+
+		if _, ok := shadowed[pattern.Value]; !ok {
+			if previous, ok := c.fn.symbols.store[pattern.Value]; ok {
+				shadowed[pattern.Value] = &previous
+			} else {
+				shadowed[pattern.Value] = nil
+			}
+		}
+
+		c.storeSymbol(c.fn.symbols.defineMatchSlot(c.matchDepth, pattern.Value), value)
+
+	case *ast.ArrayLiteral:
+		check := c.temp()
+		c.emit(OpMatchArray, check, value, len(pattern.Elements))
+		*failJumps = append(*failJumps, c.emit(OpJumpIfFalse, check, 0, 0))
+
+		for i, el := range pattern.Elements {
+			if ident, ok := el.(*ast.Identifier); ok && ident.Value == "_" {
+				continue
+			}
+
+			index := c.temp()
+			c.emit(OpLoadK, index, c.addConstant(&object.Integer{Value: int64(i)}), 0)
+
+			element := c.temp()
+			c.emit(OpIndex, element, value, index)
+
+			err := c.compilePattern(el, element, failJumps, shadowed)
+			if err != nil {
+				return err
+			}
+		}
+
+	case *ast.HashLiteral:
+		check := c.temp()
+		c.emit(OpMatchHash, check, value, 0)
+		*failJumps = append(*failJumps, c.emit(OpJumpIfFalse, check, 0, 0))
+
+		keys := []ast.Expression{}
+		for k := range pattern.Pairs {
+			keys = append(keys, k)
+		}
+
+		sort.Slice(keys, func(i, j int) bool { // Same ordering as hash literals so the checks run in a fixed order
+			return keys[i].String() < keys[j].String()
+		})
+
+		for _, k := range keys {
+			key, err := c.operand(k)
+			if err != nil {
+				return err
+			}
+
+			c.emit(OpMatchKey, check, value, key)
+			*failJumps = append(*failJumps, c.emit(OpJumpIfFalse, check, 0, 0))
+
+			element := c.temp()
+			c.emit(OpIndex, element, value, key)
+
+			err = c.compilePattern(pattern.Pairs[k], element, failJumps, shadowed)
+			if err != nil {
+				return err
+			}
+		}
+
+	default: // Literals, the parser has already rejected anything else
+		literal, err := c.operand(pattern)
+		if err != nil {
+			return err
+		}
+
+		check := c.temp()
+		c.emit(OpMatchEqual, check, value, literal)
+		*failJumps = append(*failJumps, c.emit(OpJumpIfFalse, check, 0, 0))
+	}
+
+	return nil
+}
+
+func (c *Compiler) storeSymbol(s symbol, value int) {
+	if s.scope == globalScope {
+		c.emit(OpSetGlobal, value, s.index, 0)
+	} else if s.index != value {
+		c.emit(OpMove, s.index, value, 0)
+	}
+}
+
+// The value is destructured in place, into the registers starting at its own, and then stored name by name
+func (c *Compiler) compileDestructuringLetStatement(node *ast.DestructuringLetStatement) error {
+	base := c.temp()
+	err := c.compileExpression(node.Value, base)
+	if err != nil {
+		return err
+	}
+
+	flags := 0
+	if c.options.Strict {
+		flags |= DestructureStrict
+	}
+
+	names := []*ast.Identifier{}
+
+	switch pattern := node.Pattern.(type) {
+	case *ast.ArrayPattern:
+		names = append(names, pattern.Elements...)
+
+		if pattern.Rest != nil {
+			names = append(names, pattern.Rest)
+			flags |= DestructureRest
+		}
+
+		for i := 1; i < len(names); i++ {
+			c.temp()
+		}
+
+		c.emit(OpDestructureArray, base, len(pattern.Elements), flags)
+
+	case *ast.HashPattern:
+		names = append(names, pattern.Keys...)
+
+		for _, k := range pattern.Keys {
+			c.emit(OpLoadK, c.temp(), c.addConstant(&object.String{Value: k.Value}), 0)
+		}
+
+		c.emit(OpDestructureHash, base, len(pattern.Keys), flags)
+	}
+
+	for i, name := range names {
+		c.storeSymbol(c.fn.symbols.define(name.Value), base+i)
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package rvm
+
+import (
+	"fmt"
+	"strings"
+	"compiler/object"
+)
+
+// Function is a compiled function body, the program itself is one too
+type Function struct {
+	Instructions []Instruction
+	NumRegisters int // Parameters and locals first, the temporaries of expressions after them
+	NumParameters int // Counts parameters with a default value but not the rest parameter
+	NumDefaults int
+	Variadic bool // The arguments past NumParameters are collected into an array in register NumParameters
+	Name string
+	Functions []*Function // The prototypes OpClosure refers to by index
+	Captures []Capture // What OpClosure copies into the closure's free variables, in order
+}
+
+type captureKind int
+
+const (
+	captureRegister captureKind = iota // A register of the enclosing call
+	captureFree // A free variable of the enclosing closure
+	captureSelf // The enclosing closure itself
+)
+
+type Capture struct {
+	kind captureKind
+	index int
+}
+
+// String lists the instructions of the function followed by the functions defined in it
+func (fn *Function) String() string {
+	var out strings.Builder
+	fn.write(&out, "main")
+	return out.String()
+}
+
+func (fn *Function) write(out *strings.Builder, name string) {
+	fmt.Fprintf(out, "== %s (params %d, registers %d) ==\n", name, fn.NumParameters, fn.NumRegisters)
+	for i, ins := range fn.Instructions {
+		fmt.Fprintf(out, "%04d %s\n", i, ins)
+	}
+
+	for i, inner := range fn.Functions {
+		innerName := inner.Name
+		if innerName == "" {
+			innerName = "<anonymous>"
+		}
+
+		out.WriteString("\n")
+		inner.write(out, fmt.Sprintf("%s/%d %s", name, i, innerName))
+	}
+}
+
+type Closure struct {
+	Fn *Function
+	Free []object.Object
+}
+
+// Closures print like the stack VM's so the two engines show the same results
+func (c *Closure) Type() object.ObjectType { return object.CLOSURE_OBJ }
+func (c *Closure) Inspect() string {
+	if c.Fn.Name != "" {
+		return fmt.Sprintf("Closure[%s]", c.Fn.Name)
+	}
+
+	return fmt.Sprintf("Closure[%p]", c)
+}
+
+func (c *Closure) Contents() []object.Object { return c.Free }
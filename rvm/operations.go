@@ -0,0 +1,197 @@
+package rvm
+
+import (
+	"fmt"
+	"compiler/object"
+)
+
+// The operations give the same results and errors as the stack VM's, the differential tests rely on it
+
+func arithmetic(op Opcode, left, right object.Object, memory *object.MemoryTracker) (object.Object, error) {
+	switch {
+	case left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ:
+		leftValue := left.(*object.Integer).Value
+		rightValue := right.(*object.Integer).Value
+
+		switch op {
+		case OpAdd:
+			return object.NewInteger(leftValue + rightValue), nil
+		case OpSub:
+			return object.NewInteger(leftValue - rightValue), nil
+		case OpMul:
+			return object.NewInteger(leftValue * rightValue), nil
+		default:
+			if rightValue == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			return object.NewInteger(leftValue / rightValue), nil
+		}
+	case left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ:
+		if op != OpAdd {
+			return nil, fmt.Errorf("unknown string operator: %s", definitions[op].Name)
+		}
+
+		leftValue := left.(*object.String).Value
+		rightValue := right.(*object.String).Value
+
+		err := memory.Alloc(object.StringSize(len(leftValue) + len(rightValue)))
+		if err != nil {
+			return nil, err
+		}
+
+		return &object.String{Value: leftValue + rightValue}, nil
+	default:
+		return nil, fmt.Errorf("unsupported types for binary operation: %s %s", left.Type(), right.Type())
+	}
+}
+
+// Integers compare by value, everything else by identity, which is what makes true == true hold
+func compare(op Opcode, left, right object.Object) (bool, error) {
+	leftInteger, leftOk := left.(*object.Integer)
+	rightInteger, rightOk := right.(*object.Integer)
+
+	if leftOk && rightOk {
+		switch op {
+		case OpEqual:
+			return leftInteger.Value == rightInteger.Value, nil
+		case OpNotEqual:
+			return leftInteger.Value != rightInteger.Value, nil
+		default:
+			return leftInteger.Value > rightInteger.Value, nil
+		}
+	}
+
+	if leftOk || rightOk {
+		return false, fmt.Errorf("unsupported types for comparison: %s %s", left.Type(), right.Type())
+	}
+
+	switch op {
+	case OpEqual:
+		return left == right, nil
+	case OpNotEqual:
+		return left != right, nil
+	default:
+		return false, fmt.Errorf("unknown operator: %s (%s, %s)", definitions[op].Name, left.Type(), right.Type())
+	}
+}
+
+func index(left, index object.Object) (object.Object, error) {
+	switch {
+	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
+		elements := left.(*object.Array).Elements
+		i := index.(*object.Integer).Value
+
+		if i < 0 || i >= int64(len(elements)) {
+			return Null, nil
+		}
+		return elements[i], nil
+	case left.Type() == object.HASH_OBJ:
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return nil, fmt.Errorf("unusable as hash key: %s", index.Type())
+		}
+
+		pair, ok := left.(*object.Hash).Pairs[key.HashKey()]
+		if !ok {
+			return Null, nil
+		}
+		return pair.Value, nil
+	default:
+		return nil, fmt.Errorf("index operator not supported :%s", left.Type())
+	}
+}
+
+// pairs holds the keys and values alternately
+func buildHash(pairs []object.Object) (object.Object, error) {
+	hashedPairs := make(map[object.HashKey]object.HashPair, len(pairs)/2)
+
+	for i := 0; i < len(pairs); i += 2 {
+		key, ok := pairs[i].(object.Hashable)
+		if !ok {
+			return nil, fmt.Errorf("unusable as hash key: %s", pairs[i].Type())
+		}
+
+		hashedPairs[key.HashKey()] = object.HashPair{Key: pairs[i], Value: pairs[i+1]}
+	}
+
+	return &object.Hash{Pairs: hashedPairs}, nil
+}
+
+// regs starts at the register holding the array, the elements replace it
+func destructureArray(regs []object.Object, numElements, flags int, memory *object.MemoryTracker) error {
+	array, ok := regs[0].(*object.Array)
+	if !ok {
+		return fmt.Errorf("cannot destructure %s as an array", regs[0].Type())
+	}
+
+	for i := 0; i < numElements; i++ {
+		if i < len(array.Elements) {
+			regs[i] = array.Elements[i]
+		} else if flags&DestructureStrict != 0 {
+			return fmt.Errorf("missing element %d in destructuring, array has %d elements", i, len(array.Elements))
+		} else {
+			regs[i] = Null
+		}
+	}
+
+	if flags&DestructureRest != 0 {
+		numRest := 0
+		if numElements < len(array.Elements) {
+			numRest = len(array.Elements) - numElements
+		}
+
+		err := memory.Alloc(object.ArraySize(numRest))
+		if err != nil {
+			return err
+		}
+		rest := make([]object.Object, numRest)
+		copy(rest, array.Elements[len(array.Elements)-numRest:])
+
+		regs[numElements] = &object.Array{Elements: rest}
+	}
+
+	return nil
+}
+
+// regs starts at the register holding the hash, the keys follow it and the values replace both
+func destructureHash(regs []object.Object, numKeys, flags int) error {
+	hash, ok := regs[0].(*object.Hash)
+	if !ok {
+		return fmt.Errorf("cannot destructure %s as a hash", regs[0].Type())
+	}
+
+	keys := make([]object.Object, numKeys)
+	copy(keys, regs[1:1+numKeys])
+
+	for i, key := range keys {
+		pair, ok := hash.Pairs[key.(object.Hashable).HashKey()] // The keys are always string constants
+		if ok {
+			regs[i] = pair.Value
+		} else if flags&DestructureStrict != 0 {
+			return fmt.Errorf("missing key %s in destructuring", key.Inspect())
+		} else {
+			regs[i] = Null
+		}
+	}
+
+	return nil
+}
+
+func isTruthy(obj object.Object) bool {
+	switch obj := obj.(type) {
+	case *object.Boolean:
+		return obj.Value
+	case *object.Null:
+		return false
+	default:
+		return true
+	}
+}
+
+func nativeBoolToBooleanObject(input bool) *object.Boolean {
+	if input {
+		return True
+	}
+
+	return False
+}
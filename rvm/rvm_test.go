@@ -0,0 +1,381 @@
+package rvm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"compiler/ast"
+	"compiler/compiler"
+	"compiler/lexer"
+	"compiler/object"
+	"compiler/parser"
+	"compiler/vm"
+)
+
+// The programs of the vm package's suite run on this backend too, see testOtherEngines there
+
+func parse(input string) *ast.Program {
+	l := lexer.New(input)
+	p := parser.New(l)
+	return p.ParseProgram()
+}
+
+func run(t *testing.T, input string, options Options) (object.Object, error) {
+	t.Helper()
+
+	comp := NewCompiler()
+	comp.SetOptions(options)
+	program, err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	return New().Run(program)
+}
+
+func TestLowering(t *testing.T) {
+	tests := []struct {
+		input string
+		expected []string
+	}{
+		{
+			// Locals are read where they are, no copies onto a stack
+			input: `fn(a, b) { a + b }`,
+			expected: []string{
+				"ADD R2 R0 R1",
+				"RETURN R2",
+			},
+		},
+		{
+			input: `fn(n) { n - 1 }`,
+			expected: []string{
+				"SUBK R1 R0 K0",
+				"RETURN R1",
+			},
+		},
+		{
+			// Comparisons in a condition jump directly instead of making a boolean first
+			input: `fn(n) { if (n < 2) { n } else { 0 } }`,
+			expected: []string{
+				"LOADK R2 K1",
+				"JUMPIFNOTGT R2 R0 @4",
+				"MOVE R1 R0",
+				"JUMP @5",
+				"LOADK R1 K2",
+				"RETURN R1",
+			},
+		},
+		{
+			// The callee and its arguments sit in consecutive registers, the result replaces the callee
+			input: `fn(f, x) { f(x, 1) }`,
+			expected: []string{
+				"MOVE R2 R0",
+				"MOVE R3 R1",
+				"LOADK R4 K0",
+				"TAILCALL R2 2",
+				"RETURN R2",
+			},
+		},
+		{
+			// A call is a tail call when only moves and jumps stand between it and the return
+			input: `fn(f, n) { if (n < 1) { f(n) } else { f(n) + 1 } }`,
+			expected: []string{
+				"LOADK R3 K0",
+				"JUMPIFNOTGT R3 R1 @6",
+				"MOVE R2 R0",
+				"MOVE R3 R1",
+				"TAILCALL R2 1",
+				"JUMP @10",
+				"MOVE R3 R0",
+				"MOVE R4 R1",
+				"CALL R3 1",
+				"ADDK R2 R3 K0",
+				"RETURN R2",
+			},
+		},
+		{
+			// A let further down still gets a register below the temporaries
+			input: `fn(x) { let y = x * 2; let z = y + x; z }`,
+			expected: []string{
+				"LOADK R3 K1",
+				"MUL R1 R0 R3",
+				"ADD R2 R1 R0",
+				"RETURN R2",
+			},
+		},
+	}
+
+	comp := NewCompiler() // Shared, so equal constants keep their index from the earlier programs
+	for _, tt := range tests {
+		program, err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		fn := program.Main.Functions[0]
+		got := []string{}
+		for _, ins := range fn.Instructions {
+			got = append(got, ins.String())
+		}
+
+		if strings.Join(got, "\n") != strings.Join(tt.expected, "\n") {
+			t.Errorf("wrong instructions for %q.\nwant:\n%s\ngot:\n%s", tt.input, strings.Join(tt.expected, "\n"), strings.Join(got, "\n"))
+		}
+	}
+}
+
+// Runtime errors read the same as the stack VM's, the CLI and the REPL print them as they are
+func TestErrorsMatchTheStackVM(t *testing.T) {
+	tests := []struct {
+		input string
+		strict bool
+	}{
+		{input: `fn() { 1; }(1)`},
+		{input: `fn(a, b = 1) { a + b; }(1, 2, 3);`},
+		{input: `fn(a, ...rest) { a; }();`},
+		{input: `fn add(a, b) { a + b; } add(1);`},
+		{input: `impl Integer { fn plus(self, x) { self + x } } 1.plus();`},
+		{input: `fn(a) { a; }(...1);`},
+		{input: `1.nothing()`},
+		{input: `1 + "a"`},
+		{input: `10 / (5 - 5)`},
+		{input: `let x = 1; x()`},
+		{input: `1[0]`},
+		{input: `{[1]: 2}`},
+		{input: `{"a": 1}[[1]]`},
+		{input: `let [a] = 1;`},
+		{input: `let {a} = [1];`},
+		{input: `let [a, b] = [1];`, strict: true},
+		{input: `let {a} = {"b": 1};`, strict: true},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		comp.SetOptions(compiler.Options{Strict: tt.strict})
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		machine := vm.New(comp.Bytecode())
+		want := machine.Run()
+		if want == nil {
+			t.Fatalf("expected the vm to fail on %q", tt.input)
+		}
+
+		_, got := run(t, tt.input, Options{Strict: tt.strict})
+		if got == nil {
+			t.Errorf("expected an error for %q", tt.input)
+			continue
+		}
+
+		if got.Error() != want.Error() {
+			t.Errorf("wrong error for %q. want=%q, got=%q", tt.input, want, got)
+		}
+	}
+}
+
+func TestStackOverflow(t *testing.T) {
+	_, err := run(t, `let f = fn(x) { f(x + 1) + 1 }; f(0)`, Options{})
+	if err == nil || err.Error() != "stack overflow" {
+		t.Fatalf("expected a stack overflow, got=%v", err)
+	}
+}
+
+// A method call moves its arguments up a register, at the very end of the registers that is an overflow rather than a panic
+func TestMethodCallAtTheLastRegister(t *testing.T) {
+	comp := NewCompiler()
+	defs, err := comp.Compile(parse(`impl Integer { fn plus(self, x) { self + x } }`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	machine := New()
+	_, err = machine.Run(defs)
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	receiver := RegisterStackSize - 2
+	program := &Program{
+		Main: &Function{
+			Instructions: []Instruction{
+				{Op: OpLoadK, A: receiver, B: 0},
+				{Op: OpLoadK, A: receiver + 1, B: 0},
+				{Op: OpCallMethod, A: receiver, B: 1, C: 1},
+				{Op: OpReturn, A: receiver},
+			},
+			NumRegisters: RegisterStackSize,
+		},
+		Constants: []object.Object{&object.Integer{Value: 1}, &object.String{Value: "plus"}},
+	}
+
+	_, err = machine.Run(program)
+	if err == nil || err.Error() != "stack overflow" {
+		t.Fatalf("expected a stack overflow, got=%v", err)
+	}
+}
+
+// The REPL compiles and runs one input after another, functions and methods from earlier ones keep working
+func TestLimits(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		input string
+		limits object.Limits
+		ctx context.Context
+		expected object.LimitKind
+	}{
+		{input: `let f = fn() { f() }; f()`, limits: object.Limits{MaxInstructions: 10000}, expected: object.InstructionLimit},
+		{input: `let f = fn(n) { f(n) + 1 }; f(0)`, limits: object.Limits{MaxDepth: 10}, expected: object.DepthLimit},
+		{input: `let f = fn() { f() + 1 }; f()`, expected: object.DepthLimit},
+		{input: `[1, 2, 3, 4, 5, 6, 7, 8, 9, 10]`, limits: object.Limits{MaxStack: 5}, expected: object.StackLimit},
+		{input: `let f = fn() { f() }; f()`, ctx: cancelled, expected: object.Cancelled},
+	}
+
+	for _, tt := range tests {
+		comp := NewCompiler()
+		program, err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		ctx := tt.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+
+		machine := New()
+		machine.SetLimits(tt.limits)
+		_, err = machine.RunContext(ctx, program)
+
+		var limitErr *object.LimitError
+		if !errors.As(err, &limitErr) {
+			t.Errorf("%q: expected a LimitError, got=%v", tt.input, err)
+			continue
+		}
+		if limitErr.Kind != tt.expected {
+			t.Errorf("%q: wrong limit. want=%d, got=%d (%s)", tt.input, tt.expected, limitErr.Kind, limitErr)
+		}
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	tests := []struct {
+		input string
+		limit int64
+		fits bool
+	}{
+		{`let grow = fn(a, n) { if (n == 0) { a } else { grow(push(a, n), n - 1) } }; grow([], 100000)`, 1 << 16, false},
+		{`let double = fn(s, n) { if (n == 0) { s } else { double(s + s, n - 1) } }; double("ab", 64)`, 1 << 20, false},
+		{`let make = fn(n) { if (n == 0) { 0 } else { [1, 2, 3]; {"a": 1}; make(n - 1) } }; make(100000)`, 1 << 20, true}, // Each is dropped before the next is made
+		{`let a = [1, 2, 3, 4, 5, 6, 7, 8]; rest(a)`, 200, false}, // Stopped before rest runs
+		{`let f = fn(...xs) { xs }; f(1, 2, 3, 4, 5, 6, 7, 8)`, 100, false},
+		{`let a = [1, 2, 3, 4, 5, 6, 7, 8]; let [first, ...others] = a;`, 200, false},
+		{`let a = [1, 2, 3, 4, 5, 6, 7, 8]; let f = fn(x) { x }; f(...a)`, 250, false},
+	}
+
+	for _, tt := range tests {
+		comp := NewCompiler()
+		program, err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		machine := New()
+		machine.SetLimits(object.Limits{MaxMemory: tt.limit})
+		_, err = machine.Run(program)
+
+		var limitErr *object.LimitError
+		switch {
+		case tt.fits && err != nil:
+			t.Errorf("%q: expected the run to fit in %d bytes, got=%v", tt.input, tt.limit, err)
+		case !tt.fits && (!errors.As(err, &limitErr) || limitErr.Kind != object.MemoryLimit):
+			t.Errorf("%q: expected the memory limit to stop the run, got=%v", tt.input, err)
+		}
+		if machine.Memory().Peak() > tt.limit {
+			t.Errorf("%q: peak usage %d is past the limit %d", tt.input, machine.Memory().Peak(), tt.limit)
+		}
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	comp := NewCompiler()
+	program, err := comp.Compile(parse(`let a = push([1, 2], 3); let s = "ab" + "cd"; let make = fn(n) { if (n == 0) { 0 } else { [1, 2, 3]; make(n - 1) } }; make(10000)`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	machine := New()
+	_, err = machine.Run(program)
+	if err != nil {
+		t.Fatalf("rvm error: %s", err)
+	}
+
+	// The globals are still held, and only one of the arrays make makes is held at a time
+	held := object.ArraySize(3) + object.StringSize(4)
+	if machine.Memory().Used() < held || machine.Memory().Used() > held+object.ArraySize(3) {
+		t.Errorf("wrong memory usage. want about %d, got=%d", held, machine.Memory().Used())
+	}
+	if machine.Memory().Peak() < held || machine.Memory().Peak() > 2*held {
+		t.Errorf("wrong peak. want about %d, got=%d", held, machine.Memory().Peak())
+	}
+}
+
+func TestStateAcrossPrograms(t *testing.T) {
+	comp := NewCompiler()
+	machine := New()
+
+	inputs := []struct {
+		input string
+		expected string
+	}{
+		{`let base = 10; let add = fn(x) { x + base };`, "Closure[add]"},
+		{`impl Integer { fn twice(self) { add(self) * 2 } }`, "<nothing>"},
+		{`let s = "a"; 5.twice()`, "30"},
+		{`s == "a"`, "true"},
+	}
+
+	for _, tt := range inputs {
+		program, err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		result, err := machine.Run(program)
+		if err != nil {
+			t.Fatalf("rvm error on %q: %s", tt.input, err)
+		}
+
+		got := "<nothing>"
+		if result != nil {
+			got = result.Inspect()
+		}
+		if got != tt.expected {
+			t.Errorf("wrong result for %q. want=%s, got=%s", tt.input, tt.expected, got)
+		}
+	}
+
+	expected := []Global{{"base", 0}, {"add", 1}, {"s", 2}}
+	if fmt.Sprint(comp.Globals()) != fmt.Sprint(expected) {
+		t.Errorf("wrong globals. want=%v, got=%v", expected, comp.Globals())
+	}
+	if machine.Global(0).Inspect() != "10" {
+		t.Errorf("wrong value for base. got=%s", machine.Global(0).Inspect())
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	comp := NewCompiler()
+	_, err := comp.Compile(parse(`match 1 { 1 => 2 }`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	if len(comp.Warnings()) != 1 || !strings.HasPrefix(comp.Warnings()[0], "match expression is not exhaustive") {
+		t.Errorf("wrong warnings. got=%v", comp.Warnings())
+	}
+}
@@ -0,0 +1,136 @@
+package rvm
+
+import (
+	"sort"
+	"strconv"
+)
+
+type symbolScope int
+
+const (
+	globalScope symbolScope = iota
+	localScope // Index is the register the value lives in
+	builtinScope
+	freeScope
+	functionScope // The function's own name
+)
+
+type symbol struct {
+	scope symbolScope
+	index int
+}
+
+// Scoping follows the stack compiler's symbol table: a name defined anywhere in a function lives until the
+// function ends, except for match bindings, and names from enclosing functions become free variables
+type symbolTable struct {
+	outer *symbolTable
+	store map[string]symbol
+	numDefinitions int
+	free []symbol // The symbols of the enclosing function this one captures
+	matchSlots map[string]symbol // Slots match bindings have already taken, by nesting depth and name
+	captured map[int]bool // Globals some function refers to, only kept on the outermost table
+}
+
+func newSymbolTable(outer *symbolTable) *symbolTable {
+	return &symbolTable{outer: outer, store: map[string]symbol{}}
+}
+
+func (s *symbolTable) define(name string) symbol {
+	sym := symbol{scope: localScope, index: s.numDefinitions}
+	if s.outer == nil {
+		sym.scope = globalScope
+	}
+
+	s.store[name] = sym
+	s.numDefinitions++
+	return sym
+}
+
+func (s *symbolTable) defineBuiltin(index int, name string) {
+	s.store[name] = symbol{scope: builtinScope, index: index}
+}
+
+func (s *symbolTable) defineFunctionName(name string) {
+	s.store[name] = symbol{scope: functionScope}
+}
+
+func (s *symbolTable) resolve(name string) (symbol, bool) {
+	sym, ok := s.store[name]
+	if ok || s.outer == nil {
+		return sym, ok
+	}
+
+	sym, ok = s.outer.resolve(name)
+	if ok && sym.scope == globalScope {
+		s.markCaptured(sym.index)
+	}
+
+	if !ok || sym.scope == globalScope || sym.scope == builtinScope {
+		return sym, ok
+	}
+
+	s.free = append(s.free, sym)
+	free := symbol{scope: freeScope, index: len(s.free) - 1}
+	s.store[name] = free
+	return free, true
+}
+
+func (s *symbolTable) markCaptured(index int) {
+	outermost := s
+	for outermost.outer != nil {
+		outermost = outermost.outer
+	}
+
+	if outermost.captured == nil {
+		outermost.captured = map[int]bool{}
+	}
+	outermost.captured[index] = true
+}
+
+// Same as the stack compiler: a match binding reuses the slot its nesting depth took the first time,
+// so matching at the top level over and over doesn't use up globals
+func (s *symbolTable) defineMatchSlot(depth int, name string) symbol {
+	key := strconv.Itoa(depth) + "#" + name
+	sym, ok := s.matchSlots[key]
+	if !ok {
+		sym = s.define(name)
+
+		if s.matchSlots == nil {
+			s.matchSlots = map[string]symbol{}
+		}
+		s.matchSlots[key] = sym
+	}
+
+	s.store[name] = sym
+	return sym
+}
+
+// A global binding a function refers to stays the function's, no later match may reuse it
+func (s *symbolTable) releaseMatchSlot(depth int, name string) {
+	key := strconv.Itoa(depth) + "#" + name
+	if sym, ok := s.matchSlots[key]; ok && sym.scope == globalScope && s.captured[sym.index] {
+		delete(s.matchSlots, key)
+	}
+}
+
+// Puts back what a match binding shadowed once its arm is compiled
+func (s *symbolTable) restore(name string, shadowed symbol, ok bool) {
+	if ok {
+		s.store[name] = shadowed
+	} else {
+		delete(s.store, name)
+	}
+}
+
+// The globals in index order, a name that was defined again only shows up at its latest index
+func (s *symbolTable) globals() []Global {
+	globals := []Global{}
+	for name, sym := range s.store {
+		if sym.scope == globalScope {
+			globals = append(globals, Global{Name: name, Index: sym.index})
+		}
+	}
+
+	sort.Slice(globals, func(i, j int) bool { return globals[i].Index < globals[j].Index })
+	return globals
+}
@@ -0,0 +1,599 @@
+package rvm
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"compiler/object"
+)
+
+const RegisterStackSize = 1 << 16
+const MaxFrames = 1024
+
+var True = object.TRUE
+var False = object.FALSE
+
+var Null = object.NULL
+
+// Every call gets a window of the register stack starting right after its callee's register, so the
+// arguments the caller put there are already the callee's first registers
+type frame struct {
+	cl *Closure
+	pc int
+	base int
+	numArgs int // How many arguments the caller actually passed, parameters past it take their default value
+}
+
+// VM keeps its globals and methods between runs, so the REPL can run one program after another
+type VM struct {
+	constants []object.Object
+	registers []object.Object
+	globals []object.Object
+	frames []frame
+	methods object.MethodTable
+
+	limits object.Limits
+	memory *object.MemoryTracker
+	maxRegisters int // The registers and frames a run may use, RegisterStackSize and MaxFrames unless limits lower them
+	maxFrames int
+}
+
+func New() *VM {
+	vm := &VM{
+		registers: make([]object.Object, RegisterStackSize),
+		frames: make([]frame, 0, MaxFrames),
+		methods: object.NewMethodTable(),
+		maxRegisters: RegisterStackSize,
+		maxFrames: MaxFrames,
+	}
+	vm.memory = object.NewMemoryTracker(0, vm.roots)
+
+	return vm
+}
+
+// SetLimits bounds the runs that follow. MaxStack counts registers, and it and MaxDepth can only lower
+// RegisterStackSize and MaxFrames.
+func (vm *VM) SetLimits(limits object.Limits) {
+	vm.limits = limits
+	vm.memory.SetLimit(limits.MaxMemory)
+
+	vm.maxRegisters = RegisterStackSize
+	if limits.MaxStack > 0 && limits.MaxStack < RegisterStackSize {
+		vm.maxRegisters = limits.MaxStack
+	}
+
+	vm.maxFrames = MaxFrames
+	if limits.MaxDepth > 0 && limits.MaxDepth < MaxFrames-1 {
+		vm.maxFrames = limits.MaxDepth + 1 // Main's frame isn't a call
+	}
+}
+
+func (vm *VM) Global(index int) object.Object {
+	if index >= len(vm.globals) {
+		return nil
+	}
+
+	return vm.globals[index]
+}
+
+func (vm *VM) SetGlobal(index int, value object.Object) {
+	for index >= len(vm.globals) {
+		vm.globals = append(vm.globals, nil)
+	}
+
+	vm.globals[index] = value
+}
+
+// Memory reports how much the VM holds in strings, arrays and hashes, and the most it held, for monitoring
+func (vm *VM) Memory() *object.MemoryTracker {
+	return vm.memory
+}
+
+// Everything a run can still reach: the registers and closures of the calls in progress, the globals and
+// the methods
+func (vm *VM) roots(visit func(object.Object)) {
+	if len(vm.frames) > 0 {
+		f := vm.frames[len(vm.frames)-1]
+		for _, r := range vm.registers[:f.base+f.cl.Fn.NumRegisters] {
+			visit(r)
+		}
+	}
+	for _, g := range vm.globals {
+		visit(g)
+	}
+	for _, f := range vm.frames {
+		visit(f.cl)
+	}
+	for _, methods := range vm.methods {
+		for _, method := range methods {
+			visit(method)
+		}
+	}
+}
+
+// Run executes the program and returns the value of its last statement, which is nil when there was none
+func (vm *VM) Run(program *Program) (object.Object, error) {
+	return vm.RunContext(context.Background(), program)
+}
+
+// RunContext stops the run with a *object.LimitError once ctx is done, or when it goes past the VM's limits
+func (vm *VM) RunContext(ctx context.Context, program *Program) (object.Object, error) {
+	vm.constants = program.Constants
+	vm.frames = vm.frames[:0]
+	vm.memory.Reset()
+
+	main := program.Main
+	if main.NumRegisters > vm.maxRegisters {
+		return nil, vm.stackOverflow()
+	}
+
+	for i := 0; i < main.NumRegisters; i++ {
+		vm.registers[i] = nil
+	}
+
+	vm.frames = append(vm.frames, frame{cl: &Closure{Fn: main}})
+
+	return vm.execute(ctx)
+}
+
+func (vm *VM) execute(ctx context.Context) (object.Object, error) {
+	f := &vm.frames[len(vm.frames)-1]
+	ins := f.cl.Fn.Instructions
+	regs := vm.registers[f.base:]
+
+	done := ctx.Done() // Nil for a context that can't be cancelled, the check is skipped then
+	maxInstructions := int64(math.MaxInt64)
+	if vm.limits.MaxInstructions > 0 {
+		maxInstructions = vm.limits.MaxInstructions
+	}
+	var executed int64
+
+	for {
+		if done != nil && executed%object.CancelCheckInterval == 0 {
+			select {
+			case <-done:
+				return nil, &object.LimitError{Kind: object.Cancelled, Err: ctx.Err()}
+			default:
+			}
+		}
+
+		executed++
+		if executed > maxInstructions {
+			return nil, &object.LimitError{Kind: object.InstructionLimit, Limit: maxInstructions}
+		}
+
+		in := ins[f.pc]
+		f.pc++
+
+		switch in.Op {
+		case OpMove:
+			regs[in.A] = regs[in.B]
+		case OpLoadK:
+			regs[in.A] = vm.constants[in.B]
+		case OpLoadTrue:
+			regs[in.A] = True
+		case OpLoadFalse:
+			regs[in.A] = False
+		case OpLoadNull:
+			regs[in.A] = Null
+		case OpGetGlobal:
+			regs[in.A] = vm.Global(in.B)
+		case OpSetGlobal:
+			vm.SetGlobal(in.B, regs[in.A])
+		case OpGetFree:
+			regs[in.A] = f.cl.Free[in.B]
+		case OpGetBuiltin:
+			regs[in.A] = object.Builtins[in.B].Builtin
+		case OpCurrentClosure:
+			regs[in.A] = f.cl
+		case OpAdd, OpSub, OpMul, OpDiv:
+			result, err := arithmetic(in.Op, regs[in.B], regs[in.C], vm.memory)
+			if err != nil {
+				return nil, err
+			}
+			regs[in.A] = result
+		case OpAddK, OpSubK:
+			left, ok := regs[in.B].(*object.Integer)
+			right := vm.constants[in.C].(*object.Integer) // The compiler only uses these with integer constants
+			if ok && in.Op == OpAddK {
+				regs[in.A] = object.NewInteger(left.Value + right.Value)
+				continue
+			}
+			if ok {
+				regs[in.A] = object.NewInteger(left.Value - right.Value)
+				continue
+			}
+
+			op := OpAdd
+			if in.Op == OpSubK {
+				op = OpSub
+			}
+			result, err := arithmetic(op, regs[in.B], right, vm.memory)
+			if err != nil {
+				return nil, err
+			}
+			regs[in.A] = result
+		case OpEqual, OpNotEqual, OpGreater:
+			result, err := compare(in.Op, regs[in.B], regs[in.C])
+			if err != nil {
+				return nil, err
+			}
+			regs[in.A] = nativeBoolToBooleanObject(result)
+		case OpMinus:
+			operand, ok := regs[in.B].(*object.Integer)
+			if !ok {
+				return nil, fmt.Errorf("unsupported type for negation: %s", regs[in.B].Type())
+			}
+			regs[in.A] = object.NewInteger(-operand.Value)
+		case OpNot:
+			regs[in.A] = nativeBoolToBooleanObject(!isTruthy(regs[in.B]))
+		case OpJump:
+			f.pc = in.A
+		case OpJumpIfFalse:
+			if !isTruthy(regs[in.A]) {
+				f.pc = in.B
+			}
+		case OpJumpIfNotGreater, OpJumpIfNotEqual:
+			left, ok := regs[in.A].(*object.Integer)
+			right, isInteger := regs[in.B].(*object.Integer)
+			if ok && isInteger {
+				if (in.Op == OpJumpIfNotGreater && left.Value <= right.Value) || (in.Op == OpJumpIfNotEqual && left.Value != right.Value) {
+					f.pc = in.C
+				}
+				continue
+			}
+
+			op := OpGreater
+			if in.Op == OpJumpIfNotEqual {
+				op = OpEqual
+			}
+			result, err := compare(op, regs[in.A], regs[in.B])
+			if err != nil {
+				return nil, err
+			}
+			if !result {
+				f.pc = in.C
+			}
+		case OpArray:
+			err := vm.memory.Alloc(object.ArraySize(in.C))
+			if err != nil {
+				return nil, err
+			}
+
+			elements := make([]object.Object, in.C)
+			copy(elements, regs[in.B:in.B+in.C])
+			regs[in.A] = &object.Array{Elements: elements}
+		case OpHash:
+			err := vm.memory.Alloc(object.HashSize(in.C))
+			if err != nil {
+				return nil, err
+			}
+
+			hash, err := buildHash(regs[in.B : in.B+2*in.C])
+			if err != nil {
+				return nil, err
+			}
+			regs[in.A] = hash
+		case OpIndex:
+			result, err := index(regs[in.B], regs[in.C])
+			if err != nil {
+				return nil, err
+			}
+			regs[in.A] = result
+		case OpClosure:
+			regs[in.A] = vm.newClosure(f, f.cl.Fn.Functions[in.B])
+		case OpCall:
+			called, err := vm.call(f.base+in.A, in.B)
+			if err != nil {
+				return nil, err
+			}
+			if called {
+				f = &vm.frames[len(vm.frames)-1] // The current frame changed
+				ins, regs = f.cl.Fn.Instructions, vm.registers[f.base:]
+			}
+		case OpTailCall:
+			called, err := vm.tailCall(f.base+in.A, in.B)
+			if err != nil {
+				return nil, err
+			}
+			if called {
+				f = &vm.frames[len(vm.frames)-1] // The current frame changed
+				ins, regs = f.cl.Fn.Instructions, vm.registers[f.base:]
+			}
+		case OpCallSpread:
+			numArgs, err := vm.spreadArguments(f.base+in.A, in.B)
+			if err != nil {
+				return nil, err
+			}
+
+			called, err := vm.call(f.base+in.A, numArgs)
+			if err != nil {
+				return nil, err
+			}
+			if called {
+				f = &vm.frames[len(vm.frames)-1] // The current frame changed
+				ins, regs = f.cl.Fn.Instructions, vm.registers[f.base:]
+			}
+		case OpTailCallSpread:
+			numArgs, err := vm.spreadArguments(f.base+in.A, in.B)
+			if err != nil {
+				return nil, err
+			}
+
+			called, err := vm.tailCall(f.base+in.A, numArgs)
+			if err != nil {
+				return nil, err
+			}
+			if called {
+				f = &vm.frames[len(vm.frames)-1] // The current frame changed
+				ins, regs = f.cl.Fn.Instructions, vm.registers[f.base:]
+			}
+		case OpCallMethod:
+			name := vm.constants[in.C].(*object.String).Value
+			receiver := regs[in.A]
+
+			method, ok := vm.lookupMethod(receiver.Type(), name)
+			if !ok {
+				return nil, fmt.Errorf("undefined method %s for %s", name, receiver.Type())
+			}
+
+			// Everything moves up one register so the method sits where the callee goes, the receiver becomes the first argument (self)
+			if f.base+in.A+in.B+2 > vm.maxRegisters {
+				return nil, vm.stackOverflow()
+			}
+			copy(regs[in.A+1:in.A+in.B+2], regs[in.A:in.A+in.B+1])
+			regs[in.A] = method
+
+			called, err := vm.call(f.base+in.A, in.B+1)
+			if err != nil {
+				return nil, err
+			}
+			if called {
+				f = &vm.frames[len(vm.frames)-1] // The current frame changed
+				ins, regs = f.cl.Fn.Instructions, vm.registers[f.base:]
+			}
+		case OpDefineMethod:
+			objType := object.ObjectType(vm.constants[in.A].(*object.String).Value)
+			name := vm.constants[in.B].(*object.String).Value
+
+			vm.methods.Set(objType, name, regs[in.C])
+		case OpSkipDefault:
+			if f.numArgs > in.A { // The caller passed this argument, so the default is not evaluated
+				f.pc = in.B
+			}
+		case OpMatchEqual:
+			regs[in.A] = nativeBoolToBooleanObject(object.Equal(regs[in.B], regs[in.C]))
+		case OpMatchArray:
+			array, ok := regs[in.B].(*object.Array)
+			regs[in.A] = nativeBoolToBooleanObject(ok && len(array.Elements) == in.C)
+		case OpMatchHash:
+			_, ok := regs[in.B].(*object.Hash)
+			regs[in.A] = nativeBoolToBooleanObject(ok)
+		case OpMatchKey:
+			hash := regs[in.B].(*object.Hash) // OpMatchHash has already checked the type
+			found := false
+			if key, ok := regs[in.C].(object.Hashable); ok {
+				_, found = hash.Pairs[key.HashKey()]
+			}
+			regs[in.A] = nativeBoolToBooleanObject(found)
+		case OpDestructureArray:
+			err := destructureArray(regs[in.A:], in.B, in.C, vm.memory)
+			if err != nil {
+				return nil, err
+			}
+		case OpDestructureHash:
+			err := destructureHash(regs[in.A:], in.B, in.C)
+			if err != nil {
+				return nil, err
+			}
+		case OpReturn, OpReturnNull:
+			value := object.Object(Null)
+			if in.Op == OpReturn {
+				value = regs[in.A]
+			}
+
+			if len(vm.frames) == 1 {
+				return value, nil
+			}
+
+			vm.registers[f.base-1] = value // Where the callee was
+			vm.frames = vm.frames[:len(vm.frames)-1]
+			f = &vm.frames[len(vm.frames)-1]
+			ins, regs = f.cl.Fn.Instructions, vm.registers[f.base:]
+		default:
+			return nil, fmt.Errorf("opcode %d undefined", in.Op)
+		}
+	}
+}
+
+// Calls the function in register callee of the whole register stack with the numArgs registers after it as arguments.
+// A builtin runs right away, for a closure it pushes a frame and reports that the current frame changed.
+func (vm *VM) call(callee, numArgs int) (bool, error) {
+	switch fn := vm.registers[callee].(type) {
+	case *Closure:
+		return true, vm.pushFrame(fn, callee+1, numArgs)
+	case *object.Builtin:
+		args := vm.registers[callee+1 : callee+1+numArgs]
+		if fn.Size != nil {
+			err := vm.memory.Alloc(fn.Size(args...))
+			if err != nil {
+				return false, err
+			}
+		}
+
+		result := fn.Fn(args...)
+		if result == nil {
+			result = Null
+		}
+
+		vm.registers[callee] = result
+		return false, nil
+	default:
+		return false, fmt.Errorf("calling non-function and non-built-in")
+	}
+}
+
+// A closure called in tail position replaces the current frame, it and its arguments move down to where the
+// current callee and its arguments were. Anything else is an ordinary call, the return after it hands back the result
+func (vm *VM) tailCall(callee, numArgs int) (bool, error) {
+	cl, ok := vm.registers[callee].(*Closure)
+	if !ok || len(vm.frames) == 1 { // Main's frame is never given up
+		return vm.call(callee, numArgs)
+	}
+
+	err := checkArity(cl.Fn, numArgs)
+	if err != nil {
+		return false, err
+	}
+
+	base := vm.frames[len(vm.frames)-1].base
+	copy(vm.registers[base-1:], vm.registers[callee:callee+numArgs+1])
+	vm.frames = vm.frames[:len(vm.frames)-1]
+
+	return true, vm.pushFrame(cl, base, numArgs)
+}
+
+func (vm *VM) pushFrame(cl *Closure, base, numArgs int) error {
+	fn := cl.Fn
+	err := checkArity(fn, numArgs)
+	if err != nil {
+		return err
+	}
+
+	if base+fn.NumRegisters > vm.maxRegisters {
+		return vm.stackOverflow()
+	}
+	if len(vm.frames) >= vm.maxFrames {
+		return &object.LimitError{Kind: object.DepthLimit, Limit: int64(vm.maxFrames - 1)}
+	}
+
+	if fn.Variadic { // Extra arguments are moved into an array in the register right after the parameters
+		numRest := 0
+		if numArgs > fn.NumParameters {
+			numRest = numArgs - fn.NumParameters
+		}
+
+		err := vm.memory.Alloc(object.ArraySize(numRest))
+		if err != nil {
+			return err
+		}
+		rest := make([]object.Object, numRest)
+		copy(rest, vm.registers[base+numArgs-numRest:base+numArgs])
+
+		vm.registers[base+fn.NumParameters] = &object.Array{Elements: rest}
+	}
+
+	vm.frames = append(vm.frames, frame{cl: cl, base: base, numArgs: numArgs})
+	return nil
+}
+
+func (vm *VM) stackOverflow() error {
+	return &object.LimitError{Kind: object.StackLimit, Limit: int64(vm.maxRegisters)}
+}
+
+func checkArity(fn *Function, numArgs int) error {
+	minArgs := fn.NumParameters - fn.NumDefaults
+
+	if numArgs < minArgs || (!fn.Variadic && numArgs > fn.NumParameters) {
+		if fn.Name != "" {
+			return fmt.Errorf("wrong number of arguments to %s: want=%s, got=%d", fn.Name, arityString(fn), numArgs)
+		}
+		return fmt.Errorf("wrong number of arguments: want=%s, got=%d", arityString(fn), numArgs)
+	}
+
+	return nil
+}
+
+func arityString(fn *Function) string {
+	minArgs := fn.NumParameters - fn.NumDefaults
+
+	switch {
+	case fn.Variadic:
+		return fmt.Sprintf("at least %d", minArgs)
+	case fn.NumDefaults > 0:
+		return fmt.Sprintf("%d..%d", minArgs, fn.NumParameters)
+	default:
+		return fmt.Sprintf("%d", fn.NumParameters)
+	}
+}
+
+// The arguments were grouped into arrays by the compiler, they are flattened into the registers after the callee
+func (vm *VM) spreadArguments(callee, numSegments int) (int, error) {
+	segments := vm.registers[callee+1 : callee+1+numSegments]
+	numArgs := 0
+
+	for _, s := range segments {
+		arr, ok := s.(*object.Array)
+		if !ok {
+			return 0, fmt.Errorf("spread argument must be ARRAY, got %s", s.Type())
+		}
+
+		numArgs += len(arr.Elements)
+	}
+
+	err := vm.memory.Alloc(object.ArraySize(numArgs)) // The arguments are gathered before they go in the registers
+	if err != nil {
+		return 0, err
+	}
+
+	args := make([]object.Object, 0, numArgs)
+	for _, s := range segments {
+		args = append(args, s.(*object.Array).Elements...)
+	}
+
+	if callee+1+len(args) > vm.maxRegisters {
+		return 0, vm.stackOverflow()
+	}
+
+	copy(vm.registers[callee+1:], args)
+	return len(args), nil
+}
+
+func (vm *VM) lookupMethod(t object.ObjectType, name string) (object.Object, bool) {
+	if method, ok := vm.methods.Get(t, name); ok { // Methods from impl blocks take priority over the builtin ones
+		return method, true
+	}
+
+	if builtin := object.GetBuiltinMethod(t, name); builtin != nil {
+		return builtin, true
+	}
+
+	return nil, false
+}
+
+func (vm *VM) newClosure(f *frame, fn *Function) *Closure {
+	free := make([]object.Object, len(fn.Captures))
+	for i, c := range fn.Captures {
+		switch c.kind {
+		case captureRegister:
+			free[i] = vm.registers[f.base+c.index]
+		case captureFree:
+			free[i] = f.cl.Free[c.index]
+		case captureSelf:
+			free[i] = f.cl
+		}
+	}
+
+	return &Closure{Fn: fn, Free: free}
+}
+
+// Lists the frames that were active when Run returned, innermost first, so it is only meaningful after an error
+func (vm *VM) StackTrace() []string {
+	trace := []string{}
+
+	for i := len(vm.frames) - 1; i >= 0; i-- {
+		f := vm.frames[i]
+
+		name := f.cl.Fn.Name
+		switch {
+		case i == 0:
+			name = "<main>"
+		case name == "":
+			name = "<anonymous>"
+		}
+
+		trace = append(trace, fmt.Sprintf("at %s (pc %d)", name, f.pc-1))
+	}
+
+	return trace
+}
@@ -5,6 +5,7 @@ type TokenType string
 type Token struct {
 	Type TokenType
 	Literal string
+	Line int // 1-based line the token starts on, 0 for tokens the parser makes up
 }
 
 const (
@@ -18,6 +19,7 @@ const (
 
 	// Operators
 	ASSIGN = "="
+	ARROW = "=>"
 	PLUS = "+"
 	MINUS = "-"
 	BANG = "!"
@@ -34,6 +36,8 @@ const (
 	COMMA = ","
 	SEMICOLON = ";"
 	COLON = ":"
+	DOT = "."
+	ELLIPSIS = "..."
 
 	LPAREN = "("
 	RPAREN = ")"
@@ -50,6 +54,8 @@ const (
 	IF = "IF"
 	ELSE = "ELSE"
 	RETURN = "RETURN"
+	IMPL = "IMPL"
+	MATCH = "MATCH"
 )
 
 var keywords = map[string]TokenType {
@@ -60,6 +66,8 @@ var keywords = map[string]TokenType {
 	"if": IF,
 	"else": ELSE,
 	"return": RETURN,
+	"impl": IMPL,
+	"match": MATCH,
 }
 
 func LookupIndent(indent string) TokenType {
@@ -0,0 +1,315 @@
+// Package verifier checks bytecode before the VM runs it. The VM trusts its instructions completely,
+// so a bad operand would otherwise index out of range and panic instead of returning an error.
+package verifier
+
+import (
+	"fmt"
+	"compiler/code"
+	"compiler/object"
+)
+
+// Verify checks the main program and every compiled function in the constant pool.
+// numGlobals is the size of the globals store the program will run with.
+func Verify(ins code.Instructions, constants []object.Object, numGlobals int) error {
+	err := verifyFunction(ins, nil, constants, numGlobals)
+	if err != nil {
+		return fmt.Errorf("main program: %s", err)
+	}
+
+	for i, c := range constants {
+		fn, ok := c.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+
+		err := verifyFunction(fn.Instructions, fn, constants, numGlobals)
+		if err != nil {
+			name := fn.Name
+			if name == "" {
+				name = "anonymous function"
+			}
+			return fmt.Errorf("%s (constant %d): %s", name, i, err)
+		}
+	}
+
+	return nil
+}
+
+type instruction struct {
+	op code.Opcode
+	def *code.Definition
+	operands []int
+	next int // Offset of the following instruction
+}
+
+// fn is nil for the main program, which has no locals, parameters or free variables
+func verifyFunction(ins code.Instructions, fn *object.CompiledFunction, constants []object.Object, numGlobals int) error {
+	decoded, err := decode(ins)
+	if err != nil {
+		return err
+	}
+
+	for offset, in := range decoded {
+		err := checkOperands(in, fn, constants, numGlobals, decoded, len(ins))
+		if err != nil {
+			return fmt.Errorf("%04d %s: %s", offset, in.def.Name, err)
+		}
+	}
+
+	return checkStack(decoded, fn, len(ins))
+}
+
+// Splits the instructions up, which also finds every instruction boundary a jump may land on
+func decode(ins code.Instructions) (map[int]instruction, error) {
+	decoded := map[int]instruction{}
+
+	i := 0
+	for i < len(ins) {
+		def, err := code.Lookup(ins[i])
+		if err != nil {
+			return nil, fmt.Errorf("%04d: %s", i, err)
+		}
+
+		width := 0
+		for _, w := range def.OperandWidths {
+			width += w
+		}
+
+		if i+1+width > len(ins) {
+			return nil, fmt.Errorf("%04d %s: instruction is cut off", i, def.Name)
+		}
+
+		operands, read := code.ReadOperands(def, ins[i+1:])
+		decoded[i] = instruction{op: code.Opcode(ins[i]), def: def, operands: operands, next: i + 1 + read}
+
+		i += 1 + read
+	}
+
+	return decoded, nil
+}
+
+func checkOperands(in instruction, fn *object.CompiledFunction, constants []object.Object, numGlobals int, decoded map[int]instruction, end int) error {
+	numLocals, numParameters, numFree := 0, 0, 0
+	if fn != nil {
+		numLocals, numParameters, numFree = fn.NumLocals, fn.NumParameters, fn.NumFree
+	}
+
+	switch in.op {
+	case code.OpReturn:
+		if fn == nil { // A return in the main program ends it with a value, which OpReturn doesn't have
+			return fmt.Errorf("return outside of a function")
+		}
+	case code.OpConstant, code.OpConstantWide:
+		return checkConstant(in.operands[0], constants)
+	case code.OpJump, code.OpJumpNotTruthy, code.OpJumpIfNotGreater, code.OpJumpWide, code.OpJumpNotTruthyWide:
+		return checkJump(in.operands[0], decoded, end)
+	case code.OpGetLocal0, code.OpGetLocal1, code.OpGetLocal2, code.OpGetLocal3:
+		index := int(in.op - code.OpGetLocal0)
+		if index >= numLocals {
+			return fmt.Errorf("local %d out of range, function has %d", index, numLocals)
+		}
+	case code.OpAddConstInt, code.OpSubConstInt:
+		err := checkConstant(in.operands[0], constants)
+		if err != nil {
+			return err
+		}
+		if _, ok := constants[in.operands[0]].(*object.Integer); !ok {
+			return fmt.Errorf("constant %d is %s, not an integer", in.operands[0], constants[in.operands[0]].Type())
+		}
+	case code.OpSkipDefault, code.OpSkipDefaultWide:
+		if in.operands[0] >= numParameters {
+			return fmt.Errorf("parameter %d out of range, function has %d", in.operands[0], numParameters)
+		}
+		return checkJump(in.operands[1], decoded, end)
+	case code.OpGetLocal, code.OpSetLocal, code.OpGetLocalDup, code.OpGetLocalWide, code.OpSetLocalWide:
+		if in.operands[0] >= numLocals {
+			return fmt.Errorf("local %d out of range, function has %d", in.operands[0], numLocals)
+		}
+	case code.OpGetGlobal, code.OpSetGlobal, code.OpGetGlobalWide, code.OpSetGlobalWide:
+		if in.operands[0] >= numGlobals {
+			return fmt.Errorf("global %d out of range, program has %d", in.operands[0], numGlobals)
+		}
+	case code.OpGetFree, code.OpGetFreeWide:
+		if in.operands[0] >= numFree {
+			return fmt.Errorf("free variable %d out of range, function has %d", in.operands[0], numFree)
+		}
+	case code.OpGetBuiltin:
+		if in.operands[0] >= len(object.Builtins) {
+			return fmt.Errorf("builtin %d out of range, there are %d", in.operands[0], len(object.Builtins))
+		}
+	case code.OpHash:
+		if in.operands[0]%2 != 0 {
+			return fmt.Errorf("odd number of hash elements %d", in.operands[0])
+		}
+	case code.OpClosure, code.OpClosureWide:
+		err := checkConstant(in.operands[0], constants)
+		if err != nil {
+			return err
+		}
+
+		closureFn, ok := constants[in.operands[0]].(*object.CompiledFunction)
+		if !ok {
+			return fmt.Errorf("constant %d is %s, not a function", in.operands[0], constants[in.operands[0]].Type())
+		}
+
+		if closureFn.NumFree != in.operands[1] {
+			return fmt.Errorf("function needs %d free variables, got %d", closureFn.NumFree, in.operands[1])
+		}
+	case code.OpDefineMethod, code.OpDefineMethodWide:
+		for _, c := range in.operands {
+			err := checkStringConstant(c, constants)
+			if err != nil {
+				return err
+			}
+		}
+	case code.OpCallMethod, code.OpCallMethodWide:
+		return checkStringConstant(in.operands[0], constants)
+	case code.OpDestructureArray, code.OpDestructureHash:
+		if in.operands[1]&^(code.DestructureRest|code.DestructureStrict) != 0 {
+			return fmt.Errorf("unknown flags %b", in.operands[1])
+		}
+	}
+
+	return nil
+}
+
+func checkConstant(index int, constants []object.Object) error {
+	if index >= len(constants) {
+		return fmt.Errorf("constant %d out of range, pool has %d", index, len(constants))
+	}
+
+	return nil
+}
+
+func checkStringConstant(index int, constants []object.Object) error {
+	err := checkConstant(index, constants)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := constants[index].(*object.String); !ok {
+		return fmt.Errorf("constant %d is %s, not a string", index, constants[index].Type())
+	}
+
+	return nil
+}
+
+// Jumping to the very end is allowed, that is how an if at the end of the main program finishes
+func checkJump(target int, decoded map[int]instruction, end int) error {
+	if target == end {
+		return nil
+	}
+
+	if _, ok := decoded[target]; !ok {
+		return fmt.Errorf("jump target %04d is not the start of an instruction", target)
+	}
+
+	return nil
+}
+
+// How many values an instruction takes off the stack and how many it puts back
+func stackEffect(in instruction) (pops int, pushes int, err error) {
+	switch in.op {
+	case code.OpConstant, code.OpConstantWide, code.OpTrue, code.OpFalse, code.OpNull, code.OpGetGlobal, code.OpGetGlobalWide, code.OpGetLocal, code.OpGetLocalWide,
+		code.OpGetBuiltin, code.OpGetFree, code.OpGetFreeWide, code.OpCurrentClosure, code.OpGetLocal0, code.OpGetLocal1, code.OpGetLocal2, code.OpGetLocal3:
+		return 0, 1, nil
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpEqual, code.OpNotEqual, code.OpGreaterThan,
+		code.OpIndex, code.OpMatchEqual, code.OpMatchKey:
+		return 2, 1, nil
+	case code.OpMinus, code.OpBang, code.OpMatchArray, code.OpMatchHash, code.OpAddConstInt, code.OpSubConstInt:
+		return 1, 1, nil
+	case code.OpPop, code.OpSetGlobal, code.OpSetGlobalWide, code.OpSetLocal, code.OpSetLocalWide, code.OpJumpNotTruthy, code.OpJumpNotTruthyWide, code.OpDefineMethod, code.OpDefineMethodWide, code.OpReturnValue:
+		return 1, 0, nil
+	case code.OpJump, code.OpReturn, code.OpSkipDefault, code.OpJumpWide, code.OpSkipDefaultWide:
+		return 0, 0, nil
+	case code.OpArray, code.OpHash:
+		return in.operands[0], 1, nil
+	case code.OpCall, code.OpCallSpread, code.OpCallWide, code.OpTailCall, code.OpCallSpreadWide, code.OpTailCallSpread:
+		return in.operands[0] + 1, 1, nil // The arguments and the callee
+	case code.OpCallMethod, code.OpCallMethodWide:
+		return in.operands[1] + 1, 1, nil // The arguments and the receiver
+	case code.OpClosure, code.OpClosureWide:
+		return in.operands[1], 1, nil
+	case code.OpDestructureArray:
+		if in.operands[1]&code.DestructureRest != 0 {
+			return 1, in.operands[0] + 1, nil
+		}
+		return 1, in.operands[0], nil
+	case code.OpDestructureHash:
+		return in.operands[0] + 1, in.operands[0], nil
+	case code.OpGetLocalDup:
+		return 0, 2, nil
+	case code.OpJumpIfNotGreater:
+		return 2, 0, nil
+	case code.OpCall0, code.OpCall1, code.OpCall2:
+		return int(in.op-code.OpCall0) + 1, 1, nil
+	}
+
+	return 0, 0, fmt.Errorf("no stack effect known for %s", in.def.Name)
+}
+
+// Follows every path through the instructions, the stack has to be the same height whichever way an instruction is reached
+func checkStack(decoded map[int]instruction, fn *object.CompiledFunction, end int) error {
+	depths := map[int]int{0: 0}
+	work := []int{0}
+
+	if end == 0 {
+		if fn != nil {
+			return fmt.Errorf("function has no instructions")
+		}
+		return nil
+	}
+
+	for len(work) > 0 {
+		offset := work[len(work)-1]
+		work = work[:len(work)-1]
+
+		in := decoded[offset]
+		depth := depths[offset]
+
+		pops, pushes, err := stackEffect(in)
+		if err != nil {
+			return fmt.Errorf("%04d: %s", offset, err)
+		}
+
+		if depth < pops {
+			return fmt.Errorf("%04d %s: needs %d values on the stack, has %d", offset, in.def.Name, pops, depth)
+		}
+		depth = depth - pops + pushes
+
+		successors := []int{}
+		switch in.op {
+		case code.OpReturnValue, code.OpReturn:
+		case code.OpJump, code.OpJumpWide:
+			successors = append(successors, in.operands[0])
+		case code.OpJumpNotTruthy, code.OpJumpIfNotGreater, code.OpJumpNotTruthyWide:
+			successors = append(successors, in.next, in.operands[0])
+		case code.OpSkipDefault, code.OpSkipDefaultWide:
+			successors = append(successors, in.next, in.operands[1])
+		default:
+			successors = append(successors, in.next)
+		}
+
+		for _, next := range successors {
+			if next == end {
+				if fn != nil {
+					return fmt.Errorf("%04d %s: function can run past its last instruction without returning", offset, in.def.Name)
+				}
+				continue
+			}
+
+			seen, ok := depths[next]
+			if !ok {
+				depths[next] = depth
+				work = append(work, next)
+				continue
+			}
+
+			if seen != depth {
+				return fmt.Errorf("%04d: stack height is %d on one path and %d on another", next, seen, depth)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package verifier
+
+import (
+	"strings"
+	"testing"
+	"compiler/code"
+	"compiler/object"
+)
+
+func concat(instructions ...[]byte) code.Instructions {
+	out := code.Instructions{}
+	for _, ins := range instructions {
+		out = append(out, ins...)
+	}
+
+	return out
+}
+
+func function(numLocals, numParameters, numFree int, instructions ...[]byte) *object.CompiledFunction {
+	return &object.CompiledFunction{
+		Instructions: concat(instructions...),
+		NumLocals: numLocals,
+		NumParameters: numParameters,
+		NumFree: numFree,
+	}
+}
+
+func TestValidBytecode(t *testing.T) {
+	constants := []object.Object{
+		&object.Integer{Value: 1},
+		function(1, 1, 1,
+			code.Make(code.OpGetFree, 0),
+			code.Make(code.OpGetLocal, 0),
+			code.Make(code.OpAdd),
+			code.Make(code.OpReturnValue),
+		),
+	}
+
+	main := concat(
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpClosure, 1, 1),
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpCall, 1),
+		code.Make(code.OpTrue),
+		code.Make(code.OpJumpNotTruthy, 16),
+		code.Make(code.OpNull),
+		code.Make(code.OpPop),
+		code.Make(code.OpPop),
+		code.Make(code.OpGetGlobalWide, 70000),
+		code.Make(code.OpSetGlobal, 1),
+	)
+
+	err := Verify(main, constants, 70001)
+	if err != nil {
+		t.Fatalf("valid bytecode rejected: %s", err)
+	}
+
+	err = Verify(code.Instructions{}, nil, 0)
+	if err != nil {
+		t.Fatalf("empty program rejected: %s", err)
+	}
+}
+
+func TestInvalidBytecode(t *testing.T) {
+	integer := &object.Integer{Value: 1}
+
+	tests := []struct {
+		main code.Instructions
+		constants []object.Object
+		expected string
+	} {
+		{
+			code.Instructions{255},
+			nil,
+			"opcode 255 undefined",
+		},
+		{
+			code.Instructions{byte(code.OpConstant), 0},
+			[]object.Object{integer},
+			"instruction is cut off",
+		},
+		{
+			concat(code.Make(code.OpConstant, 1), code.Make(code.OpPop)),
+			[]object.Object{integer},
+			"constant 1 out of range",
+		},
+		{
+			concat(code.Make(code.OpConstantWide, 70000), code.Make(code.OpPop)),
+			[]object.Object{integer},
+			"constant 70000 out of range",
+		},
+		{
+			concat(code.Make(code.OpJump, 1), code.Make(code.OpNull), code.Make(code.OpPop)),
+			nil,
+			"jump target 0001 is not the start of an instruction",
+		},
+		{
+			concat(code.Make(code.OpJump, 100)),
+			nil,
+			"jump target 0100 is not the start of an instruction",
+		},
+		{
+			concat(code.Make(code.OpJumpWide, 70000)),
+			nil,
+			"jump target 70000 is not the start of an instruction",
+		},
+		{
+			concat(code.Make(code.OpGetLocal, 0), code.Make(code.OpPop)),
+			nil,
+			"local 0 out of range",
+		},
+		{
+			concat(code.Make(code.OpGetGlobal, 1), code.Make(code.OpPop)),
+			nil,
+			"global 1 out of range, program has 1",
+		},
+		{
+			concat(code.Make(code.OpNull), code.Make(code.OpSetGlobalWide, 70000)),
+			nil,
+			"global 70000 out of range",
+		},
+		{
+			nil,
+			[]object.Object{function(1, 0, 0, code.Make(code.OpGetLocalWide, 300), code.Make(code.OpReturnValue))},
+			"local 300 out of range",
+		},
+		{
+			concat(code.Make(code.OpGetBuiltin, 200), code.Make(code.OpPop)),
+			nil,
+			"builtin 200 out of range",
+		},
+		{
+			concat(code.Make(code.OpAdd)),
+			nil,
+			"needs 2 values on the stack, has 0",
+		},
+		{
+			concat(
+				code.Make(code.OpTrue),
+				code.Make(code.OpJumpNotTruthy, 7),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+			),
+			[]object.Object{integer},
+			"stack height is",
+		},
+		{
+			concat(code.Make(code.OpClosure, 0, 0), code.Make(code.OpPop)),
+			[]object.Object{integer},
+			"constant 0 is INTEGER, not a function",
+		},
+		{
+			concat(code.Make(code.OpClosure, 0, 0), code.Make(code.OpPop)),
+			[]object.Object{function(0, 0, 1, code.Make(code.OpGetFree, 0), code.Make(code.OpReturnValue))},
+			"function needs 1 free variables, got 0",
+		},
+		{
+			nil,
+			[]object.Object{function(0, 0, 0, code.Make(code.OpGetFree, 0), code.Make(code.OpReturnValue))},
+			"free variable 0 out of range",
+		},
+		{
+			nil,
+			[]object.Object{integer, function(0, 0, 0, code.Make(code.OpConstant, 0))},
+			"function can run past its last instruction without returning",
+		},
+		{
+			nil,
+			[]object.Object{function(1, 1, 0, code.Make(code.OpSkipDefault, 1, 4), code.Make(code.OpReturn))},
+			"parameter 1 out of range",
+		},
+		{
+			concat(code.Make(code.OpNull), code.Make(code.OpCallMethod, 0, 0), code.Make(code.OpPop)),
+			[]object.Object{integer},
+			"constant 0 is INTEGER, not a string",
+		},
+		{
+			concat(code.Make(code.OpReturn)),
+			nil,
+			"return outside of a function",
+		},
+	}
+
+	for i, tt := range tests {
+		err := Verify(tt.main, tt.constants, 1)
+		if err == nil {
+			t.Errorf("test %d: expected a verifier error containing %q but got none", i, tt.expected)
+			continue
+		}
+
+		if !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("test %d: wrong error. want it to contain %q, got=%q", i, tt.expected, err)
+		}
+	}
+}
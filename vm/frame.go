@@ -9,6 +9,7 @@ type Frame struct {
 	cl *object.Closure
 	ip int
 	basePointer int
+	numArgs int // How many arguments the caller actually passed, parameters past it take their default value
 }
 
 func NewFrame(cl *object.Closure, basePointer int) *Frame {
@@ -0,0 +1,130 @@
+package vm
+
+import (
+	"compiler/object"
+)
+
+type valueKind uint8
+
+const (
+	noValue valueKind = iota // A slot nothing was written to yet, it reads as a nil object
+	nullValue
+	integerValue
+	booleanValue
+	objectValue // Strings, arrays, hashes, closures, builtins and errors, anything that lives on the heap anyway
+)
+
+// Value is what the stack holds. Integers, booleans and null are stored in place, so pushing one never
+// allocates. object.Object is still what the globals, the constants, builtins and embedders see, values
+// are converted at those boundaries.
+type Value struct {
+	kind valueKind
+	n int64 // The integer, or 1 and 0 for true and false
+	obj object.Object
+}
+
+var nullVal = Value{kind: nullValue}
+
+func intValue(n int64) Value {
+	return Value{kind: integerValue, n: n}
+}
+
+func boolValue(b bool) Value {
+	if b {
+		return Value{kind: booleanValue, n: 1}
+	}
+
+	return Value{kind: booleanValue}
+}
+
+// fromObject unboxes integers, booleans and null. A nil object, like an unset global, stays nil.
+func fromObject(obj object.Object) Value {
+	switch obj := obj.(type) {
+	case nil:
+		return Value{}
+	case *object.Integer:
+		return intValue(obj.Value)
+	case *object.Boolean:
+		return boolValue(obj.Value)
+	case *object.Null:
+		return nullVal
+	default:
+		return Value{kind: objectValue, obj: obj}
+	}
+}
+
+// toObject boxes the value again. Booleans and null become the VM's singletons and integers come from the small integer cache where they can.
+func (v Value) toObject() object.Object {
+	switch v.kind {
+	case integerValue:
+		return object.NewInteger(v.n)
+	case booleanValue:
+		return nativeBoolToBooleanObject(v.n != 0)
+	case nullValue:
+		return Null
+	default:
+		return v.obj // nil for noValue
+	}
+}
+
+func (v Value) Type() object.ObjectType {
+	switch v.kind {
+	case integerValue:
+		return object.INTEGER_OBJ
+	case booleanValue:
+		return object.BOOLEAN_OBJ
+	case nullValue:
+		return object.NULL_OBJ
+	default:
+		return v.obj.Type()
+	}
+}
+
+func (v Value) isTruthy() bool {
+	switch v.kind {
+	case booleanValue:
+		return v.n != 0
+	case nullValue:
+		return false
+	default:
+		return true
+	}
+}
+
+// Same keys the objects themselves would give, without boxing integers and booleans first
+func (v Value) hashKey() (object.HashKey, bool) {
+	switch v.kind {
+	case integerValue:
+		return object.HashKey{Type: object.INTEGER_OBJ, Value: uint64(v.n)}, true
+	case booleanValue:
+		return object.HashKey{Type: object.BOOLEAN_OBJ, Value: uint64(v.n)}, true
+	case objectValue:
+		if hashable, ok := v.obj.(object.Hashable); ok {
+			return hashable.HashKey(), true
+		}
+	}
+
+	return object.HashKey{}, false
+}
+
+// Like object.Equal, values of different types are never equal
+func valuesEqual(left, right Value) bool {
+	if left.kind != right.kind {
+		return false
+	}
+
+	if left.kind == objectValue {
+		return object.Equal(left.obj, right.obj)
+	}
+
+	return left.n == right.n
+}
+
+func toObjects(values []Value) []object.Object {
+	objects := make([]object.Object, len(values))
+	for i, v := range values {
+		objects[i] = v.toObject()
+	}
+
+	return objects
+}
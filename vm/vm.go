@@ -1,66 +1,206 @@
 package vm
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"compiler/code"
 	"compiler/compiler"
 	"compiler/object"
 )
 
 const StackSize = 2048
-const GlobalsSize = 65536
 const MaxFrames = 1024
 
-var True = &object.Boolean{Value: true}
-var False = &object.Boolean{Value: false}
+var True = object.TRUE
+var False = object.FALSE
 
-var Null = &object.Null{}
+var Null = object.NULL
 
 type VM struct {
-	constants []object.Object
+	constants []Value // Converted once in New so OpConstant never has to unbox
 
-	stack []object.Object
+	stack []Value
 	sp int // Always points to the next value. Top of the stack is [sp-1] --> Maybe this is why compiler does not decrease index position
 
 	globals []object.Object
 
 	frames []*Frame
 	framesIndex int
+
+	methods object.MethodTable
+
+	limits object.Limits
+	memory *object.MemoryTracker
+	maxStack int // The stack slots and frames a run may use, StackSize and MaxFrames unless limits lower them
+	maxFrames int
 }
 
 func New(bytecode *compiler.Bytecode) *VM {
-	mainFn := &object.CompiledFunction{Instructions: bytecode.Instructions}
+	mainFn := &object.CompiledFunction{Instructions: bytecode.Instructions, SourceMap: bytecode.SourceMap}
 	mainClosure := &object.Closure{Fn: mainFn}
 	mainFrame := NewFrame(mainClosure, 0)
 
 	frames := make([]*Frame, MaxFrames)
 	frames[0] = mainFrame
 
-	return &VM{
-		constants: bytecode.Constants,
+	constants := make([]Value, len(bytecode.Constants))
+	for i, c := range bytecode.Constants {
+		constants[i] = fromObject(c)
+	}
+
+	vm := &VM{
+		constants: constants,
 
-		stack: make([]object.Object, StackSize),
+		stack: make([]Value, StackSize),
 		sp: 0, // Always points to the next free slot in the stack (which is why stack[sp-1] accesses the top stack)
 
-		globals: make([]object.Object, GlobalsSize),
+		globals: make([]object.Object, bytecode.NumGlobals), // Sized by the compiler, a one-line script gets a handful of slots
 
 		frames: frames,
 		framesIndex: 1,
+
+		methods: object.NewMethodTable(),
+
+		maxStack: StackSize,
+		maxFrames: MaxFrames,
+	}
+	vm.memory = object.NewMemoryTracker(0, vm.roots)
+
+	return vm
+}
+
+// SetLimits bounds the runs that follow, MaxStack and MaxDepth can only lower StackSize and MaxFrames
+func (vm *VM) SetLimits(limits object.Limits) {
+	vm.limits = limits
+	vm.memory.SetLimit(limits.MaxMemory)
+
+	vm.maxStack = StackSize
+	if limits.MaxStack > 0 && limits.MaxStack < StackSize {
+		vm.maxStack = limits.MaxStack
+	}
+
+	vm.maxFrames = MaxFrames
+	if limits.MaxDepth > 0 && limits.MaxDepth < MaxFrames-1 {
+		vm.maxFrames = limits.MaxDepth + 1 // Main's frame isn't a call
 	}
 }
 
+// The store is grown to fit the bytecode's globals, so a REPL can start with an empty one. It may be
+// reallocated while growing, Globals returns the store the VM actually used.
 func NewWithGlobalsStore(bytecode *compiler.Bytecode, s []object.Object) *VM {
 	vm := New(bytecode)
+	if len(s) < bytecode.NumGlobals {
+		s = append(s, make([]object.Object, bytecode.NumGlobals-len(s))...)
+	}
 	vm.globals = s
 	return vm
 }
 
+func NewWithState(bytecode *compiler.Bytecode, s []object.Object, methods object.MethodTable) *VM {
+	vm := NewWithGlobalsStore(bytecode, s)
+	vm.methods = methods
+	return vm
+}
+
+func (vm *VM) Globals() []object.Object {
+	return vm.globals
+}
+
+// SetGlobals swaps in a store holding the same globals, for a host whose store moved while growing in the
+// middle of a run. It must be at least as long as the one it replaces.
+func (vm *VM) SetGlobals(s []object.Object) {
+	vm.globals = s
+}
+
 func (vm *VM) Run() error {
+	return vm.RunContext(context.Background())
+}
+
+// Call runs fn, a closure or a builtin, with args until it returns and gives back its result. The VM's
+// own program is set aside, so a host can call back into a script through a VM made with the script's
+// constants and globals.
+func (vm *VM) Call(fn object.Object, args ...object.Object) (object.Object, error) {
+	op := code.OpCall
+	if len(args) > math.MaxUint8 {
+		op = code.OpCallWide
+	}
+	ins, err := code.MakeChecked(op, len(args))
+	if err != nil {
+		return nil, err
+	}
+
+	vm.frames[0] = NewFrame(&object.Closure{Fn: &object.CompiledFunction{Instructions: ins}}, 0)
+	vm.framesIndex = 1
+	vm.sp = 0
+
+	for _, v := range append([]object.Object{fn}, args...) {
+		err := vm.push(fromObject(v))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = vm.Run()
+	if err != nil {
+		return nil, err
+	}
+
+	return vm.StackTop(), nil
+}
+
+// Memory reports how much the VM holds in strings, arrays and hashes, and the most it held, for monitoring
+func (vm *VM) Memory() *object.MemoryTracker {
+	return vm.memory
+}
+
+// Everything a run can still reach: the stack, the globals, the closures of the calls in progress and
+// the methods
+func (vm *VM) roots(visit func(object.Object)) {
+	for _, v := range vm.stack[:vm.sp] {
+		visit(v.obj)
+	}
+	for _, g := range vm.globals {
+		visit(g)
+	}
+	for _, f := range vm.frames[:vm.framesIndex] {
+		visit(f.cl)
+	}
+	for _, methods := range vm.methods {
+		for _, method := range methods {
+			visit(method)
+		}
+	}
+}
+
+// RunContext stops the run with a *object.LimitError once ctx is done, or when it goes past the VM's limits
+func (vm *VM) RunContext(ctx context.Context) error {
 	var ip int
 	var ins code.Instructions
 	var op code.Opcode
+
+	done := ctx.Done() // Nil for a context that can't be cancelled, the check is skipped then
+	maxInstructions := int64(math.MaxInt64)
+	if vm.limits.MaxInstructions > 0 {
+		maxInstructions = vm.limits.MaxInstructions
+	}
+	var executed int64
+	vm.memory.Reset()
 	
 	for vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
+		if done != nil && executed%object.CancelCheckInterval == 0 {
+			select {
+			case <-done:
+				return &object.LimitError{Kind: object.Cancelled, Err: ctx.Err()}
+			default:
+			}
+		}
+
+		executed++
+		if executed > maxInstructions {
+			return &object.LimitError{Kind: object.InstructionLimit, Limit: maxInstructions}
+		}
+
 		vm.currentFrame().ip++
 
 		ip = vm.currentFrame().ip // Keeps track of the current ip being process in case it is incremented by the ip is needed to access the operand
@@ -76,6 +216,14 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}	
+		case code.OpConstantWide:
+			constIndex := code.ReadUint32(ins[ip+1:])
+			vm.currentFrame().ip += 4
+
+			err := vm.push(vm.constants[constIndex])
+			if err != nil {
+				return err
+			}
 		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
 			err := vm.executeBinaryOperation(op)
 			if err != nil {
@@ -97,17 +245,17 @@ func (vm *VM) Run() error {
 				return err
 			}
 		case code.OpTrue:
-			err := vm.push(True)
+			err := vm.push(boolValue(true))
 			if err != nil {
 				return err
 			}
 		case code.OpFalse:
-			err := vm.push(False)
+			err := vm.push(boolValue(false))
 			if err != nil {
 				return err
 			}
 		case code.OpNull:
-			err := vm.push(Null)
+			err := vm.push(nullVal)
 			if err != nil {
 				return err
 			}
@@ -116,22 +264,58 @@ func (vm *VM) Run() error {
 			vm.currentFrame().ip += 2
 
 			condition := vm.pop()
-			if !isTruthy(condition) {
+			if !condition.isTruthy() {
 				vm.currentFrame().ip = pos - 1
 			}
 		case code.OpJump:
 			pos := int(code.ReadUint16(ins[ip+1:]))
 			vm.currentFrame().ip = pos - 1
+		case code.OpJumpNotTruthyWide:
+			pos := int(code.ReadUint32(ins[ip+1:]))
+			vm.currentFrame().ip += 4
+
+			condition := vm.pop()
+			if !condition.isTruthy() {
+				vm.currentFrame().ip = pos - 1
+			}
+		case code.OpJumpWide:
+			pos := int(code.ReadUint32(ins[ip+1:]))
+			vm.currentFrame().ip = pos - 1
+		case code.OpJumpIfNotGreater:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			greater, err := vm.popGreaterThan()
+			if err != nil {
+				return err
+			}
+
+			if !greater {
+				vm.currentFrame().ip = pos - 1
+			}
 		case code.OpSetGlobal:
 			globalIndex := code.ReadUint16(ins[ip+1:]) // instructions[ip+1:] is the operands (in this case the index represented with 2 bytes)
 			vm.currentFrame().ip += 2
 
-			vm.globals[globalIndex] = vm.pop() // pops off the value on top of the stack and sets it as the value to the globals dictionary with the index being the key
+			vm.globals[globalIndex] = vm.pop().toObject() // pops off the value on top of the stack and sets it as the value to the globals dictionary with the index being the key
 		case code.OpGetGlobal:
 			globalIndex := code.ReadUint16(ins[ip+1:])
 			vm.currentFrame().ip += 2
 
-			err := vm.push(vm.globals[globalIndex]) // pushes the symbol onto the stack (because you are getting the value of the variable presumably to use it)
+			err := vm.push(fromObject(vm.globals[globalIndex])) // pushes the symbol onto the stack (because you are getting the value of the variable presumably to use it)
+			if err != nil {
+				return err
+			}
+		case code.OpSetGlobalWide:
+			globalIndex := code.ReadUint32(ins[ip+1:])
+			vm.currentFrame().ip += 4
+
+			vm.globals[globalIndex] = vm.pop().toObject()
+		case code.OpGetGlobalWide:
+			globalIndex := code.ReadUint32(ins[ip+1:])
+			vm.currentFrame().ip += 4
+
+			err := vm.push(fromObject(vm.globals[globalIndex]))
 			if err != nil {
 				return err
 			}
@@ -152,14 +336,59 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
+		case code.OpSetLocalWide:
+			localIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			vm.stack[vm.currentFrame().basePointer+int(localIndex)] = vm.pop()
+		case code.OpGetLocalWide:
+			localIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			err := vm.push(vm.stack[vm.currentFrame().basePointer+int(localIndex)])
+			if err != nil {
+				return err
+			}
+		case code.OpGetLocal0, code.OpGetLocal1, code.OpGetLocal2, code.OpGetLocal3:
+			err := vm.push(vm.stack[vm.currentFrame().basePointer+int(op-code.OpGetLocal0)])
+			if err != nil {
+				return err
+			}
+		case code.OpAddConstInt, code.OpSubConstInt:
+			constIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			err := vm.executeConstIntOperation(op, vm.constants[constIndex])
+			if err != nil {
+				return err
+			}
+		case code.OpGetLocalDup:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			local := vm.stack[vm.currentFrame().basePointer+int(localIndex)]
+			err := vm.push(local)
+			if err != nil {
+				return err
+			}
+
+			err = vm.push(local)
+			if err != nil {
+				return err
+			}
 		case code.OpArray:
 			numElements := int(code.ReadUint16(ins[ip+1:]))
 			vm.currentFrame().ip += 2
+
+			err := vm.memory.Alloc(object.ArraySize(numElements))
+			if err != nil {
+				return err
+			}
 			
 			array := vm.buildArray(vm.sp-numElements, vm.sp)
 			vm.sp = vm.sp - numElements
 			
-			err := vm.push(array)
+			err = vm.push(fromObject(array))
 			if err != nil {
 				return err
 			}	
@@ -167,13 +396,18 @@ func (vm *VM) Run() error {
 			numElements := int(code.ReadUint16(ins[ip+1:]))
 			vm.currentFrame().ip += 2
 
+			err := vm.memory.Alloc(object.HashSize(numElements / 2))
+			if err != nil {
+				return err
+			}
+
 			hash, err := vm.buildHash(vm.sp-numElements, vm.sp)
 			if err != nil {
 				return err
 			}
 			vm.sp = vm.sp - numElements
 			
-			err = vm.push(hash)
+			err = vm.push(fromObject(hash))
 			if err != nil {
 				return err
 			}
@@ -193,8 +427,32 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
+		case code.OpCallWide:
+			numArgs := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			err := vm.executeCall(int(numArgs))
+			if err != nil {
+				return err
+			}
+		case code.OpTailCall:
+			numArgs := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err := vm.executeTailCall(int(numArgs))
+			if err != nil {
+				return err
+			}
+		case code.OpCall0, code.OpCall1, code.OpCall2:
+			err := vm.executeCall(int(op - code.OpCall0))
+			if err != nil {
+				return err
+			}
 		case code.OpReturnValue:
 			returnValue := vm.pop()
+			if vm.framesIndex == 1 { // A return in the main program ends it, and what it returns is the result
+				return nil
+			}
 
 			frame := vm.popFrame() // Pops off the frame that was just executed
 			vm.sp = frame.basePointer - 1 // Replaces the vm.pop() --> Pops off ALL of the local bindings AND the just executed function -> The function is why we add the -1
@@ -207,7 +465,7 @@ func (vm *VM) Run() error {
 			frame := vm.popFrame()
 			vm.sp = frame.basePointer - 1
 
-			err := vm.push(Null)
+			err := vm.push(nullVal)
 			if err != nil {
 				return err
 			}
@@ -216,7 +474,7 @@ func (vm *VM) Run() error {
 			vm.currentFrame().ip += 1
 
 			definition := object.Builtins[builtinIndex] // This is being accessed like an ordinary slice with an INDEX not a key/map
-			err := vm.push(definition.Builtin)
+			err := vm.push(fromObject(definition.Builtin))
 			if err != nil {
 				return err
 			}
@@ -225,6 +483,15 @@ func (vm *VM) Run() error {
 			numFree := code.ReadUint8(ins[ip+3:])
 			vm.currentFrame().ip += 3 
 
+			err := vm.pushClosure(int(constIndex), int(numFree))
+			if err != nil {
+				return err
+			}
+		case code.OpClosureWide:
+			constIndex := code.ReadUint32(ins[ip+1:])
+			numFree := code.ReadUint16(ins[ip+5:])
+			vm.currentFrame().ip += 6
+
 			err := vm.pushClosure(int(constIndex), int(numFree))
 			if err != nil {
 				return err
@@ -234,7 +501,164 @@ func (vm *VM) Run() error {
 			vm.currentFrame().ip += 1
 
 			currentClosure := vm.currentFrame().cl
-			err := vm.push(currentClosure.Free[freeIndex])
+			err := vm.push(fromObject(currentClosure.Free[freeIndex]))
+			if err != nil {
+				return err
+			}
+		case code.OpGetFreeWide:
+			freeIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			err := vm.push(fromObject(vm.currentFrame().cl.Free[freeIndex]))
+			if err != nil {
+				return err
+			}
+		case code.OpDefineMethod:
+			typeIndex := code.ReadUint16(ins[ip+1:])
+			nameIndex := code.ReadUint16(ins[ip+3:])
+			vm.currentFrame().ip += 4
+
+			objType := object.ObjectType(vm.constants[typeIndex].obj.(*object.String).Value)
+			name := vm.constants[nameIndex].obj.(*object.String).Value
+
+			vm.methods.Set(objType, name, vm.pop().toObject())
+		case code.OpDefineMethodWide:
+			typeIndex := code.ReadUint32(ins[ip+1:])
+			nameIndex := code.ReadUint32(ins[ip+5:])
+			vm.currentFrame().ip += 8
+
+			objType := object.ObjectType(vm.constants[typeIndex].obj.(*object.String).Value)
+			name := vm.constants[nameIndex].obj.(*object.String).Value
+
+			vm.methods.Set(objType, name, vm.pop().toObject())
+		case code.OpCallMethod:
+			nameIndex := code.ReadUint16(ins[ip+1:])
+			numArgs := code.ReadUint8(ins[ip+3:])
+			vm.currentFrame().ip += 3
+
+			name := vm.constants[nameIndex].obj.(*object.String).Value
+
+			err := vm.executeMethodCall(name, int(numArgs))
+			if err != nil {
+				return err
+			}
+		case code.OpCallMethodWide:
+			nameIndex := code.ReadUint32(ins[ip+1:])
+			numArgs := code.ReadUint16(ins[ip+5:])
+			vm.currentFrame().ip += 6
+
+			name := vm.constants[nameIndex].obj.(*object.String).Value
+
+			err := vm.executeMethodCall(name, int(numArgs))
+			if err != nil {
+				return err
+			}
+		case code.OpMatchEqual:
+			right := vm.pop()
+			left := vm.pop()
+
+			err := vm.push(boolValue(valuesEqual(left, right)))
+			if err != nil {
+				return err
+			}
+		case code.OpMatchArray:
+			numElements := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			array, ok := vm.pop().obj.(*object.Array)
+
+			err := vm.push(boolValue(ok && len(array.Elements) == numElements))
+			if err != nil {
+				return err
+			}
+		case code.OpMatchHash:
+			_, ok := vm.pop().obj.(*object.Hash)
+
+			err := vm.push(boolValue(ok))
+			if err != nil {
+				return err
+			}
+		case code.OpMatchKey:
+			key := vm.pop()
+			hash, ok := vm.pop().obj.(*object.Hash) // OpMatchHash has already checked the type for compiled code, the verifier can't know types
+			if !ok {
+				return fmt.Errorf("OpMatchKey needs a hash")
+			}
+
+			found := false
+			if hashKey, ok := key.hashKey(); ok {
+				_, found = hash.Pairs[hashKey]
+			}
+
+			err := vm.push(boolValue(found))
+			if err != nil {
+				return err
+			}
+		case code.OpDestructureArray:
+			numElements := int(code.ReadUint16(ins[ip+1:]))
+			flags := int(code.ReadUint8(ins[ip+3:]))
+			vm.currentFrame().ip += 3
+
+			err := vm.destructureArray(vm.pop(), numElements, flags)
+			if err != nil {
+				return err
+			}
+		case code.OpDestructureHash:
+			numKeys := int(code.ReadUint16(ins[ip+1:]))
+			flags := int(code.ReadUint8(ins[ip+3:]))
+			vm.currentFrame().ip += 3
+
+			err := vm.destructureHash(numKeys, flags)
+			if err != nil {
+				return err
+			}
+		case code.OpSkipDefault:
+			paramIndex := int(code.ReadUint16(ins[ip+1:]))
+			pos := int(code.ReadUint16(ins[ip+3:]))
+			vm.currentFrame().ip += 4
+
+			if vm.currentFrame().numArgs > paramIndex { // The caller passed this argument, so the default is not evaluated
+				vm.currentFrame().ip = pos - 1
+			}
+		case code.OpSkipDefaultWide:
+			paramIndex := int(code.ReadUint16(ins[ip+1:]))
+			pos := int(code.ReadUint32(ins[ip+3:]))
+			vm.currentFrame().ip += 6
+
+			if vm.currentFrame().numArgs > paramIndex {
+				vm.currentFrame().ip = pos - 1
+			}
+		case code.OpCallSpread:
+			numSegments := int(code.ReadUint8(ins[ip+1:]))
+			vm.currentFrame().ip += 1
+
+			err := vm.executeSpreadCall(numSegments)
+			if err != nil {
+				return err
+			}
+		case code.OpCallSpreadWide:
+			numSegments := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			err := vm.executeSpreadCall(numSegments)
+			if err != nil {
+				return err
+			}
+		case code.OpTailCallSpread:
+			numSegments := int(code.ReadUint8(ins[ip+1:]))
+			vm.currentFrame().ip += 1
+
+			numArgs, err := vm.spreadArguments(numSegments)
+			if err != nil {
+				return err
+			}
+
+			err = vm.executeTailCall(numArgs)
+			if err != nil {
+				return err
+			}
+		case code.OpCurrentClosure:
+			err := vm.push(fromObject(vm.currentFrame().cl))
 			if err != nil {
 				return err
 			}
@@ -246,17 +670,44 @@ func (vm *VM) Run() error {
 	return nil
 }
 
+// Lists the frames that were active when Run returned, innermost first, so it is only meaningful after an error
+func (vm *VM) StackTrace() []string {
+	trace := []string{}
+
+	for i := vm.framesIndex - 1; i >= 0; i-- {
+		frame := vm.frames[i]
+
+		name := frame.cl.Fn.Name
+		switch {
+		case i == 0:
+			name = "<main>"
+		case name == "":
+			name = "<anonymous>"
+		}
+
+		line := frame.cl.Fn.SourceMap.Line(frame.ip)
+		if line == 0 {
+			trace = append(trace, fmt.Sprintf("at %s (ip %d)", name, frame.ip))
+			continue
+		}
+
+		trace = append(trace, fmt.Sprintf("at %s (line %d, ip %d)", name, line, frame.ip))
+	}
+
+	return trace
+}
+
 func (vm *VM) StackTop() object.Object {
 	if vm.sp == 0 {
 		return nil
 	}
 
-	return vm.stack[vm.sp-1]
+	return vm.stack[vm.sp-1].toObject()
 }
 
-func (vm *VM) push(o object.Object) error {
-	if vm.sp >= StackSize {
-		return fmt.Errorf("stack overflow")
+func (vm *VM) push(o Value) error {
+	if vm.sp >= vm.maxStack {
+		return vm.stackOverflow()
 	}
 
 	vm.stack[vm.sp] = o // Overrides the previously popped element in the stack, then increments to the next available spot in the stack
@@ -265,7 +716,7 @@ func (vm *VM) push(o object.Object) error {
 	return nil
 }
 
-func (vm *VM) pop() object.Object {
+func (vm *VM) pop() Value {
 	o := vm.stack[vm.sp-1]
 	vm.sp--
 
@@ -273,7 +724,7 @@ func (vm *VM) pop() object.Object {
 }
 
 func (vm *VM) LastPoppedStackElem() object.Object {
-	return vm.stack[vm.sp] // Because it is now popped off, therefore sp-- + 1 -> sp
+	return vm.stack[vm.sp].toObject() // Because it is now popped off, therefore sp-- + 1 -> sp
 }
 
 func (vm *VM) executeBinaryOperation(op code.Opcode) error {
@@ -294,9 +745,49 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 
 }
 
-func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, left, right object.Object) error {
-	leftValue := left.(*object.Integer).Value
-	rightValue := right.(*object.Integer).Value
+// Adds or subtracts without the type switch when the operand is an integer too, anything else takes the OpAdd or OpSub path for the same result or error
+func (vm *VM) executeConstIntOperation(op code.Opcode, constant Value) error {
+	left := vm.stack[vm.sp-1]
+	if left.kind == integerValue && constant.kind == integerValue {
+		if op == code.OpAddConstInt {
+			vm.stack[vm.sp-1] = intValue(left.n + constant.n)
+		} else {
+			vm.stack[vm.sp-1] = intValue(left.n - constant.n)
+		}
+		return nil
+	}
+
+	err := vm.push(constant)
+	if err != nil {
+		return err
+	}
+
+	if op == code.OpAddConstInt {
+		return vm.executeBinaryOperation(code.OpAdd)
+	}
+	return vm.executeBinaryOperation(code.OpSub)
+}
+
+// Pops the operands of a comparison and reports whether the left one is greater, with the same errors OpGreaterThan gives
+func (vm *VM) popGreaterThan() (bool, error) {
+	left := vm.stack[vm.sp-2]
+	right := vm.stack[vm.sp-1]
+	if left.kind == integerValue && right.kind == integerValue {
+		vm.sp -= 2
+		return left.n > right.n, nil
+	}
+
+	err := vm.executeComparison(code.OpGreaterThan)
+	if err != nil {
+		return false, err
+	}
+
+	return vm.pop().isTruthy(), nil
+}
+
+func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, left, right Value) error {
+	leftValue := left.n
+	rightValue := right.n
 
 	var result int64
 
@@ -308,54 +799,66 @@ func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, left, right object.O
 	case code.OpMul:
 		result = leftValue * rightValue
 	case code.OpDiv:
+		if rightValue == 0 {
+			return fmt.Errorf("division by zero")
+		}
 		result = leftValue / rightValue
 	default: 
 		return fmt.Errorf("unknown integer operator: %d", op)
 	}
 
-	return vm.push(&object.Integer{Value: result})
+	return vm.push(intValue(result))
 }
 
-func (vm *VM) executeBinaryStringOperation(op code.Opcode, left, right object.Object) error {
+func (vm *VM) executeBinaryStringOperation(op code.Opcode, left, right Value) error {
 	if op != code.OpAdd {
 		return fmt.Errorf("unknown string operator: %d", op)
 	}
 
-	leftValue := left.(*object.String).Value
-	rightValue := right.(*object.String).Value
+	leftValue := left.obj.(*object.String).Value
+	rightValue := right.obj.(*object.String).Value
 
-	return vm.push(&object.String{Value: leftValue + rightValue})
+	err := vm.memory.Alloc(object.StringSize(len(leftValue) + len(rightValue))) // Before concatenating, a doubling string stops at the ceiling rather than past it
+	if err != nil {
+		return err
+	}
+
+	return vm.push(fromObject(&object.String{Value: leftValue + rightValue}))
 }
 
 func (vm *VM) executeComparison(op code.Opcode) error {
 	right := vm.pop()
 	left := vm.pop()
 
-	if left.Type() == object.INTEGER_OBJ || right.Type() == object.INTEGER_OBJ {
+	if left.kind == integerValue && right.kind == integerValue {
 		return vm.executeIntegerComparison(op, left, right)
 	}
 
-	switch op {
+	if left.kind == integerValue || right.kind == integerValue {
+		return fmt.Errorf("unsupported types for comparison: %s %s", left.Type(), right.Type())
+	}
+
+	switch op { // Booleans and null compare by value, which is what identity gave with the singletons, everything else is still compared by identity
 	case code.OpEqual:
-		return vm.push(nativeBoolToBooleanObject(right == left))
+		return vm.push(boolValue(right == left))
 	case code.OpNotEqual:
-		return vm.push(nativeBoolToBooleanObject(right != left))
+		return vm.push(boolValue(right != left))
 	default:
 		return fmt.Errorf("unknown operator: %d (%s, %s)", op, left.Type(), right.Type())
 	}
 }
 
-func (vm *VM) executeIntegerComparison(op code.Opcode, left, right object.Object) error {
-	leftValue := left.(*object.Integer).Value
-	rightValue := right.(*object.Integer).Value
+func (vm *VM) executeIntegerComparison(op code.Opcode, left, right Value) error {
+	leftValue := left.n
+	rightValue := right.n
 
 	switch op {
 	case code.OpEqual:
-		return vm.push(nativeBoolToBooleanObject(rightValue == leftValue))
+		return vm.push(boolValue(rightValue == leftValue))
 	case code.OpNotEqual:
-		return vm.push(nativeBoolToBooleanObject(rightValue != leftValue))
+		return vm.push(boolValue(rightValue != leftValue))
 	case code.OpGreaterThan:
-		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+		return vm.push(boolValue(leftValue > rightValue))
 	default:
 		return fmt.Errorf("unknown operator: %d", op)
 	}
@@ -364,27 +867,24 @@ func (vm *VM) executeIntegerComparison(op code.Opcode, left, right object.Object
 func (vm *VM) executeBangOperator() error {
 	operand := vm.pop() // Pop off the more recent expression added to the stack
 
-	switch operand {
-	case True:
-		return vm.push(False)
-	case False:
-		return vm.push(True)
-	case Null:
-		return vm.push(True)
+	switch operand.kind {
+	case booleanValue:
+		return vm.push(boolValue(operand.n == 0))
+	case nullValue:
+		return vm.push(boolValue(true))
 	default:
-		return vm.push(False)
+		return vm.push(boolValue(false))
 	}
 }
 
 func (vm *VM) executeMinusOperator() error {
 	operand := vm.pop()
 
-	if operand.Type() != object.INTEGER_OBJ {
+	if operand.kind != integerValue {
 		return fmt.Errorf("unsupported")
 	}
 
-	value := operand.(*object.Integer).Value
-	return vm.push(&object.Integer{Value: -value})
+	return vm.push(intValue(-operand.n))
 
 }
 
@@ -392,7 +892,7 @@ func (vm *VM) buildArray(startIndex, endIndex int) object.Object {
 	elements := make([]object.Object, endIndex-startIndex)
 
 	for i := startIndex; i < endIndex; i++ {
-		elements[i-startIndex] = vm.stack[i] // Wouldn't this be FIFO...? Because stack[i] and i increments so it starts from the bottom of the stack and goes to the top?
+		elements[i-startIndex] = vm.stack[i].toObject() // Wouldn't this be FIFO...? Because stack[i] and i increments so it starts from the bottom of the stack and goes to the top?
 	} // As in the array is LIFO but the constants inside of the array are FIFO??? (when building the array)
 
 	return &object.Array{Elements: elements}
@@ -405,20 +905,20 @@ func (vm *VM) buildHash(startIndex, endIndex int) (object.Object, error) {
 		key := vm.stack[i]
 		value := vm.stack[i+1]
 
-		pair := object.HashPair{Key: key, Value: value}
+		pair := object.HashPair{Key: key.toObject(), Value: value.toObject()}
 
-		hashKey, ok := key.(object.Hashable)
+		hashKey, ok := key.hashKey()
 		if !ok {
 			return nil, fmt.Errorf("unusable as hash key: %s", key.Type())
 		}
 
-		hashedPairs[hashKey.HashKey()] = pair
+		hashedPairs[hashKey] = pair
 	}
 
 	return &object.Hash{Pairs: hashedPairs}, nil
 }
 
-func (vm *VM) executeIndexExpression(left, index object.Object) error {
+func (vm *VM) executeIndexExpression(left, index Value) error {
 	switch {
 	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
 		return vm.executeArrayIndex(left, index)
@@ -429,43 +929,107 @@ func (vm *VM) executeIndexExpression(left, index object.Object) error {
 	}
 }
 
-func (vm *VM) executeArrayIndex(array, index object.Object) error {
-	arrayObject := array.(*object.Array)
-	i := index.(*object.Integer).Value
+func (vm *VM) executeArrayIndex(array, index Value) error {
+	arrayObject := array.obj.(*object.Array)
+	i := index.n
 	max := int64(len(arrayObject.Elements) - 1)
 
 	if i < 0 || i > max {
-		return vm.push(Null)
+		return vm.push(nullVal)
 	}
 
-	return vm.push(arrayObject.Elements[i])
+	return vm.push(fromObject(arrayObject.Elements[i]))
 }
 
-func (vm *VM) executeHashIndex(hash, index object.Object) error {
-	hashObject := hash.(*object.Hash)
+func (vm *VM) executeHashIndex(hash, index Value) error {
+	hashObject := hash.obj.(*object.Hash)
 
-	key, ok := index.(object.Hashable)
+	key, ok := index.hashKey()
 	if !ok {
 		return fmt.Errorf("unusable as hash key: %s", index.Type())
 	}
 
-	pair, ok := hashObject.Pairs[key.HashKey()]
+	pair, ok := hashObject.Pairs[key]
 	if !ok {
-		return vm.push(Null)
+		return vm.push(nullVal)
 	}
 
-	return vm.push(pair.Value)
+	return vm.push(fromObject(pair.Value))
 }
 
-func isTruthy(obj object.Object) bool {
-	switch obj := obj.(type) {
-	case *object.Boolean:
-		return obj.Value
-	case *object.Null:
-		return false
-	default:
-		return true
+func (vm *VM) destructureArray(value Value, numElements, flags int) error {
+	array, ok := value.obj.(*object.Array)
+	if !ok {
+		return fmt.Errorf("cannot destructure %s as an array", value.Type())
+	}
+
+	for i := 0; i < numElements; i++ {
+		element := nullVal
+
+		if i < len(array.Elements) {
+			element = fromObject(array.Elements[i])
+		} else if flags&code.DestructureStrict != 0 {
+			return fmt.Errorf("missing element %d in destructuring, array has %d elements", i, len(array.Elements))
+		}
+
+		err := vm.push(element)
+		if err != nil {
+			return err
+		}
+	}
+
+	if flags&code.DestructureRest != 0 {
+		numRest := 0
+		if numElements < len(array.Elements) {
+			numRest = len(array.Elements) - numElements
+		}
+
+		err := vm.memory.Alloc(object.ArraySize(numRest))
+		if err != nil {
+			return err
+		}
+		rest := make([]object.Object, numRest)
+		copy(rest, array.Elements[len(array.Elements)-numRest:])
+
+		return vm.push(fromObject(&object.Array{Elements: rest}))
+	}
+
+	return nil
+}
+
+func (vm *VM) destructureHash(numKeys, flags int) error {
+	keys := make([]Value, numKeys)
+	copy(keys, vm.stack[vm.sp-numKeys:vm.sp])
+	vm.sp = vm.sp - numKeys
+
+	value := vm.pop()
+	hash, ok := value.obj.(*object.Hash)
+	if !ok {
+		return fmt.Errorf("cannot destructure %s as a hash", value.Type())
+	}
+
+	for _, key := range keys {
+		element := nullVal
+
+		hashKey, ok := key.hashKey() // Our compiler only gives string constants, other bytecode may not
+		if !ok {
+			return fmt.Errorf("unusable as hash key: %s", key.Type())
+		}
+
+		pair, ok := hash.Pairs[hashKey]
+		if ok {
+			element = fromObject(pair.Value)
+		} else if flags&code.DestructureStrict != 0 {
+			return fmt.Errorf("missing key %s in destructuring", key.toObject().Inspect())
+		}
+
+		err := vm.push(element)
+		if err != nil {
+			return err
+		}
 	}
+
+	return nil
 }
 
 func nativeBoolToBooleanObject(input bool) *object.Boolean {
@@ -480,6 +1044,10 @@ func (vm *VM) currentFrame() *Frame {
 	return vm.frames[vm.framesIndex-1]
 }
 
+func (vm *VM) stackOverflow() error {
+	return &object.LimitError{Kind: object.StackLimit, Limit: int64(vm.maxStack)}
+}
+
 func (vm *VM) pushFrame(f *Frame) {
 	vm.frames[vm.framesIndex] = f
 	vm.framesIndex++
@@ -491,35 +1059,115 @@ func (vm *VM) popFrame() *Frame {
 }
 
 func (vm *VM) callClosure(cl *object.Closure, numArgs int) error {
-	if numArgs != cl.Fn.NumParameters {
-		return fmt.Errorf("wrong number of arguments: want=%d, got=%d", cl.Fn.NumParameters, numArgs)
+	fn := cl.Fn
+	err := checkArity(fn, numArgs)
+	if err != nil {
+		return err
 	}
 
-	frame := NewFrame(cl, vm.sp-numArgs) // We subtract vm.sp by the number of arguments because the arguments are called as OpConstants onto the stack before basePointer is set to vm.sp, and therefore we need to decrement vm.sp to properly index the arguments, else it will lead to basePointer plus the index of the local binding pointing to certain empty slots
+	basePointer := vm.sp-numArgs // We subtract vm.sp by the number of arguments because the arguments are called as OpConstants onto the stack before basePointer is set to vm.sp, and therefore we need to decrement vm.sp to properly index the arguments, else it will lead to basePointer plus the index of the local binding pointing to certain empty slots
+	if basePointer+fn.NumLocals >= vm.maxStack {
+		return vm.stackOverflow()
+	}
+	if vm.framesIndex >= vm.maxFrames {
+		return &object.LimitError{Kind: object.DepthLimit, Limit: int64(vm.maxFrames - 1)}
+	}
+
+	if fn.Variadic { // Extra arguments are moved into an array in the slot right after the parameters
+		numRest := 0
+		if numArgs > fn.NumParameters {
+			numRest = numArgs - fn.NumParameters
+		}
+
+		err := vm.memory.Alloc(object.ArraySize(numRest))
+		if err != nil {
+			return err
+		}
+		rest := toObjects(vm.stack[vm.sp-numRest:vm.sp])
+
+		vm.stack[basePointer+fn.NumParameters] = fromObject(&object.Array{Elements: rest})
+	}
+
+	frame := NewFrame(cl, basePointer)
+	frame.numArgs = numArgs
 	vm.pushFrame(frame) 
-	vm.sp = frame.basePointer + cl.Fn.NumLocals 
+	vm.sp = frame.basePointer + fn.NumLocals 
 
 	return nil
 }
 
+func arityString(fn *object.CompiledFunction) string {
+	minArgs := fn.NumParameters - fn.NumDefaults
+
+	switch {
+	case fn.Variadic:
+		return fmt.Sprintf("at least %d", minArgs)
+	case fn.NumDefaults > 0:
+		return fmt.Sprintf("%d..%d", minArgs, fn.NumParameters)
+	default:
+		return fmt.Sprintf("%d", fn.NumParameters)
+	}
+}
+
 func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
-	args := vm.stack[vm.sp-numArgs:vm.sp] // Takes the argument from the callstack
+	args := toObjects(vm.stack[vm.sp-numArgs:vm.sp]) // Takes the argument from the callstack, builtins only see objects
+
+	if builtin.Size != nil { // Charged while the arguments are still on the stack, so they count as held
+		err := vm.memory.Alloc(builtin.Size(args...))
+		if err != nil {
+			return err
+		}
+	}
 
 	result := builtin.Fn(args...) // Passes the arguments into the builtin function
 	vm.sp = vm.sp - numArgs - 1 // Decreases stack pointer to take the number of arguments and -1 (the function) off the stack
 
 	if result != nil { // If there is a result, push result on stack, else ppush Null
-		vm.push(result)
+		vm.push(fromObject(result))
 	} else {
-		vm.push(Null)
+		vm.push(nullVal)
+	}
+
+	return nil
+}
+
+func checkArity(fn *object.CompiledFunction, numArgs int) error {
+	minArgs := fn.NumParameters - fn.NumDefaults
+
+	if numArgs < minArgs || (!fn.Variadic && numArgs > fn.NumParameters) {
+		if fn.Name != "" {
+			return fmt.Errorf("wrong number of arguments to %s: want=%s, got=%d", fn.Name, arityString(fn), numArgs)
+		}
+		return fmt.Errorf("wrong number of arguments: want=%s, got=%d", arityString(fn), numArgs)
 	}
 
 	return nil
 }
 
+// A closure called in tail position takes over the current frame, it and its arguments are moved down to
+// where the current function and its arguments were. Anything else is an ordinary call, the OpReturnValue
+// after it hands back the result
+func (vm *VM) executeTailCall(numArgs int) error {
+	callee, ok := vm.stack[vm.sp-1-numArgs].obj.(*object.Closure)
+	if !ok || vm.framesIndex == 1 { // The main frame is never given up
+		return vm.executeCall(numArgs)
+	}
+
+	err := checkArity(callee.Fn, numArgs) // Before the current frame is gone, so the stack trace still shows the caller
+	if err != nil {
+		return err
+	}
+
+	frame := vm.popFrame()
+	copy(vm.stack[frame.basePointer-1:], vm.stack[vm.sp-1-numArgs:vm.sp])
+	vm.sp = frame.basePointer + numArgs
+
+	return vm.callClosure(callee, numArgs)
+}
+
 func (vm *VM) executeCall(numArgs int) error {
 	callee := vm.stack[vm.sp-1-numArgs]
-	switch callee := callee.(type) {
+	switch callee := callee.obj.(type) {
 	case *object.Closure:
 		return vm.callClosure(callee, numArgs)
 	case *object.Builtin:
@@ -529,20 +1177,100 @@ func (vm *VM) executeCall(numArgs int) error {
 	}
 }
 
+// The arguments were grouped into arrays by the compiler, they are flattened back onto the stack above the callee
+func (vm *VM) executeSpreadCall(numSegments int) error {
+	numArgs, err := vm.spreadArguments(numSegments)
+	if err != nil {
+		return err
+	}
+
+	return vm.executeCall(numArgs)
+}
+
+// Replaces the argument arrays on top of the stack with their elements, and returns how many there are
+func (vm *VM) spreadArguments(numSegments int) (int, error) {
+	segments := vm.stack[vm.sp-numSegments:vm.sp]
+	numArgs := 0
+
+	for _, s := range segments {
+		arr, ok := s.obj.(*object.Array)
+		if !ok {
+			return 0, fmt.Errorf("spread argument must be ARRAY, got %s", s.Type())
+		}
+
+		numArgs += len(arr.Elements)
+	}
+
+	err := vm.memory.Alloc(object.ArraySize(numArgs)) // The arguments are gathered before they go on the stack
+	if err != nil {
+		return 0, err
+	}
+
+	args := make([]object.Object, 0, numArgs)
+	for _, s := range segments {
+		args = append(args, s.obj.(*object.Array).Elements...)
+	}
+
+	vm.sp -= numSegments
+
+	if vm.sp+len(args) >= vm.maxStack {
+		return 0, vm.stackOverflow()
+	}
+
+	for _, a := range args {
+		vm.stack[vm.sp] = fromObject(a)
+		vm.sp++
+	}
+
+	return len(args), nil
+}
+
+func (vm *VM) executeMethodCall(name string, numArgs int) error {
+	receiver := vm.stack[vm.sp-1-numArgs]
+
+	method, ok := vm.lookupMethod(receiver.Type(), name)
+	if !ok {
+		return fmt.Errorf("undefined method %s for %s", name, receiver.Type())
+	}
+
+	if vm.sp >= vm.maxStack {
+		return vm.stackOverflow()
+	}
+
+	// Shifts the receiver and the arguments up one slot so the method sits where executeCall expects the callee, the receiver then becomes the first argument (self)
+	copy(vm.stack[vm.sp-numArgs:vm.sp+1], vm.stack[vm.sp-1-numArgs:vm.sp])
+	vm.stack[vm.sp-1-numArgs] = fromObject(method)
+	vm.sp++
+
+	return vm.executeCall(numArgs + 1)
+}
+
+func (vm *VM) lookupMethod(t object.ObjectType, name string) (object.Object, bool) {
+	if method, ok := vm.methods.Get(t, name); ok { // Methods from impl blocks take priority over the builtin ones
+		return method, true
+	}
+
+	if builtin := object.GetBuiltinMethod(t, name); builtin != nil {
+		return builtin, true
+	}
+
+	return nil, false
+}
+
 func (vm *VM) pushClosure(constIndex, numFree int) error {
 	constant := vm.constants[constIndex]
-	function, ok := constant.(*object.CompiledFunction)
+	function, ok := constant.obj.(*object.CompiledFunction)
 	if !ok {
-		return fmt.Errorf("not a function: %+v", constant)
+		return fmt.Errorf("not a function: %+v", constant.toObject())
 	}
 
 	free := make([]object.Object, numFree)
 	for i := 0; i < numFree; i ++ {
-		free[i] = vm.stack[vm.sp-numFree+i]
+		free[i] = vm.stack[vm.sp-numFree+i].toObject()
 	}
 
 	vm.sp = vm.sp - numFree
 
 	closure := &object.Closure{Fn: function, Free: free}
-	return vm.push(closure)
+	return vm.push(fromObject(closure))
 }
\ No newline at end of file
@@ -1,13 +1,21 @@
 package vm
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"compiler/ast"
+	"compiler/code"
 	"compiler/compiler"
+	"compiler/evaluator"
 	"compiler/lexer"
 	"compiler/object"
 	"compiler/parser"
+	"compiler/rvm"
+	"compiler/verifier"
+	"strings"
 	"testing"
+	"time"
 )
 
 type vmTestCase struct {
@@ -21,8 +29,16 @@ func parse(input string) *ast.Program {
 	return p.ParseProgram()
 }
 
-func runVmTests(t *testing.T, tests []vmTestCase) {
-	t.Helper()
+// Runs every program again after it went through Encode and Decode
+func TestSerializedBytecode(t *testing.T) {
+	tests := []vmTestCase{
+		{`let fib = fn(x) { if (x < 2) { x } else { fib(x - 1) + fib(x - 2) } }; fib(10)`, 55},
+		{`fn add(a, b = 10, ...rest) { a + b + len(rest) } add(1) + add(1, 2, 3, 4)`, 16},
+		{`let adder = fn(x) { fn(y) { x + y } }; adder(2)(3)`, 5},
+		{`match {"type": "pair", "v": [1, 2]} { {"type": "pair", "v": [a, b]} => a + b, _ => 0 }`, 3},
+		{`impl String { fn shout(self) { self + "!" } }; "hi".shout()`, "hi!"},
+		{`let [a, ...b] = [1, 2, 3]; b`, []int{2, 3}},
+	}
 
 	for _, tt := range tests {
 		program := parse(tt.input)
@@ -33,16 +49,158 @@ func runVmTests(t *testing.T, tests []vmTestCase) {
 			t.Fatalf("compiler error: %s", err)
 		}
 
-		vm := New(comp.Bytecode())
+		data, err := compiler.Encode(comp.Bytecode())
+		if err != nil {
+			t.Fatalf("encode error: %s", err)
+		}
+
+		bytecode, err := compiler.Decode(data)
+		if err != nil {
+			t.Fatalf("decode error: %s", err)
+		}
+
+		vm := New(bytecode)
 		err = vm.Run()
 		if err != nil {
 			t.Fatalf("vm error: %s", err)
 		}
 
-		stackElem := vm.LastPoppedStackElem()
-		
-		testExpectedObject(t, tt.expected, stackElem)
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+	}
+}
+
+func runVmTests(t *testing.T, tests []vmTestCase) {
+	t.Helper()
+
+	// Every program in the suite doubles as a test of the verifier, and runs once more with the optimizations turned on
+	optionSets := []compiler.Options{
+		{Verify: true},
+		{Verify: true, FoldConstants: true, Peephole: true, Superinstructions: true},
+	}
+
+	for _, tt := range tests {
+		for _, options := range optionSets {
+			program := parse(tt.input)
+
+			comp := compiler.New()
+			comp.SetOptions(options)
+			err := comp.Compile(program)
+			if err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+
+			vm := New(comp.Bytecode())
+			err = vm.Run()
+			if err != nil {
+				t.Fatalf("vm error (options %+v): %s", options, err)
+			}
+
+			stackElem := vm.LastPoppedStackElem()
+
+			testExpectedObject(t, tt.expected, stackElem)
+		}
+
+		testOtherEngines(t, tt.input)
+	}
+}
+
+// The register VM and the evaluator must agree with the stack VM on every program of the suite
+func testOtherEngines(t *testing.T, input string) {
+	t.Helper()
+
+	comp := compiler.New()
+	err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	machine := New(comp.Bytecode())
+	err = machine.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	want := machine.LastPoppedStackElem()
+
+	rcomp := rvm.NewCompiler()
+	program, err := rcomp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("rvm compiler error: %s", err)
+	}
+
+	got, err := rvm.New().Run(program)
+	if err != nil {
+		t.Fatalf("rvm error for %q: %s", input, err)
+	}
+	if !sameResult(want, got) {
+		t.Errorf("rvm disagrees with the vm on %q. vm=%s, rvm=%s", input, describeResult(want), describeResult(got))
+	}
+
+	evaluated := evaluator.Eval(parse(input), object.NewEnvironment())
+	if !sameResult(want, evaluated) {
+		t.Errorf("evaluator disagrees with the vm on %q. vm=%s, eval=%s", input, describeResult(want), describeResult(evaluated))
+	}
+}
+
+// Functions are compared by type only, each engine has its own representation for them
+func sameResult(want, got object.Object) bool {
+	if want == nil || got == nil {
+		return want == got
+	}
+
+	if isFunction(want) || isFunction(got) {
+		return isFunction(want) && isFunction(got)
+	}
+
+	if want.Type() != got.Type() {
+		return false
+	}
+
+	switch want := want.(type) {
+	case *object.Array:
+		got := got.(*object.Array)
+		if len(want.Elements) != len(got.Elements) {
+			return false
+		}
+
+		for i := range want.Elements {
+			if !sameResult(want.Elements[i], got.Elements[i]) {
+				return false
+			}
+		}
+		return true
+	case *object.Hash: // Inspect would depend on the map's iteration order
+		got := got.(*object.Hash)
+		if len(want.Pairs) != len(got.Pairs) {
+			return false
+		}
+
+		for key, pair := range want.Pairs {
+			other, ok := got.Pairs[key]
+			if !ok || !sameResult(pair.Value, other.Value) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return want.Inspect() == got.Inspect()
+}
+
+func isFunction(obj object.Object) bool {
+	switch obj.Type() {
+	case object.CLOSURE_OBJ, object.FUNCTION_OBJ, object.BUILTIN_OBJ:
+		return true
+	}
+
+	return false
+}
+
+func describeResult(obj object.Object) string {
+	if obj == nil {
+		return "<nothing>"
 	}
+
+	return fmt.Sprintf("%s %s", obj.Type(), obj.Inspect())
 }
 
 func TestIntegerArithmetic(t *testing.T) {
@@ -119,6 +277,24 @@ func TestConditionals(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestReturnInMainProgram(t *testing.T) {
+	tests := []vmTestCase{
+		{"return 10;", 10},
+		{"return 10; 9;", 10},
+		{"9; return 2 * 5; 9;", 10},
+		{"let a = 1; if (a) { return 5; } 9;", 5},
+		{"let double = fn(x) { x * 2 }; return double(4); 1;", 8},
+	}
+
+	runVmTests(t, tests)
+
+	// The evaluator has always allowed it, and both engines have to agree
+	for _, tt := range tests {
+		evaluated := evaluator.Eval(parse(tt.input), object.NewEnvironment())
+		testExpectedObject(t, tt.expected, evaluated)
+	}
+}
+
 func TestGlobalLetStatements(t *testing.T) {
 	tests := []vmTestCase{
 		{"let one = 1; one", 1},
@@ -401,6 +577,38 @@ func TestCallingFunctionsWithWrongArguments(t *testing.T) {
 			input: `fn(a, b) { a + b; }(1);`,
 			expected: `wrong number of arguments: want=2, got=1`,
 		},
+		{
+			input: `fn(a, b = 1) { a + b; }();`,
+			expected: `wrong number of arguments: want=1..2, got=0`,
+		},
+		{
+			input: `fn(a, b = 1) { a + b; }(1, 2, 3);`,
+			expected: `wrong number of arguments: want=1..2, got=3`,
+		},
+		{
+			input: `fn(a, ...rest) { a; }();`,
+			expected: `wrong number of arguments: want=at least 1, got=0`,
+		},
+		{
+			input: `fn add(a, b) { a + b; } add(1);`,
+			expected: `wrong number of arguments to add: want=2, got=1`,
+		},
+		{
+			input: `impl Integer { fn plus(self, x) { self + x } } 1.plus();`,
+			expected: `wrong number of arguments to Integer.plus: want=2, got=1`,
+		},
+		{
+			input: `fn(a) { a; }(...1);`,
+			expected: `spread argument must be ARRAY, got INTEGER`,
+		},
+		{
+			input: `let zero = 0; 10 / zero`,
+			expected: `division by zero`,
+		},
+		{
+			input: `fn(f) { f(1, 2) }(fn(a) { a })`,
+			expected: `wrong number of arguments: want=1, got=2`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -424,6 +632,39 @@ func TestCallingFunctionsWithWrongArguments(t *testing.T) {
 	}
 }
 
+func TestDefaultAndRestParameters(t *testing.T) {
+	tests := []vmTestCase{
+		{`fn(a, b = 10) { a + b }(1)`, 11},
+		{`fn(a, b = 10) { a + b }(1, 2)`, 3},
+		{`fn(a = 1, b = a * 2) { a + b }()`, 3},
+		{`fn(a = 1, b = a * 2) { a + b }(5)`, 15},
+		{`let n = 0; let f = fn(x = n) { x }; f()`, 0},
+		{`let f = fn(x = []) { push(x, 1) }; f(); f()`, []int{1}}, // Defaults are evaluated on every call
+		{`fn(...rest) { rest }()`, []int{}},
+		{`fn(...rest) { rest }(1, 2, 3)`, []int{1, 2, 3}},
+		{`fn(a, ...rest) { rest }(1, 2, 3)`, []int{2, 3}},
+		{`fn(a, b = 2, ...rest) { [a, b, len(rest)] }(1)`, []int{1, 2, 0}},
+		{`fn(a, b = 2, ...rest) { [a, b, len(rest)] }(1, 5, 6, 7)`, []int{1, 5, 2}},
+		{`let outer = fn(x) { fn(y = x, ...more) { y + len(more) } }; outer(4)(1, 1, 1)`, 3},
+		{`let outer = fn(x) { fn(y = x, ...more) { y + len(more) } }; outer(4)()`, 4},
+		{`impl Integer { fn plus(self, x = 1) { self + x } }; 5.plus() + 5.plus(10)`, 21},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestSpreadCalls(t *testing.T) {
+	tests := []vmTestCase{
+		{`let add = fn(a, b) { a + b }; add(...[1, 2])`, 3},
+		{`let add = fn(a, b) { a + b }; let args = [2]; add(1, ...args)`, 3},
+		{`let f = fn(...xs) { xs }; f(1, ...[2, 3], 4, ...[])`, []int{1, 2, 3, 4}},
+		{`let f = fn(a, b = 10) { a + b }; f(...[1])`, 11},
+		{`len(...["four"])`, 4},
+	}
+
+	runVmTests(t, tests)
+}
+
 func TestBuiltinFunctions(t *testing.T) {
 	tests := []vmTestCase{
 		{`len("")`, 0},
@@ -573,6 +814,590 @@ func TestRecursiveFibonacci(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestRecursiveFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let countDown = fn(x) {
+				if (x == 0) {
+					return 0;
+				} else {
+					countDown(x - 1);
+				}
+			};
+			countDown(1);
+			`,
+			expected: 0,
+		},
+		{
+			input: `
+			let wrapper = fn() {
+				let countDown = fn(x) {
+					if (x == 0) {
+						return 0;
+					} else {
+						countDown(x - 1);
+					}
+				};
+				countDown(1);
+			};
+			wrapper();
+			`,
+			expected: 0,
+		},
+		{
+			input: `
+			let wrapper = fn() {
+				fn countDown(x) {
+					if (x == 0) { 0 } else { countDown(x - 1) }
+				}
+				countDown(5);
+			};
+			wrapper();
+			`,
+			expected: 0,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestNamedFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{`fn add(a, b) { a + b } add(1, 2)`, 3},
+		{`fn add(a, b = 2) { a + b }; add(1)`, 3},
+		{`fn five() { 5 } let f = five; f()`, 5},
+	}
+
+	runVmTests(t, tests)
+
+	inspected := []struct {
+		input string
+		expected string
+	} {
+		{`fn add(a, b) { a + b } add`, "Closure[add]"},
+		{`let sub = fn(a, b) { a - b }; sub`, "Closure[sub]"},
+	}
+
+	for _, tt := range inspected {
+		program := parse(tt.input)
+
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		if vm.LastPoppedStackElem().Inspect() != tt.expected {
+			t.Errorf("wrong Inspect. want=%q, got=%q", tt.expected, vm.LastPoppedStackElem().Inspect())
+		}
+	}
+}
+
+// Far deeper than MaxFrames, so these only finish when the calls in tail position reuse their frame
+func TestTailCalls(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let count = fn(n, acc) { if (n == 0) { acc } else { count(n - 1, acc + 1) } };
+			count(100000, 0)
+			`,
+			expected: 100000,
+		},
+		{
+			input: `
+			fn sum(n, acc) {
+				if (n == 0) { return acc; }
+				return sum(n - 1, acc + n);
+			}
+			sum(100000, 0)
+			`,
+			expected: 5000050000,
+		},
+		{
+			input: `
+			let isOdd = fn(n, isEven) { if (n == 0) { false } else { isEven(n - 1) } };
+			let isEven = fn(n) { if (n == 0) { true } else { isOdd(n - 1, isEven) } };
+			isEven(100001)
+			`,
+			expected: false,
+		},
+		{
+			// The callee moves down over the caller's arguments, including ones it doesn't take
+			input: `
+			let step = fn(n, down) { down(n, n, n + 1, n + 2) };
+			let down = fn(n, a, b, c) { if (n == 0) { [a, b, c] } else { step(n - 1, down) } };
+			down(50000, 0, 0, 0)
+			`,
+			expected: []int{0, 1, 2},
+		},
+		{
+			input: `
+			let h = fn(n, acc) { match n { 0 => acc, _ => h(n - 1, acc + 1) } };
+			h(100000, 0)
+			`,
+			expected: 100000,
+		},
+		{
+			input: `
+			let s = fn(n, acc) { if (n == 0) { acc } else { s(n - 1, ...[acc + 1]) } };
+			s(100000, 0)
+			`,
+			expected: 100000,
+		},
+		{
+			input: `fn(...xs) { len(...xs) }([1, 2])`,
+			expected: 2,
+		},
+		{
+			input: `fn(a) { len(a) }([1, 2])`,
+			expected: 2,
+		},
+		{
+			input: `fn(f) { f() + 1 }(fn() { 1 })`,
+			expected: 2,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestLimits(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		input string
+		limits object.Limits
+		ctx context.Context
+		expected object.LimitKind
+	}{
+		{input: `let f = fn() { f() }; f()`, limits: object.Limits{MaxInstructions: 10000}, expected: object.InstructionLimit},
+		{input: `let f = fn(n) { f(n) + 1 }; f(0)`, limits: object.Limits{MaxDepth: 10}, expected: object.DepthLimit},
+		{input: `let f = fn() { f() + 1 }; f()`, expected: object.DepthLimit}, // One stack slot a call, so MaxFrames runs out before StackSize
+		{input: `[1, 2, 3, 4, 5, 6, 7, 8, 9, 10]`, limits: object.Limits{MaxStack: 5}, expected: object.StackLimit},
+		{input: `let f = fn() { f() }; f()`, ctx: cancelled, expected: object.Cancelled},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		ctx := tt.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+
+		vm := New(comp.Bytecode())
+		vm.SetLimits(tt.limits)
+		err = vm.RunContext(ctx)
+
+		var limitErr *object.LimitError
+		if !errors.As(err, &limitErr) {
+			t.Errorf("%q: expected a LimitError, got=%v", tt.input, err)
+			continue
+		}
+		if limitErr.Kind != tt.expected {
+			t.Errorf("%q: wrong limit. want=%d, got=%d (%s)", tt.input, tt.expected, limitErr.Kind, limitErr)
+		}
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	tests := []struct {
+		input string
+		limit int64
+		fits bool
+	}{
+		{`let grow = fn(a, n) { if (n == 0) { a } else { grow(push(a, n), n - 1) } }; grow([], 100000)`, 1 << 16, false},
+		{`let double = fn(s, n) { if (n == 0) { s } else { double(s + s, n - 1) } }; double("ab", 64)`, 1 << 20, false},
+		{`let make = fn(n) { if (n == 0) { 0 } else { [1, 2, 3]; {"a": 1}; make(n - 1) } }; make(100000)`, 1 << 20, true}, // Each is dropped before the next is made
+		{`let a = [1, 2, 3, 4, 5, 6, 7, 8]; rest(a)`, 200, false}, // Stopped before rest runs
+		{`let f = fn(...xs) { xs }; f(1, 2, 3, 4, 5, 6, 7, 8)`, 100, false},
+		{`let a = [1, 2, 3, 4, 5, 6, 7, 8]; let [first, ...others] = a;`, 200, false},
+		{`let a = [1, 2, 3, 4, 5, 6, 7, 8]; let f = fn(x) { x }; f(...a)`, 250, false},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		vm.SetLimits(object.Limits{MaxMemory: tt.limit})
+		err = vm.Run()
+
+		var limitErr *object.LimitError
+		switch {
+		case tt.fits && err != nil:
+			t.Errorf("%q: expected the run to fit in %d bytes, got=%v", tt.input, tt.limit, err)
+		case !tt.fits && (!errors.As(err, &limitErr) || limitErr.Kind != object.MemoryLimit):
+			t.Errorf("%q: expected the memory limit to stop the run, got=%v", tt.input, err)
+		}
+		if vm.Memory().Peak() > tt.limit {
+			t.Errorf("%q: peak usage %d is past the limit %d", tt.input, vm.Memory().Peak(), tt.limit)
+		}
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`let a = push([1, 2], 3); let s = "ab" + "cd"; {1: a}`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	// The globals are still held, the hash was popped. It was held along with them once it was made.
+	used := object.ArraySize(3) + object.StringSize(4)
+	peak := used + object.HashSize(1)
+	if vm.Memory().Used() != used || vm.Memory().Peak() != peak {
+		t.Errorf("wrong memory usage. want used=%d, peak=%d, got used=%d, peak=%d", used, peak, vm.Memory().Used(), vm.Memory().Peak())
+	}
+
+	err = vm.Run() // The program is done, so this run makes nothing and the globals stay
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	if vm.Memory().Used() != used || vm.Memory().Peak() != peak {
+		t.Errorf("wrong memory usage after a second run. want used=%d, peak=%d, got used=%d, peak=%d", used, peak, vm.Memory().Used(), vm.Memory().Peak())
+	}
+}
+
+func TestMemoryPeakOfDroppedValues(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`let make = fn(n) { if (n == 0) { 0 } else { [1, 2, 3]; make(n - 1) } }; make(10000)`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	// Only one of the arrays is ever held, the peak is nowhere near the 10000 that were made
+	if vm.Memory().Peak() < object.ArraySize(3) || vm.Memory().Peak() > 2*object.ArraySize(3) {
+		t.Errorf("wrong peak. want about %d, got=%d", object.ArraySize(3), vm.Memory().Peak())
+	}
+}
+
+func TestRunContextDeadline(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`let f = fn() { f() }; f()`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err = New(comp.Bytecode()).RunContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to stop the run, got=%v", err)
+	}
+}
+
+func TestStackTrace(t *testing.T) {
+	input := `
+	fn inner(x) { x + true }
+	fn outer() { fn() { inner(1) + 1 }() + 1 }
+	outer();
+	`
+
+	program := parse(input)
+
+	comp := compiler.New()
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	err = vm.Run()
+	if err == nil {
+		t.Fatalf("expected VM error but resulted in none.")
+	}
+
+	trace := vm.StackTrace()
+	expected := []string{"at inner (line 2,", "at <anonymous> (line 3,", "at outer (line 3,", "at <main> (line 4,"}
+
+	if len(trace) != len(expected) {
+		t.Fatalf("wrong stack trace length. want=%d, got=%d (%q)", len(expected), len(trace), trace)
+	}
+
+	for i, prefix := range expected {
+		if !strings.HasPrefix(trace[i], prefix) {
+			t.Errorf("wrong stack trace entry %d. want prefix %q, got=%q", i, prefix, trace[i])
+		}
+	}
+}
+
+func TestMethodCalls(t *testing.T) {
+	tests := []vmTestCase{
+		{`[1, 2, 3].len()`, 3},
+		{`"four".len()`, 4},
+		{`{1: 2, 3: 4}.len()`, 2},
+		{`[1, 2].push(3)`, []int{1, 2, 3}},
+		{`[1, 2, 3].rest().first()`, 2},
+		{
+			input: `
+			impl Integer {
+				fn add(self, x) { self + x }
+			}
+			1.add(2).add(3)
+			`,
+			expected: 6,
+		},
+		{
+			input: `
+			impl Array {
+				fn sum(self) {
+					if (self.len() == 0) {
+						0
+					} else {
+						self.first() + self.rest().sum()
+					}
+				}
+			}
+			[1, 2, 3, 4].sum()
+			`,
+			expected: 10,
+		},
+		{
+			input: `
+			let scale = 10;
+			impl Integer { fn scaled(self) { self * scale } }
+			let f = fn(x) { x.scaled() };
+			f(4)
+			`,
+			expected: 40,
+		},
+		{
+			input: `
+			impl String { fn len(self) { 42 } }
+			"abc".len()
+			`,
+			expected: 42,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestUndefinedMethod(t *testing.T) {
+	program := parse(`1.len()`)
+
+	comp := compiler.New()
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	err = vm.Run()
+	if err == nil {
+		t.Fatalf("expected VM error but resulted in none.")
+	}
+
+	expected := "undefined method len for INTEGER"
+	if err.Error() != expected {
+		t.Fatalf("wrong VM error: want=%q, got=%q", expected, err)
+	}
+}
+
+func TestMatchExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{`match 0 { 0 => "zero", _ => "other" }`, "zero"},
+		{`match 5 { 0 => "zero", _ => "other" }`, "other"},
+		{`match -1 { 1 => 1, -1 => 2 }`, 2},
+		{`match "b" { "a" => 1, "b" => 2 }`, 2},
+		{`match true { false => 1, true => 2 }`, 2},
+		{`match "1" { 1 => 1, _ => 2 }`, 2},
+		{`match 3 { 1 => 1, 2 => 2 }`, Null},
+		{`match [1, 2] { [a] => a, [a, b] => a + b, _ => 0 }`, 3},
+		{`match [1, [2, 3]] { [a, [b, c]] => a + b + c }`, 6},
+		{`match [1, 2] { [1, x] => x, _ => 0 }`, 2},
+		{`match [3, 2] { [1, x] => x, _ => 0 }`, 0},
+		{`match 5 { [x] => x, _ => 0 }`, 0},
+		{`match {"type": "x", "v": 7} { {"type": "y", "v": v} => 0, {"type": "x", "v": v} => v }`, 7},
+		{`match {"v": 7} { {"type": "x"} => 0, {} => 1 }`, 1},
+		{`match 12 { n if n > 10 => n * 2, n => n }`, 24},
+		{`match 8 { n if n > 10 => n * 2, n => n }`, 8},
+		{`let x = 1; match 2 { x => x }; x`, 1},
+		{
+			input: `
+			let describe = fn(value) {
+				match value {
+					[] => "empty",
+					[x] => "one",
+					{"name": name} => name,
+					_ => "unknown",
+				}
+			};
+			describe([]) + describe([1]) + describe({"name": "!"}) + describe(5)
+			`,
+			expected: "emptyone!unknown",
+		},
+		{
+			input: `
+			let adders = fn(pair) {
+				match pair { [a, b] => fn(c) { a + b + c } }
+			};
+			adders([1, 2])(3)
+			`,
+			expected: 6,
+		},
+		{
+			input: `
+			let sum = fn(arr) {
+				match len(arr) {
+					0 => 0,
+					_ => first(arr) + sum(rest(arr)),
+				}
+			};
+			sum([1, 2, 3, 4])
+			`,
+			expected: 10,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestMatchBindingsAreScopedToTheirArm(t *testing.T) {
+	program := parse(`match 1 { x => x }; x`)
+
+	comp := compiler.New()
+	err := comp.Compile(program)
+	if err == nil {
+		t.Fatalf("expected compiler error but resulted in none.")
+	}
+
+	if err.Error() != "Undefined variable x" {
+		t.Fatalf("wrong compiler error: got=%q", err)
+	}
+}
+
+func TestMatchSlotsAreReused(t *testing.T) {
+	tests := []vmTestCase{
+		{`match 1 { n => n }; match 2 { n => n }`, 2},
+		{`let f = match 1 { n => fn() { n } }; match 2 { n => n }; f()`, 1},
+		{`match [1, 2] { [a, b] if match b { 1 => false, b => true } => a + b, _ => 0 }`, 3},
+		{`match 1 { 2 => 0, n if match 5 { n => false } => 0, n => n }`, 1},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestDestructuringLetStatements(t *testing.T) {
+	tests := []vmTestCase{
+		{`let [a, b] = [1, 2]; a + b`, 3},
+		{`let [a, b] = [1]; b`, Null},
+		{`let [a, ...rest] = [1, 2, 3]; rest`, []int{2, 3}},
+		{`let [a, b, ...rest] = [1]; rest`, []int{}},
+		{`let [...all] = [1, 2]; all`, []int{1, 2}},
+		{`let {name, age} = {"name": "celeste", "age": 3}; name`, "celeste"},
+		{`let {name, missing} = {"name": "celeste"}; missing`, Null},
+		{
+			input: `
+			let swap = fn(pair) {
+				let [a, b] = pair;
+				[b, a]
+			};
+			swap([1, 2])
+			`,
+			expected: []int{2, 1},
+		},
+		{
+			input: `
+			let area = fn(rect) {
+				let {width, height} = rect;
+				fn() { width * height }
+			};
+			area({"width": 3, "height": 4})()
+			`,
+			expected: 12,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestDestructuringErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		strict bool
+		expected string
+	} {
+		{`let [a] = 1;`, false, "cannot destructure INTEGER as an array"},
+		{`let {a} = [1];`, false, "cannot destructure ARRAY as a hash"},
+		{`let [a, b] = [1];`, true, "missing element 1 in destructuring, array has 1 elements"},
+		{`let {name, age} = {"name": 1};`, true, "missing key age in destructuring"},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		comp := compiler.New()
+		comp.SetOptions(compiler.Options{Strict: tt.strict})
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error but resulted in none.")
+		}
+
+		if err.Error() != tt.expected {
+			t.Fatalf("wrong VM error: want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+// Bytecode our compiler doesn't make, but that the verifier lets through
+func TestDestructureHashUnhashableKey(t *testing.T) {
+	bytecode := &compiler.Bytecode{Constants: []object.Object{}}
+	for _, ins := range [][]byte{
+		code.Make(code.OpHash, 0),
+		code.Make(code.OpArray, 0),
+		code.Make(code.OpDestructureHash, 1, 0),
+		code.Make(code.OpPop),
+	} {
+		bytecode.Instructions = append(bytecode.Instructions, ins...)
+	}
+
+	err := verifier.Verify(bytecode.Instructions, bytecode.Constants, 0)
+	if err != nil {
+		t.Fatalf("verifier error: %s", err)
+	}
+
+	err = New(bytecode).Run()
+	if err == nil || err.Error() != "unusable as hash key: ARRAY" {
+		t.Fatalf("wrong VM error: got=%v", err)
+	}
+}
+
 func testExpectedObject(t *testing.T, expected interface{}, actual object.Object) {
 	t.Helper()
 
@@ -688,4 +1513,290 @@ func testStringObject(expected string, actual object.Object) error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+// Every program must give the same result with and without folding, including the runtime errors folding has to leave alone
+func TestConstantFolding(t *testing.T) {
+	inputs := []string{
+		"1 + 2 * 3 - 4 / 2",
+		"-5 * -(2 + 1)",
+		"!true",
+		"!!5",
+		"!(1 < 2) == false",
+		"true != (3 > 4)",
+		`"foo" + "bar" + "baz"`,
+		`let s = "x"; s + "y" + "z"`,
+		"if (1 < 2) { 10 } else { 20 }",
+		"if (false) { 10 }",
+		"if (0) { 10 } else { 20 }",
+		"if (false) { let b = 1; b } else { 2 }; let c = 3; c",
+		"fn(x) { if (true) { x * (2 + 3) } }(2)",
+		"let f = fn() { if (false) { return 1 } 2 }; f()",
+		"1 / 0",
+		"(1 - 1) / (2 - 2) + 3",
+		"-true",
+		`"a" == "a"`,
+		`"a" - "b"`,
+		"9223372036854775807 + 1",
+	}
+
+	run := func(input string, fold bool) (string, error) {
+		comp := compiler.New()
+		comp.SetOptions(compiler.Options{Verify: true, FoldConstants: fold})
+		err := comp.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("input=%q fold=%t: compiler error: %s", input, fold, err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err != nil {
+			return "", err
+		}
+		return vm.LastPoppedStackElem().Inspect(), nil
+	}
+
+	for _, input := range inputs {
+		want, wantErr := run(input, false)
+		got, gotErr := run(input, true)
+
+		if fmt.Sprint(wantErr) != fmt.Sprint(gotErr) {
+			t.Errorf("input=%q: folding changed the error. want=%v, got=%v", input, wantErr, gotErr)
+		}
+
+		if want != got {
+			t.Errorf("input=%q: folding changed the result. want=%s, got=%s", input, want, got)
+		}
+	}
+}
+
+func TestWideConstants(t *testing.T) {
+	var input strings.Builder
+	for i := 0; i <= 70000; i++ {
+		fmt.Fprintf(&input, "%d;", i)
+	}
+	input.WriteString("65536 + 65537")
+
+	runVmTests(t, []vmTestCase{{input.String(), 131073}})
+}
+
+func TestWideMethodConstants(t *testing.T) {
+	var input strings.Builder
+	for i := 0; i <= 70000; i++ {
+		fmt.Fprintf(&input, "%d;", i)
+	}
+	input.WriteString("impl Integer { fn add(self, x) { self + x } }\n1.add(2).add(3)")
+
+	runVmTests(t, []vmTestCase{{input.String(), 6}})
+}
+
+func TestWideGlobals(t *testing.T) {
+	name := func(i int) string { // Identifiers can't contain digits
+		return "g" + strings.Map(func(r rune) rune { return 'a' + r - '0' }, fmt.Sprint(i))
+	}
+
+	var input strings.Builder
+	for i := 0; i <= 70000; i++ {
+		fmt.Fprintf(&input, "let %s = %d;", name(i), i%10)
+	}
+	fmt.Fprintf(&input, "%s + %s + %s", name(65535), name(65536), name(70000))
+
+	runVmTests(t, []vmTestCase{{input.String(), 11}})
+}
+
+func TestWideLocalsAndCalls(t *testing.T) {
+	name := func(i int) string {
+		return "g" + strings.Map(func(r rune) rune { return 'a' + r - '0' }, fmt.Sprint(i))
+	}
+
+	var lets, params, args strings.Builder
+	for i := 0; i < 300; i++ {
+		fmt.Fprintf(&lets, "let %s = %d;", name(i), i)
+		if i > 0 {
+			params.WriteString(", ")
+			args.WriteString(", ")
+		}
+		params.WriteString(name(i))
+		fmt.Fprint(&args, i)
+	}
+
+	last := name(299)
+	spreads := strings.TrimSuffix(strings.Repeat("...[1], ", 300), ", ")
+
+	runVmTests(t, []vmTestCase{
+		{fmt.Sprintf("fn() { %s %s + %s }()", lets.String(), name(1), last), 300},
+		{fmt.Sprintf("fn() { %s fn() { let all = [%s]; all[1] + all[299] } }()()", lets.String(), params.String()), 300},
+		{fmt.Sprintf("fn(%s) { %s }(%s)", params.String(), last, args.String()), 299},
+		{fmt.Sprintf("fn(...rest) { len(rest) }(%s)", args.String()), 300},
+		{fmt.Sprintf("let f = fn(%s, extra = 5) { extra }; [f(%s), f(%s, 7)]", params.String(), args.String(), args.String()), []int{5, 7}},
+		{fmt.Sprintf("impl Integer { fn count(self, ...rest) { len(rest) } } 1.count(%s)", args.String()), 300},
+		{fmt.Sprintf("fn(...rest) { len(rest) }(%s)", spreads), 300},
+	})
+}
+
+// Every construct that jumps, with more than 64KiB of instructions to jump over
+func TestLargeJumps(t *testing.T) {
+	body := strings.Repeat("x + 1;", 10000)
+
+	runVmTests(t, []vmTestCase{
+		{fmt.Sprintf("let f = fn(c, x) { if (c) { %s 1 } else { 2 } }; [f(true, 1), f(false, 1)]", body), []int{1, 2}},
+		{fmt.Sprintf("let x = 1; if (x > 2) { %s 1 } else { 2 }", body), 2},
+		{fmt.Sprintf("let f = fn(x) { match x { 1 => if (x > 0) { %s 10 } else { 0 }, _ => 20 } }; [f(1), f(2)]", body), []int{10, 20}},
+		{fmt.Sprintf("let f = fn(x, b = if (x > 0) { %s 7 } else { 0 }) { b }; [f(1), f(1, 3)]", body), []int{7, 3}},
+	})
+}
+
+func TestGlobalsStore(t *testing.T) {
+	compile := func(input string, symbolTable *compiler.SymbolTable) *compiler.Bytecode {
+		comp := compiler.NewWithState(symbolTable, []object.Object{})
+		err := comp.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		return comp.Bytecode()
+	}
+
+	machine := New(compile("let a = 1; let b = 2;", compiler.NewSymbolTable()))
+	if len(machine.Globals()) != 2 {
+		t.Errorf("globals store should be sized by the compiler. want=2, got=%d", len(machine.Globals()))
+	}
+
+	// Like the REPL, each input runs on a new VM that grows the store the previous one left behind
+	symbolTable := compiler.NewSymbolTable()
+	globals := []object.Object{}
+
+	for _, input := range []string{"let a = 1;", "let b = a + 1;", "let c = a + b; c"} {
+		machine := NewWithGlobalsStore(compile(input, symbolTable), globals)
+		err := machine.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		globals = machine.Globals()
+	}
+
+	if len(globals) != 3 {
+		t.Fatalf("wrong number of globals. want=3, got=%d", len(globals))
+	}
+
+	err := testIntegerObject(3, globals[2])
+	if err != nil {
+		t.Errorf("wrong value for c: %s", err)
+	}
+}
+
+// The specialized opcodes fall back to the general ones for anything but integers, so the errors have to stay the same
+func TestSuperinstructionErrors(t *testing.T) {
+	inputs := []string{
+		`fn(x) { x + 1 }("a")`,
+		`fn(x) { x - 1 }(true)`,
+		`fn(x, y) { if (x > y) { 1 } else { 2 } }("a", "b")`,
+		`fn(a, b) { a(b) }(1, 2)`,
+		`fn() { 1 }(1, 2)`,
+	}
+
+	run := func(input string, options compiler.Options) error {
+		comp := compiler.New()
+		comp.SetOptions(options)
+		err := comp.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("input=%q: compiler error: %s", input, err)
+		}
+
+		return New(comp.Bytecode()).Run()
+	}
+
+	for _, input := range inputs {
+		want := run(input, compiler.Options{})
+		got := run(input, compiler.Options{Verify: true, Superinstructions: true})
+
+		if want == nil {
+			t.Fatalf("input=%q: expected an error", input)
+		}
+
+		if fmt.Sprint(want) != fmt.Sprint(got) {
+			t.Errorf("input=%q: superinstructions changed the error. want=%v, got=%v", input, want, got)
+		}
+	}
+}
+
+// Arithmetic results in the small integer range are the shared objects, not fresh allocations
+func TestSmallIntegerResults(t *testing.T) {
+	tests := []struct {
+		input string
+		expected int64
+	}{
+		{"1 + 2", 3},
+		{"10 - 11", -1},
+		{"-5", -5},
+		{"6 * 7", 42},
+		{"let f = fn(x) { x + 1 }; f(99)", 100},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		if vm.LastPoppedStackElem() != object.NewInteger(tt.expected) {
+			t.Errorf("result of %q is not the shared integer %d", tt.input, tt.expected)
+		}
+	}
+}
+
+// Mixing an integer with anything else used to panic in the integer comparison
+func TestMixedComparisons(t *testing.T) {
+	tests := []struct {
+		input string
+		expected string
+	}{
+		{"1 == true", "unsupported types for comparison: INTEGER BOOLEAN"},
+		{`"a" != 1`, "unsupported types for comparison: STRING INTEGER"},
+		{"fn(x) { x > 1 }([])", "unsupported types for comparison: ARRAY INTEGER"},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		err = New(comp.Bytecode()).Run()
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("input=%q: wrong error. want=%q, got=%v", tt.input, tt.expected, err)
+		}
+	}
+}
+
+// Integers and booleans live on the stack unboxed, so a call doing arithmetic outside the small integer range only allocates its frame
+func TestStackValuesDoNotAllocate(t *testing.T) {
+	allocs := func(n int) float64 {
+		input := fmt.Sprintf("let f = fn(n, acc) { if (n == 0) { acc } else { f(n - 1, acc + 100000) } }; f(%d, 0)", n)
+
+		comp := compiler.New()
+		err := comp.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		return testing.AllocsPerRun(5, func() {
+			err := New(comp.Bytecode()).Run()
+			if err != nil {
+				t.Fatalf("vm error: %s", err)
+			}
+		})
+	}
+
+	perCall := (allocs(600) - allocs(100)) / 500
+	if perCall > 1 {
+		t.Errorf("too many allocations per call. want at most 1, got=%.2f", perCall)
+	}
+}